@@ -0,0 +1,244 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Backup is an earlier version of a binary kept on a host: a backup
+// directory made by an install, or a release of a Release upload.
+type Backup struct {
+	Binary  string    `json:"binary"`
+	Name    string    `json:"name"` // the backup's timestamp, e.g. "20240102T150405Z", or the release
+	Path    string    `json:"path"` // its directory on the host
+	Release bool      `json:"release,omitempty"`
+	Current bool      `json:"current,omitempty"` // for releases, whether current points at it
+	Time    time.Time `json:"time"`              // when it was backed up, or the release installed
+	SizeKB  int64     `json:"size_kb"`
+	SHA256  string    `json:"sha256,omitempty"` // of the binary in it, if it holds one
+}
+
+// HostBackups is what ListBackups found on a host.
+type HostBackups struct {
+	Host    string   `json:"host"`
+	Backups []Backup `json:"backups"`
+}
+
+// backupMarker prefixes each line listBackupsTemplate prints for a backup.
+const backupMarker = "binaryinstall-backup:"
+
+// releaseDir is a Release upload's destination, for listBackupsTemplate.
+type releaseDir struct {
+	Dir, Binary string
+}
+
+// listBackupsData is ScriptData with the release directories to list.
+type listBackupsData struct {
+	ScriptData
+	Releases []releaseDir
+}
+
+// listBackupsTemplate prints a line per backup under BackupDir and per
+// release in each of Releases, newest first: its kind, binary, name, size
+// in KiB, the binary's checksum or "-", modification time, whether it is
+// the current release, and its path. It changes nothing.
+var listBackupsTemplate = template.Must(template.Must(scriptTemplate.Clone()).New("backups").Parse(`set -e
+
+BACKUP_DIR={{ q .BackupDir }}
+case $BACKUP_DIR in "~/"*) BACKUP_DIR="$HOME/${BACKUP_DIR#"~/"}" ;; esac
+{{ template "escalation" . }}
+
+# backup_line KIND BINARY NAME PATH CURRENT
+backup_line() {
+    size=$(as_root du -sk "$4" | cut -f1)
+    sum=-
+    if as_root test -f "$4/$2"; then
+        sum=$( (as_root sha256sum "$4/$2" 2>/dev/null || as_root shasum -a 256 "$4/$2") | cut -d' ' -f1)
+    fi
+    mtime=$(stat -c %Y "$4" 2>/dev/null || stat -f %m "$4")
+    echo "` + backupMarker + ` $1 $2 $3 $size $sum $mtime $5 $4"
+}
+
+for root in "${BACKUP_DIR%/}"/*/; do
+    [ -d "$root" ] || continue
+    binary=${root%/}
+    binary=${binary##*/}
+    for dir in $(ls -1r "$root" | grep -E '^[0-9]{8}T[0-9]{6}Z(\.[0-9]+)?$'); do
+        backup_line backup "$binary" "$dir" "$root$dir" -
+    done
+done
+{{ range .Releases }}
+APP_DIR={{ q .Dir }}
+case $APP_DIR in "~/"*) APP_DIR="$HOME/${APP_DIR#"~/"}" ;; esac
+APP_DIR=${APP_DIR%/}
+current=$(readlink "$APP_DIR/current" 2>/dev/null || true)
+for dir in $(ls -1t "$APP_DIR/releases" 2>/dev/null); do
+    is_current=-
+    [ "releases/$dir" != "$current" ] || is_current=current
+    backup_line release {{ q .Binary }} "$dir" "$APP_DIR/releases/$dir" "$is_current"
+done
+{{ end }}`))
+
+// ListBackups reports the backups kept on every host of config, for each
+// binary with a directory under BackupDir, and the releases of the uploads
+// in config.Uploads that set Release, newest first. Hosts that cannot be
+// reached are reported as InstallFailures, after every host has been tried.
+func ListBackups(config BinaryInstallConfig) ([]HostBackups, error) {
+	hosts := fleetHosts(config)
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no remote host provided")
+	}
+	if kind, _ := transportKind(config); kind == TransportWinRM {
+		return nil, fmt.Errorf("listing backups is not supported on %s targets", kind)
+	}
+
+	var (
+		mu      sync.Mutex
+		results []HostBackups
+	)
+	err := runAll(len(hosts), config.MaxParallelHosts, true, func(i int) error {
+		hostConfig := forHost(config, hosts[i])
+		releases, err := releaseDirs(hostConfig.Uploads)
+		if err != nil {
+			return &InstallFailure{Host: hostConfig.RemoteHost, Err: err}
+		}
+		backups, err := listBackupsHost(hostConfig, releases)
+		if err != nil {
+			return &InstallFailure{Host: hostConfig.RemoteHost, Err: err}
+		}
+		mu.Lock()
+		results = append(results, backups)
+		mu.Unlock()
+		return nil
+	})
+	sort.Slice(results, func(i, j int) bool { return results[i].Host < results[j].Host })
+	return results, err
+}
+
+// releaseDirs returns the destinations of the uploads that set Release.
+func releaseDirs(uploads []BinaryUpload) ([]releaseDir, error) {
+	var dirs []releaseDir
+	for _, upload := range uploads {
+		if upload.Release == "" {
+			continue
+		}
+		upload, err := expandUploadVars(upload)
+		if err != nil {
+			return nil, err
+		}
+		if name := uploadBinaryName(upload); name != "" && upload.DestinationDir != "" {
+			dirs = append(dirs, releaseDir{Dir: upload.DestinationDir, Binary: name})
+		}
+	}
+	return dirs, nil
+}
+
+// listBackupsHost runs listBackupsTemplate on config.RemoteHost.
+func listBackupsHost(config BinaryInstallConfig, releases []releaseDir) (HostBackups, error) {
+	result := HostBackups{Host: config.RemoteHost, Backups: []Backup{}}
+	for _, p := range append([]string{config.BackupDir}, releasePaths(releases)...) {
+		if strings.ContainsAny(p, "\x00\n\r") {
+			return result, fmt.Errorf("path %q contains control characters", p)
+		}
+	}
+	transport, err := connectHost(&config)
+	if err != nil {
+		return result, err
+	}
+	defer transport.Close()
+	return runListBackups(config, transport, releases)
+}
+
+// runListBackups runs listBackupsTemplate over transport, and parses what it
+// prints.
+func runListBackups(config BinaryInstallConfig, transport Transport, releases []releaseDir) (HostBackups, error) {
+	result := HostBackups{Host: config.RemoteHost, Backups: []Backup{}}
+	sData := listBackupsData{
+		ScriptData: ScriptData{
+			SudoPassword: config.SudoPassword,
+			Escalation:   config.Escalation,
+			BackupDir:    config.BackupDir,
+		},
+		Releases: releases,
+	}
+	var script bytes.Buffer
+	if err := listBackupsTemplate.Execute(&script, sData); err != nil {
+		return result, fmt.Errorf("failed to render backup listing script: %w", err)
+	}
+	out, err := runScript(config, transport, script.String())
+	if err != nil {
+		return result, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		rest, ok := strings.CutPrefix(line, backupMarker)
+		if !ok {
+			continue
+		}
+		// The path comes last, so it may hold spaces
+		fields := strings.SplitN(strings.TrimSpace(rest), " ", 8)
+		if len(fields) != 8 {
+			continue
+		}
+		b := Backup{
+			Release: fields[0] == "release",
+			Binary:  fields[1],
+			Name:    fields[2],
+			Current: fields[6] == "current",
+			Path:    fields[7],
+		}
+		b.SizeKB, _ = strconv.ParseInt(fields[3], 10, 64)
+		if fields[4] != "-" {
+			b.SHA256 = fields[4]
+		}
+		// Backups are named by when they were made; releases have only
+		// their modification time
+		stamp, _, _ := strings.Cut(b.Name, ".")
+		if t, err := time.Parse(backupStampLayout, stamp); err == nil && !b.Release {
+			b.Time = t
+		} else if mtime, err := strconv.ParseInt(fields[5], 10, 64); err == nil {
+			b.Time = time.Unix(mtime, 0).UTC()
+		}
+		result.Backups = append(result.Backups, b)
+	}
+	if config.Verbose {
+		log.Printf("Found %d backups on %s", len(result.Backups), config.RemoteHost)
+	}
+	return result, nil
+}
+
+// releasePaths returns the directories of releases.
+func releasePaths(releases []releaseDir) []string {
+	var paths []string
+	for _, r := range releases {
+		paths = append(paths, path.Join(r.Dir, "releases"))
+	}
+	return paths
+}
+
+// pruneScript is scriptTemplate's "prune", which removes the binary's
+// backups beyond the count, age and size kept.
+const pruneScript = `{{ define "prune" }}
+{{- if or .BackupKeep .BackupCutoff .BackupMaxKB }}
+# Prune the binary's older backups, newest first, always keeping the most
+# recent. Only directories named by timestamp are backups.
+n=0
+total=0
+for dir in $(ls -1r "$BACKUP_ROOT" 2>/dev/null | grep -E '^[0-9]{8}T[0-9]{6}Z(\.[0-9]+)?$'); do
+    n=$((n + 1))
+    total=$((total + $(as_root du -sk "$BACKUP_ROOT/$dir" | cut -f1)))
+    [ "$n" -gt 1 ] || continue
+    if {{ if .BackupKeep }}[ "$n" -gt {{ .BackupKeep }} ] || {{ end }}{{ if .BackupCutoff }}awk -v a="$dir" -v b={{ q .BackupCutoff }} 'BEGIN { exit !(a < b) }' || {{ end }}{{ if .BackupMaxKB }}[ "$total" -gt {{ .BackupMaxKB }} ] || {{ end }}false; then
+        as_root rm -rf "$BACKUP_ROOT/$dir"
+        echo "pruned backup $BACKUP_ROOT/$dir"
+    fi
+done
+{{- end }}
+{{ end }}`
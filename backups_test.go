@@ -0,0 +1,97 @@
+package binaryinstall
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReleaseDirs(t *testing.T) {
+	got, err := releaseDirs([]BinaryUpload{
+		{Path: "api_Linux_x86_64.tar.gz", DestinationDir: "/opt/api", Release: "{{.version}}", Vars: map[string]string{"version": "1.2.3"}},
+		{Path: "tool_Linux_x86_64.tar.gz", DestinationDir: "/usr/local/bin"},
+		{Path: "bundle.tar.gz", ArchivePath: "bin/worker", DestinationDir: "/opt/worker", Release: "2.0.0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []releaseDir{{Dir: "/opt/api", Binary: "api"}, {Dir: "/opt/worker", Binary: "worker"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("releaseDirs() = %+v, want %+v", got, want)
+	}
+}
+
+func TestListBackupsOutput(t *testing.T) {
+	config := BinaryInstallConfig{RemoteHost: "web1", BackupDir: "/var/backups"}
+	transport := &scriptRecorder{output: "noise\n" +
+		backupMarker + " backup api 20240102T150405Z.1 120 aaa 1700000000 - /var/backups/api/20240102T150405Z.1\n" +
+		backupMarker + " backup api 20231231T000000Z 4 - 1700000000 - /var/backups/api/20231231T000000Z\n" +
+		backupMarker + " release api 1.2.3 96 bbb 1704067200 current /opt/my api/releases/1.2.3\n" +
+		backupMarker + " truncated\n"}
+	got, err := runListBackups(config, transport, []releaseDir{{Dir: "/opt/my api", Binary: "api"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := HostBackups{Host: "web1", Backups: []Backup{
+		{Binary: "api", Name: "20240102T150405Z.1", Path: "/var/backups/api/20240102T150405Z.1", Time: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC), SizeKB: 120, SHA256: "aaa"},
+		{Binary: "api", Name: "20231231T000000Z", Path: "/var/backups/api/20231231T000000Z", Time: time.Date(2023, 12, 31, 0, 0, 0, 0, time.UTC), SizeKB: 4},
+		{Binary: "api", Name: "1.2.3", Path: "/opt/my api/releases/1.2.3", Release: true, Current: true, Time: time.Unix(1704067200, 0).UTC(), SizeKB: 96, SHA256: "bbb"},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("runListBackups() = %+v\nwant %+v", got, want)
+	}
+	if script := transport.script(); !strings.Contains(script, `APP_DIR='/opt/my api'`) || !strings.Contains(script, `backup_line release 'api' "$dir"`) {
+		t.Errorf("script does not list the releases:\n%s", script)
+	}
+}
+
+func TestListBackupsHost(t *testing.T) {
+	dir := t.TempDir()
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "bin.old"), Escalation: EscalateNone}
+	app := filepath.Join(dir, "app")
+	for _, p := range []string{
+		"bin.old/api/20240101T000000Z/api",
+		"bin.old/api/20240102T000000Z/api",
+		"bin.old/api/not-a-backup/api",
+		"bin.old/tool/20240103T000000Z/tool",
+		"app/releases/1.0.0/api",
+		"app/releases/1.1.0/api",
+	} {
+		if err := os.MkdirAll(filepath.Join(dir, filepath.Dir(p)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, p), []byte(p), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(app, "releases", "1.0.0"), old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("releases/1.1.0", filepath.Join(app, "current")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := runListBackups(config, shTransport{}, []releaseDir{{Dir: app, Binary: "api"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, b := range got.Backups {
+		name := b.Binary + "/" + b.Name
+		if b.Current {
+			name += " (current)"
+		}
+		names = append(names, name)
+		if len(b.SHA256) != 64 || b.SizeKB == 0 || b.Time.IsZero() {
+			t.Errorf("backup %+v", b)
+		}
+	}
+	want := []string{"api/20240102T000000Z", "api/20240101T000000Z", "tool/20240103T000000Z", "api/1.1.0 (current)", "api/1.0.0"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("listed %q, want %q", names, want)
+	}
+}
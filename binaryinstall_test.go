@@ -0,0 +1,812 @@
+package binaryinstall
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeArchive writes a tar.gz at path holding entries, in order.
+func writeArchive(t *testing.T, path string, entries ...tar.Header) {
+	t.Helper()
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, h := range entries {
+		h := h
+		body := ""
+		if h.Typeflag == tar.TypeReg {
+			body = "#!/bin/sh\necho " + h.Name + "\n"
+			h.Size = int64(len(body))
+		}
+		if h.Mode == 0 {
+			h.Mode = 0o755
+		}
+		if err := tw.WriteHeader(&h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func file(name string) tar.Header { return tar.Header{Name: name, Typeflag: tar.TypeReg} }
+
+func symlink(name, target string) tar.Header {
+	return tar.Header{Name: name, Typeflag: tar.TypeSymlink, Linkname: target}
+}
+
+func hardlink(name, target string) tar.Header {
+	return tar.Header{Name: name, Typeflag: tar.TypeLink, Linkname: target}
+}
+
+func TestArchiveChecks(t *testing.T) {
+	stubCommand(t, "sudo", "exit 0")
+	tests := []struct {
+		name    string
+		entries []tar.Header
+		wantErr string
+	}{
+		{name: "plain", entries: []tar.Header{file("tool"), file("README.md")}},
+		{name: "link inside the archive", entries: []tar.Header{file("tool"), file("lib/a"), symlink("lib/b", "a")}},
+		{name: "parent-relative member", entries: []tar.Header{file("tool"), file("../../etc/cron.d/evil")}, wantErr: "absolute or parent-relative"},
+		{name: "absolute member", entries: []tar.Header{file("tool"), file("/etc/cron.d/evil")}, wantErr: "absolute or parent-relative"},
+		{name: "symlink out", entries: []tar.Header{symlink("etc", "/etc"), file("tool")}, wantErr: "links pointing outside"},
+		{name: "symlink up", entries: []tar.Header{symlink("up", "../.."), file("tool")}, wantErr: "links pointing outside"},
+		{name: "hard link out", entries: []tar.Header{hardlink("passwd", "../../etc/passwd"), file("tool")}, wantErr: "links pointing outside"},
+		{name: "absolute hard link", entries: []tar.Header{hardlink("passwd", "/etc/passwd"), file("tool")}, wantErr: "links pointing outside"},
+		{name: "hard link inside the archive", entries: []tar.Header{file("tool"), hardlink("tool2", "tool")}},
+		{name: "binary is a link", entries: []tar.Header{file("real"), symlink("tool", "real")}, wantErr: "exit status"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			archive := filepath.Join(dir, "tool_Linux_x86_64.tar.gz")
+			writeArchive(t, archive, tt.entries...)
+			config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup")}
+			upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755"}
+
+			err := processUploadSingleCommand(config, shTransport{}, upload)
+			if tt.wantErr == "" && err != nil {
+				t.Fatalf("install failed: %v", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("install returned %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestValidateScriptData(t *testing.T) {
+	valid := func() ScriptData {
+		return ScriptData{
+			BinaryName:     "app",
+			DestinationDir: "/usr/local/bin",
+			BackupDir:      "/var/backups",
+			Permission:     "0755",
+			Owner:          "root",
+			Group:          "root",
+		}
+	}
+	tests := []struct {
+		name   string
+		change func(*ScriptData)
+		ok     bool
+	}{
+		{"valid", func(d *ScriptData) {}, true},
+
+		// quoted in the script, so allowed
+		{"quote in binary name", func(d *ScriptData) { d.BinaryName = "it's" }, true},
+		{"command substitution in destination", func(d *ScriptData) { d.DestinationDir = "/opt/$(touch pwned)" }, true},
+
+		{"newline in destination", func(d *ScriptData) { d.DestinationDir = "/opt/bin\n; rm -rf /" }, false},
+		{"carriage return in backup directory", func(d *ScriptData) { d.BackupDir = "/var/backups\r" }, false},
+		{"NUL in archive path", func(d *ScriptData) { d.UploadPath = "/tmp/a\x00b.tar.gz" }, false},
+
+		{"binary name with slash", func(d *ScriptData) { d.BinaryName = "../app" }, false},
+		{"binary name with backslash", func(d *ScriptData) { d.BinaryName = `..\app` }, false},
+		{"binary name dot dot", func(d *ScriptData) { d.BinaryName = ".." }, false},
+		{"binary name like a flag", func(d *ScriptData) { d.BinaryName = "-rf" }, false},
+		{"empty binary name", func(d *ScriptData) { d.BinaryName = "" }, false},
+		{"no destination", func(d *ScriptData) { d.DestinationDir = "" }, false},
+
+		{"owner with command substitution", func(d *ScriptData) { d.Owner = "$(id)" }, false},
+		{"owner with quote", func(d *ScriptData) { d.Owner = "root'" }, false},
+		{"owner with colon", func(d *ScriptData) { d.Owner = "root:wheel" }, false},
+		{"permission with command", func(d *ScriptData) { d.Permission = "0755; id" }, false},
+		{"symbolic permission", func(d *ScriptData) { d.Permission = "u+x" }, false},
+		{"setuid permission", func(d *ScriptData) { d.Permission = "4755" }, true},
+		{"group with semicolon", func(d *ScriptData) { d.Group = "wheel;id" }, false},
+	}
+	for _, tt := range tests {
+		d := valid()
+		tt.change(&d)
+		err := validateScriptData(d, false)
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%s: validated, want an error", tt.name)
+		}
+	}
+}
+
+func TestHostileInputs(t *testing.T) {
+	// Commands run as root are run directly, except changing owners
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	dir := t.TempDir()
+	pwned := filepath.Join(dir, "pwned")
+	hostile := "$(touch " + pwned + ")`touch " + pwned + "`'\"; touch " + pwned + "; '* ?"
+
+	archive := filepath.Join(dir, "it's a $(tool)_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("it's a $(tool)"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup "+hostile)}
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin "+hostile), Owner: "root", Permission: "0755"}
+	if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(pwned); err == nil {
+		t.Fatalf("a hostile value ran a command")
+	}
+	if _, err := os.Stat(filepath.Join(upload.DestinationDir, "it's a $(tool)")); err != nil {
+		t.Errorf("binary not installed under its literal name: %v", err)
+	}
+
+	upload.Owner = "root; touch " + pwned
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err == nil {
+		t.Errorf("an owner with shell syntax was accepted")
+	}
+	if _, err := os.Stat(pwned); err == nil {
+		t.Fatalf("a hostile owner ran a command")
+	}
+}
+
+func TestSudoPassword(t *testing.T) {
+	const password = "pa$$ 'w0rd'"
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "tool_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("tool"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup"), SudoPassword: password}
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755"}
+	if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("sudo reads it on stdin", func(t *testing.T) {
+		// sudo -S -p '' COMMAND...
+		args := stubCommand(t, "sudo", `IFS= read -r pw; printf '%s\n' "$pw" >> "$0.stdin"; shift 3
+case $1 in chown) exit 0 ;; esac
+exec "$@"`)
+		if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+			t.Fatal(err)
+		}
+		stdin, err := os.ReadFile(filepath.Dir(args) + "/sudo.stdin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pw := range strings.Split(strings.TrimSuffix(string(stdin), "\n"), "\n") {
+			if pw != password {
+				t.Errorf("sudo read %q from stdin, want the password", pw)
+			}
+		}
+		if strings.Contains(strings.Join(readArgs(t, args), " "), "pa$$") {
+			t.Errorf("sudo got the password as an argument")
+		}
+	})
+
+	t.Run("CLI transports send the script on stdin", func(t *testing.T) {
+		args := stubCommand(t, "docker", `cat > "$0.stdin"`)
+		if err := processUploadSingleCommand(config, newDockerTransport("box"), upload); err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Join(readArgs(t, args), " "); got != "exec -i box sh -c sh" {
+			t.Errorf("docker called with %q", got)
+		}
+		stdin, err := os.ReadFile(filepath.Dir(args) + "/docker.stdin")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(stdin), "SUDO_PASSWORD="+shellQuote(password)) {
+			t.Errorf("script on stdin lacks the password:\n%s", stdin)
+		}
+	})
+
+	t.Run("refused over SSM", func(t *testing.T) {
+		config := config
+		config.RemoteHost = "ssm://i-0123456789abcdef0"
+		if err := installHost(config, ""); err == nil || !strings.Contains(err.Error(), "records the scripts it runs") {
+			t.Errorf("installHost over SSM returned %v", err)
+		}
+	})
+
+	t.Run("masked in logs", func(t *testing.T) {
+		script := "SUDO_PASSWORD=" + shellQuote(password)
+		if got := redactSecrets(config, script); strings.Contains(got, "w0rd") {
+			t.Errorf("redacted script still has the password: %s", got)
+		}
+	})
+}
+
+func TestRestartService(t *testing.T) {
+	systemdHost(t)
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	calls := stubSystemctl(t, `case $2 in broken) echo "broken.service failed"; exit 1 ;; esac`)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "tool_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("tool"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup")}
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755", Reinstall: true, RestartService: "tool"}
+	if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := calls(), "restart tool\nis-active --quiet tool"; got != want {
+		t.Errorf("systemctl called with\n%s\nwant\n%s", got, want)
+	}
+
+	upload.RestartService = "broken"
+	err := processUploadSingleCommand(config, shTransport{}, upload)
+	if err == nil || !strings.Contains(err.Error(), "failed to restart broken") {
+		t.Errorf("a failed restart returned %v", err)
+	}
+	if got := calls(); !strings.Contains(got, "status broken --no-pager") {
+		t.Errorf("a failed restart did not show the status: systemctl called with\n%s", got)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		change  func(*BinaryUpload)
+		wantErr string
+	}{
+		{"bad name", func(u *BinaryUpload) { u.RestartService = "tool; reboot" }, "invalid service name"},
+		{"no sudo", func(u *BinaryUpload) { u.NoSudo = true }, "needs root"},
+	} {
+		upload := upload
+		upload.RestartService = "tool"
+		tt.change(&upload)
+		if err := processUploadSingleCommand(config, &scriptRecorder{}, upload); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: returned %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestStopService(t *testing.T) {
+	systemdHost(t)
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	// Services named running* are active
+	calls := stubSystemctl(t, `case $1 in is-active) case $3 in running*) exit 0 ;; *) exit 3 ;; esac ;; esac`)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "tool_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("tool"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup")}
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755", Reinstall: true}
+	if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	upload.StopService = "running-tool"
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := calls(), "is-active --quiet running-tool\nstop running-tool\nstart running-tool\nis-active --quiet running-tool"; got != want {
+		t.Errorf("systemctl called with\n%s\nwant\n%s", got, want)
+	}
+
+	upload.StopService = "idle-tool"
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := calls(), "is-active --quiet idle-tool"; got != want {
+		t.Errorf("a service not running: systemctl called with\n%s\nwant\n%s", got, want)
+	}
+
+	// A failed install starts the stopped service again on the old version
+	upload.StopService = "running-tool"
+	upload.DestinationDir = filepath.Join(dir, "missing", "bin")
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err == nil {
+		t.Fatal("installing into a missing directory succeeded")
+	}
+	if got, want := calls(), "is-active --quiet running-tool\nstop running-tool\nstart running-tool"; got != want {
+		t.Errorf("a failed install: systemctl called with\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRestartHooks(t *testing.T) {
+	systemdHost(t)
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	args := stubCommand(t, "systemctl", `echo "systemctl $*" >> "$0.calls"; case $1 in is-active) exit 0 ;; esac`)
+	log := filepath.Join(filepath.Dir(args), "systemctl.calls")
+	calls := func() string {
+		raw, _ := os.ReadFile(log)
+		os.Remove(log)
+		return strings.TrimSpace(string(raw))
+	}
+	hook := func(name string) string { return "echo " + name + " {{.env}} >> " + shellQuote(log) }
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "tool_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("tool"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup")}
+	base := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755", Reinstall: true,
+		Vars: map[string]string{"env": "prod"}, PreRestart: hook("pre"), PostRestart: hook("post")}
+	if err := os.MkdirAll(base.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		change  func(*BinaryUpload)
+		want    string
+		wantErr string
+	}{
+		{name: "around a restart", change: func(u *BinaryUpload) { u.RestartService = "tool" },
+			want: "pre prod\nsystemctl restart tool\nsystemctl is-active --quiet tool\npost prod"},
+		{name: "around a stop", change: func(u *BinaryUpload) { u.StopService = "tool" },
+			want: "systemctl is-active --quiet tool\npre prod\nsystemctl stop tool\nsystemctl start tool\nsystemctl is-active --quiet tool\npost prod"},
+		{name: "failed pre-restart hook", change: func(u *BinaryUpload) { u.RestartService, u.PreRestart = "tool", "exit 3" },
+			wantErr: "pre-restart hook failed"},
+		{name: "overrunning hook", change: func(u *BinaryUpload) { u.RestartService, u.PostRestart, u.HookTimeout = "tool", "sleep 5", time.Second },
+			want: "pre prod\nsystemctl restart tool\nsystemctl is-active --quiet tool", wantErr: "post-restart hook failed"},
+		{name: "no service", change: func(u *BinaryUpload) {}, wantErr: "restart hooks need a service"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "overrunning hook" {
+				if _, err := exec.LookPath("timeout"); err != nil {
+					t.Skip("no timeout command")
+				}
+			}
+			upload := base
+			tt.change(&upload)
+			err := processUploadSingleCommand(config, shTransport{}, upload)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("install returned %v, want an error containing %q", err, tt.wantErr)
+			}
+			if got := calls(); got != tt.want {
+				t.Errorf("ran\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+// stubSystemctl stubs systemctl with body, returning a func that lists
+// the calls made to it since the last, one per line.
+func stubSystemctl(t *testing.T, body string) func() string {
+	t.Helper()
+	args := stubCommand(t, "systemctl", `echo "$*" >> "$0.calls"`+"\n"+body)
+	log := filepath.Join(filepath.Dir(args), "systemctl.calls")
+	return func() string {
+		raw, _ := os.ReadFile(log)
+		os.Remove(log)
+		return strings.TrimSpace(string(raw))
+	}
+}
+
+// systemdHost skips a test of the service scripts unless this machine
+// looks like a systemd host to them.
+func systemdHost(t *testing.T) {
+	t.Helper()
+	if _, err := os.Stat("/run/systemd/system"); err != nil {
+		t.Skip("not a systemd host")
+	}
+}
+
+func TestReloadOnly(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	calls := stubSystemctl(t, "")
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "tool_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("tool"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup")}
+	base := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755", Reinstall: true,
+		RestartService: "tool", ReloadOnly: true}
+	if err := os.MkdirAll(base.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	systemdHost(t)
+
+	t.Run("init system reload", func(t *testing.T) {
+		if err := processUploadSingleCommand(config, shTransport{}, base); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := calls(), "reload tool\nis-active --quiet tool"; got != want {
+			t.Errorf("systemctl called with\n%s\nwant\n%s", got, want)
+		}
+	})
+
+	t.Run("signal to the main process", func(t *testing.T) {
+		upload := base
+		upload.ReloadSignal = "sighup"
+		if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := calls(), "kill --kill-whom=main --signal=HUP tool\nis-active --quiet tool"; got != want {
+			t.Errorf("systemctl called with\n%s\nwant\n%s", got, want)
+		}
+	})
+
+	t.Run("signal to the pid file's process", func(t *testing.T) {
+		marker := filepath.Join(dir, "reloaded")
+		ready := filepath.Join(dir, "ready")
+		service := exec.Command("sh", "-c", `trap 'echo reloaded > "$1"; exit 0' USR1; touch "$2"; while :; do sleep 0.05; done`, "sh", marker, ready)
+		if err := service.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer service.Process.Kill()
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(ready); err == nil {
+				break
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+		pidFile := filepath.Join(dir, "tool.pid")
+		if err := os.WriteFile(pidFile, []byte(strconv.Itoa(service.Process.Pid)), 0o644); err != nil {
+			t.Fatal(err)
+		}
+
+		upload := base
+		upload.ReloadSignal, upload.PIDFile = "USR1", pidFile
+		if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+			t.Fatal(err)
+		}
+		if err := service.Wait(); err != nil {
+			t.Errorf("service exited with %v", err)
+		}
+		if _, err := os.Stat(marker); err != nil {
+			t.Errorf("service got no USR1")
+		}
+	})
+
+	for _, tt := range []struct {
+		name    string
+		change  func(*BinaryUpload)
+		wantErr string
+	}{
+		{"no service", func(u *BinaryUpload) { u.RestartService = "" }, "needs a service to reload"},
+		{"signal without reload-only", func(u *BinaryUpload) { u.ReloadOnly, u.ReloadSignal = false, "HUP" }, "only sent with reload-only"},
+		{"bad signal", func(u *BinaryUpload) { u.ReloadSignal = "HUP; reboot" }, "invalid reload signal"},
+		{"relative pid file", func(u *BinaryUpload) { u.ReloadSignal, u.PIDFile = "HUP", "tool.pid" }, "must be an absolute path"},
+		{"pid file without signal", func(u *BinaryUpload) { u.PIDFile = "/run/tool.pid" }, "needs a reload signal"},
+	} {
+		upload := base
+		tt.change(&upload)
+		if err := processUploadSingleCommand(config, &scriptRecorder{}, upload); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: returned %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWaitActive(t *testing.T) {
+	systemdHost(t)
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	// tool comes up at its second check; dead never does
+	calls := stubSystemctl(t, `case $1 in is-active)
+    case $3 in dead) exit 3 ;; esac
+    [ $(grep -c is-active "$0.calls") -ge 2 ] ;;
+esac`)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "tool_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("tool"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup")}
+	base := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755", Reinstall: true,
+		RestartService: "tool", ActiveTimeout: 3 * time.Second}
+	if err := os.MkdirAll(base.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	ready := filepath.Join(dir, "ready")
+
+	tests := []struct {
+		name      string
+		change    func(*BinaryUpload)
+		wantCalls string
+		wantErr   string
+	}{
+		{name: "comes up", change: func(u *BinaryUpload) {},
+			wantCalls: "restart tool\nis-active --quiet tool\nis-active --quiet tool"},
+		{name: "never comes up", change: func(u *BinaryUpload) { u.RestartService, u.ActiveTimeout = "dead", time.Second },
+			wantErr: "dead did not come up within 1s"},
+		{name: "ready command", change: func(u *BinaryUpload) { u.ReadyCommand = "test -f " + shellQuote(ready) },
+			wantCalls: "restart tool"},
+		{name: "ready command without a service", change: func(u *BinaryUpload) { u.RestartService, u.ReadyCommand = "", "true" },
+			wantErr: "a ready command needs a service"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls()
+			if err := os.WriteFile(ready, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			upload := base
+			tt.change(&upload)
+			err := processUploadSingleCommand(config, shTransport{}, upload)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("install returned %v, want an error containing %q", err, tt.wantErr)
+			}
+			if got := calls(); tt.wantCalls != "" {
+				if got != tt.wantCalls {
+					t.Errorf("systemctl called with\n%s\nwant\n%s", got, tt.wantCalls)
+				}
+			}
+		})
+	}
+}
+
+func TestTimestampedBackups(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "api_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("api"))
+	backups := filepath.Join(dir, "bin.old")
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: backups}
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755"}
+	if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	installed := filepath.Join(upload.DestinationDir, "api")
+
+	// Nothing is replaced, so nothing is backed up
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(backups); !os.IsNotExist(err) {
+		t.Errorf("first install created %s: %v", backups, err)
+	}
+
+	// Each later install backs up what it replaced into a directory of its
+	// own, even within the same second
+	for _, previous := range []string{"first", "second"} {
+		if err := os.WriteFile(installed, []byte(previous), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	dirs, err := os.ReadDir(filepath.Join(backups, "api"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp := regexp.MustCompile(`^\d{8}T\d{6}Z(\.\d+)?$`)
+	var got []string
+	for _, d := range dirs {
+		if !stamp.MatchString(d.Name()) {
+			t.Errorf("backup directory %q is not a UTC timestamp", d.Name())
+		}
+		raw, err := os.ReadFile(filepath.Join(backups, "api", d.Name(), "api"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, string(raw))
+	}
+	if want := []string{"first", "second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("backed up %q, want %q", got, want)
+	}
+}
+
+func TestPruneBackups(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	// Backups from oldest to newest, each holding a 300 KiB binary
+	existing := []string{"20200101T000000Z", "20230101T000000Z", "20240101T000000Z", "20240101T000000Z.1"}
+	tests := []struct {
+		name   string
+		change func(*BinaryInstallConfig)
+		want   []string // the existing backups left beside the new one
+	}{
+		{"no limits", func(*BinaryInstallConfig) {}, existing},
+		{"count", func(c *BinaryInstallConfig) { c.KeepBackups = 3 }, existing[2:]},
+		{"age", func(c *BinaryInstallConfig) { c.BackupMaxAge = time.Since(time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC)) }, existing[1:]},
+		// The new backup of 64 KiB and three older ones fit in 1 MiB
+		{"size", func(c *BinaryInstallConfig) { c.BackupMaxSizeMB = 1 }, existing[1:]},
+		{"all", func(c *BinaryInstallConfig) { c.KeepBackups = 1; c.BackupMaxAge = time.Hour }, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			archive := filepath.Join(dir, "api_Linux_x86_64.tar.gz")
+			writeArchive(t, archive, file("api"))
+			config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "bin.old")}
+			tt.change(&config)
+			upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755"}
+			big := strings.Repeat("x", 300<<10)
+			for _, name := range existing {
+				if err := os.MkdirAll(filepath.Join(config.BackupDir, "api", name), 0o755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(config.BackupDir, "api", name, "api"), []byte(big), 0o755); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Not a backup, so never pruned
+			if err := os.MkdirAll(filepath.Join(config.BackupDir, "api", "keep"), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(filepath.Join(upload.DestinationDir, "api"), []byte(strings.Repeat("x", 64<<10)), 0o755); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+				t.Fatal(err)
+			}
+			entries, err := os.ReadDir(filepath.Join(config.BackupDir, "api"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, e := range entries {
+				got = append(got, e.Name())
+			}
+			if n := len(got); n < 2 || got[n-1] != "keep" || got[n-2] <= existing[len(existing)-1] {
+				t.Fatalf("backups %q lack the new backup or the other directory", got)
+			}
+			if got = got[:len(got)-2]; !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("kept backups %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUnchangedSkipped(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	me, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	group, err := user.LookupGroupId(me.Gid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "api_1.0.0_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("api"))
+	config := BinaryInstallConfig{
+		RemoteHost:   "local",
+		BackupDir:    filepath.Join(dir, "bin.old"),
+		AuditLog:     filepath.Join(dir, "audit.log"),
+		HostManifest: filepath.Join(dir, "manifest.json"),
+		results:      &results{},
+	}
+	// chown is stubbed out, so the binary stays ours
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: me.Username, Group: group.Name, Permission: "0755"}
+	if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	installed := filepath.Join(upload.DestinationDir, "api")
+	install := func(upload BinaryUpload) bool {
+		t.Helper()
+		if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+			t.Fatal(err)
+		}
+		last := config.results.uploads[len(config.results.uploads)-1]
+		return last.Unchanged
+	}
+	if install(upload) {
+		t.Fatal("the first install was skipped")
+	}
+
+	if !install(upload) {
+		t.Error("reinstalling the same binary was not skipped")
+	}
+	if _, err := os.Stat(config.BackupDir); !os.IsNotExist(err) {
+		t.Errorf("skipped install made a backup: %v", err)
+	}
+	// Skips are still audited and recorded in the host manifest
+	raw, _ := os.ReadFile(config.AuditLog)
+	if lines := strings.Split(strings.TrimSpace(string(raw)), "\n"); len(lines) != 2 || !strings.Contains(lines[1], "binary="+installed+" unchanged=true") {
+		t.Errorf("audit log:\n%s", raw)
+	}
+	if entry := readHostManifest(t, config.HostManifest)[installed]; entry.Version != "1.0.0" {
+		t.Errorf("host manifest entry %+v", entry)
+	}
+
+	changes := []struct {
+		name   string
+		change func(*BinaryUpload)
+	}{
+		{"reinstall", func(u *BinaryUpload) { u.Reinstall = true }},
+		{"mode", func(u *BinaryUpload) { u.Permission = "4755" }},
+		{"owner", func(u *BinaryUpload) { u.Owner = "binaryinstall-nobody" }},
+	}
+	if _, err := exec.LookPath("getcap"); err == nil && runtime.GOOS == "linux" {
+		changes = append(changes, struct {
+			name   string
+			change func(*BinaryUpload)
+		}{"capabilities", func(u *BinaryUpload) { u.Capabilities = []string{"cap_net_bind_service"} }})
+	}
+	for _, tt := range changes {
+		changed := upload
+		tt.change(&changed)
+		if install(changed) {
+			t.Errorf("%s: install was skipped", tt.name)
+		}
+		// Put the binary back as the upload installs it
+		if err := os.Chmod(installed, 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !install(upload) {
+		t.Error("reinstalling the same binary after the changes was not skipped")
+	}
+	// A different binary is installed
+	if err := os.WriteFile(installed, []byte("older"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if install(upload) {
+		t.Error("replacing a different binary was skipped")
+	}
+}
+
+func TestInstallFilesLiterally(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "api_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("api"), file("api.conf"))
+	conf := filepath.Join(dir, "etc")
+	if err := os.MkdirAll(conf, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	other := filepath.Join(conf, "other.conf")
+	if err := os.WriteFile(other, []byte("other"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// A destination with glob characters names that one file, and does not
+	// expand to the files it would match
+	dest := filepath.Join(conf, "*.conf")
+	upload := BinaryUpload{
+		Path:           archive,
+		DestinationDir: filepath.Join(dir, "bin"),
+		Owner:          "root",
+		Permission:     "0755",
+		Files:          []ArchiveFile{{Source: "api.conf", Destination: dest}},
+	}
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backups")}
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+		t.Fatal(err)
+	}
+	if raw, err := os.ReadFile(dest); err != nil || !strings.Contains(string(raw), "api.conf") {
+		t.Errorf("%s = %q, %v; want the archive's api.conf", dest, raw, err)
+	}
+	if raw, err := os.ReadFile(other); err != nil || string(raw) != "other" {
+		t.Errorf("%s = %q, %v; want it untouched", other, raw, err)
+	}
+	matches, _ := filepath.Glob(filepath.Join(conf, "*.binaryinstall-new"))
+	if len(matches) != 0 {
+		t.Errorf("staged files left behind: %q", matches)
+	}
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bufio"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/dropsite-ai/binaryinstall"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
 )
 
 // uploadSpec is a custom type for parsing key=value pairs passed to -upload.
@@ -17,8 +24,8 @@ type uploadSpec struct {
 
 func (u *uploadSpec) String() string {
 	// Return a short identifier for debugging (not strictly needed).
-	return fmt.Sprintf("path=%s,dest=%s,owner=%s,perm=%s,bindlowports=%t",
-		u.Path, u.DestinationDir, u.Owner, u.Permission, u.BindLowPorts)
+	return fmt.Sprintf("path=%s,local=%s,dest=%s,owner=%s,perm=%s,bindlowports=%t",
+		u.Path, u.LocalPath, u.DestinationDir, u.Owner, u.Permission, u.BindLowPorts)
 }
 
 // Set parses a string like "path=/x.tar.gz,dest=/usr/local/bin,owner=root,perm=0755,bindlowports=true"
@@ -31,24 +38,276 @@ func (u *uploadSpec) Set(value string) error {
 		}
 		key := strings.ToLower(strings.TrimSpace(kv[0]))
 		val := strings.TrimSpace(kv[1])
+		var err error
 
 		switch key {
 		case "path":
 			u.Path = val
+		case "local":
+			u.LocalPath = val
+		case "dist":
+			u.Dist = val
+		case "url", "oci":
+			u.URL = val
+			if key == "oci" {
+				u.URL = "oci://" + val
+			}
+		case "presign":
+			if u.Presign, err = parseBool(key, val); err != nil {
+				return err
+			}
+		case "fetchlocal":
+			if u.FetchLocal, err = parseBool(key, val); err != nil {
+				return err
+			}
+		case "var":
+			name, v, ok := strings.Cut(val, ":")
+			if !ok {
+				return fmt.Errorf("invalid var %q, expected name:value", val)
+			}
+			if u.Vars == nil {
+				u.Vars = map[string]string{}
+			}
+			u.Vars[name] = v
+		case "checksumheader":
+			u.ChecksumHeader = val
+		case "header":
+			// Expand $VARS so tokens can come from the environment.
+			u.Headers = append(u.Headers, os.ExpandEnv(val))
+		case "sha256":
+			u.SHA256 = val
+		case "binarysha256":
+			u.BinarySHA256 = val
+		case "checksums":
+			u.Checksums = val
+		case "minisignkey":
+			u.MinisignPublicKey = val
+		case "minisig":
+			u.MinisignSignature = val
+		case "slsasource":
+			u.SLSASourceURI = val
+		case "slsabuilder":
+			u.SLSABuilderID = val
+		case "provenance":
+			u.SLSAProvenance = val
 		case "dest":
 			u.DestinationDir = val
 		case "owner":
 			u.Owner = val
 		case "perm":
 			u.Permission = val
+		case "group":
+			u.Group = val
+		case "setuid", "setgid", "sticky":
+			on, err := parseBool(key, val)
+			if err != nil {
+				return err
+			}
+			switch key {
+			case "setuid":
+				u.Setuid = on
+			case "setgid":
+				u.Setgid = on
+			default:
+				u.Sticky = on
+			}
+		case "member":
+			u.ArchivePath = val
+		case "strip":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return fmt.Errorf("invalid strip %q: %w", val, err)
+			}
+			u.StripComponents = n
+		case "fixdeps":
+			if u.FixDependencies, err = parseBool(key, val); err != nil {
+				return err
+			}
+		case "apkkeys":
+			u.APKKeysDir = val
+		case "docs":
+			if u.InstallDocs, err = parseBool(key, val); err != nil {
+				return err
+			}
+		case "extract":
+			if u.ExtractAll, err = parseBool(key, val); err != nil {
+				return err
+			}
+		case "reinstall":
+			if u.Reinstall, err = parseBool(key, val); err != nil {
+				return err
+			}
+		case "release":
+			u.Release = val
+		case "filelist":
+			u.FilesManifest = val
+		case "unit", "exec", "runas", "env", "restart", "listen":
+			if u.Systemd == nil {
+				u.Systemd = &binaryinstall.SystemdUnit{}
+			}
+			switch key {
+			case "unit":
+				// a name, or true for one after the binary
+				if on, err := parseBool(key, val); err != nil {
+					u.Systemd.Name = val
+				} else if !on {
+					return fmt.Errorf("invalid %s %q: leave it out for none", key, val)
+				}
+			case "exec":
+				u.Systemd.ExecStart = val
+			case "runas":
+				u.Systemd.User = val
+			case "env":
+				name, v, ok := strings.Cut(val, ":")
+				if !ok {
+					return fmt.Errorf("invalid env %q, expected NAME:value", val)
+				}
+				if u.Systemd.Environment == nil {
+					u.Systemd.Environment = map[string]string{}
+				}
+				u.Systemd.Environment[name] = v
+			case "restart":
+				u.Systemd.Restart = val
+			case "listen":
+				u.Systemd.Listen = append(u.Systemd.Listen, val)
+			}
+		case "restartservice":
+			u.RestartService = val
+		case "stopservice":
+			u.StopService = val
+		case "activetimeout":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("invalid activetimeout %q: %w", val, err)
+			}
+			u.ActiveTimeout = d
+		case "readycmd":
+			u.ReadyCommand = val
+		case "reloadonly":
+			if u.ReloadOnly, err = parseBool(key, val); err != nil {
+				return err
+			}
+		case "reloadsignal":
+			u.ReloadSignal = val
+		case "pidfile":
+			u.PIDFile = val
+		case "userservice":
+			if u.UserService, err = parseBool(key, val); err != nil {
+				return err
+			}
+		case "prerestart":
+			u.PreRestart = val
+		case "postrestart":
+			u.PostRestart = val
+		case "hooktimeout":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return fmt.Errorf("invalid hooktimeout %q: %w", val, err)
+			}
+			u.HookTimeout = d
+		case "healthurl", "healthcmd", "healthstatus", "healthtimeout", "healthretries", "healthinterval":
+			if u.HealthCheck == nil {
+				u.HealthCheck = &binaryinstall.HealthCheck{}
+			}
+			var err error
+			switch key {
+			case "healthurl":
+				u.HealthCheck.URL = val
+			case "healthcmd":
+				u.HealthCheck.Command = val
+			case "healthstatus":
+				u.HealthCheck.Status, err = strconv.Atoi(val)
+			case "healthtimeout":
+				u.HealthCheck.Timeout, err = time.ParseDuration(val)
+			case "healthretries":
+				u.HealthCheck.Retries, err = strconv.Atoi(val)
+			case "healthinterval":
+				u.HealthCheck.Interval, err = time.ParseDuration(val)
+			}
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", key, val, err)
+			}
+		case "consul", "consulid", "consulport", "consuladdress", "consultag", "consulmeta",
+			"consulagent", "consultokenfile", "consulinterval", "consulderegister":
+			if u.Consul == nil {
+				u.Consul = &binaryinstall.ConsulService{}
+			}
+			var err error
+			switch key {
+			case "consul":
+				// a name, or true for one after the binary
+				if on, err := parseBool(key, val); err != nil {
+					u.Consul.Name = val
+				} else if !on {
+					return fmt.Errorf("invalid %s %q: leave it out for none", key, val)
+				}
+			case "consulid":
+				u.Consul.ID = val
+			case "consulport":
+				u.Consul.Port, err = strconv.Atoi(val)
+			case "consuladdress":
+				u.Consul.Address = val
+			case "consultag":
+				u.Consul.Tags = append(u.Consul.Tags, val)
+			case "consulmeta":
+				name, v, ok := strings.Cut(val, ":")
+				if !ok {
+					return fmt.Errorf("invalid consulmeta %q, expected NAME:value", val)
+				}
+				if u.Consul.Meta == nil {
+					u.Consul.Meta = map[string]string{}
+				}
+				u.Consul.Meta[name] = v
+			case "consulagent":
+				u.Consul.Agent = val
+			case "consultokenfile":
+				u.Consul.TokenFile = val
+			case "consulinterval":
+				u.Consul.CheckInterval, err = time.ParseDuration(val)
+			case "consulderegister":
+				u.Consul.DeregisterAfter, err = time.ParseDuration(val)
+			}
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", key, val, err)
+			}
+		case "hostgroup":
+			u.HostGroups = append(u.HostGroups, val)
+		case "all":
+			if u.InstallAll, err = parseBool(key, val); err != nil {
+				return err
+			}
+		case "nosudo":
+			if u.NoSudo, err = parseBool(key, val); err != nil {
+				return err
+			}
+		case "restorecon":
+			if u.SELinuxRestore, err = parseBool(key, val); err != nil {
+				return err
+			}
+		case "selinux":
+			u.SELinuxContext = val
+		case "cap":
+			u.Capabilities = append(u.Capabilities, val)
 		case "bindlowports":
-			lower := strings.ToLower(val)
-			u.BindLowPorts = (lower == "true" || lower == "1" || lower == "yes")
+			if u.BindLowPorts, err = parseBool(key, val); err != nil {
+				return err
+			}
 		default:
 			return fmt.Errorf("unknown field %q in upload spec", key)
 		}
 	}
 
+	if u.Path == "" && u.LocalPath == "" && u.URL == "" && u.Dist == "" {
+		return fmt.Errorf("upload %q needs a path, local archive, dist directory, or url", value)
+	}
+
+	// Credentials for artifact repositories come from the environment.
+	if u.URL != "" {
+		u.BasicAuthUser = os.Getenv("BINARYINSTALL_REPO_USER")
+		u.BasicAuthPassword = os.Getenv("BINARYINSTALL_REPO_PASSWORD")
+		u.BearerToken = os.Getenv("BINARYINSTALL_REPO_TOKEN")
+	}
+
 	// Provide some defaults if desired:
 	if u.DestinationDir == "" {
 		u.DestinationDir = "/usr/local/bin"
@@ -63,13 +322,43 @@ func (u *uploadSpec) Set(value string) error {
 	return nil
 }
 
+// parseBool parses the value of a boolean upload field: true, yes or 1, or
+// false, no or 0, in any case.
+func parseBool(key, val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "true", "yes", "1":
+		return true, nil
+	case "false", "no", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid %s %q, expected true or false", key, val)
+}
+
+// stringList collects the values of a repeatable string flag.
+type stringList []string
+
+func (sl *stringList) String() string {
+	return strings.Join(*sl, ", ")
+}
+
+func (sl *stringList) Set(value string) error {
+	*sl = append(*sl, value)
+	return nil
+}
+
 // uploadList is a slice of uploadSpec that implements flag.Value
 type uploadList []binaryinstall.BinaryUpload
 
 func (ul *uploadList) String() string {
 	var out []string
 	for _, u := range *ul {
-		out = append(out, fmt.Sprintf("path=%s", u.Path))
+		if u.LocalPath != "" {
+			out = append(out, fmt.Sprintf("local=%s", u.LocalPath))
+		} else if u.URL != "" {
+			out = append(out, fmt.Sprintf("url=%s", u.URL))
+		} else {
+			out = append(out, fmt.Sprintf("path=%s", u.Path))
+		}
 	}
 	return strings.Join(out, "; ")
 }
@@ -83,45 +372,560 @@ func (ul *uploadList) Set(value string) error {
 	return nil
 }
 
+// promptSecret reads a line from the terminal without echoing it.
+func promptSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(secret), nil
+}
+
+// confirmRegion asks on the terminal whether to continue from region done
+// to region next.
+func confirmRegion(done, next string) bool {
+	fmt.Fprintf(os.Stderr, "Finished %s. Continue with %s? [y/N] ", done, next)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// keyIsEncrypted reports whether the private key at path needs a passphrase.
+func keyIsEncrypted(path string) bool {
+	keyBytes, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+	_, err = ssh.ParsePrivateKey(keyBytes)
+	var missing *ssh.PassphraseMissingError
+	return errors.As(err, &missing)
+}
+
 func main() {
 	var (
-		remoteHost string
-		sshUser    string
-		sshKeyPath string
-		backupDir  string
-		verbose    bool
-		uploads    uploadList
+		remoteHost   string
+		sshUser      string
+		sshKeyPath   string
+		sshAgent     bool
+		askPass      bool
+		sudoPass     bool
+		escalate     string
+		fwdAgent     bool
+		compress     bool
+		jumps        stringList
+		jumpKey      string
+		proxyURL     string
+		sshOpts      stringList
+		sshConfig    bool
+		hostKey      string
+		knownHosts   string
+		hostKeys     stringList
+		transport    string
+		awsRegion    string
+		awsProfile   string
+		gcsKey       string
+		retries      int
+		backoff      time.Duration
+		connectTO    time.Duration
+		kubeNS       string
+		kubeCont     string
+		kubeCtx      string
+		winrmUser    string
+		winrmHTTPS   bool
+		tshProxy     string
+		tshCluster   string
+		tshIdent     string
+		gcpProject   string
+		gcpZone      string
+		commandTO    time.Duration
+		keepAlive    time.Duration
+		seedHost     string
+		invPath      string
+		ec2Tags      string
+		ec2Address   string
+		consulSvc    string
+		consulTag    string
+		consulDC     string
+		consulAddr   string
+		srvName      string
+		tfOutput     string
+		tfState      string
+		tfDir        string
+		hostSpecs    stringList
+		batchSize    int
+		batchPause   time.Duration
+		keepGoing    bool
+		canaries     string
+		canaryHealth string
+		soak         time.Duration
+		maxHosts     int
+		keepOnErr    bool
+		rollback     bool
+		serial       bool
+		lock         bool
+		lockPath     string
+		lockTTL      time.Duration
+		lockWait     time.Duration
+		windows      stringList
+		windowFile   string
+		envName      string
+		windowWait   bool
+		force        bool
+		regions      string
+		regionHold   time.Duration
+		regionAsk    bool
+		stateFile    string
+		retryState   string
+		maxUploads   int
+		seedCopy     string
+		backupDir    string
+		keepBaks     int
+		bakMaxAge    time.Duration
+		bakMaxMB     int
+		auditLog     string
+		hostManifest string
+		jsonOut      bool
+		removeUnit   bool
+		removeConfig bool
+		removeBaks   bool
+		verbose      bool
+		uploads      uploadList
+		manifest     string
+		distDir      string
 	)
 
-	flag.StringVar(&remoteHost, "remote", "", "Remote host address (required)")
+	flag.StringVar(&remoteHost, "remote", "", "Remote host address, or a comma-separated list of hosts to install on in parallel (required unless -inventory is given)")
 	flag.StringVar(&sshUser, "sshuser", "ec2-user", "SSH user for remote host (default: ec2-user)")
-	flag.StringVar(&sshKeyPath, "sshkey", "", "Path to SSH key (required)")
-	flag.Var(&uploads, "upload", "Specify an upload in the form \"path=/x.tar.gz,dest=/usr/local/bin,owner=root,perm=0755,bindlowports=true\" (can be repeated)")
+	flag.StringVar(&transport, "transport", binaryinstall.TransportSSH, "Transport to use: ssh, ssm (-remote is an EC2 instance ID), docker (-remote is a container), k8s (-remote is [namespace/]pod), winrm, tsh, or iap")
+	flag.StringVar(&awsRegion, "awsregion", "", "AWS region for the ssm transport and s3:// URLs")
+	flag.StringVar(&awsProfile, "awsprofile", "", "AWS CLI profile for the ssm transport and locally fetched s3:// URLs")
+	flag.StringVar(&gcsKey, "gcskey", "", "Service-account key file for fetching gs:// URLs locally")
+	flag.StringVar(&kubeNS, "namespace", "", "Kubernetes namespace for the k8s transport")
+	flag.StringVar(&kubeCont, "container", "", "Container within the pod for the k8s transport")
+	flag.StringVar(&kubeCtx, "kubecontext", "", "kubectl context for the k8s transport")
+	flag.StringVar(&winrmUser, "winrmuser", "", "User for the winrm transport (password from BINARYINSTALL_WINRM_PASSWORD or -askpass)")
+	flag.BoolVar(&winrmHTTPS, "winrmhttps", false, "Use HTTPS for the winrm transport")
+	flag.StringVar(&tshProxy, "tshproxy", "", "Teleport proxy address for the tsh transport")
+	flag.StringVar(&tshCluster, "tshcluster", "", "Teleport cluster for the tsh transport")
+	flag.StringVar(&tshIdent, "tshidentity", "", "Teleport identity file for the tsh transport (e.g. from tbot)")
+	flag.StringVar(&gcpProject, "project", "", "GCP project for the iap transport")
+	flag.StringVar(&gcpZone, "zone", "", "GCP zone for the iap transport")
+	flag.StringVar(&sshKeyPath, "sshkey", "", "Path to SSH key (required unless using the SSH agent)")
+	flag.BoolVar(&sshAgent, "sshagent", false, "Authenticate with the SSH agent at SSH_AUTH_SOCK")
+	flag.BoolVar(&fwdAgent, "A", false, "Forward the local SSH agent to the remote host")
+	flag.BoolVar(&compress, "C", false, "Compress data sent to the remote host")
+	flag.BoolVar(&askPass, "askpass", false, "Prompt for an SSH password (or set BINARYINSTALL_SSH_PASSWORD)")
+	flag.StringVar(&escalate, "escalate", binaryinstall.EscalateSudo, "Privilege escalation on the remote: sudo, doas, su, or none")
+	flag.BoolVar(&sudoPass, "sudopass", false, "Prompt for the remote sudo password (or set BINARYINSTALL_SUDO_PASSWORD)")
+	flag.Var(&jumps, "jump", "Jump host to tunnel through, as [user@]host[:port][,key=/path] (repeat for multiple hops, in order)")
+	flag.StringVar(&jumpKey, "jumpkey", "", "Path to SSH key for jump hosts without their own key (default: -sshkey)")
+	flag.Var(&sshOpts, "sshopt", "Extra SSH option as Key=Value, e.g. ServerAliveInterval=15 (can be repeated)")
+	flag.StringVar(&proxyURL, "proxy", "", "SOCKS5 proxy to dial SSH through, e.g. socks5://proxy.internal:1080")
+	flag.BoolVar(&sshConfig, "sshconfig", false, "Resolve -remote as an alias in ~/.ssh/config")
+	flag.StringVar(&hostKey, "hostkeycheck", binaryinstall.HostKeyStrict, "Host key checking mode: strict, accept-new to add unknown hosts to known_hosts, or insecure")
+	flag.Var(&hostKeys, "hostkey", "Pin a host key fingerprint as [host=]SHA256:... (host defaults to -remote; can be repeated)")
+	flag.StringVar(&knownHosts, "knownhosts", "", "Path to known_hosts file (default: ~/.ssh/known_hosts)")
+	flag.IntVar(&retries, "retries", 0, "Number of times to retry transient connection failures")
+	flag.DurationVar(&backoff, "retrybackoff", time.Second, "Initial delay between retries, doubled after each attempt")
+	flag.DurationVar(&connectTO, "connecttimeout", 30*time.Second, "Timeout for connecting to the remote host")
+	flag.DurationVar(&commandTO, "timeout", 0, "Timeout for each install script (0 for none)")
+	flag.DurationVar(&keepAlive, "keepalive", 30*time.Second, "Interval between SSH keepalives (0 to disable)")
+	flag.Var(&uploads, "upload", "Specify an upload in the form \"path=/x.tar.gz,dest=/usr/local/bin,owner=root,perm=0755,bindlowports=true\"; use local=./x.tar.gz or url=https://... instead of path to transfer or download the archive (can be repeated)")
+	flag.StringVar(&ec2Tags, "ec2tags", "", "Install on the running EC2 instances with these tags, e.g. Service=api,Env=prod (uses -awsregion and -awsprofile)")
+	flag.StringVar(&ec2Address, "ec2address", binaryinstall.AddressPrivate, "Address of discovered EC2 instances to connect to: private, public, or instance-id (for -transport ssm)")
+	flag.StringVar(&consulSvc, "consul", "", "Install on the nodes with a passing instance of this Consul service")
+	flag.StringVar(&consulTag, "consultag", "", "Only use instances of the -consul service with this tag")
+	flag.StringVar(&consulDC, "consuldc", "", "Consul datacenter to look up -consul in (default: the agent's)")
+	flag.StringVar(&consulAddr, "consuladdr", "", "Consul HTTP API address (default: $CONSUL_HTTP_ADDR or http://127.0.0.1:8500; token from $CONSUL_HTTP_TOKEN)")
+	flag.StringVar(&srvName, "srv", "", "Install on the targets of this DNS SRV record, e.g. _api._tcp.example.com")
+	flag.StringVar(&tfOutput, "tfoutput", "", "Install on the addresses in this Terraform output (a string, list, or map of strings)")
+	flag.StringVar(&tfState, "tfstate", "", "Read -tfoutput from this terraform.tfstate file instead of running terraform output")
+	flag.StringVar(&tfDir, "tfdir", "", "Terraform working directory to run terraform output -json in (default: current directory)")
+	flag.Var(&hostSpecs, "host", "Host to install on with its own login, as [user@]host[:port][,key=/path] (can be repeated)")
+	flag.StringVar(&invPath, "inventory", "", "YAML or Ansible INI inventory of hosts to install on, with per-host users, keys, ports and variables")
+	flag.IntVar(&batchSize, "batch", 0, "Install on this many hosts at a time, in order (0 for all at once)")
+	flag.DurationVar(&batchPause, "batchpause", 0, "Pause between batches, e.g. 2m")
+	flag.BoolVar(&keepGoing, "batchkeepgoing", false, "Start the next batch even if a host in the previous one failed")
+	flag.StringVar(&canaries, "canary", "", "Comma-separated hosts or inventory groups to install on first, before the rest")
+	flag.StringVar(&canaryHealth, "canaryhealth", "", "Shell command run on canary hosts after install, which must keep succeeding during -canarysoak, and on each host with -serial")
+	flag.DurationVar(&soak, "canarysoak", 5*time.Minute, "How long canaries must stay healthy before the rollout continues")
+	flag.StringVar(&stateFile, "statefile", "", "Write each host's outcome (installed, failed, or skipped) to this JSON file after the run")
+	flag.StringVar(&retryState, "retryfailed", "", "Install only on the hosts this -statefile from an earlier run records as failed or skipped, and update it")
+	flag.StringVar(&regions, "regions", "", "Comma-separated regions to roll out to one after another, e.g. us-east-1,eu-west-1 (hosts' regions come from -inventory or -ec2tags)")
+	flag.DurationVar(&regionHold, "regionpause", 0, "Hold between regions, e.g. 30m")
+	flag.BoolVar(&regionAsk, "regionconfirm", false, "Ask for confirmation on the terminal before moving on to the next region")
+	flag.Var(&windows, "window", "Cron expression for when installs may run, e.g. \"* 9-16 * * mon-thu\" (can be repeated)")
+	flag.StringVar(&windowFile, "windows", "", "YAML file of deploy windows per environment; use with -environment")
+	flag.StringVar(&envName, "environment", "", "Environment whose deploy windows in -windows apply")
+	flag.BoolVar(&windowWait, "waitforwindow", false, "Outside the deploy windows, wait for the next one instead of refusing to run")
+	flag.BoolVar(&force, "force", false, "Install even outside the deploy windows")
+	flag.BoolVar(&lock, "lock", false, "Take a lock on each host before installing, so concurrent runs cannot install on it at once")
+	flag.StringVar(&lockPath, "lockpath", binaryinstall.DefaultLockPath, "Lock directory on each host for -lock")
+	flag.DurationVar(&lockTTL, "lockttl", 15*time.Minute, "How long a -lock outlives a run that stopped renewing it before another run may break it as stale")
+	flag.DurationVar(&lockWait, "lockwait", 0, "How long to wait for a -lock held by another run (0 to fail at once)")
+	flag.BoolVar(&serial, "serial", false, "Install on one host at a time, in order, stopping at the first that fails to install or fails -canaryhealth")
+	flag.BoolVar(&rollback, "rollback", false, "Restore the previous version of an upload, and restart its service, when its health check fails")
+	flag.BoolVar(&keepOnErr, "continueonerror", false, "Keep installing the remaining uploads and hosts after a failure and report every failure at the end (default: stop starting new ones at the first)")
+	flag.IntVar(&maxHosts, "parallelhosts", 0, "Install on at most this many hosts at once (0 for no limit)")
+	flag.IntVar(&maxUploads, "paralleluploads", 0, "Run at most this many uploads at once on each host (0 for no limit)")
+	flag.StringVar(&seedHost, "seed", "", "Upload local artifacts once to this host and copy them from host to host from there")
+	flag.StringVar(&seedCopy, "seedcopy", binaryinstall.SeedCopySCP, "How hosts copy seeded artifacts to each other: scp or rsync")
+	flag.StringVar(&distDir, "dist", "", "goreleaser dist directory; installs each binary's archive matching the host's OS and arch with default dest, owner and perm")
+	flag.StringVar(&manifest, "manifest", "", "YAML or JSON file listing uploads, used in addition to -upload")
 	flag.StringVar(&backupDir, "backup", "/home/ec2-user/bin.old", "Backup directory on remote (default: /home/ec2-user/bin.old)")
+	flag.IntVar(&keepBaks, "keepbackups", 0, "After each install, prune the binary's backups beyond the most recent N (0 to keep all)")
+	flag.DurationVar(&bakMaxAge, "backupmaxage", 0, "After each install, prune the binary's backups older than this, e.g. 720h (0 for no limit)")
+	flag.IntVar(&bakMaxMB, "backupmaxsize", 0, "After each install, prune the binary's oldest backups while they take more than this many MiB (0 for no limit)")
+	flag.StringVar(&auditLog, "auditlog", "", "File on the remote host to append a line to for each install, e.g. /var/log/binaryinstall.log")
+	flag.StringVar(&hostManifest, "hostmanifest", "", "JSON file on the remote host recording what each install put there, e.g. /var/lib/binaryinstall/manifest.json")
+	flag.BoolVar(&jsonOut, "json", false, "Print status, backups or drift as JSON")
+	flag.BoolVar(&removeUnit, "removeunit", false, "With uninstall, also remove the upload's service unit")
+	flag.BoolVar(&removeConfig, "removeconfig", false, "With uninstall, also remove files the upload keeps if they exist, such as configs")
+	flag.BoolVar(&removeBaks, "removebackups", false, "With uninstall, also remove the binary's backups")
 	flag.BoolVar(&verbose, "verbose", false, "Enable verbose output")
 
+	// "binaryinstall rollback", "uninstall", "status", "list-backups" and
+	// "verify" take the same flags as an install.
+	command := "install"
+	if len(os.Args) > 1 && (os.Args[1] == "rollback" || os.Args[1] == "uninstall" || os.Args[1] == "status" || os.Args[1] == "list-backups" || os.Args[1] == "verify") {
+		command = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 	flag.Parse()
 
-	if remoteHost == "" || sshKeyPath == "" || len(uploads) == 0 {
-		fmt.Println("Error: -remote, -sshkey, and at least one -upload flag are required.")
+	hosts := strings.Split(remoteHost, ",")
+	remoteHost = hosts[0]
+
+	if distDir != "" {
+		var u uploadSpec
+		if err := u.Set("dist=" + distDir); err != nil {
+			log.Fatalf("Invalid -dist: %v", err)
+		}
+		uploads = append(uploads, u.BinaryUpload)
+	}
+
+	if manifest != "" {
+		loaded, err := binaryinstall.LoadUploads(manifest)
+		if err != nil {
+			log.Fatalf("Failed to load manifest: %v", err)
+		}
+		for _, u := range loaded {
+			// Same defaults as -upload.
+			if u.DestinationDir == "" {
+				u.DestinationDir = "/usr/local/bin"
+			}
+			if u.Owner == "" {
+				u.Owner = "root"
+			}
+			if u.Permission == "" {
+				u.Permission = "0755"
+			}
+			uploads = append(uploads, u)
+		}
+	}
+
+	if sshConfig {
+		// Let ~/.ssh/config supply the user unless -sshuser was given explicitly.
+		userSet := false
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "sshuser" {
+				userSet = true
+			}
+		})
+		if !userSet {
+			sshUser = ""
+		}
+	}
+
+	winrmPassword := os.Getenv("BINARYINSTALL_WINRM_PASSWORD")
+	if askPass && winrmUser != "" && winrmPassword == "" {
+		var err error
+		winrmPassword, err = promptSecret(fmt.Sprintf("WinRM password for %s@%s: ", winrmUser, remoteHost))
+		if err != nil {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+	}
+
+	sshPassword := os.Getenv("BINARYINSTALL_SSH_PASSWORD")
+	if askPass && winrmUser == "" && sshPassword == "" {
+		var err error
+		sshPassword, err = promptSecret(fmt.Sprintf("SSH password for %s@%s: ", sshUser, remoteHost))
+		if err != nil {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+	}
+
+	sudoPassword := os.Getenv("BINARYINSTALL_SUDO_PASSWORD")
+	if sudoPass && sudoPassword == "" {
+		var err error
+		sudoPassword, err = promptSecret(fmt.Sprintf("sudo password for %s: ", remoteHost))
+		if err != nil {
+			log.Fatalf("Failed to read password: %v", err)
+		}
+	}
+
+	keyPassphrase := os.Getenv("BINARYINSTALL_SSH_KEY_PASSPHRASE")
+	if keyPassphrase == "" && sshKeyPath != "" && keyIsEncrypted(sshKeyPath) && term.IsTerminal(int(os.Stdin.Fd())) {
+		var err error
+		keyPassphrase, err = promptSecret(fmt.Sprintf("Passphrase for %s: ", sshKeyPath))
+		if err != nil {
+			log.Fatalf("Failed to read passphrase: %v", err)
+		}
+	}
+
+	if sshKeyPath == "" && sshPassword == "" && !sshAgent && os.Getenv("SSH_AUTH_SOCK") != "" {
+		sshAgent = true
+	}
+
+	usesSSH := transport == binaryinstall.TransportSSH && !strings.Contains(remoteHost, "://")
+	var targets []binaryinstall.Host
+	if invPath != "" {
+		var err error
+		if targets, err = binaryinstall.LoadInventory(invPath); err != nil {
+			log.Fatalf("Failed to load inventory: %v", err)
+		}
+	}
+	if ec2Tags != "" {
+		tags, err := binaryinstall.ParseTags(ec2Tags)
+		if err != nil {
+			log.Fatalf("Invalid -ec2tags: %v", err)
+		}
+		found, err := binaryinstall.DiscoverEC2(binaryinstall.EC2Query{Tags: tags, Region: awsRegion, Profile: awsProfile, Address: ec2Address})
+		if err != nil {
+			log.Fatalf("Failed to discover EC2 instances: %v", err)
+		}
+		if len(found) == 0 {
+			log.Fatalf("No running EC2 instances tagged %s", ec2Tags)
+		}
+		targets = append(targets, found...)
+	}
+	if consulSvc != "" {
+		found, err := binaryinstall.DiscoverConsul(binaryinstall.ConsulQuery{Service: consulSvc, Tag: consulTag, Datacenter: consulDC, Address: consulAddr})
+		if err != nil {
+			log.Fatalf("Failed to discover Consul service: %v", err)
+		}
+		if len(found) == 0 {
+			log.Fatalf("No healthy instances of Consul service %s", consulSvc)
+		}
+		targets = append(targets, found...)
+	}
+	if srvName != "" {
+		found, err := binaryinstall.DiscoverSRV(srvName)
+		if err != nil {
+			log.Fatalf("Failed to discover hosts: %v", err)
+		}
+		if len(found) == 0 {
+			log.Fatalf("No targets in SRV record %s", srvName)
+		}
+		targets = append(targets, found...)
+	}
+	if tfOutput != "" {
+		found, err := binaryinstall.DiscoverTerraform(binaryinstall.TerraformQuery{Output: tfOutput, StateFile: tfState, Dir: tfDir})
+		if err != nil {
+			log.Fatalf("Failed to discover hosts: %v", err)
+		}
+		if len(found) == 0 {
+			log.Fatalf("Terraform output %s holds no addresses", tfOutput)
+		}
+		targets = append(targets, found...)
+	}
+	for _, spec := range hostSpecs {
+		spec, key, _ := strings.Cut(spec, ",key=")
+		host := binaryinstall.ParseHost(spec)
+		host.KeyPath = key
+		targets = append(targets, host)
+	}
+	// Hosts from -inventory, discovery or -host may each bring their own key.
+	if remoteHost == "" && len(targets) > 0 {
+		usesSSH = false
+		for _, t := range targets {
+			usesSSH = usesSSH || t.KeyPath == ""
+		}
+	}
+
+	// Status needs uploads only to find binaries the host manifest lacks, and
+	// listing backups only to find releases
+	needUploads := command == "install" || command == "rollback" || command == "uninstall" || ((command == "status" || command == "verify") && hostManifest == "")
+	if (remoteHost == "" && len(targets) == 0) || (usesSSH && sshKeyPath == "" && sshPassword == "" && !sshAgent && !sshConfig) || (needUploads && len(uploads) == 0) {
+		fmt.Println("Error: -remote, -host, -inventory, -ec2tags, -consul, -srv, or -tfoutput, -sshkey (or -sshagent or a password), and at least one -upload, -dist, or -manifest are required.")
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	var jumpHosts []binaryinstall.JumpHop
+	for _, spec := range jumps {
+		spec, key, _ := strings.Cut(spec, ",key=")
+		hop := binaryinstall.ParseJumpHop(spec)
+		hop.KeyPath = key
+		if hop.KeyPath == "" {
+			hop.KeyPath = jumpKey
+		}
+		jumpHosts = append(jumpHosts, hop)
+	}
+
+	fingerprints := map[string]string{}
+	for _, spec := range hostKeys {
+		host, fp, ok := strings.Cut(spec, "=")
+		if !ok {
+			host, fp = remoteHost, spec
+		}
+		fingerprints[host] = fp
+	}
+
+	if retryState != "" {
+		if stateFile != "" && stateFile != retryState {
+			log.Fatalf("-retryfailed and -statefile name different files")
+		}
+		stateFile = retryState
+	}
+
 	config := binaryinstall.BinaryInstallConfig{
-		RemoteHost: remoteHost,
-		SSHUser:    sshUser,
-		SSHKeyPath: sshKeyPath,
-		Uploads:    uploads,
-		BackupDir:  backupDir,
-		Verbose:    verbose,
+		RegistryUsername:    os.Getenv("BINARYINSTALL_REGISTRY_USERNAME"),
+		RegistryPassword:    os.Getenv("BINARYINSTALL_REGISTRY_PASSWORD"),
+		RemoteHost:          remoteHost,
+		Hosts:               hosts[1:],
+		Targets:             targets,
+		BatchSize:           batchSize,
+		BatchPause:          batchPause,
+		BatchKeepGoing:      keepGoing,
+		CanaryHealthCommand: canaryHealth,
+		CanarySoak:          soak,
+		MaxParallelHosts:    maxHosts,
+		ContinueOnError:     keepOnErr,
+		Rollback:            rollback,
+		Serial:              serial,
+		Lock:                lock,
+		LockPath:            lockPath,
+		LockTTL:             lockTTL,
+		LockWait:            lockWait,
+		DeployWindows:       windows,
+		DeployWindowWait:    windowWait,
+		IgnoreDeployWindows: force,
+		RegionPause:         regionHold,
+		StateFile:           stateFile,
+		RetryFailed:         retryState != "",
+		MaxParallelUploads:  maxUploads,
+		SeedHost:            seedHost,
+		SeedCopy:            seedCopy,
+		SSHUser:             sshUser,
+		SSHKeyPath:          sshKeyPath,
+		SSHAgent:            sshAgent,
+		SSHPassword:         sshPassword,
+		SSHKeyPassphrase:    keyPassphrase,
+		SudoPassword:        sudoPassword,
+		Escalation:          escalate,
+		AgentForwarding:     fwdAgent,
+		Compression:         compress,
+		JumpHosts:           jumpHosts,
+		ProxyURL:            proxyURL,
+		SSHOptions:          sshOpts,
+		UseSSHConfig:        sshConfig,
+		HostKeyCheck:        hostKey,
+		KnownHostsPath:      knownHosts,
+		HostKeyFingerprints: fingerprints,
+		Transport:           transport,
+		AWSRegion:           awsRegion,
+		AWSProfile:          awsProfile,
+		GCSCredentialsFile:  gcsKey,
+		KubeNamespace:       kubeNS,
+		KubeContainer:       kubeCont,
+		KubeContext:         kubeCtx,
+		WinRMUser:           winrmUser,
+		WinRMPassword:       winrmPassword,
+		WinRMHTTPS:          winrmHTTPS,
+		TeleportProxy:       tshProxy,
+		TeleportCluster:     tshCluster,
+		TeleportIdentity:    tshIdent,
+		GCPProject:          gcpProject,
+		GCPZone:             gcpZone,
+		RetryAttempts:       retries,
+		RetryBackoff:        backoff,
+		ConnectTimeout:      connectTO,
+		CommandTimeout:      commandTO,
+		KeepAliveInterval:   keepAlive,
+		Uploads:             uploads,
+		BackupDir:           backupDir,
+		KeepBackups:         keepBaks,
+		BackupMaxAge:        bakMaxAge,
+		BackupMaxSizeMB:     bakMaxMB,
+		AuditLog:            auditLog,
+		HostManifest:        hostManifest,
+		Verbose:             verbose,
+	}
+
+	if canaries != "" {
+		config.Canaries = strings.Split(canaries, ",")
+	}
+	if windowFile != "" {
+		if envName == "" {
+			log.Fatalf("-windows needs -environment")
+		}
+		envWindows, err := binaryinstall.LoadDeployWindows(windowFile, envName)
+		if err != nil {
+			log.Fatalf("Failed to load deploy windows: %v", err)
+		}
+		config.DeployWindows = append(config.DeployWindows, envWindows...)
+	}
+	if regions != "" {
+		config.Regions = strings.Split(regions, ",")
+	}
+	if regionAsk {
+		config.RegionConfirm = confirmRegion
+	}
+
+	if command == "rollback" {
+		rollbackUploads(config)
+		return
+	}
+	if command == "uninstall" {
+		uninstallUploads(config, binaryinstall.UninstallOptions{
+			RemoveUnit:    removeUnit,
+			RemoveConfig:  removeConfig,
+			RemoveBackups: removeBaks,
+		})
+		return
+	}
+	if command == "status" {
+		printStatus(config, jsonOut)
+		return
+	}
+	if command == "list-backups" {
+		printBackups(config, jsonOut)
+		return
+	}
+	if command == "verify" {
+		printDrift(config, jsonOut)
+		return
 	}
 
 	if config.Verbose {
-		log.Printf("Starting installation on %s", remoteHost)
+		if len(targets) > 0 {
+			log.Printf("Starting installation on %d hosts from -inventory, -host and discovery", len(targets))
+		}
+		if remoteHost != "" {
+			log.Printf("Starting installation on %s", strings.Join(hosts, ", "))
+		}
 	}
 
-	if err := binaryinstall.InstallBinaries(config); err != nil {
+	results, err := binaryinstall.Install(config)
+	for _, r := range results {
+		if r.Unchanged {
+			fmt.Printf("%s: %s is unchanged, skipped\n", r.Host, r.Upload)
+		}
+	}
+	if err != nil {
+		if failures := binaryinstall.Failures(err); len(failures) > 1 {
+			for _, f := range failures {
+				if errors.Is(f, binaryinstall.ErrRolledBack) {
+					log.Printf("ROLLED BACK %s", f)
+				} else {
+					log.Printf("FAILED %s", f)
+				}
+			}
+			log.Fatalf("Installation failed: %d failures", len(failures))
+		}
 		log.Fatalf("Installation failed: %v", err)
 	}
 
@@ -129,3 +933,186 @@ func main() {
 		fmt.Println("Binaries installed successfully.")
 	}
 }
+
+// rollbackUploads restores the most recent backup of each upload's binary on
+// every host of config and reports the versions restored.
+func rollbackUploads(config binaryinstall.BinaryInstallConfig) {
+	failed := 0
+	for _, u := range config.Uploads {
+		results, err := binaryinstall.Rollback(config, u)
+		for _, r := range results {
+			fmt.Printf("%s: restored %s backed up at %s (sha256 %s)\n", r.Host, r.Path, r.Backup, r.SHA256)
+		}
+		if failures := binaryinstall.Failures(err); len(failures) > 0 {
+			for _, f := range failures {
+				log.Printf("FAILED %s", f)
+			}
+			failed += len(failures)
+		} else if err != nil {
+			log.Printf("FAILED %v", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("Rollback failed: %d failures", failed)
+	}
+}
+
+// uninstallUploads removes each upload's binary from every host, with its
+// service stopped and disabled, and whatever else opts selects.
+func uninstallUploads(config binaryinstall.BinaryInstallConfig, opts binaryinstall.UninstallOptions) {
+	failed := 0
+	for _, u := range config.Uploads {
+		results, err := binaryinstall.Uninstall(config, u, opts)
+		for _, r := range results {
+			if len(r.Removed) == 0 {
+				fmt.Printf("%s: nothing to remove\n", r.Host)
+			}
+			for _, p := range r.Removed {
+				fmt.Printf("%s: removed %s\n", r.Host, p)
+			}
+		}
+		if failures := binaryinstall.Failures(err); len(failures) > 0 {
+			for _, f := range failures {
+				log.Printf("FAILED %s", f)
+			}
+			failed += len(failures)
+		} else if err != nil {
+			log.Printf("FAILED %v", err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		log.Fatalf("Uninstall failed: %d failures", failed)
+	}
+}
+
+// printStatus prints what is installed on each host, as a line per binary
+// or, with asJSON, as a JSON array of hosts for scripts.
+func printStatus(config binaryinstall.BinaryInstallConfig, asJSON bool) {
+	statuses, err := binaryinstall.Status(config)
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(statuses); err != nil {
+			log.Fatalf("Failed to encode status: %v", err)
+		}
+	} else {
+		for _, s := range statuses {
+			if len(s.Binaries) == 0 {
+				fmt.Printf("%s: nothing installed\n", s.Host)
+			}
+			for _, b := range s.Binaries {
+				name := b.Path
+				if b.Package != "" {
+					name = "package " + b.Package
+				}
+				version := b.Version
+				if version == "" {
+					version = "unknown version"
+				}
+				line := fmt.Sprintf("%s: %s %s sha256 %s", s.Host, name, version, b.SHA256)
+				if b.Recorded {
+					line += " installed " + b.InstalledAt.Format(time.RFC3339)
+				} else {
+					line += " (not in host manifest)"
+				}
+				fmt.Println(line)
+			}
+		}
+	}
+	if failures := binaryinstall.Failures(err); len(failures) > 0 {
+		for _, f := range failures {
+			log.Printf("FAILED %s", f)
+		}
+		log.Fatalf("Status failed: %d failures", len(failures))
+	} else if err != nil {
+		log.Fatalf("Status failed: %v", err)
+	}
+}
+
+// printBackups prints the backups and releases kept on each host, newest
+// first, as a line per backup or, with asJSON, as a JSON array of hosts.
+func printBackups(config binaryinstall.BinaryInstallConfig, asJSON bool) {
+	hosts, err := binaryinstall.ListBackups(config)
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(hosts); err != nil {
+			log.Fatalf("Failed to encode backups: %v", err)
+		}
+	} else {
+		for _, h := range hosts {
+			if len(h.Backups) == 0 {
+				fmt.Printf("%s: no backups\n", h.Host)
+			}
+			for _, b := range h.Backups {
+				name := b.Name
+				if b.Release {
+					name = "release " + name
+					if b.Current {
+						name += " (current)"
+					}
+				}
+				sum := b.SHA256
+				if sum == "" {
+					sum = "-"
+				}
+				fmt.Printf("%s: %s %s %s %d KiB sha256 %s\n",
+					h.Host, b.Binary, name, b.Time.Format(time.RFC3339), b.SizeKB, sum)
+			}
+		}
+	}
+	if failures := binaryinstall.Failures(err); len(failures) > 0 {
+		for _, f := range failures {
+			log.Printf("FAILED %s", f)
+		}
+		log.Fatalf("Listing backups failed: %d failures", len(failures))
+	} else if err != nil {
+		log.Fatalf("Listing backups failed: %v", err)
+	}
+}
+
+// printDrift prints how the files on each host differ from the host manifest
+// and uploads, as a line per difference or, with asJSON, as a JSON array of
+// hosts, and exits non-zero if any do, for CI.
+func printDrift(config binaryinstall.BinaryInstallConfig, asJSON bool) {
+	hosts, err := binaryinstall.CheckDrift(config)
+	drifted := 0
+	for _, h := range hosts {
+		if len(h.Drift) > 0 {
+			drifted++
+		}
+	}
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(hosts); err != nil {
+			log.Fatalf("Failed to encode drift: %v", err)
+		}
+	} else {
+		for _, h := range hosts {
+			if len(h.Drift) == 0 {
+				fmt.Printf("%s: %d files as expected\n", h.Host, h.Checked)
+			}
+			for _, d := range h.Drift {
+				if d.Field == "missing" {
+					fmt.Printf("%s: %s is missing (%s)\n", h.Host, d.Path, d.Source)
+					continue
+				}
+				fmt.Printf("%s: %s %s is %s, expected %s (%s)\n", h.Host, d.Path, d.Field, d.Actual, d.Expected, d.Source)
+			}
+		}
+	}
+	if failures := binaryinstall.Failures(err); len(failures) > 0 {
+		for _, f := range failures {
+			log.Printf("FAILED %s", f)
+		}
+		log.Fatalf("Verify failed: %d failures, %d hosts drifted", len(failures), drifted)
+	} else if err != nil {
+		log.Fatalf("Verify failed: %v", err)
+	}
+	if drifted > 0 {
+		log.Fatalf("Drift found on %d of %d hosts", drifted, len(hosts))
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestUploadSpecBools(t *testing.T) {
+	tests := []struct {
+		spec string
+		ok   bool
+		want func(uploadSpec) bool
+	}{
+		{"local=a.tar.gz,nosudo=true", true, func(u uploadSpec) bool { return u.NoSudo }},
+		{"local=a.tar.gz,nosudo=YES", true, func(u uploadSpec) bool { return u.NoSudo }},
+		{"local=a.tar.gz,nosudo=1", true, func(u uploadSpec) bool { return u.NoSudo }},
+		{"local=a.tar.gz,nosudo=false", true, func(u uploadSpec) bool { return !u.NoSudo }},
+		{"local=a.tar.gz,nosudo=No", true, func(u uploadSpec) bool { return !u.NoSudo }},
+		{"local=a.tar.gz,nosudo=0", true, func(u uploadSpec) bool { return !u.NoSudo }},
+		{"local=a.tar.gz,setgid=true", true, func(u uploadSpec) bool { return u.Setgid && !u.Setuid }},
+		{"local=a.tar.gz,unit=true", true, func(u uploadSpec) bool { return u.Systemd != nil && u.Systemd.Name == "" }},
+		{"local=a.tar.gz,unit=api", true, func(u uploadSpec) bool { return u.Systemd != nil && u.Systemd.Name == "api" }},
+		{"local=a.tar.gz,consul=web", true, func(u uploadSpec) bool { return u.Consul != nil && u.Consul.Name == "web" }},
+
+		{"local=a.tar.gz,nosudo=ture", false, nil},
+		{"local=a.tar.gz,reinstall=", false, nil},
+		{"local=a.tar.gz,bindlowports=on", false, nil},
+		{"local=a.tar.gz,sticky=2", false, nil},
+		{"local=a.tar.gz,unit=false", false, nil},
+		{"local=a.tar.gz,consul=no", false, nil},
+	}
+	for _, tt := range tests {
+		var u uploadSpec
+		err := u.Set(tt.spec)
+		switch {
+		case tt.ok && err != nil:
+			t.Errorf("%s: %v", tt.spec, err)
+		case !tt.ok && err == nil:
+			t.Errorf("%s: accepted, want an error", tt.spec)
+		case tt.ok && !tt.want(u):
+			t.Errorf("%s: parsed as %+v", tt.spec, u.BinaryUpload)
+		}
+	}
+}
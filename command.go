@@ -0,0 +1,200 @@
+package binaryinstall
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+)
+
+// commandTransport runs scripts through a local CLI such as docker, which
+// runs the shell command given as its final argument on the target.
+type commandTransport struct {
+	name string   // CLI binary
+	args []string // arguments placed before the command
+}
+
+// Run sends the script to sh on the CLI's stdin, like the SSH transport, so
+// secrets in it such as a sudo password show up neither in the local process
+// list nor in the target's.
+func (t *commandTransport) Run(ctx context.Context, script string) (string, error) {
+	args := append(append([]string{}, t.args...), "sh")
+	cmd := exec.CommandContext(ctx, t.name, args...)
+	cmd.Stdin = strings.NewReader(stdinScript(script))
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return string(out), fmt.Errorf("%s: %w", t.name, err)
+	}
+	return string(out), nil
+}
+
+// Stage streams a local artifact to the target through the CLI's stdin.
+// Like the SSH transport, it resumes interrupted transfers of the same file.
+func (t *commandTransport) Stage(ctx context.Context, localPath string) (string, error) {
+	return stageResumable(ctx, localPath, t.Run, t.send)
+}
+
+// StageReader streams r to the target through the CLI's stdin.
+func (t *commandTransport) StageReader(ctx context.Context, name string, r io.Reader) (string, error) {
+	remotePath := stagingPath(name)
+	return remotePath, t.send(ctx, name, r, remotePath, false)
+}
+
+// send writes r to remotePath, appending to it when resuming.
+func (t *commandTransport) send(ctx context.Context, name string, r io.Reader, remotePath string, resume bool) error {
+	redirect := " > "
+	if resume {
+		redirect = " >> "
+	}
+	args := append(append([]string{}, t.args...), "cat"+redirect+shellQuote(remotePath))
+	cmd := exec.CommandContext(ctx, t.name, args...)
+	cmd.Stdin = r
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to upload %s: %w: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (t *commandTransport) Close() error {
+	return nil
+}
+
+// sudoShim defines sudo as a passthrough when the target has no sudo binary,
+// which is the norm in containers that already run as root.
+const sudoShim = "command -v sudo >/dev/null 2>&1 || sudo() { \"$@\"; }\n"
+
+// dockerTransport installs into a running Docker container with docker exec.
+type dockerTransport struct {
+	commandTransport
+	container string
+}
+
+func newDockerTransport(container string) *dockerTransport {
+	return &dockerTransport{
+		commandTransport: commandTransport{
+			name: "docker",
+			args: []string{"exec", "-i", container, "sh", "-c"},
+		},
+		container: container,
+	}
+}
+
+func (t *dockerTransport) Run(ctx context.Context, script string) (string, error) {
+	return t.commandTransport.Run(ctx, sudoShim+script)
+}
+
+// Stage copies a local artifact into the container with docker cp.
+func (t *dockerTransport) Stage(ctx context.Context, localPath string) (string, error) {
+	remotePath := stagingPath(localPath)
+	out, err := exec.CommandContext(ctx, "docker", "cp", localPath, t.container+":"+remotePath).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("docker cp %s: %w: %s", localPath, err, strings.TrimSpace(string(out)))
+	}
+	return remotePath, nil
+}
+
+// kubernetesTransport installs into a pod container with kubectl exec.
+type kubernetesTransport struct {
+	commandTransport
+	pod   string
+	flags []string // namespace, container and context selection
+}
+
+// newKubernetesTransport targets pod, given as "pod" or "namespace/pod".
+func newKubernetesTransport(config BinaryInstallConfig, pod string) *kubernetesTransport {
+	namespace := config.KubeNamespace
+	if ns, name, ok := strings.Cut(pod, "/"); ok {
+		namespace, pod = ns, name
+	}
+
+	var flags []string
+	if namespace != "" {
+		flags = append(flags, "--namespace", namespace)
+	}
+	if config.KubeContainer != "" {
+		flags = append(flags, "--container", config.KubeContainer)
+	}
+	if config.KubeContext != "" {
+		flags = append(flags, "--context", config.KubeContext)
+	}
+
+	args := append([]string{"exec", "-i", pod}, flags...)
+	args = append(args, "--", "sh", "-c")
+	return &kubernetesTransport{
+		commandTransport: commandTransport{name: "kubectl", args: args},
+		pod:              pod,
+		flags:            flags,
+	}
+}
+
+func (t *kubernetesTransport) Run(ctx context.Context, script string) (string, error) {
+	return t.commandTransport.Run(ctx, sudoShim+script)
+}
+
+// Stage copies a local artifact into the pod with kubectl cp.
+func (t *kubernetesTransport) Stage(ctx context.Context, localPath string) (string, error) {
+	remotePath := stagingPath(localPath)
+	args := append([]string{"cp", localPath, t.pod + ":" + remotePath}, t.flags...)
+	out, err := exec.CommandContext(ctx, "kubectl", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("kubectl cp %s: %w: %s", localPath, err, strings.TrimSpace(string(out)))
+	}
+	return remotePath, nil
+}
+
+// newTeleportTransport runs scripts with "tsh ssh". Certificates come from
+// the current tsh login or, for machine users, the identity file issued by tbot.
+func newTeleportTransport(config BinaryInstallConfig, host string) *commandTransport {
+	args := []string{"ssh"}
+	if config.TeleportProxy != "" {
+		args = append(args, "--proxy", config.TeleportProxy)
+	}
+	if config.TeleportCluster != "" {
+		args = append(args, "--cluster", config.TeleportCluster)
+	}
+	if config.TeleportIdentity != "" {
+		args = append(args, "--identity", config.TeleportIdentity)
+	}
+	if config.AgentForwarding {
+		args = append(args, "-A")
+	}
+	args = append(args, sshOptionFlags(config)...)
+	target := host
+	if config.SSHUser != "" {
+		target = config.SSHUser + "@" + host
+	}
+	return &commandTransport{name: "tsh", args: append(args, target)}
+}
+
+// newGCloudTransport runs scripts with "gcloud compute ssh" tunneled through
+// Identity-Aware Proxy, for GCE instances without external access.
+func newGCloudTransport(config BinaryInstallConfig, instance string) *commandTransport {
+	target := instance
+	if config.SSHUser != "" {
+		target = config.SSHUser + "@" + instance
+	}
+	args := []string{"compute", "ssh", target, "--tunnel-through-iap", "--quiet"}
+	if config.GCPProject != "" {
+		args = append(args, "--project", config.GCPProject)
+	}
+	if config.GCPZone != "" {
+		args = append(args, "--zone", config.GCPZone)
+	}
+	if config.SSHKeyPath != "" {
+		args = append(args, "--ssh-key-file", config.SSHKeyPath)
+	}
+	if config.AgentForwarding {
+		args = append(args, "--ssh-flag=-A")
+	}
+	if config.Compression {
+		args = append(args, "--ssh-flag=-C")
+	}
+	for _, flag := range sshOptionFlags(config) {
+		args = append(args, "--ssh-flag="+flag)
+	}
+	return &commandTransport{name: "gcloud", args: append(args, "--command")}
+}
@@ -0,0 +1,149 @@
+package binaryinstall
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultConsulAgent is the Consul agent HTTP API registered with unless
+// ConsulService.Agent is set, as seen from the host.
+const DefaultConsulAgent = "http://127.0.0.1:8500"
+
+// ConsulService registers an upload's binary with the host's Consul agent
+// once it is installed, restarted and healthy, replacing any registration
+// under the same ID. The upload's HealthCheck, if any, is registered as the
+// service's check.
+type ConsulService struct {
+	Name    string            // defaults to the binary name
+	ID      string            // defaults to Name
+	Port    int               // port the service listens on
+	Address string            // defaults to the agent's address
+	Tags    []string          // e.g. ["v2", "primary"]
+	Meta    map[string]string // e.g. {"version": "1.2.3"}
+
+	Agent     string // agent HTTP API; defaults to DefaultConsulAgent
+	TokenFile string // file on the host holding an ACL token, read as root
+
+	CheckInterval   time.Duration // how often Consul runs the check; defaults to 10s
+	DeregisterAfter time.Duration // deregister once critical this long; never if zero
+}
+
+// consulRegistration is what the remote script sends to the Consul agent.
+type consulRegistration struct {
+	ID        string
+	URL       string // the agent's register endpoint
+	TokenFile string
+	Payload   string // the service definition as JSON
+}
+
+// consulCheck is a check in the Consul agent's service definition.
+type consulCheck struct {
+	Name                           string
+	HTTP                           string   `json:",omitempty"`
+	Args                           []string `json:",omitempty"`
+	Interval                       string
+	Timeout                        string
+	DeregisterCriticalServiceAfter string `json:",omitempty"`
+}
+
+// consulNamePattern matches Consul service names and IDs usable in DNS
+// lookups and API paths.
+var consulNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// consulService returns the registration of upload's Consul service with
+// its defaults filled in, or nil if it has none. check is the upload's
+// health check, from healthCheck. URL checks pass on any 2xx status in
+// Consul, and command checks need the agent's enable_script_checks.
+func consulService(upload BinaryUpload, binaryName string, check *HealthCheck) (*consulRegistration, error) {
+	if upload.Consul == nil {
+		return nil, nil
+	}
+	svc := *upload.Consul
+	if svc.Name == "" {
+		svc.Name = binaryName
+	}
+	if svc.ID == "" {
+		svc.ID = svc.Name
+	}
+	for _, s := range []string{svc.Name, svc.ID} {
+		if !consulNamePattern.MatchString(s) {
+			return nil, fmt.Errorf("invalid Consul service name %q", s)
+		}
+	}
+	if svc.Port < 0 || svc.Port > 65535 {
+		return nil, fmt.Errorf("invalid Consul service port %d", svc.Port)
+	}
+	if svc.Agent == "" {
+		svc.Agent = DefaultConsulAgent
+	}
+	u, err := url.Parse(svc.Agent)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid Consul agent %q, expected an http or https URL", svc.Agent)
+	}
+	if strings.ContainsAny(svc.TokenFile, "\x00\n\r") {
+		return nil, fmt.Errorf("Consul token file %q contains control characters", svc.TokenFile)
+	}
+	if svc.CheckInterval <= 0 {
+		svc.CheckInterval = 10 * time.Second
+	}
+
+	def := struct {
+		ID, Name string
+		Address  string            `json:",omitempty"`
+		Port     int               `json:",omitempty"`
+		Tags     []string          `json:",omitempty"`
+		Meta     map[string]string `json:",omitempty"`
+		Checks   []consulCheck     `json:",omitempty"`
+	}{ID: svc.ID, Name: svc.Name, Address: svc.Address, Port: svc.Port, Tags: svc.Tags, Meta: svc.Meta}
+	if check != nil {
+		c := consulCheck{
+			Name:     svc.Name + " health",
+			HTTP:     check.URL,
+			Interval: svc.CheckInterval.String(),
+			Timeout:  check.Timeout.String(),
+		}
+		if check.Command != "" {
+			c.Args = []string{"/bin/sh", "-c", check.Command}
+		}
+		if svc.DeregisterAfter > 0 {
+			c.DeregisterCriticalServiceAfter = svc.DeregisterAfter.String()
+		}
+		def.Checks = append(def.Checks, c)
+	}
+	payload, err := json.MarshalIndent(def, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode Consul service: %w", err)
+	}
+	return &consulRegistration{
+		ID:        svc.ID,
+		URL:       strings.TrimSuffix(svc.Agent, "/") + "/v1/agent/service/register?replace-existing-checks=true",
+		TokenFile: svc.TokenFile,
+		Payload:   string(payload),
+	}, nil
+}
+
+// consulScript is scriptTemplate's "consul", which registers the service with
+// the local Consul agent once it is running.
+const consulScript = `{{ define "consul" }}
+{{- with .Consul }}
+# Register the service with the Consul agent, replacing any registration
+# under the same ID. The ACL token is passed in a file, not on the command
+# line.
+if ! command -v curl >/dev/null 2>&1; then
+    echo "registering with Consul needs curl" >&2
+    exit 1
+fi
+cat > "$TEMP_DIR/consul.json" <<'BINARYINSTALL_CONSUL'
+{{ .Payload }}
+BINARYINSTALL_CONSUL
+{{- if .TokenFile }}
+(umask 077; printf 'X-Consul-Token: %s\n' "$(as_root cat {{ q .TokenFile }})" > "$TEMP_DIR/consul.headers")
+{{- end }}
+curl -fsS -X PUT{{ if .TokenFile }} -H @"$TEMP_DIR/consul.headers"{{ end }} --data-binary @"$TEMP_DIR/consul.json" {{ q .URL }}
+echo "registered "{{ q .ID }}" with Consul"
+{{- end }}
+{{ end }}`
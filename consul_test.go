@@ -0,0 +1,114 @@
+package binaryinstall
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConsulService(t *testing.T) {
+	upload := BinaryUpload{Consul: &ConsulService{Port: 8080, Tags: []string{"v2"}, Meta: map[string]string{"version": "1.2.3"}, DeregisterAfter: time.Hour}}
+	check := &HealthCheck{URL: "http://localhost:8080/healthz", Timeout: 5 * time.Second}
+	reg, err := consulService(upload, "api", check)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.ID != "api" || reg.URL != DefaultConsulAgent+"/v1/agent/service/register?replace-existing-checks=true" {
+		t.Errorf("registering %s at %s", reg.ID, reg.URL)
+	}
+	var got map[string]any
+	if err := json.Unmarshal([]byte(reg.Payload), &got); err != nil {
+		t.Fatalf("payload is not JSON: %v\n%s", err, reg.Payload)
+	}
+	want := map[string]any{
+		"ID": "api", "Name": "api", "Port": 8080.0,
+		"Tags": []any{"v2"},
+		"Meta": map[string]any{"version": "1.2.3"},
+		"Checks": []any{map[string]any{
+			"Name": "api health", "HTTP": "http://localhost:8080/healthz", "Interval": "10s", "Timeout": "5s",
+			"DeregisterCriticalServiceAfter": "1h0m0s",
+		}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("payload\n%v\nwant\n%v", got, want)
+	}
+
+	// A command check runs through a shell
+	upload.Consul = &ConsulService{Name: "api", ID: "api-1", Agent: "https://consul.local:8501/"}
+	reg, err = consulService(upload, "api", &HealthCheck{Command: "api --check", Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reg.URL != "https://consul.local:8501/v1/agent/service/register?replace-existing-checks=true" {
+		t.Errorf("registering at %s", reg.URL)
+	}
+	if !strings.Contains(reg.Payload, `"Args": [`+"\n"+`        "/bin/sh",`) || !strings.Contains(reg.Payload, `"api --check"`) || strings.Contains(reg.Payload, "HTTP") {
+		t.Errorf("payload has no command check:\n%s", reg.Payload)
+	}
+
+	if reg, err := consulService(BinaryUpload{}, "api", nil); reg != nil || err != nil {
+		t.Errorf("without Consul, consulService() = %+v, %v", reg, err)
+	}
+	for _, tt := range []struct {
+		svc     ConsulService
+		wantErr string
+	}{
+		{ConsulService{Name: "api server"}, "invalid Consul service name"},
+		{ConsulService{ID: "api/1"}, "invalid Consul service name"},
+		{ConsulService{Port: 70000}, "invalid Consul service port"},
+		{ConsulService{Agent: "127.0.0.1:8500"}, "invalid Consul agent"},
+		{ConsulService{TokenFile: "/etc/token\n"}, "contains control characters"},
+	} {
+		svc := tt.svc
+		upload.Consul = &svc
+		if _, err := consulService(upload, "api", nil); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%+v: returned %v, want an error containing %q", tt.svc, err, tt.wantErr)
+		}
+	}
+}
+
+func TestConsulScript(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	// curl -fsS -X PUT -H @HEADERS --data-binary @PAYLOAD URL
+	args := stubCommand(t, "curl", `cat "${5#@}" > "$0.headers"; cat "${7#@}" > "$0.payload"`)
+	dir := t.TempDir()
+	token := filepath.Join(dir, "token")
+	if err := os.WriteFile(token, []byte("s3cret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	archive := filepath.Join(dir, "api_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("api"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup")}
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755",
+		Consul: &ConsulService{Port: 8080, TokenFile: token}}
+	if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+		t.Fatal(err)
+	}
+	argv := readArgs(t, args)
+	if got := argv[len(argv)-1]; got != DefaultConsulAgent+"/v1/agent/service/register?replace-existing-checks=true" {
+		t.Errorf("curl called with %q", argv)
+	}
+	if strings.Contains(strings.Join(argv, " "), "s3cret") {
+		t.Errorf("the token is on curl's command line: %q", argv)
+	}
+	headers, _ := os.ReadFile(filepath.Join(filepath.Dir(args), "curl.headers"))
+	if string(headers) != "X-Consul-Token: s3cret\n" {
+		t.Errorf("curl sent headers %q", headers)
+	}
+	payload, _ := os.ReadFile(filepath.Join(filepath.Dir(args), "curl.payload"))
+	var def struct {
+		ID   string
+		Port int
+	}
+	if err := json.Unmarshal(payload, &def); err != nil || def.ID != "api" || def.Port != 8080 {
+		t.Errorf("curl sent %s (%v)", payload, err)
+	}
+}
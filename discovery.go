@@ -0,0 +1,338 @@
+package binaryinstall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Address kinds for discovered hosts.
+const (
+	AddressPrivate    = "private"     // private DNS name, or IP if it has none
+	AddressPublic     = "public"      // public DNS name, or IP if it has none
+	AddressInstanceID = "instance-id" // for the ssm transport
+)
+
+// EC2Query selects running EC2 instances to install on by their tags.
+type EC2Query struct {
+	Tags    map[string]string // e.g. {"Service": "api", "Env": "prod"}; instances must have all of them
+	Region  string            // AWS region; the aws CLI's default if empty
+	Profile string            // AWS CLI profile
+	Address string            // AddressPrivate (default), AddressPublic, or AddressInstanceID
+}
+
+// ParseTags parses comma-separated key=value tags, e.g. "Service=api,Env=prod".
+func ParseTags(s string) (map[string]string, error) {
+	tags := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok || key == "" {
+			return nil, fmt.Errorf("invalid tag %q, expected key=value", pair)
+		}
+		tags[key] = val
+	}
+	return tags, nil
+}
+
+// DiscoverEC2 lists the running instances matching query with the aws CLI,
+// in order of instance ID. Each host's Region is the instance's region, and
+// its Vars hold its instance_id, availability_zone, and the instance's tags
+// as tag_<Key>.
+func DiscoverEC2(query EC2Query) ([]Host, error) {
+	if len(query.Tags) == 0 {
+		return nil, fmt.Errorf("ec2 discovery needs at least one tag")
+	}
+	switch query.Address {
+	case "", AddressPrivate, AddressPublic, AddressInstanceID:
+	default:
+		return nil, fmt.Errorf("unknown ec2 address kind %q", query.Address)
+	}
+
+	args := []string{"ec2", "describe-instances", "--output", "json",
+		"--filters", "Name=instance-state-name,Values=running"}
+	keys := make([]string, 0, len(query.Tags))
+	for key := range query.Tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		args = append(args, "Name=tag:"+key+",Values="+query.Tags[key])
+	}
+	if query.Region != "" {
+		args = append(args, "--region", query.Region)
+	}
+	if query.Profile != "" {
+		args = append(args, "--profile", query.Profile)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, "aws", args...).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("failed to describe ec2 instances: %w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("failed to describe ec2 instances: %w", err)
+	}
+
+	var resp struct {
+		Reservations []struct {
+			Instances []struct {
+				InstanceId       string
+				PrivateDnsName   string
+				PrivateIpAddress string
+				PublicDnsName    string
+				PublicIpAddress  string
+				Placement        struct{ AvailabilityZone string }
+				Tags             []struct{ Key, Value string }
+			}
+		}
+	}
+	if err := json.Unmarshal(out, &resp); err != nil {
+		return nil, fmt.Errorf("failed to parse ec2 instances: %w", err)
+	}
+
+	var hosts []Host
+	for _, r := range resp.Reservations {
+		for _, inst := range r.Instances {
+			var address string
+			switch query.Address {
+			case AddressPublic:
+				address = firstNonEmpty(inst.PublicDnsName, inst.PublicIpAddress)
+			case AddressInstanceID:
+				address = inst.InstanceId
+			default:
+				address = firstNonEmpty(inst.PrivateDnsName, inst.PrivateIpAddress)
+			}
+			if address == "" {
+				return nil, fmt.Errorf("ec2 instance %s has no %s address", inst.InstanceId, query.Address)
+			}
+			vars := map[string]string{"instance_id": inst.InstanceId, "availability_zone": inst.Placement.AvailabilityZone}
+			for _, tag := range inst.Tags {
+				vars["tag_"+tag.Key] = tag.Value
+			}
+			region := query.Region
+			if zone := inst.Placement.AvailabilityZone; region == "" && zone != "" {
+				region = strings.TrimRight(zone, "abcdefghijklmnopqrstuvwxyz")
+			}
+			hosts = append(hosts, Host{Address: address, Region: region, Vars: vars})
+		}
+	}
+	sort.Slice(hosts, func(i, j int) bool {
+		return hosts[i].Vars["instance_id"] < hosts[j].Vars["instance_id"]
+	})
+	return hosts, nil
+}
+
+// ConsulQuery selects the nodes running a Consul service to install on.
+type ConsulQuery struct {
+	Service    string // service name, e.g. "api"
+	Tag        string // only instances of the service with this tag
+	Datacenter string // the agent's datacenter if empty
+	Address    string // Consul HTTP API; CONSUL_HTTP_ADDR or http://127.0.0.1:8500 if empty
+	Token      string // ACL token; CONSUL_HTTP_TOKEN if empty
+}
+
+// DiscoverConsul lists the nodes with a passing instance of query.Service,
+// fetched from Consul's health API with curl. Hosts are addressed by node
+// address, with the variables consul_node, service_address and
+// service_port. A node running several instances is listed once.
+func DiscoverConsul(query ConsulQuery) ([]Host, error) {
+	if query.Service == "" {
+		return nil, fmt.Errorf("consul discovery needs a service name")
+	}
+	addr := firstNonEmpty(query.Address, os.Getenv("CONSUL_HTTP_ADDR"), "http://127.0.0.1:8500")
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	params := url.Values{"passing": {"true"}}
+	if query.Tag != "" {
+		params.Set("tag", query.Tag)
+	}
+	if query.Datacenter != "" {
+		params.Set("dc", query.Datacenter)
+	}
+	endpoint := strings.TrimSuffix(addr, "/") + "/v1/health/service/" + url.PathEscape(query.Service) + "?" + params.Encode()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	// The token is passed on stdin to keep it out of the process list.
+	cmd := exec.CommandContext(ctx, "curl", "-fsSL", "--retry", "3", "-H", "@-", endpoint)
+	if token := firstNonEmpty(query.Token, os.Getenv("CONSUL_HTTP_TOKEN")); token != "" {
+		cmd.Stdin = strings.NewReader("X-Consul-Token: " + token + "\n")
+	} else {
+		cmd.Stdin = strings.NewReader("")
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return nil, fmt.Errorf("failed to query consul for %s: %w: %s", query.Service, err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return nil, fmt.Errorf("failed to query consul for %s: %w", query.Service, err)
+	}
+
+	var entries []struct {
+		Node struct {
+			Node    string
+			Address string
+		}
+		Service struct {
+			Address string
+			Port    int
+		}
+	}
+	if err := json.Unmarshal(out, &entries); err != nil {
+		return nil, fmt.Errorf("failed to parse consul response: %w", err)
+	}
+
+	var hosts []Host
+	seen := map[string]bool{}
+	for _, e := range entries {
+		if e.Node.Address == "" || seen[e.Node.Address] {
+			continue
+		}
+		seen[e.Node.Address] = true
+		hosts = append(hosts, Host{Address: e.Node.Address, Vars: map[string]string{
+			"consul_node":     e.Node.Node,
+			"service_address": firstNonEmpty(e.Service.Address, e.Node.Address),
+			"service_port":    strconv.Itoa(e.Service.Port),
+		}})
+	}
+	return hosts, nil
+}
+
+// DiscoverSRV lists the targets of the DNS SRV record name, e.g.
+// "_api._tcp.example.com" or "api.service.consul", in order of priority
+// and weight. The record's port is not used for SSH; it is the srv_port
+// variable of each host.
+func DiscoverSRV(name string) ([]Host, error) {
+	_, records, err := net.LookupSRV("", "", name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up SRV record %s: %w", name, err)
+	}
+	var hosts []Host
+	seen := map[string]bool{}
+	for _, r := range records {
+		target := strings.TrimSuffix(r.Target, ".")
+		if target == "" || seen[target] {
+			continue
+		}
+		seen[target] = true
+		hosts = append(hosts, Host{Address: target, Vars: map[string]string{"srv_port": strconv.Itoa(int(r.Port))}})
+	}
+	return hosts, nil
+}
+
+// TerraformQuery reads the hosts to install on from a Terraform output.
+type TerraformQuery struct {
+	Output    string // name of the output holding the addresses
+	StateFile string // a terraform.tfstate file to read the output from
+	Dir       string // otherwise, the working directory to run "terraform output -json" in
+}
+
+// DiscoverTerraform lists the addresses in a Terraform output, which may be
+// a string, a list of strings, or a map of names to addresses, e.g.
+//
+//	output "web_ips" {
+//	  value = aws_instance.web[*].private_ip
+//	}
+//
+// For a map, each host's tf_key variable is its name, and hosts are in
+// order of name.
+func DiscoverTerraform(query TerraformQuery) ([]Host, error) {
+	if query.Output == "" {
+		return nil, fmt.Errorf("terraform discovery needs an output name")
+	}
+	var outputs map[string]struct {
+		Value json.RawMessage `json:"value"`
+	}
+	if query.StateFile != "" {
+		raw, err := os.ReadFile(query.StateFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read terraform state: %w", err)
+		}
+		var state struct {
+			Outputs json.RawMessage `json:"outputs"`
+		}
+		if err := json.Unmarshal(raw, &state); err != nil {
+			return nil, fmt.Errorf("failed to parse terraform state %s: %w", query.StateFile, err)
+		}
+		if len(state.Outputs) > 0 {
+			if err := json.Unmarshal(state.Outputs, &outputs); err != nil {
+				return nil, fmt.Errorf("failed to parse terraform state %s: %w", query.StateFile, err)
+			}
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, "terraform", "output", "-json")
+		cmd.Dir = query.Dir
+		out, err := cmd.Output()
+		if err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				return nil, fmt.Errorf("terraform output failed: %w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+			}
+			return nil, fmt.Errorf("terraform output failed: %w", err)
+		}
+		if err := json.Unmarshal(out, &outputs); err != nil {
+			return nil, fmt.Errorf("failed to parse terraform output: %w", err)
+		}
+	}
+
+	output, ok := outputs[query.Output]
+	if !ok {
+		return nil, fmt.Errorf("no terraform output named %q", query.Output)
+	}
+	var (
+		one   string
+		list  []string
+		named map[string]string
+	)
+	switch {
+	case json.Unmarshal(output.Value, &one) == nil:
+		list = []string{one}
+	case json.Unmarshal(output.Value, &list) == nil:
+	case json.Unmarshal(output.Value, &named) == nil:
+	default:
+		return nil, fmt.Errorf("terraform output %q is not a string, a list of strings, or a map of strings", query.Output)
+	}
+
+	var hosts []Host
+	for _, address := range list {
+		if address != "" {
+			hosts = append(hosts, Host{Address: address})
+		}
+	}
+	keys := make([]string, 0, len(named))
+	for key := range named {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if named[key] != "" {
+			hosts = append(hosts, Host{Address: named[key], Vars: map[string]string{"tf_key": key}})
+		}
+	}
+	return hosts, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
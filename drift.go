@@ -0,0 +1,202 @@
+package binaryinstall
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Drift is a way a file on a host differs from what was installed there, as
+// its HostManifest records it, or from what its upload would install.
+type Drift struct {
+	Path     string `json:"path"`
+	Field    string `json:"field"` // "missing", "sha256", "mode", "owner", "group" or "capabilities"
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Source   string `json:"source"` // "manifest" or "upload"
+}
+
+// HostDrift is what CheckDrift found on a host.
+type HostDrift struct {
+	Host    string  `json:"host"`
+	Checked int     `json:"checked"` // files checked
+	Drift   []Drift `json:"drift"`
+}
+
+// CheckDrift compares the files installed on every host of config with the
+// entries of its HostManifest, by checksum, mode and ownership, and with the
+// binaries config.Uploads would install: their mode, owner and group, unless
+// NoSudo, capabilities where getcap is available, and BinarySHA256 if set.
+// Only uploads of a single binary from a named archive are checked against
+// their upload. A file that is missing drifts on that alone. Hosts that
+// cannot be reached are reported as InstallFailures, after every host has
+// been tried.
+func CheckDrift(config BinaryInstallConfig) ([]HostDrift, error) {
+	hosts := fleetHosts(config)
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no remote host provided")
+	}
+	if kind, _ := transportKind(config); kind == TransportWinRM {
+		return nil, fmt.Errorf("checking for drift is not supported on %s targets", kind)
+	}
+	if config.HostManifest == "" && len(config.Uploads) == 0 {
+		return nil, fmt.Errorf("no host manifest or uploads to check against")
+	}
+
+	var (
+		mu      sync.Mutex
+		results []HostDrift
+	)
+	err := runAll(len(hosts), config.MaxParallelHosts, true, func(i int) error {
+		hostConfig := forHost(config, hosts[i])
+		files, err := installedFiles(hostConfig.Uploads)
+		if err != nil {
+			return &InstallFailure{Host: hostConfig.RemoteHost, Err: err}
+		}
+		drift, err := driftHost(hostConfig, files)
+		if err != nil {
+			return &InstallFailure{Host: hostConfig.RemoteHost, Err: err}
+		}
+		mu.Lock()
+		results = append(results, drift)
+		mu.Unlock()
+		return nil
+	})
+	sort.Slice(results, func(i, j int) bool { return results[i].Host < results[j].Host })
+	return results, err
+}
+
+// driftHost compares the files on config.RemoteHost with its manifest's
+// entries and with files.
+func driftHost(config BinaryInstallConfig, files []installedFile) (HostDrift, error) {
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, f.Path)
+	}
+	installs, states, err := inspectHost(config, paths, true)
+	if err != nil {
+		return HostDrift{Host: config.RemoteHost, Drift: []Drift{}}, err
+	}
+	result := compareDrift(config.RemoteHost, files, installs, states)
+	if config.Verbose {
+		log.Printf("Found %d differences in %d files on %s", len(result.Drift), result.Checked, config.RemoteHost)
+	}
+	return result, nil
+}
+
+// compareDrift compares the files inspectHost found on host, states, with
+// the manifest entries installs and with files. Files are told apart by
+// their path on the host, with "~/" expanded, so a file both in the
+// manifest and installed by an upload is checked once.
+func compareDrift(host string, files []installedFile, installs []InstalledBinary, states []fileState) HostDrift {
+	result := HostDrift{Host: host, Drift: []Drift{}}
+	found := map[string]fileState{}
+	for _, s := range states {
+		found[s.Path] = s
+		if s.Requested != "" {
+			found[s.Requested] = s
+		}
+	}
+
+	reported := map[string]bool{}
+	add := func(d Drift) {
+		if key := d.Path + "\x00" + d.Field; !reported[key] {
+			reported[key] = true
+			result.Drift = append(result.Drift, d)
+		}
+	}
+	// check returns the file at p, as given in the manifest or an upload, and
+	// whether it exists, reporting it missing if not
+	checked := map[string]bool{}
+	check := func(p, source string) (fileState, bool) {
+		s, ok := found[p]
+		if !ok {
+			s = fileState{Path: p, Missing: true}
+		}
+		checked[s.Path] = true
+		if s.Missing {
+			add(Drift{Path: s.Path, Field: "missing", Expected: "present", Actual: "missing", Source: source})
+			return s, false
+		}
+		return s, true
+	}
+
+	for _, f := range files {
+		s, ok := check(f.Path, "upload")
+		if !ok {
+			continue
+		}
+		upload := f.Upload
+		if upload.BinarySHA256 != "" && !strings.EqualFold(s.SHA256, upload.BinarySHA256) {
+			add(Drift{Path: s.Path, Field: "sha256", Expected: strings.ToLower(upload.BinarySHA256), Actual: s.SHA256, Source: "upload"})
+		}
+		if mode := permission(upload); mode != "" && !sameMode(mode, s.Mode) {
+			add(Drift{Path: s.Path, Field: "mode", Expected: mode, Actual: s.Mode, Source: "upload"})
+		}
+		if !upload.NoSudo && upload.Owner != "" {
+			group := upload.Group
+			if group == "" {
+				group = upload.Owner
+			}
+			if s.Owner != upload.Owner {
+				add(Drift{Path: s.Path, Field: "owner", Expected: upload.Owner, Actual: s.Owner, Source: "upload"})
+			}
+			// macOS and FreeBSD have no root group; installs use wheel
+			if s.Group != group && !(group == "root" && s.Group == "wheel") {
+				add(Drift{Path: s.Path, Field: "group", Expected: group, Actual: s.Group, Source: "upload"})
+			}
+		}
+		if s.Capabilities != "-" {
+			want := "none"
+			if caps := capabilities(upload); len(caps) > 0 {
+				sort.Strings(caps)
+				want = strings.Join(caps, ",")
+			}
+			have := strings.Split(s.Capabilities, ",")
+			sort.Strings(have)
+			if got := strings.Join(have, ","); got != want {
+				add(Drift{Path: s.Path, Field: "capabilities", Expected: want, Actual: got, Source: "upload"})
+			}
+		}
+	}
+
+	for _, b := range installs {
+		if b.Path == "" {
+			continue
+		}
+		s, ok := check(b.Path, "manifest")
+		if !ok {
+			continue
+		}
+		if b.SHA256 != "" && s.SHA256 != b.SHA256 {
+			add(Drift{Path: s.Path, Field: "sha256", Expected: b.SHA256, Actual: s.SHA256, Source: "manifest"})
+		}
+		if b.Mode != "" && !sameMode(b.Mode, s.Mode) {
+			add(Drift{Path: s.Path, Field: "mode", Expected: b.Mode, Actual: s.Mode, Source: "manifest"})
+		}
+		if b.Owner != "" && s.Owner != b.Owner {
+			add(Drift{Path: s.Path, Field: "owner", Expected: b.Owner, Actual: s.Owner, Source: "manifest"})
+		}
+		if b.Group != "" && s.Group != b.Group {
+			add(Drift{Path: s.Path, Field: "group", Expected: b.Group, Actual: s.Group, Source: "manifest"})
+		}
+	}
+	result.Checked = len(checked)
+
+	sort.SliceStable(result.Drift, func(i, j int) bool { return result.Drift[i].Path < result.Drift[j].Path })
+	return result
+}
+
+// sameMode reports whether the octal modes a and b, such as "0755" and
+// "755", are equal.
+func sameMode(a, b string) bool {
+	x, errA := strconv.ParseUint(a, 8, 32)
+	y, errB := strconv.ParseUint(b, 8, 32)
+	if errA != nil || errB != nil {
+		return a == b
+	}
+	return x == y
+}
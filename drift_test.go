@@ -0,0 +1,118 @@
+package binaryinstall
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// inspectLocally runs statusTemplate for paths with sh on this machine, with
+// home as the remote user's home directory.
+func inspectLocally(t *testing.T, home, hostManifest string, paths []string) ([]InstalledBinary, []fileState) {
+	t.Helper()
+	config := BinaryInstallConfig{Escalation: EscalateNone, HostManifest: hostManifest}
+	script, err := inspectScript(config, paths, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command("sh", "-c", script)
+	cmd.Env = append(os.Environ(), "HOME="+home)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("status script failed: %v: %s", err, out)
+	}
+	installs, states, err := parseInspection(hostManifest, string(out), paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return installs, states
+}
+
+func TestCompareDriftHomePaths(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the status script needs a POSIX shell")
+	}
+	current, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := t.TempDir()
+	bin := filepath.Join(home, "bin", "tool")
+	if err := os.MkdirAll(filepath.Dir(bin), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(bin, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(bin, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte("#!/bin/sh\n"))
+	group := current.Username
+	if g, err := user.LookupGroupId(current.Gid); err == nil {
+		group = g.Name
+	}
+	// The install recorded the path with "~/" expanded
+	manifest := fmt.Sprintf(`{"installs": [
+  {"path":%q,"binary":"tool","sha256":%q,"mode":"755","owner":%q,"group":%q,"installed_at":"2026-01-02T15:04:05Z"}
+]}
+`, bin, hex.EncodeToString(sum[:]), current.Username, group)
+	if err := os.WriteFile(filepath.Join(home, "manifest.json"), []byte(manifest), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	files := []installedFile{{
+		Path:   "~/bin/tool",
+		Upload: BinaryUpload{DestinationDir: "~/bin", Permission: "0755", NoSudo: true},
+	}}
+
+	installs, states := inspectLocally(t, home, "~/manifest.json", []string{"~/bin/tool"})
+	drift := compareDrift("h", files, installs, states)
+	if len(drift.Drift) != 0 || drift.Checked != 1 {
+		t.Fatalf("unchanged ~/ install: got %d files checked and drift %+v, want 1 and none", drift.Checked, drift.Drift)
+	}
+
+	if err := os.Chmod(bin, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	installs, states = inspectLocally(t, home, "~/manifest.json", []string{"~/bin/tool"})
+	drift = compareDrift("h", files, installs, states)
+	want := Drift{Path: bin, Field: "mode", Expected: "0755", Actual: "700", Source: "upload"}
+	if len(drift.Drift) != 1 || drift.Drift[0] != want || drift.Checked != 1 {
+		t.Fatalf("chmodded ~/ install: got %d files checked and drift %+v, want 1 and %+v", drift.Checked, drift.Drift, want)
+	}
+
+	if err := os.Remove(bin); err != nil {
+		t.Fatal(err)
+	}
+	installs, states = inspectLocally(t, home, "~/manifest.json", []string{"~/bin/tool"})
+	drift = compareDrift("h", files, installs, states)
+	want = Drift{Path: bin, Field: "missing", Expected: "present", Actual: "missing", Source: "upload"}
+	if len(drift.Drift) != 1 || drift.Drift[0] != want {
+		t.Fatalf("removed ~/ install: got drift %+v, want %+v", drift.Drift, want)
+	}
+}
+
+func TestSameMode(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{"0755", "755", true},
+		{"755", "755", true},
+		{"4755", "4755", true},
+		{"0755", "700", false},
+		{"u+x", "u+x", true},
+		{"u+x", "755", false},
+	}
+	for _, tt := range tests {
+		if got := sameMode(tt.a, tt.b); got != tt.want {
+			t.Errorf("sameMode(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package binaryinstall
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// InstallFailure is the failure of one upload, or of a whole host when
+// Upload is empty, e.g. because it could not be reached. InstallBinaries
+// returns them joined with errors.Join; Failures lists them.
+type InstallFailure struct {
+	Host   string // remote host; empty when installing on a single host
+	Upload string // the upload's archive, as in logs
+	Err    error
+}
+
+func (f *InstallFailure) Error() string {
+	msg := f.Err.Error()
+	if f.Upload != "" {
+		msg = fmt.Sprintf("failed to process upload '%s': %s", f.Upload, msg)
+	}
+	if f.Host != "" {
+		msg = f.Host + ": " + msg
+	}
+	return msg
+}
+
+func (f *InstallFailure) Unwrap() error { return f.Err }
+
+// Failures returns every InstallFailure in err, which may join several, in
+// the order they occurred.
+func Failures(err error) []*InstallFailure {
+	var failures []*InstallFailure
+	var walk func(error)
+	walk = func(err error) {
+		switch e := err.(type) {
+		case nil:
+		case *InstallFailure:
+			failures = append(failures, e)
+		case interface{ Unwrap() []error }:
+			for _, inner := range e.Unwrap() {
+				walk(inner)
+			}
+		default:
+			walk(errors.Unwrap(err))
+		}
+	}
+	walk(err)
+	return failures
+}
+
+// runAll calls fn for items 0 to n-1 in parallel, at most parallel (if
+// positive) at a time. Unless keepGoing is set, it starts no more items once
+// one fails and returns the first error; otherwise it runs them all and
+// returns every error joined.
+func runAll(n, parallel int, keepGoing bool, fn func(i int) error) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	sem := make(chan struct{}, limit(parallel, n))
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		mu.Lock()
+		stop := len(errs) > 0 && !keepGoing
+		mu.Unlock()
+		if stop {
+			<-sem
+			break
+		}
+		i := i // capture within loop
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			if err := fn(i); err != nil {
+				mu.Lock()
+				errs = append(errs, err)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !keepGoing && len(errs) > 0 {
+		return errs[0]
+	}
+	return errors.Join(errs...)
+}
+
+// limit returns most if it is positive and below n, or n otherwise, for
+// sizing a semaphore over n tasks.
+func limit(most, n int) int {
+	if most > 0 && most < n {
+		return most
+	}
+	return max(n, 1)
+}
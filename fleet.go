@@ -0,0 +1,579 @@
+package binaryinstall
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"path"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SeedCopy methods for copying seeded artifacts between hosts.
+const (
+	SeedCopySCP   = "scp"
+	SeedCopyRsync = "rsync"
+)
+
+// fleetHosts returns every host to install on: RemoteHost followed by
+// Hosts and Targets.
+func fleetHosts(config BinaryInstallConfig) []Host {
+	var hosts []Host
+	seen := map[string]bool{}
+	for _, address := range append([]string{config.RemoteHost}, config.Hosts...) {
+		if address != "" && !seen[address] {
+			seen[address] = true
+			hosts = append(hosts, Host{Address: address})
+		}
+	}
+	for _, host := range config.Targets {
+		if !seen[host.Address] {
+			seen[host.Address] = true
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// ParseHost parses a host given as "[user@]host[:port]".
+func ParseHost(spec string) Host {
+	host := Host{Address: spec}
+	if at := strings.LastIndex(spec, "@"); at >= 0 {
+		host.User, host.Address = spec[:at], spec[at+1:]
+	}
+	return host
+}
+
+// forHost returns config for installing on host alone, with the host's own
+// settings applied and only the uploads meant for its groups.
+func forHost(config BinaryInstallConfig, host Host) BinaryInstallConfig {
+	config.RemoteHost, config.Hosts, config.Targets, config.SeedHost = host.Address, nil, nil, ""
+	if host.Port != 0 && !strings.Contains(host.Address, "://") {
+		address := host.Address
+		if h, _, err := net.SplitHostPort(address); err == nil {
+			address = h
+		}
+		config.RemoteHost = net.JoinHostPort(address, strconv.Itoa(host.Port))
+	}
+	if host.User != "" {
+		config.SSHUser = host.User
+	}
+	if host.KeyPath != "" {
+		config.SSHKeyPath = expandHome(host.KeyPath)
+	}
+	var uploads []BinaryUpload
+	for _, upload := range config.Uploads {
+		if !inHostGroups(host, upload.HostGroups) {
+			continue
+		}
+		upload.Vars = mergeVars(host.Vars, upload.Vars)
+		uploads = append(uploads, upload)
+	}
+	config.Uploads = uploads
+	return config
+}
+
+// inHostGroups reports whether host belongs to one of groups, or groups is
+// empty.
+func inHostGroups(host Host, groups []string) bool {
+	if len(groups) == 0 {
+		return true
+	}
+	for _, g := range groups {
+		if slices.Contains(host.Groups, g) {
+			return true
+		}
+	}
+	return false
+}
+
+// installFleet installs config.Uploads on every host in parallel, seeding
+// local artifacts through config.SeedHost first when it is set.
+func installFleet(config BinaryInstallConfig, hosts []Host) error {
+	// Check every host has a known region before anything is installed.
+	if len(config.Regions) > 0 {
+		if _, err := splitRegions(hosts, config.Regions); err != nil {
+			return err
+		}
+	}
+
+	var seedDir string
+	if config.SeedHost != "" {
+		var err error
+		config, seedDir, err = seedArtifacts(config, hosts)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(config.Canaries) > 0 {
+		canaries, rest, err := splitCanaries(hosts, config.Canaries)
+		if err != nil {
+			return err
+		}
+		if config.Verbose {
+			log.Printf("Installing on %d canary hosts", len(canaries))
+		}
+		if err := installHosts(config, canaries, seedDir); err != nil {
+			return fmt.Errorf("canary install failed, leaving the remaining %d hosts alone: %w", len(rest), err)
+		}
+		if err := soakCanaries(config, canaries); err != nil {
+			for _, host := range canaries {
+				config.outcomes.record(host.Address, err)
+			}
+			return fmt.Errorf("%w; leaving the remaining %d hosts alone", err, len(rest))
+		}
+		hosts = rest
+	}
+
+	if len(config.Regions) > 0 {
+		return installRegions(config, hosts, seedDir)
+	}
+	return installBatches(config, hosts, seedDir)
+}
+
+// installRegions installs on the hosts of each of config.Regions in turn,
+// holding for RegionPause and asking RegionConfirm between them.
+func installRegions(config BinaryInstallConfig, hosts []Host, seedDir string) error {
+	byRegion, err := splitRegions(hosts, config.Regions)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for i, region := range config.Regions {
+		if len(byRegion[i]) == 0 {
+			continue
+		}
+		if config.Verbose {
+			log.Printf("Installing on %d hosts in %s", len(byRegion[i]), region)
+		}
+		if err := installBatches(config, byRegion[i], seedDir); err != nil {
+			if !config.ContinueOnError {
+				return fmt.Errorf("%s: %w; stopped before the remaining regions", region, err)
+			}
+			errs = append(errs, err)
+		}
+
+		next := ""
+		for j := i + 1; j < len(config.Regions) && next == ""; j++ {
+			if len(byRegion[j]) > 0 {
+				next = config.Regions[j]
+			}
+		}
+		if next == "" {
+			break
+		}
+		if config.RegionPause > 0 {
+			if config.Verbose {
+				log.Printf("Holding %s before %s", config.RegionPause, next)
+			}
+			time.Sleep(config.RegionPause)
+		}
+		if config.RegionConfirm != nil && !config.RegionConfirm(region, next) {
+			errs = append(errs, fmt.Errorf("rollout stopped after %s, before %s", region, next))
+			break
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// splitRegions groups hosts by the position of their Region in regions,
+// failing for a host whose region is not listed.
+func splitRegions(hosts []Host, regions []string) ([][]Host, error) {
+	byRegion := make([][]Host, len(regions))
+	for _, host := range hosts {
+		i := slices.Index(regions, host.Region)
+		if i < 0 {
+			if host.Region == "" {
+				return nil, fmt.Errorf("host %s has no region", host.Address)
+			}
+			return nil, fmt.Errorf("host %s is in region %s, which is not in the rollout order", host.Address, host.Region)
+		}
+		byRegion[i] = append(byRegion[i], host)
+	}
+	return byRegion, nil
+}
+
+// installBatches installs on hosts BatchSize at a time, or one at a time
+// when config.Serial is set.
+func installBatches(config BinaryInstallConfig, hosts []Host, seedDir string) error {
+	if config.Serial {
+		return installSerial(config, hosts, seedDir)
+	}
+
+	// Without a batch size, the whole fleet is one batch.
+	size := config.BatchSize
+	if size <= 0 {
+		size = len(hosts)
+	}
+	var errs []error
+	for start := 0; start < len(hosts); start += size {
+		end := min(start+size, len(hosts))
+		if start > 0 && config.BatchPause > 0 {
+			if config.Verbose {
+				log.Printf("Pausing %s before the next batch", config.BatchPause)
+			}
+			time.Sleep(config.BatchPause)
+		}
+		if config.Verbose && end-start < len(hosts) {
+			log.Printf("Installing batch %d of %d (%d hosts)", start/size+1, (len(hosts)+size-1)/size, end-start)
+		}
+		if err := installHosts(config, hosts[start:end], seedDir); err != nil {
+			if !config.BatchKeepGoing && !config.ContinueOnError && end < len(hosts) {
+				return fmt.Errorf("%w; stopped before the remaining %d hosts", err, len(hosts)-end)
+			}
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// installSerial installs on hosts one at a time, in order, running
+// config.CanaryHealthCommand on each after its install, and stops at the
+// first host that fails either.
+func installSerial(config BinaryInstallConfig, hosts []Host, seedDir string) error {
+	for i, host := range hosts {
+		if i > 0 && config.BatchPause > 0 {
+			time.Sleep(config.BatchPause)
+		}
+		if config.Verbose {
+			log.Printf("Installing on host %d of %d: %s", i+1, len(hosts), host.Address)
+		}
+		err := installHosts(config, []Host{host}, seedDir)
+		if err == nil && config.CanaryHealthCommand != "" {
+			if err = checkHealth(config, host); err != nil {
+				config.outcomes.record(host.Address, err)
+			}
+		}
+		if err != nil {
+			if rest := len(hosts) - i - 1; rest > 0 {
+				return fmt.Errorf("%w; stopped before the remaining %d hosts", err, rest)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHealth runs config.CanaryHealthCommand once on host.
+func checkHealth(config BinaryInstallConfig, host Host) error {
+	hostConfig := forHost(config, host)
+	t, err := connectWithRetry(hostConfig)
+	if err != nil {
+		return &InstallFailure{Host: hostConfig.RemoteHost, Err: err}
+	}
+	defer t.Close()
+	if _, err := runScript(hostConfig, t, config.CanaryHealthCommand); err != nil {
+		return &InstallFailure{Host: hostConfig.RemoteHost, Err: fmt.Errorf("failed its health check: %w", err)}
+	}
+	return nil
+}
+
+// installHosts installs config.Uploads on hosts in parallel, at most
+// config.MaxParallelHosts at a time.
+func installHosts(config BinaryInstallConfig, hosts []Host, seedDir string) error {
+	var targets []Host
+	var configs []BinaryInstallConfig
+	for _, host := range hosts {
+		hostConfig := config
+		if config.seedMissed[host.Address] {
+			hostConfig.Uploads = config.directUploads
+		}
+		hostConfig = forHost(hostConfig, host)
+		if len(hostConfig.Uploads) == 0 {
+			if config.Verbose {
+				log.Printf("No uploads for the groups of %s", host.Address)
+			}
+			config.outcomes.record(host.Address, nil)
+			continue
+		}
+		targets = append(targets, host)
+		configs = append(configs, hostConfig)
+	}
+
+	return runAll(len(configs), config.MaxParallelHosts, config.ContinueOnError, func(i int) error {
+		hostConfig := configs[i]
+		err := installHost(hostConfig, seedDir)
+		config.outcomes.record(targets[i].Address, err)
+		if err == nil {
+			return nil
+		}
+		failures := Failures(err)
+		if len(failures) == 0 {
+			return &InstallFailure{Host: hostConfig.RemoteHost, Err: err}
+		}
+		for _, f := range failures {
+			f.Host = hostConfig.RemoteHost
+		}
+		return err
+	})
+}
+
+// splitCanaries separates the hosts named in canaries, by address or
+// inventory group, from the rest.
+func splitCanaries(hosts []Host, canaries []string) (canary, rest []Host, err error) {
+	matched := map[string]bool{}
+	for _, host := range hosts {
+		isCanary := false
+		for _, c := range canaries {
+			if host.Address == c || slices.Contains(host.Groups, c) {
+				isCanary, matched[c] = true, true
+			}
+		}
+		if isCanary {
+			canary = append(canary, host)
+		} else {
+			rest = append(rest, host)
+		}
+	}
+	for _, c := range canaries {
+		if !matched[c] {
+			return nil, nil, fmt.Errorf("canary %s is not one of the hosts", c)
+		}
+	}
+	return canary, rest, nil
+}
+
+// soakCanaries runs config.CanaryHealthCommand on every canary each
+// CanaryInterval until CanarySoak has passed, failing as soon as one check
+// does.
+func soakCanaries(config BinaryInstallConfig, canaries []Host) error {
+	interval := config.CanaryInterval
+	if interval <= 0 {
+		interval = 15 * time.Second
+	}
+	if config.CanaryHealthCommand == "" {
+		if config.Verbose {
+			log.Printf("No health check configured; soaking canaries for %s", config.CanarySoak)
+		}
+		time.Sleep(config.CanarySoak)
+		return nil
+	}
+
+	transports := make([]Transport, len(canaries))
+	configs := make([]BinaryInstallConfig, len(canaries))
+	for i, host := range canaries {
+		configs[i] = forHost(config, host)
+		t, err := connectWithRetry(configs[i])
+		if err != nil {
+			return fmt.Errorf("canary %s: %w", host.Address, err)
+		}
+		defer t.Close()
+		transports[i] = t
+	}
+
+	deadline := time.Now().Add(config.CanarySoak)
+	for {
+		for i, t := range transports {
+			if _, err := runScript(configs[i], t, config.CanaryHealthCommand); err != nil {
+				return fmt.Errorf("canary %s failed its health check: %w", canaries[i].Address, err)
+			}
+		}
+		if !time.Now().Add(interval).Before(deadline) {
+			break
+		}
+		time.Sleep(interval)
+	}
+	if config.Verbose {
+		log.Printf("Canaries stayed healthy for %s", config.CanarySoak)
+	}
+	return nil
+}
+
+// seedArtifacts uploads every local artifact, including the archives of
+// Dist directories, once, to config.SeedHost, and then has the hosts copy
+// them among themselves, doubling the number of copies each round. It
+// returns config with those uploads rewritten to the seeded paths, and the
+// directory holding them on every host. With ContinueOnError, hosts the
+// copies fail for install the uploads as given instead.
+func seedArtifacts(config BinaryInstallConfig, hosts []Host) (BinaryInstallConfig, string, error) {
+	if kind, _ := transportKind(config); kind != TransportSSH {
+		return config, "", fmt.Errorf("seeding artifacts requires the %s transport, not %s", TransportSSH, kind)
+	}
+
+	// Artifacts keep their file names so binary names derive as usual.
+	seedDir := fmt.Sprintf("/tmp/binaryinstall-seed-%d", time.Now().UnixNano())
+	uploads := append([]BinaryUpload(nil), config.Uploads...)
+
+	seedHost := Host{Address: config.SeedHost}
+	for _, host := range hosts {
+		if host.Address == config.SeedHost {
+			seedHost = host
+		}
+	}
+	seedConfig := forHost(config, seedHost)
+	seed, err := connectWithRetry(seedConfig)
+	if err != nil {
+		return config, "", err
+	}
+	defer seed.Close()
+
+	if _, err := runScript(seedConfig, seed, "mkdir -p "+shellQuote(seedDir)); err != nil {
+		return config, "", err
+	}
+	// seedFile stages one artifact on the seed host and moves it to dest.
+	seedFile := func(dest, localPath string, r io.Reader) error {
+		var staged string
+		var err error
+		if r != nil {
+			staged, err = stageStream(seedConfig, seed, path.Base(dest), r)
+		} else {
+			staged, err = stageArtifact(seedConfig, seed, localPath)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = runScript(seedConfig, seed, "mkdir -p "+shellQuote(path.Dir(dest))+" && mv "+shellQuote(staged)+" "+shellQuote(dest))
+		return err
+	}
+	seeded, streamed := 0, false
+	for i, upload := range uploads {
+		switch {
+		case upload.LocalPath != "":
+			dest := seedDir + "/" + path.Base(strings.ReplaceAll(upload.LocalPath, `\`, "/"))
+			if err := seedFile(dest, upload.LocalPath, nil); err != nil {
+				return config, "", err
+			}
+			uploads[i].Path, uploads[i].LocalPath = dest, ""
+		case upload.Reader != nil && upload.Name != "":
+			dest := seedDir + "/" + upload.Name
+			if err := seedFile(dest, "", upload.Reader); err != nil {
+				return config, "", err
+			}
+			uploads[i].Path, uploads[i].Reader = dest, nil
+			streamed = true
+		case upload.Dist != "":
+			// Hosts may differ in platform, so every archive is seeded and
+			// each host still picks its own from them.
+			artifacts, err := ScanDist(upload.Dist)
+			if err != nil {
+				return config, "", err
+			}
+			dir := fmt.Sprintf("%s/dist-%d", seedDir, i)
+			for _, artifact := range artifacts {
+				if err := seedFile(dir+"/"+filepath.Base(artifact.Path), artifact.Path, nil); err != nil {
+					return config, "", err
+				}
+			}
+			uploads[i].seedDist = dir
+		default:
+			continue
+		}
+		seeded++
+	}
+	if seeded == 0 {
+		runScript(seedConfig, seed, "rm -rf "+shellQuote(seedDir))
+		return config, "", nil
+	}
+
+	// Fan out: every host holding the artifacts copies them to one that
+	// does not, in parallel, until all hosts have them.
+	holders := []Host{seedHost}
+	var pending []Host
+	for _, host := range hosts {
+		if host.Address != config.SeedHost {
+			pending = append(pending, host)
+		}
+	}
+	for len(pending) > 0 {
+		n := min(len(holders), len(pending))
+		if config.MaxParallelHosts > 0 {
+			n = min(n, config.MaxParallelHosts)
+		}
+		var wg sync.WaitGroup
+		errs := make([]error, n)
+		for i := 0; i < n; i++ {
+			i, from, to := i, holders[i], pending[i]
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := copyToPeer(config, from, to, seedDir); err != nil {
+					errs[i] = fmt.Errorf("failed to copy artifacts from %s to %s: %w", from.Address, to.Address, err)
+				}
+			}()
+		}
+		wg.Wait()
+		for i, err := range errs {
+			if err == nil {
+				holders = append(holders, pending[i])
+				continue
+			}
+			// A streamed upload cannot be read a second time.
+			if !config.ContinueOnError || streamed {
+				return config, "", err
+			}
+			if config.Verbose {
+				log.Printf("%v; uploading to %s directly instead", err, pending[i].Address)
+			}
+			if config.seedMissed == nil {
+				config.seedMissed = map[string]bool{}
+			}
+			config.seedMissed[pending[i].Address] = true
+		}
+		pending = pending[n:]
+	}
+
+	// A seed outside the fleet only relays; drop its copy.
+	inFleet := false
+	for _, host := range hosts {
+		inFleet = inFleet || host.Address == config.SeedHost
+	}
+	if !inFleet {
+		runScript(seedConfig, seed, "rm -rf "+shellQuote(seedDir))
+	}
+
+	config.directUploads, config.Uploads = config.Uploads, uploads
+	return config, seedDir, nil
+}
+
+// copyToPeer copies dir from host from to host to, running scp or rsync on from.
+func copyToPeer(config BinaryInstallConfig, from, to Host, dir string) error {
+	toConfig := forHost(config, to)
+	user := toConfig.SSHUser
+	if user == "" {
+		user = localUsername()
+	}
+	address := toConfig.RemoteHost
+	strict := "yes"
+	switch config.HostKeyCheck {
+	case HostKeyAcceptNew:
+		strict = "accept-new"
+	case HostKeyInsecure:
+		strict = "no"
+	}
+	sshOpts := "-o BatchMode=yes -o StrictHostKeyChecking=" + strict
+	if host, port, err := net.SplitHostPort(address); err == nil {
+		address = host
+		sshOpts += " -o Port=" + port
+	}
+	target := shellQuote(user + "@" + address + ":" + path.Dir(dir) + "/")
+
+	var command string
+	switch config.SeedCopy {
+	case "", SeedCopySCP:
+		command = "scp -q -r " + sshOpts + " " + shellQuote(dir) + " " + target
+	case SeedCopyRsync:
+		command = "rsync -a -e " + shellQuote("ssh "+sshOpts) + " " + shellQuote(dir) + " " + target
+	default:
+		return fmt.Errorf("unknown seed copy method %q", config.SeedCopy)
+	}
+
+	fromConfig := forHost(config, from)
+	transport, err := connectWithRetry(fromConfig)
+	if err != nil {
+		return err
+	}
+	defer transport.Close()
+
+	if config.Verbose {
+		log.Printf("Copying seeded artifacts from %s to %s", from.Address, to.Address)
+	}
+	_, err = runScript(fromConfig, transport, command)
+	return err
+}
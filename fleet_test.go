@@ -0,0 +1,337 @@
+package binaryinstall
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubFleet stands in for a fleet of docker containers whose install
+// scripts succeed unless the container's name starts with "bad", and whose
+// health check, the command check-health, passes unless it starts with
+// "sick". It returns funcs listing the containers that were installed on,
+// and those that were checked, in order.
+func stubFleet(t *testing.T) (installed, checked func() []string) {
+	t.Helper()
+	// docker exec -i CONTAINER sh -c sh
+	args := stubCommand(t, "docker", `script=$(cat)
+case $script in *check-health*)
+    echo "$3" >> "$0.checks"
+    case $3 in sick*) echo unhealthy; exit 1 ;; esac
+    exit 0 ;;
+esac
+grep -qx "$3" "$0.hosts" 2>/dev/null || echo "$3" >> "$0.hosts"
+case $3 in bad*) echo "install failed"; exit 1 ;; esac`)
+	list := func(name string) func() []string {
+		return func() []string {
+			raw, err := os.ReadFile(filepath.Join(filepath.Dir(args), name))
+			if err != nil && !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+			return strings.Fields(string(raw))
+		}
+	}
+	return list("docker.hosts"), list("docker.checks")
+}
+
+// containers returns hosts for the named docker containers.
+func containers(names ...string) []Host {
+	var hosts []Host
+	for _, name := range names {
+		hosts = append(hosts, Host{Address: "docker://" + name})
+	}
+	return hosts
+}
+
+// fleetConfig returns a config installing one archive already on the hosts.
+func fleetConfig() BinaryInstallConfig {
+	return BinaryInstallConfig{
+		BackupDir: "/var/backups",
+		Uploads:   []BinaryUpload{{Path: "/tmp/tool_Linux_x86_64.tar.gz", DestinationDir: "/usr/local/bin", Owner: "root", Permission: "0755"}},
+	}
+}
+
+// batches splits installed into consecutive batches of the given sizes,
+// each sorted, as hosts within a batch are installed in parallel.
+func batches(installed []string, sizes ...int) string {
+	var out []string
+	for _, size := range sizes {
+		if len(installed) == 0 {
+			break
+		}
+		if size > len(installed) {
+			size = len(installed)
+		}
+		batch := append([]string{}, installed[:size]...)
+		sort.Strings(batch)
+		out = append(out, strings.Join(batch, ","))
+		installed = installed[size:]
+	}
+	return fmt.Sprint(out)
+}
+
+func TestInstallFleetBatches(t *testing.T) {
+	tests := []struct {
+		name      string
+		hosts     []string
+		keepGoing bool
+		want      string // installed hosts, batch by batch
+		wantErr   string
+	}{
+		{name: "all healthy", hosts: []string{"h1", "h2", "h3", "h4", "h5"}, want: "[h1,h2 h3,h4 h5]"},
+		{name: "stops after a failed batch", hosts: []string{"h1", "bad2", "h3", "h4", "h5"}, want: "[bad2,h1]",
+			wantErr: "stopped before the remaining 3 hosts"},
+		{name: "keeps going", hosts: []string{"h1", "bad2", "h3", "h4", "h5"}, keepGoing: true, want: "[bad2,h1 h3,h4 h5]",
+			wantErr: "bad2"},
+		{name: "last batch fails", hosts: []string{"h1", "h2", "bad3"}, want: "[h1,h2 bad3]", wantErr: "bad3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installed, _ := stubFleet(t)
+			config := fleetConfig()
+			config.BatchSize, config.BatchPause, config.BatchKeepGoing = 2, 50*time.Millisecond, tt.keepGoing
+
+			started := time.Now()
+			err := installFleet(config, containers(tt.hosts...))
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("installFleet returned %v, want an error containing %q", err, tt.wantErr)
+			}
+			got := installed()
+			if b := batches(got, 2, 2, 2); b != tt.want {
+				t.Errorf("installed %s, want %s", b, tt.want)
+			}
+			if pauses := (len(got)+1)/2 - 1; time.Since(started) < time.Duration(pauses)*config.BatchPause {
+				t.Errorf("took %s, less than %d pauses between batches", time.Since(started), pauses)
+			}
+		})
+	}
+}
+
+func TestInstallFleetCanaries(t *testing.T) {
+	tests := []struct {
+		name     string
+		hosts    []Host
+		canaries []string
+		want     string // installed hosts, canaries first
+		checked  string // the container health checked
+		wantErr  string
+	}{
+		{name: "healthy canary", hosts: containers("c1", "h2", "h3"), canaries: []string{"docker://c1"}, want: "[c1 h2,h3]", checked: "c1"},
+		{
+			name:     "canary group",
+			hosts:    append(containers("h1", "h2"), Host{Address: "docker://c3", Groups: []string{"canary"}}),
+			canaries: []string{"canary"},
+			want:     "[c3 h1,h2]",
+			checked:  "c3",
+		},
+		{name: "unhealthy canary", hosts: containers("sick1", "h2", "h3"), canaries: []string{"docker://sick1"}, want: "[sick1]",
+			checked: "sick1", wantErr: "docker://sick1 failed its health check"},
+		{name: "failed canary install", hosts: containers("bad1", "h2"), canaries: []string{"docker://bad1"}, want: "[bad1]",
+			wantErr: "canary install failed, leaving the remaining 1 hosts alone"},
+		{name: "unknown canary", hosts: containers("h1", "h2"), canaries: []string{"docker://h9"}, want: "[]",
+			wantErr: "canary docker://h9 is not one of the hosts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installed, checked := stubFleet(t)
+			config := fleetConfig()
+			config.Canaries, config.CanaryHealthCommand = tt.canaries, "check-health"
+			config.CanarySoak, config.CanaryInterval = 30*time.Millisecond, 10*time.Millisecond
+
+			err := installFleet(config, tt.hosts)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("installFleet returned %v, want an error containing %q", err, tt.wantErr)
+			}
+			if b := batches(installed(), 1, len(tt.hosts)); b != tt.want {
+				t.Errorf("installed %s, want %s", b, tt.want)
+			}
+			// Only the canary is checked, and a healthy one throughout the soak
+			checks := checked()
+			for _, host := range checks {
+				if host != tt.checked {
+					t.Errorf("checked %s, not the canary", host)
+				}
+			}
+			if tt.wantErr == "" && len(checks) < 2 {
+				t.Errorf("canary checked %d times during the soak", len(checks))
+			}
+		})
+	}
+}
+
+func TestInstallFleetSerial(t *testing.T) {
+	tests := []struct {
+		name      string
+		hosts     []string
+		installed string
+		checked   string
+		wantErr   string
+	}{
+		{name: "all healthy", hosts: []string{"h1", "h2", "h3"}, installed: "h1 h2 h3", checked: "h1 h2 h3"},
+		{name: "stops at an unhealthy host", hosts: []string{"h1", "sick2", "h3"}, installed: "h1 sick2", checked: "h1 sick2",
+			wantErr: "failed its health check"},
+		{name: "stops at a failed install", hosts: []string{"h1", "bad2", "h3"}, installed: "h1 bad2", checked: "h1",
+			wantErr: "stopped before the remaining 1 hosts"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installed, checked := stubFleet(t)
+			config := fleetConfig()
+			config.Serial, config.CanaryHealthCommand = true, "check-health"
+
+			err := installFleet(config, containers(tt.hosts...))
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("installFleet returned %v, want an error containing %q", err, tt.wantErr)
+			}
+			if got := strings.Join(installed(), " "); got != tt.installed {
+				t.Errorf("installed %s, want %s", got, tt.installed)
+			}
+			if got := strings.Join(checked(), " "); got != tt.checked {
+				t.Errorf("checked %s, want %s", got, tt.checked)
+			}
+		})
+	}
+}
+
+func TestInstallFleetRegions(t *testing.T) {
+	inRegion := func(region string, names ...string) []Host {
+		hosts := containers(names...)
+		for i := range hosts {
+			hosts[i].Region = region
+		}
+		return hosts
+	}
+	tests := []struct {
+		name    string
+		hosts   []Host
+		confirm bool
+		sizes   []int  // hosts per region, in rollout order
+		want    string // installed hosts, region by region
+		wantErr string
+	}{
+		{
+			name:    "in the configured order",
+			hosts:   append(inRegion("us-east-1", "u1", "u2"), inRegion("eu-west-1", "e1")...),
+			confirm: true,
+			sizes:   []int{1, 2},
+			want:    "[e1 u1,u2]",
+		},
+		{
+			name:    "stops after a failed region",
+			hosts:   append(inRegion("us-east-1", "u1"), inRegion("eu-west-1", "bad1", "e2")...),
+			confirm: true,
+			sizes:   []int{2},
+			want:    "[bad1,e2]",
+			wantErr: "eu-west-1: ",
+		},
+		{
+			name:    "not confirmed",
+			hosts:   append(inRegion("us-east-1", "u1"), inRegion("eu-west-1", "e1")...),
+			sizes:   []int{1},
+			want:    "[e1]",
+			wantErr: "rollout stopped after eu-west-1, before us-east-1",
+		},
+		{
+			name:    "unlisted region",
+			hosts:   append(inRegion("us-east-1", "u1"), inRegion("ap-south-1", "a1")...),
+			confirm: true,
+			want:    "[]",
+			wantErr: "host docker://a1 is in region ap-south-1, which is not in the rollout order",
+		},
+		{
+			name:    "no region",
+			hosts:   append(inRegion("us-east-1", "u1"), containers("h1")...),
+			confirm: true,
+			want:    "[]",
+			wantErr: "host docker://h1 has no region",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			installed, _ := stubFleet(t)
+			config := fleetConfig()
+			config.Regions = []string{"eu-west-1", "us-east-1"}
+			var asked []string
+			config.RegionConfirm = func(done, next string) bool {
+				asked = append(asked, done+">"+next)
+				return tt.confirm
+			}
+
+			err := installFleet(config, tt.hosts)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("installFleet returned %v, want an error containing %q", err, tt.wantErr)
+			}
+			if b := batches(installed(), tt.sizes...); b != tt.want {
+				t.Errorf("installed %s, want %s", b, tt.want)
+			}
+			if len(asked) > 1 || len(asked) == 1 && asked[0] != "eu-west-1>us-east-1" {
+				t.Errorf("asked to confirm %q", asked)
+			}
+		})
+	}
+}
+
+func TestSeedFallback(t *testing.T) {
+	// docker exec -i CONTAINER sh -c sh
+	args := stubCommand(t, "docker", `cat >> "$0.$3"`)
+	dir := filepath.Dir(args)
+
+	config := fleetConfig()
+	config.directUploads = config.Uploads
+	config.Uploads = []BinaryUpload{config.Uploads[0]}
+	config.Uploads[0].Path = "/tmp/binaryinstall-seed-1/tool_Linux_x86_64.tar.gz"
+	config.seedMissed = map[string]bool{"docker://web2": true}
+	if err := installHosts(config, containers("web1", "web2"), "/tmp/binaryinstall-seed-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	for host, want := range map[string]string{"web1": config.Uploads[0].Path, "web2": config.directUploads[0].Path} {
+		raw, err := os.ReadFile(filepath.Join(dir, "docker."+host))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(raw), want) {
+			t.Errorf("%s installed from the wrong path; want %s in:\n%s", host, want, raw)
+		}
+	}
+}
+
+func TestSeededDist(t *testing.T) {
+	dist := t.TempDir()
+	for _, name := range []string{"tool_Linux_x86_64.tar.gz", "tool_Linux_arm64.tar.gz"} {
+		if err := os.WriteFile(filepath.Join(dist, name), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stubCommand(t, "docker", `echo Linux aarch64`)
+
+	config := BinaryInstallConfig{RemoteHost: "docker://web1"}
+	transport, err := connectHost(&config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploads := []BinaryUpload{{Dist: dist, seedDist: "/tmp/binaryinstall-seed-1/dist-0"}}
+	got, err := expandDist(config, transport, uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Path != "/tmp/binaryinstall-seed-1/dist-0/tool_Linux_arm64.tar.gz" || got[0].LocalPath != "" {
+		t.Errorf("expandDist() = %+v, want the seeded arm64 archive", got)
+	}
+}
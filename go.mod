@@ -1,3 +1,13 @@
 module github.com/dropsite-ai/binaryinstall
 
 go 1.21.5
+
+require (
+	github.com/kevinburke/ssh_config v1.2.0
+	golang.org/x/crypto v0.31.0
+	golang.org/x/net v0.33.0
+	golang.org/x/term v0.27.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require golang.org/x/sys v0.28.0 // indirect
@@ -0,0 +1,164 @@
+package binaryinstall
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/url"
+	"time"
+)
+
+// ErrRolledBack is wrapped by the error of an upload whose health check
+// failed and that was rolled back to the previous version; see
+// BinaryInstallConfig.Rollback.
+var ErrRolledBack = errors.New("health check failed; rolled back to the previous version")
+
+// rolledBackMarker is printed by the remote script once it has rolled an
+// upload back.
+const rolledBackMarker = "binaryinstall-rolled-back"
+
+// HealthCheck is run on the host once an upload is installed and any
+// service restarted, and retried until it passes; the upload fails if it
+// never does. Either URL or Command is set.
+type HealthCheck struct {
+	// URL is polled from the host with curl or wget, e.g.
+	// "http://localhost:8080/healthz", until it answers with Status,
+	// which defaults to 200.
+	URL    string
+	Status int
+
+	// Command is a shell command run on the host, as the remote user, that
+	// must exit 0, e.g. "api --check-config".
+	Command string
+
+	Timeout  time.Duration // limit on each attempt; defaults to 5s
+	Retries  int           // attempts after the first fails; defaults to 10, negative for none
+	Interval time.Duration // pause between attempts; defaults to 3s
+}
+
+// healthCheck returns upload's HealthCheck with its defaults filled in and
+// its URL and Command expanded from the upload's Vars, or nil if it has
+// none.
+func healthCheck(upload BinaryUpload) (*HealthCheck, error) {
+	if upload.HealthCheck == nil {
+		return nil, nil
+	}
+	check := *upload.HealthCheck
+	if (check.URL == "") == (check.Command == "") {
+		return nil, fmt.Errorf("health check needs either a URL or a command")
+	}
+	var err error
+	if check.URL, err = expandVars("health check URL", check.URL, upload.Vars); err != nil {
+		return nil, err
+	}
+	if check.Command, err = expandVars("health check command", check.Command, upload.Vars); err != nil {
+		return nil, err
+	}
+	if check.URL != "" {
+		u, err := url.Parse(check.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("invalid health check URL %q, expected an http or https URL", check.URL)
+		}
+	}
+
+	if check.Status == 0 {
+		check.Status = 200
+	} else if check.Status < 100 || check.Status > 599 {
+		return nil, fmt.Errorf("invalid health check status %d", check.Status)
+	}
+	if check.Timeout <= 0 {
+		check.Timeout = 5 * time.Second
+	}
+	if check.Interval <= 0 {
+		check.Interval = 3 * time.Second
+	}
+	switch {
+	case check.Retries == 0:
+		check.Retries = 10
+	case check.Retries < 0:
+		check.Retries = 0
+	}
+	return &check, nil
+}
+
+// seconds rounds d up to whole seconds, at least one, for the timeout and
+// sleep commands of the remote script.
+func seconds(d time.Duration) int {
+	return max(1, int(math.Ceil(d.Seconds())))
+}
+
+// healthScript is scriptTemplate's "health", which polls the upload's
+// HealthCheck until it passes, rolling back with Rollback if it never does.
+const healthScript = `{{ define "health" }}
+{{- with .Health }}
+# Poll the health check until it passes, failing the upload if it never does.
+healthy() {
+{{- if .URL }}
+    if command -v curl >/dev/null 2>&1; then
+        code=$(curl -s -o /dev/null -w '%{http_code}' --max-time {{ seconds .Timeout }} {{ q .URL }} || true)
+    else
+        code=$(wget -S -q -O /dev/null -T {{ seconds .Timeout }} {{ q .URL }} 2>&1 | awk '$1 ~ /^HTTP\// { c = $2 } END { print c }')
+    fi
+    [ "$code" = {{ .Status }} ]
+{{- else }}
+    if command -v timeout >/dev/null 2>&1; then
+        timeout {{ seconds .Timeout }} sh -c {{ q .Command }}
+    else
+        sh -c {{ q .Command }}
+    fi
+{{- end }}
+}
+attempt=1
+until healthy; do
+    if [ "$attempt" -gt {{ .Retries }} ]; then
+        echo "health check failed after $attempt attempts{{ if .URL }}, last status ${code:-none}{{ end }}" >&2
+        {{ if $.Rollback }}rollback
+        {{ end }}exit 1
+    fi
+    attempt=$((attempt + 1))
+    sleep {{ seconds .Interval }}
+done
+echo "health check passed"
+{{- end }}
+{{ end }}`
+
+// replacingScript is scriptTemplate's "replacing", which defines replacing,
+// to note each path an install replaces, and rollback, to put them back
+// when the upload's health check fails.
+const replacingScript = `{{ define "replacing" }}
+# 2f) Note each path about to be replaced and where its backup goes, or "-"
+# if it is new, so a failed health check can put them back
+ROLLBACK_LIST="$TEMP_DIR.rollback"
+: > "$ROLLBACK_LIST"
+replacing() {
+    if [ -e "$1" ]; then
+        printf '%s\t%s\n' "$1" "$2" >> "$ROLLBACK_LIST"
+    else
+        printf '%s\t-\n' "$1" >> "$ROLLBACK_LIST"
+    fi
+}
+rollback() {
+    while IFS='	' read -r path backup; do
+        as_root rm -rf "$path"
+        if [ "$backup" = - ]; then
+            echo "rollback: removed $path" >&2
+        else
+            as_root mv "$backup" "$path"
+            echo "rollback: restored $path" >&2
+        fi
+    done < "$ROLLBACK_LIST"
+    rm -f "$ROLLBACK_LIST"
+    rmdir "$BACKUP_DIR" 2>/dev/null || true
+    {{ if .Release }}if [ -n "$PREVIOUS_RELEASE" ]; then
+        point_current "$PREVIOUS_RELEASE"
+        as_root rmdir "$DEST_DIR" 2>/dev/null || true
+        echo "rollback: current is $PREVIOUS_RELEASE again" >&2
+    fi
+    {{ end }}
+    {{ if .ServiceUnit }}[ "$INIT" != systemd ] || systemctl_ daemon-reload
+    {{ end }}{{ if .RestartService }}svc restart "$RESTART_SERVICE" || echo "rollback: failed to restart $RESTART_SERVICE" >&2
+    {{ end }}{{ if .StopService }}[ -z "$stopped" ] || svc restart "$STOP_SERVICE" || echo "rollback: failed to restart $STOP_SERVICE" >&2
+    {{ end }}{{ if .PostRestart }}run_hook post-restart {{ q .PostRestart }} || true
+    {{ end }}echo "` + rolledBackMarker + `" >&2
+}
+{{ end }}`
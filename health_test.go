@@ -0,0 +1,155 @@
+package binaryinstall
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckDefaults(t *testing.T) {
+	upload := BinaryUpload{Vars: map[string]string{"port": "8080"}}
+	upload.HealthCheck = &HealthCheck{URL: "http://localhost:{{.port}}/healthz"}
+	check, err := healthCheck(upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := HealthCheck{URL: "http://localhost:8080/healthz", Status: 200, Timeout: 5 * time.Second, Retries: 10, Interval: 3 * time.Second}
+	if *check != want {
+		t.Errorf("healthCheck() = %+v, want %+v", *check, want)
+	}
+
+	upload.HealthCheck = &HealthCheck{Command: "true", Retries: -1}
+	if check, err := healthCheck(upload); err != nil || check.Retries != 0 {
+		t.Errorf("negative retries gave %+v, %v, want none", check, err)
+	}
+
+	for _, tt := range []struct {
+		check   HealthCheck
+		wantErr string
+	}{
+		{HealthCheck{}, "either a URL or a command"},
+		{HealthCheck{URL: "http://localhost/", Command: "true"}, "either a URL or a command"},
+		{HealthCheck{URL: "localhost:8080"}, "invalid health check URL"},
+		{HealthCheck{URL: "file:///etc/passwd"}, "invalid health check URL"},
+		{HealthCheck{URL: "http://localhost/", Status: 42}, "invalid health check status"},
+		{HealthCheck{Command: "curl {{.missing}}"}, "health check command"},
+	} {
+		check := tt.check
+		upload.HealthCheck = &check
+		if _, err := healthCheck(upload); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("healthCheck(%+v) returned %v, want an error containing %q", tt.check, err, tt.wantErr)
+		}
+	}
+}
+
+func TestHealthCheckScript(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "tool_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("tool"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup")}
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755", Reinstall: true}
+	if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	attempts := filepath.Join(dir, "attempts")
+	// Passes from the second attempt
+	flaky := "echo x >> " + shellQuote(attempts) + "; [ $(wc -l < " + shellQuote(attempts) + ") -ge 2 ]"
+
+	tests := []struct {
+		name         string
+		check        HealthCheck
+		curl         string // body of a curl stub, printing the status
+		wantAttempts int
+		wantErr      string
+	}{
+		{name: "command passes on a retry", check: HealthCheck{Command: flaky, Retries: 2, Interval: time.Millisecond}, wantAttempts: 2},
+		{name: "command never passes", check: HealthCheck{Command: flaky, Retries: -1}, wantAttempts: 1,
+			wantErr: "health check failed after 1 attempts"},
+		{name: "URL answers", check: HealthCheck{URL: "http://localhost:8080/healthz"}, curl: "printf 200"},
+		{name: "URL answers with another status", check: HealthCheck{URL: "http://localhost:8080/healthz", Retries: -1}, curl: "printf 503",
+			wantErr: "last status 503"},
+		{name: "URL with expected status", check: HealthCheck{URL: "http://localhost:8080/healthz", Status: 204}, curl: "printf 204"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.Remove(attempts)
+			if tt.curl != "" {
+				args := stubCommand(t, "curl", tt.curl)
+				defer func() {
+					if got := readArgs(t, args); got[len(got)-1] != tt.check.URL {
+						t.Errorf("curl called with %q", got)
+					}
+				}()
+			}
+			upload := upload
+			check := tt.check
+			upload.HealthCheck = &check
+			err := processUploadSingleCommand(config, shTransport{}, upload)
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("install returned %v, want an error containing %q", err, tt.wantErr)
+			}
+			if tt.wantAttempts > 0 {
+				raw, _ := os.ReadFile(attempts)
+				if got := strings.Count(string(raw), "x"); got != tt.wantAttempts {
+					t.Errorf("health check ran %d times, want %d", got, tt.wantAttempts)
+				}
+			}
+		})
+	}
+}
+
+func TestHealthCheckRollback(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "tool_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("tool"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup"), Rollback: true}
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755",
+		HealthCheck: &HealthCheck{Command: "false", Retries: -1}}
+	binary := filepath.Join(upload.DestinationDir, "tool")
+
+	t.Run("restores the previous binary", func(t *testing.T) {
+		if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(binary, []byte("old version"), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		err := processUploadSingleCommand(config, shTransport{}, upload)
+		if !errors.Is(err, ErrRolledBack) {
+			t.Fatalf("install returned %v, want ErrRolledBack", err)
+		}
+		if got, _ := os.ReadFile(binary); string(got) != "old version" {
+			t.Errorf("binary is %q after the rollback, want the old version", got)
+		}
+	})
+
+	t.Run("removes a new binary", func(t *testing.T) {
+		os.Remove(binary)
+		if err := processUploadSingleCommand(config, shTransport{}, upload); !errors.Is(err, ErrRolledBack) {
+			t.Fatalf("install returned %v, want ErrRolledBack", err)
+		}
+		if _, err := os.Stat(binary); !os.IsNotExist(err) {
+			t.Errorf("binary left after rolling back its first install: %v", err)
+		}
+	})
+
+	t.Run("not rolled back without Rollback", func(t *testing.T) {
+		config := config
+		config.Rollback = false
+		err := processUploadSingleCommand(config, shTransport{}, upload)
+		if err == nil || errors.Is(err, ErrRolledBack) {
+			t.Fatalf("install returned %v, want a plain failure", err)
+		}
+		if _, err := os.Stat(binary); err != nil {
+			t.Errorf("binary not left installed: %v", err)
+		}
+	})
+}
@@ -0,0 +1,101 @@
+package binaryinstall
+
+import (
+	"encoding/json"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// archiveVersionPattern matches the version in goreleaser-style archive
+// names, such as "1.2.3" in "llmfs_1.2.3_Linux_x86_64.tar.gz" or
+// "2.0.0-rc.1" in "api_2.0.0-rc.1_Linux_x86_64.tar.gz".
+var archiveVersionPattern = regexp.MustCompile(`[_-]v?([0-9]+\.[0-9]+\.[0-9]+(?:[-+~][0-9A-Za-z.+~-]*?)?)(?:_|\.(?:tar|tgz|tbz2?|txz|zip)\b)`)
+
+// uploadVersion returns the version upload installs, if known: its Release,
+// its "version" var, or the version in its archive's name.
+func uploadVersion(upload BinaryUpload) string {
+	if upload.Release != "" {
+		return upload.Release
+	}
+	if v := upload.Vars["version"]; v != "" {
+		return v
+	}
+	if m := archiveVersionPattern.FindStringSubmatch(path.Base(uploadLabel(upload))); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// manifestFields returns the fields of upload's host manifest entries known
+// on this side, as JSON object members: its version, unless the package
+// manager reports it, and the artifact it came from.
+func manifestFields(upload BinaryUpload, withVersion bool) string {
+	fields := map[string]string{"source": artifactLabel(upload)}
+	if v := uploadVersion(upload); withVersion && v != "" {
+		fields["version"] = v
+	}
+	// Maps encode with sorted keys, so entries read the same on every install
+	b, _ := json.Marshal(fields)
+	return strings.TrimSuffix(strings.TrimPrefix(string(b), "{"), "}")
+}
+
+// manifestScript is scriptTemplate's "manifest", which defines the functions
+// that record installs in HostManifest.
+const manifestScript = `{{ define "manifest" }}
+# The host manifest holds one JSON object per line, for a path or package.
+# manifest_file and manifest_package add entries to MANIFEST_ENTRIES, and
+# manifest_remove drops a path's; write_manifest replaces those for the same
+# path or package with them. The install is already done, so a failure to
+# write it is reported but does not fail the install.
+MANIFEST_FIELDS={{ q .ManifestFields }}
+MANIFEST_ENTRIES=
+MANIFEST_REMOVED=
+MANIFEST_TIME=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+json_str() {
+    printf '"%s"' "$(printf '%s' "$1" | sed 's/[\\"]/\\&/g')"
+}
+manifest_file() {
+    # Entries are keyed on their first comma-separated field and read back
+    # line by line, so names from the archive that would split them are left out
+    case $1 in *[,[:cntrl:]]*)
+        echo "warning: not recording $1 in $HOST_MANIFEST: its name has a comma or control character" >&2
+        return ;;
+    esac
+    sum=$( (as_root sha256sum "$1" 2>/dev/null || as_root shasum -a 256 "$1") | cut -d' ' -f1)
+    set -- "$1" $(stat -c '%a %U %G' "$1" 2>/dev/null || stat -f '%Lp %Su %Sg' "$1")
+    MANIFEST_ENTRIES="$MANIFEST_ENTRIES  {\"path\":$(json_str "$1"),\"binary\":$(json_str "${1##*/}"),$MANIFEST_FIELDS,\"sha256\":\"$sum\",\"mode\":\"$2\",\"owner\":$(json_str "$3"),\"group\":$(json_str "$4"),\"installed_at\":\"$MANIFEST_TIME\"}
+"
+}
+manifest_package() {
+    MANIFEST_ENTRIES="$MANIFEST_ENTRIES  {\"package\":$(json_str "$1"),\"version\":$(json_str "$2"),$MANIFEST_FIELDS,\"sha256\":\"$3\",\"installed_at\":\"$MANIFEST_TIME\"}
+"
+}
+manifest_remove() {
+    MANIFEST_REMOVED="$MANIFEST_REMOVED  {\"path\":$(json_str "$1")
+"
+}
+write_manifest() {
+    manifest_tmp=$(mktemp)
+    printf '%s' "$MANIFEST_ENTRIES" > "$manifest_tmp.new"
+    printf '%s%s' "$MANIFEST_REMOVED" "$MANIFEST_ENTRIES" > "$manifest_tmp.keys"
+    as_root cat "$HOST_MANIFEST" 2>/dev/null | grep '^  {' | sed 's/,$//' > "$manifest_tmp.old" || true
+    {
+        echo '{"installs": ['
+        # Entries are keyed by their first field, the path or package
+        awk -F, 'NR == FNR { skip[$1]; next } !($1 in skip)' "$manifest_tmp.keys" "$manifest_tmp.old" |
+            cat - "$manifest_tmp.new" |
+            awk 'NR > 1 { print prev "," } { prev = $0 } END { if (NR) print prev }'
+        echo ']}'
+    } > "$manifest_tmp"
+    if as_root mkdir -p "${HOST_MANIFEST%/*}" &&
+        as_root cp "$manifest_tmp" "$HOST_MANIFEST.tmp" &&
+        as_root chmod 0644 "$HOST_MANIFEST.tmp" &&
+        as_root mv -f "$HOST_MANIFEST.tmp" "$HOST_MANIFEST"; then
+        echo "recorded in $HOST_MANIFEST"
+    else
+        echo "warning: could not update host manifest $HOST_MANIFEST" >&2
+    fi
+    rm -f "$manifest_tmp" "$manifest_tmp.new" "$manifest_tmp.keys" "$manifest_tmp.old"
+}
+{{ end }}`
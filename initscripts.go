@@ -0,0 +1,381 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// initScripts are a service's init scripts for hosts without systemd.
+type initScripts struct {
+	OpenRC string // for /etc/init.d on OpenRC hosts such as Alpine
+	SysV   string // for /etc/init.d elsewhere
+	RCD    string // for /usr/local/etc/rc.d on FreeBSD
+}
+
+// initScript is what the init scripts are rendered from: upload's Systemd
+// unit, with its defaults filled in.
+type initScript struct {
+	Name, Description string
+	RCName            string   // Name as a shell variable name, for rc.conf
+	Command           string   // the program, first word of ExecStart
+	Args              []string // and its arguments
+	RunAs             string   // user, or user:group
+	WorkingDirectory  string
+	Environment       []string // NAME=value
+	EnvironmentFile   string   // without any leading "-"
+	OptionalEnvFile   bool     // the file may be missing
+	Respawn           bool     // restart the service when it fails
+	RespawnDelay      int      // seconds between restarts
+	DaemonArgs        string   // daemon(8) arguments running the service, for rc.d
+}
+
+// rcNamePattern matches what may not appear in a shell variable name.
+var rcNamePattern = regexp.MustCompile(`[^A-Za-z0-9_]`)
+
+var initFuncs = template.FuncMap{"q": shellQuote, "args": shellArgs}
+
+// shellArgs quotes each of args for the shell and joins them with spaces.
+func shellArgs(args []string) string {
+	quoted := make([]string, len(args))
+	for i, a := range args {
+		quoted[i] = shellQuote(a)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// openrcTemplate is an openrc-run script, supervised by supervise-daemon
+// when the service should respawn.
+var openrcTemplate = template.Must(template.New("openrc").Funcs(initFuncs).Parse(`#!/sbin/openrc-run
+description={{ q .Description }}
+command={{ q .Command }}
+command_args={{ q (args .Args) }}
+{{- if .RunAs }}
+command_user={{ q .RunAs }}
+{{- end }}
+{{- if .WorkingDirectory }}
+directory={{ q .WorkingDirectory }}
+{{- end }}
+{{- if .Respawn }}
+supervisor=supervise-daemon
+{{- if .RespawnDelay }}
+respawn_delay={{ .RespawnDelay }}
+{{- end }}
+{{- else }}
+command_background=true
+pidfile="/run/${RC_SVCNAME}.pid"
+{{- end }}
+{{- range .Environment }}
+export {{ q . }}
+{{- end }}
+{{- if .EnvironmentFile }}
+set -a
+{{ if .OptionalEnvFile }}[ ! -f {{ q .EnvironmentFile }} ] || {{ end }}. {{ q .EnvironmentFile }}
+set +a
+{{- end }}
+
+depend() {
+	need net
+}
+`))
+
+// sysvTemplate is an LSB init script running the service in the
+// background with start-stop-daemon.
+var sysvTemplate = template.Must(template.New("sysv").Funcs(initFuncs).Parse(`#!/bin/sh
+### BEGIN INIT INFO
+# Provides:          {{ .Name }}
+# Required-Start:    $network $remote_fs
+# Required-Stop:     $network $remote_fs
+# Default-Start:     2 3 4 5
+# Default-Stop:      0 1 6
+# Short-Description: {{ .Description }}
+### END INIT INFO
+
+NAME={{ q .Name }}
+DAEMON={{ q .Command }}
+PIDFILE="/var/run/$NAME.pid"
+{{- range .Environment }}
+export {{ q . }}
+{{- end }}
+{{- if .EnvironmentFile }}
+set -a
+{{ if .OptionalEnvFile }}[ ! -f {{ q .EnvironmentFile }} ] || {{ end }}. {{ q .EnvironmentFile }}
+set +a
+{{- end }}
+
+running() {
+    [ -f "$PIDFILE" ] && kill -0 "$(cat "$PIDFILE")" 2>/dev/null
+}
+
+case "$1" in
+start)
+    running && exit 0
+    start-stop-daemon --start --quiet --background --make-pidfile --pidfile "$PIDFILE"{{ if .RunAs }} --chuid {{ q .RunAs }}{{ end }}{{ if .WorkingDirectory }} --chdir {{ q .WorkingDirectory }}{{ end }} --exec "$DAEMON" -- {{ args .Args }}
+    ;;
+stop)
+    start-stop-daemon --stop --quiet --oknodo --retry TERM/30/KILL/5 --pidfile "$PIDFILE"
+    rm -f "$PIDFILE"
+    ;;
+restart|force-reload)
+    "$0" stop
+    "$0" start
+    ;;
+status)
+    if running; then
+        echo "$NAME is running"
+    else
+        echo "$NAME is not running"
+        exit 3
+    fi
+    ;;
+*)
+    echo "Usage: $0 {start|stop|restart|status}" >&2
+    exit 2
+    ;;
+esac
+`))
+
+// rcdTemplate is a FreeBSD rc.d script running the service under
+// daemon(8), which restarts it when it should respawn.
+var rcdTemplate = template.Must(template.New("rcd").Funcs(initFuncs).Parse(`#!/bin/sh
+#
+# PROVIDE: {{ .RCName }}
+# REQUIRE: LOGIN NETWORKING
+# KEYWORD: shutdown
+
+. /etc/rc.subr
+
+name={{ .RCName }}
+rcvar={{ .RCName }}_enable
+desc={{ q .Description }}
+
+load_rc_config $name
+: ${ {{- .RCName }}_enable:="NO"}
+{{- if .WorkingDirectory }}
+: ${ {{- .RCName }}_chdir:={{ q .WorkingDirectory }}}
+{{- end }}
+
+pidfile="/var/run/${name}.pid"
+command=/usr/sbin/daemon
+command_args={{ q .DaemonArgs }}
+{{- range .Environment }}
+export {{ q . }}
+{{- end }}
+{{- if .EnvironmentFile }}
+set -a
+{{ if .OptionalEnvFile }}[ ! -f {{ q .EnvironmentFile }} ] || {{ end }}. {{ q .EnvironmentFile }}
+set +a
+{{- end }}
+
+run_rc_command "$1"
+`))
+
+// renderInitScripts returns upload's Systemd unit as init scripts, for
+// hosts without systemd. ExecStart is split on spaces into the program and
+// its arguments. It expects renderUnit to have validated the unit.
+func renderInitScripts(upload BinaryUpload, binaryName string) (initScripts, error) {
+	var scripts initScripts
+	unit := *upload.Systemd
+	command, err := execStart(upload, binaryName)
+	if err != nil {
+		return scripts, err
+	}
+	fields := strings.Fields(command)
+	data := initScript{
+		Name:             strings.TrimSuffix(unit.Name, ".service"),
+		Description:      unit.Description,
+		Command:          fields[0],
+		Args:             fields[1:],
+		RunAs:            unit.User,
+		WorkingDirectory: unit.WorkingDirectory,
+		EnvironmentFile:  strings.TrimPrefix(unit.EnvironmentFile, "-"),
+		OptionalEnvFile:  strings.HasPrefix(unit.EnvironmentFile, "-"),
+		Respawn:          unit.Restart != "no",
+	}
+	if data.Name == "" {
+		data.Name = binaryName
+	}
+	if data.Description == "" {
+		data.Description = binaryName
+	}
+	data.RCName = rcNamePattern.ReplaceAllString(data.Name, "_")
+	if unit.User != "" && unit.Group != "" {
+		data.RunAs += ":" + unit.Group
+	}
+	if unit.RestartSec > 0 {
+		data.RespawnDelay = seconds(unit.RestartSec)
+	}
+	// rc.subr evaluates command_args, expanding $pidfile and the quoting.
+	data.DaemonArgs = "-f -P ${pidfile}"
+	if data.Respawn {
+		data.DaemonArgs += " -r"
+		if data.RespawnDelay > 0 {
+			data.DaemonArgs += fmt.Sprintf(" -R %d", data.RespawnDelay)
+		}
+	}
+	if unit.User != "" {
+		data.DaemonArgs += " -u " + shellQuote(unit.User)
+	}
+	data.DaemonArgs += " -- " + shellArgs(fields)
+	for k, v := range unit.Environment {
+		data.Environment = append(data.Environment, k+"="+v)
+	}
+	sort.Strings(data.Environment)
+
+	for _, s := range []struct {
+		kind   string
+		tmpl   *template.Template
+		script *string
+	}{
+		{"OpenRC", openrcTemplate, &scripts.OpenRC},
+		{"SysV", sysvTemplate, &scripts.SysV},
+		{"rc.d", rcdTemplate, &scripts.RCD},
+	} {
+		var buf bytes.Buffer
+		if err := s.tmpl.Execute(&buf, data); err != nil {
+			return scripts, fmt.Errorf("failed to render %s script: %w", s.kind, err)
+		}
+		*s.script = buf.String()
+	}
+	return scripts, nil
+}
+
+// restartScript is scriptTemplate's "restart", which restarts or reloads the
+// upload's service through whichever init system the host runs.
+const restartScript = `{{ define "restart" }}
+# Restart RESTART_SERVICE on the new version, or reload it, showing why if
+# it fails.
+RESTART_SERVICE={{ q .RestartService }}
+{{ if and .PreRestart (not .StopService) }}run_hook pre-restart {{ q .PreRestart }}
+{{ end -}}
+{{ if .ReloadOnly -}}
+reload_service() {
+{{- if .PIDFile }}
+    as_root kill -s {{ .ReloadSignal }} "$(as_root cat {{ q .PIDFile }})"
+{{- else if .ReloadSignal }}
+    case $INIT in
+    systemd) systemctl_ kill --kill-whom=main --signal={{ .ReloadSignal }} "$1" ;;
+    launchd) as_root launchctl kill {{ .ReloadSignal }} "system/$1" ;;
+    *) echo "sending $1 a signal needs a pid file on $INIT hosts" >&2; return 1 ;;
+    esac
+{{- else }}
+    svc reload "$1"
+{{- end }}
+}
+if ! reload_service "$RESTART_SERVICE"; then
+    svc_status "$RESTART_SERVICE" >&2 || true
+    echo "failed to reload $RESTART_SERVICE" >&2
+    exit 1
+fi
+wait_active "$RESTART_SERVICE"
+echo "reloaded $RESTART_SERVICE"
+{{- else -}}
+if ! svc restart "$RESTART_SERVICE"; then
+    svc_status "$RESTART_SERVICE" >&2 || true
+    echo "failed to restart $RESTART_SERVICE" >&2
+    exit 1
+fi
+wait_active "$RESTART_SERVICE"
+echo "restarted $RESTART_SERVICE"
+{{- end }}
+{{ end }}`
+
+// servicesScript is scriptTemplate's "services", which finds the host's
+// init system and defines svc and its helpers to manage services through it.
+const servicesScript = `{{ define "services" }}
+# Manage services through the host's init system: launchd on macOS, rc.d on
+# FreeBSD, else systemd if it is running, OpenRC, or SysV init scripts. svc
+# starts, stops, restarts or reloads one.
+OS=$(uname -s)
+{{ if .UserService -}}
+# User services belong to the remote user's own systemd instance, found
+# through a runtime directory non-interactive SSH sessions may not set
+INIT=systemd
+export XDG_RUNTIME_DIR="${XDG_RUNTIME_DIR:-/run/user/$(id -u)}"
+if [ ! -d "$XDG_RUNTIME_DIR" ]; then
+    echo "no systemd user instance for $(id -un); keep one running with loginctl enable-linger $(id -un)" >&2
+    exit 1
+fi
+systemctl_() { systemctl --user "$@"; }
+{{- else -}}
+systemctl_() { as_root systemctl "$@"; }
+if [ "$OS" = Darwin ]; then
+    INIT=launchd
+elif [ "$OS" = FreeBSD ]; then
+    INIT=rcd
+elif [ -d /run/systemd/system ]; then
+    INIT=systemd
+elif command -v openrc-run >/dev/null 2>&1; then
+    INIT=openrc
+else
+    INIT=sysv
+fi
+{{- end }}
+# macOS and FreeBSD have no root group; wheel is its equivalent
+case $OS in Darwin|FreeBSD) [ "$GROUP" != root ] || GROUP=wheel ;; esac
+svc() {
+    case $INIT in
+    launchd)
+        case $1 in
+        start) as_root launchctl bootstrap system "/Library/LaunchDaemons/$2.plist" ;;
+        stop) as_root launchctl bootout "system/$2" ;;
+        restart) as_root launchctl kickstart -k "system/$2" ;;
+        reload) as_root launchctl kill HUP "system/$2" ;;
+        esac ;;
+    systemd) systemctl_ "$1" "$2" ;;
+    openrc) as_root rc-service "$2" "$1" ;;
+    rcd) as_root service "$2" "$1" ;;
+    sysv) as_root "/etc/init.d/$2" "$1" ;;
+    esac
+}
+svc_running() {
+    case $INIT in
+    launchd) as_root launchctl print "system/$1" 2>/dev/null | grep -q 'state = running' ;;
+    systemd) systemctl_ is-active --quiet "$1" 2>/dev/null ;;
+    openrc) as_root rc-service "$1" status >/dev/null 2>&1 ;;
+    rcd) as_root service "$1" status >/dev/null 2>&1 ;;
+    sysv) [ -x "/etc/init.d/$1" ] && as_root "/etc/init.d/$1" status >/dev/null 2>&1 ;;
+    esac
+}
+svc_status() {
+    case $INIT in
+    launchd) as_root launchctl print "system/$1" | head -n 20 ;;
+    systemd) systemctl_ status "$1" --no-pager --lines 20 ;;
+    openrc) as_root rc-service "$1" status ;;
+    rcd) as_root service "$1" status ;;
+    sysv) as_root "/etc/init.d/$1" status ;;
+    esac
+}
+{{- if or .RestartService .StopService }}
+# wait_active polls until the service $1 is running, failing once
+# ACTIVE_TIMEOUT seconds have passed without it coming up.
+ACTIVE_TIMEOUT={{ seconds .ActiveTimeout }}
+wait_active() {
+    waited=0
+    until {{ if .ReadyCommand }}sh -c {{ q .ReadyCommand }}{{ else }}svc_running "$1"{{ end }}; do
+        if [ "$waited" -ge "$ACTIVE_TIMEOUT" ]; then
+            svc_status "$1" >&2 || true
+            echo "$1 did not come up within ${ACTIVE_TIMEOUT}s" >&2
+            return 1
+        fi
+        sleep 1
+        waited=$((waited + 1))
+    done
+}
+{{- end }}
+{{- if or .PreRestart .PostRestart }}
+# run_hook runs the restart hook $1, the command $2, as the remote user,
+# failing if it fails or overruns.
+run_hook() {
+    echo "running $1 hook"
+    if command -v timeout >/dev/null 2>&1; then
+        timeout {{ seconds .HookTimeout }} sh -c "$2"
+    else
+        sh -c "$2"
+    fi || { echo "$1 hook failed" >&2; return 1; }
+}
+{{- end }}
+{{ end }}`
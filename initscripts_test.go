@@ -0,0 +1,215 @@
+package binaryinstall
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderInitScripts(t *testing.T) {
+	upload := BinaryUpload{DestinationDir: "/usr/local/bin", Vars: map[string]string{"port": "8080"}}
+
+	t.Run("defaults", func(t *testing.T) {
+		upload := upload
+		upload.Systemd = &SystemdUnit{}
+		scripts, err := renderInitScripts(upload, "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		openrc, sysv := scripts.OpenRC, scripts.SysV
+		want := `#!/sbin/openrc-run
+description='api'
+command='/usr/local/bin/api'
+command_args=''
+supervisor=supervise-daemon
+
+depend() {
+	need net
+}
+`
+		if openrc != want {
+			t.Errorf("OpenRC script =\n%s\nwant\n%s", openrc, want)
+		}
+		for _, want := range []string{
+			"# Provides:          api\n",
+			"NAME='api'\nDAEMON='/usr/local/bin/api'\n",
+			`--pidfile "$PIDFILE" --exec "$DAEMON" -- ` + "\n",
+		} {
+			if !strings.Contains(sysv, want) {
+				t.Errorf("SysV script lacks %q:\n%s", want, sysv)
+			}
+		}
+	})
+
+	t.Run("everything", func(t *testing.T) {
+		upload := upload
+		upload.Systemd = &SystemdUnit{
+			Name:             "api-server",
+			Description:      "API server",
+			ExecStart:        "{{.path}} serve --port {{.port}}",
+			User:             "api",
+			Group:            "api",
+			WorkingDirectory: "/var/lib/api",
+			Environment:      map[string]string{"MODE": "prod", "TOKEN": "it's"},
+			EnvironmentFile:  "-/etc/default/api",
+			RestartSec:       2 * time.Second,
+		}
+		scripts, err := renderInitScripts(upload, "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		openrc, sysv := scripts.OpenRC, scripts.SysV
+		for _, want := range []string{
+			"command_args=''\\''serve'\\'' '\\''--port'\\'' '\\''8080'\\'''\n",
+			"command_user='api:api'\n",
+			"directory='/var/lib/api'\n",
+			"respawn_delay=2\n",
+			"export 'MODE=prod'\nexport 'TOKEN=it'\\''s'\n",
+			"set -a\n[ ! -f '/etc/default/api' ] || . '/etc/default/api'\nset +a\n",
+		} {
+			if !strings.Contains(openrc, want) {
+				t.Errorf("OpenRC script lacks %q:\n%s", want, openrc)
+			}
+		}
+		for _, want := range []string{
+			"# Short-Description: API server\n",
+			"--chuid 'api:api' --chdir '/var/lib/api' --exec \"$DAEMON\" -- 'serve' '--port' '8080'\n",
+			"export 'MODE=prod'\nexport 'TOKEN=it'\\''s'\n",
+		} {
+			if !strings.Contains(sysv, want) {
+				t.Errorf("SysV script lacks %q:\n%s", want, sysv)
+			}
+		}
+	})
+
+	t.Run("rc.d", func(t *testing.T) {
+		upload := upload
+		upload.Systemd = &SystemdUnit{
+			Name:             "api-server",
+			ExecStart:        "{{.path}} serve --port {{.port}}",
+			User:             "api",
+			WorkingDirectory: "/var/lib/api",
+			RestartSec:       2 * time.Second,
+		}
+		scripts, err := renderInitScripts(upload, "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			"# PROVIDE: api_server\n",
+			"name=api_server\nrcvar=api_server_enable\n",
+			": ${api_server_enable:=\"NO\"}\n: ${api_server_chdir:='/var/lib/api'}\n",
+		} {
+			if !strings.Contains(scripts.RCD, want) {
+				t.Errorf("rc.d script lacks %q:\n%s", want, scripts.RCD)
+			}
+		}
+
+		// rc.subr evaluates command_args, so it must give daemon(8) these
+		// arguments once evaluated
+		_, assignment, _ := strings.Cut(scripts.RCD, "\ncommand_args=")
+		assignment, _, _ = strings.Cut(assignment, "\n")
+		out, err := exec.Command("sh", "-c", "pidfile=/var/run/api_server.pid; command_args="+assignment+`; eval "set -- $command_args"; printf '%s|' "$@"`).Output()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := "-f|-P|/var/run/api_server.pid|-r|-R|2|-u|api|--|/usr/local/bin/api|serve|--port|8080|"; string(out) != want {
+			t.Errorf("daemon(8) would get %s, want %s", out, want)
+		}
+	})
+
+	t.Run("not respawned", func(t *testing.T) {
+		upload := upload
+		upload.Systemd = &SystemdUnit{Restart: "no"}
+		scripts, err := renderInitScripts(upload, "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		openrc := scripts.OpenRC
+		if strings.Contains(openrc, "supervisor") || !strings.Contains(openrc, "command_background=true\n") {
+			t.Errorf("OpenRC script supervises a service that is not respawned:\n%s", openrc)
+		}
+	})
+}
+
+func TestInitScriptsRun(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("the init scripts need a POSIX shell")
+	}
+	dir := t.TempDir()
+	pwned := filepath.Join(dir, "pwned")
+	upload := BinaryUpload{DestinationDir: "/usr/local/bin", Systemd: &SystemdUnit{
+		Environment:     map[string]string{"TOKEN": "$(touch " + pwned + ")"},
+		EnvironmentFile: "-" + filepath.Join(dir, "missing.env"),
+	}}
+	scripts, err := renderInitScripts(upload, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	openrc, sysv := scripts.OpenRC, scripts.SysV
+
+	// openrc-run sources its scripts; an optional environment file that is
+	// missing is skipped, and values are set literally
+	script := filepath.Join(dir, "openrc")
+	if err := os.WriteFile(script, []byte(openrc), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	out, err := exec.Command("sh", "-c", `. "$1" && printf '%s' "$TOKEN"`, "sh", script).CombinedOutput()
+	if err != nil || string(out) != "$(touch "+pwned+")" {
+		t.Errorf("sourcing the OpenRC script: %q, %v", out, err)
+	}
+
+	script = filepath.Join(dir, "sysv")
+	if err := os.WriteFile(script, []byte(sysv), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := exec.Command(script, "status").Run(); err == nil {
+		t.Errorf("status of a service that never started succeeded")
+	} else if exit, ok := err.(*exec.ExitError); !ok || exit.ExitCode() != 3 {
+		t.Errorf("status of a stopped service: %v, want exit status 3", err)
+	}
+	if err := exec.Command(script, "reload-everything").Run(); err == nil {
+		t.Errorf("an unknown action succeeded")
+	}
+	if _, err := os.Stat(pwned); err == nil {
+		t.Errorf("an environment value ran a command")
+	}
+}
+
+func TestRCDServices(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	stubCommand(t, "uname", `echo FreeBSD`)
+	// Services named running* are running
+	args := stubCommand(t, "service", `echo "$*" >> "$0.calls"
+case $2 in status) case $1 in running*) exit 0 ;; *) exit 1 ;; esac ;; esac`)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "tool_FreeBSD_x86_64.tar.gz")
+	writeArchive(t, archive, file("tool"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup")}
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755",
+		StopService: "running-tool", RestartService: "running-other"}
+	if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+		t.Fatal(err)
+	}
+	calls, err := os.ReadFile(filepath.Join(filepath.Dir(args), "service.calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `running-tool status
+running-tool stop
+running-tool start
+running-tool status
+running-other restart
+running-other status
+`
+	if string(calls) != want {
+		t.Errorf("service called with\n%s\nwant\n%s", calls, want)
+	}
+}
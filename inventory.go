@@ -0,0 +1,278 @@
+package binaryinstall
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Host is an install target with settings of its own, overriding those of
+// BinaryInstallConfig when installing on it.
+type Host struct {
+	Address string            // as RemoteHost, e.g. "web1.example.com" or "10.0.0.5:2222"
+	User    string            // SSH user, instead of SSHUser
+	KeyPath string            // SSH key, instead of SSHKeyPath
+	Port    int               // SSH port, instead of any in Address
+	Groups  []string          // inventory groups the host belongs to
+	Region  string            // region or zone, for rolling out region by region
+	Vars    map[string]string // variables for the host, used as defaults for each upload's Vars
+}
+
+// inventory is the YAML (or JSON) format read by LoadInventory.
+type inventory struct {
+	Vars   map[string]string `yaml:"vars"`
+	Hosts  []inventoryHost   `yaml:"hosts"`
+	Groups map[string]struct {
+		Vars map[string]string `yaml:"vars"`
+	} `yaml:"groups"`
+}
+
+type inventoryHost struct {
+	Host   string            `yaml:"host"`
+	User   string            `yaml:"user"`
+	Key    string            `yaml:"key"`
+	Port   int               `yaml:"port"`
+	Groups []string          `yaml:"groups"`
+	Region string            `yaml:"region"`
+	Vars   map[string]string `yaml:"vars"`
+}
+
+// LoadInventory reads the hosts to install on from a YAML or JSON file,
+// selected by a .yaml, .yml or .json extension, e.g.
+//
+//	vars:
+//	  env: prod
+//	hosts:
+//	  - host: web1.example.com
+//	    user: ubuntu
+//	    key: ~/.ssh/web.pem
+//	    groups: [web]
+//	    region: us-east-1
+//	  - host: worker1.example.com
+//	    port: 2222
+//	    groups: [workers]
+//	    vars:
+//	      datadir: /srv/a
+//	groups:
+//	  web:
+//	    vars:
+//	      env: staging
+//
+// or from an Ansible-style INI inventory otherwise. Variables apply from
+// the top level, then each of the host's groups, then the host itself.
+func LoadInventory(path string) ([]Host, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read inventory: %w", err)
+	}
+	var hosts []Host
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", ".json":
+		hosts, err = parseYAMLInventory(data)
+	default:
+		hosts, err = parseINIInventory(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse inventory %s: %w", path, err)
+	}
+	return hosts, nil
+}
+
+func parseYAMLInventory(data []byte) ([]Host, error) {
+	var inv inventory
+	if err := yaml.Unmarshal(data, &inv); err != nil {
+		return nil, err
+	}
+	var hosts []Host
+	for _, ih := range inv.Hosts {
+		if ih.Host == "" {
+			return nil, fmt.Errorf("inventory host without an address")
+		}
+		vars := mergeVars(nil, inv.Vars)
+		for _, g := range ih.Groups {
+			vars = mergeVars(vars, inv.Groups[g].Vars)
+		}
+		hosts = append(hosts, Host{
+			Address: ih.Host,
+			User:    ih.User,
+			KeyPath: ih.Key,
+			Port:    ih.Port,
+			Groups:  ih.Groups,
+			Region:  ih.Region,
+			Vars:    mergeVars(vars, ih.Vars),
+		})
+	}
+	return hosts, nil
+}
+
+// parseINIInventory parses an Ansible INI inventory: host lines with
+// key=value variables under [group] headers, [group:vars] and [all:vars]
+// sections, and [group:children] listing nested groups. The connection
+// variables ansible_host, ansible_user, ansible_port and
+// ansible_ssh_private_key_file set the host's address, user, port and key,
+// and the variable region its region. Lines starting with # or ; are
+// comments, as is the rest of a host line from a # field.
+func parseINIInventory(data []byte) ([]Host, error) {
+	var (
+		order     []string
+		hostVars  = map[string]map[string]string{}
+		members   = map[string][]string{} // group => hosts listed under it
+		children  = map[string][]string{} // group => nested groups
+		groupVars = map[string]map[string]string{}
+		groups    []string // groups in order of first appearance
+		section   = "ungrouped"
+		kind      = ""
+	)
+	addGroup := func(g string) {
+		if _, ok := groupVars[g]; !ok {
+			groupVars[g] = map[string]string{}
+			groups = append(groups, g)
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") {
+				return nil, fmt.Errorf("line %d: unterminated section header %q", n, line)
+			}
+			section, kind, _ = strings.Cut(line[1:len(line)-1], ":")
+			if section == "" {
+				return nil, fmt.Errorf("line %d: section without a group name", n)
+			}
+			if kind != "" && kind != "vars" && kind != "children" {
+				return nil, fmt.Errorf("line %d: unknown section type %q", n, kind)
+			}
+			addGroup(section)
+			continue
+		}
+
+		switch kind {
+		case "vars":
+			key, val, ok := strings.Cut(line, "=")
+			if !ok {
+				return nil, fmt.Errorf("line %d: expected key=value", n)
+			}
+			groupVars[section][strings.TrimSpace(key)] = unquote(strings.TrimSpace(val))
+		case "children":
+			addGroup(line)
+			children[section] = append(children[section], line)
+		default:
+			fields := strings.Fields(line)
+			name := fields[0]
+			if _, ok := hostVars[name]; !ok {
+				hostVars[name] = map[string]string{}
+				order = append(order, name)
+			}
+			for _, f := range fields[1:] {
+				if strings.HasPrefix(f, "#") {
+					break // the rest of the line is a comment
+				}
+				key, val, ok := strings.Cut(f, "=")
+				if !ok || key == "" {
+					return nil, fmt.Errorf("line %d: expected key=value, got %q", n, f)
+				}
+				hostVars[name][key] = unquote(val)
+			}
+			addGroup(section)
+			members[section] = append(members[section], name)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	// Hosts of nested groups belong to their parents as well.
+	var collect func(g string, seen map[string]bool) []string
+	collect = func(g string, seen map[string]bool) []string {
+		if seen[g] {
+			return nil
+		}
+		seen[g] = true
+		hosts := members[g]
+		for _, c := range children[g] {
+			hosts = append(hosts, collect(c, seen)...)
+		}
+		return hosts
+	}
+	inGroup := map[string][]string{}
+	for _, g := range groups {
+		for _, h := range collect(g, map[string]bool{}) {
+			if len(inGroup[h]) == 0 || inGroup[h][len(inGroup[h])-1] != g {
+				inGroup[h] = append(inGroup[h], g)
+			}
+		}
+	}
+
+	var hosts []Host
+	for _, name := range order {
+		vars := mergeVars(nil, groupVars["all"])
+		var hostGroups []string
+		for _, g := range inGroup[name] {
+			if g != "all" && g != "ungrouped" {
+				hostGroups = append(hostGroups, g)
+			}
+			vars = mergeVars(vars, groupVars[g])
+		}
+		vars = mergeVars(vars, hostVars[name])
+
+		h := Host{Address: name, Groups: hostGroups, Region: vars["region"]}
+		for key, val := range vars {
+			switch key {
+			case "ansible_host", "ansible_ssh_host":
+				h.Address = val
+			case "ansible_user", "ansible_ssh_user":
+				h.User = val
+			case "ansible_ssh_private_key_file":
+				h.KeyPath = val
+			case "ansible_port", "ansible_ssh_port":
+				port, err := strconv.Atoi(val)
+				if err != nil {
+					return nil, fmt.Errorf("host %s: invalid port %q", name, val)
+				}
+				h.Port = port
+			default:
+				continue
+			}
+			delete(vars, key)
+		}
+		if len(vars) > 0 {
+			h.Vars = vars
+		}
+		hosts = append(hosts, h)
+	}
+	return hosts, nil
+}
+
+// mergeVars returns a copy of dst with src's variables added over it.
+func mergeVars(dst, src map[string]string) map[string]string {
+	if len(dst) == 0 && len(src) == 0 {
+		return nil
+	}
+	merged := make(map[string]string, len(dst)+len(src))
+	for k, v := range dst {
+		merged[k] = v
+	}
+	for k, v := range src {
+		merged[k] = v
+	}
+	return merged
+}
+
+// unquote strips matching single or double quotes around an INI value.
+func unquote(s string) string {
+	if len(s) >= 2 && (s[0] == '"' || s[0] == '\'') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,160 @@
+package binaryinstall
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseINIInventory(t *testing.T) {
+	ini := `
+# a comment
+; another comment
+bastion ansible_host=10.0.0.1
+
+[web]
+web1 ansible_user=ubuntu ansible_port=2222 region=us-east-1   # inline comment
+web2 ansible_host=10.0.0.12 datadir='/srv/b'
+
+[db]
+db1 ansible_ssh_private_key_file=~/.ssh/db.pem
+web1
+
+[db:vars]
+datadir = "/srv/db"
+env=staging
+
+[app:children]
+web
+db
+
+[app:vars]
+env=prod
+
+[all:vars]
+env=dev
+owner=root
+`
+	hosts, err := parseINIInventory([]byte(ini))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Host{
+		{Address: "10.0.0.1", Vars: map[string]string{"env": "dev", "owner": "root"}},
+		{Address: "web1", User: "ubuntu", Port: 2222, Groups: []string{"web", "db", "app"}, Region: "us-east-1",
+			Vars: map[string]string{"env": "prod", "owner": "root", "region": "us-east-1", "datadir": "/srv/db"}},
+		{Address: "10.0.0.12", Groups: []string{"web", "app"},
+			Vars: map[string]string{"env": "prod", "owner": "root", "datadir": "/srv/b"}},
+		{Address: "db1", KeyPath: "~/.ssh/db.pem", Groups: []string{"db", "app"},
+			Vars: map[string]string{"env": "prod", "owner": "root", "datadir": "/srv/db"}},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("parsed\n%+v\nwant\n%+v", hosts, want)
+	}
+}
+
+func TestParseINIInventoryMalformed(t *testing.T) {
+	for _, ini := range []string{
+		"[web:hosts]\nweb1",
+		"[web\nweb1",
+		"[]\nweb1",
+		"[:vars]\nenv=prod",
+		"[web:vars]\nenv",
+		"web1 ansible_port",
+		"web1 =value",
+		"web1 ansible_port=ssh",
+	} {
+		if hosts, err := parseINIInventory([]byte(ini)); err == nil {
+			t.Errorf("parsed %q as %+v, want an error", ini, hosts)
+		}
+	}
+}
+
+func TestParseINIInventoryNestedCycle(t *testing.T) {
+	ini := "[a:children]\nb\n[b:children]\na\n[b]\nhost1\n"
+	hosts, err := parseINIInventory([]byte(ini))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(hosts) != 1 || !reflect.DeepEqual(hosts[0].Groups, []string{"a", "b"}) {
+		t.Errorf("parsed %+v, want host1 in a and b", hosts)
+	}
+}
+
+func TestParseYAMLInventory(t *testing.T) {
+	yml := `
+vars:
+  env: prod
+  owner: root
+hosts:
+  - host: web1.example.com
+    user: ubuntu
+    key: ~/.ssh/web.pem
+    groups: [web]
+    region: us-east-1
+  - host: worker1.example.com
+    port: 2222
+    groups: [workers, web]
+    vars:
+      datadir: /srv/a
+groups:
+  web:
+    vars:
+      env: staging
+  workers:
+    vars:
+      datadir: /srv/w
+      queue: jobs
+`
+	hosts, err := parseYAMLInventory([]byte(yml))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Host{
+		{Address: "web1.example.com", User: "ubuntu", KeyPath: "~/.ssh/web.pem", Groups: []string{"web"}, Region: "us-east-1",
+			Vars: map[string]string{"env": "staging", "owner": "root"}},
+		{Address: "worker1.example.com", Port: 2222, Groups: []string{"workers", "web"},
+			Vars: map[string]string{"env": "staging", "owner": "root", "datadir": "/srv/a", "queue": "jobs"}},
+	}
+	if !reflect.DeepEqual(hosts, want) {
+		t.Errorf("parsed\n%+v\nwant\n%+v", hosts, want)
+	}
+
+	for _, bad := range []string{
+		"hosts:\n  - user: ubuntu\n",
+		"hosts:\n  - host: web1\n    port: ssh\n",
+		"hosts: [",
+	} {
+		if hosts, err := parseYAMLInventory([]byte(bad)); err == nil {
+			t.Errorf("parsed %q as %+v, want an error", bad, hosts)
+		}
+	}
+}
+
+func TestLoadInventoryFormat(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"hosts.ini":  "[web]\nweb1\n",
+		"hosts":      "[web]\nweb1\n",
+		"hosts.yaml": "hosts:\n  - host: web1\n    groups: [web]\n",
+		"hosts.json": `{"hosts": [{"host": "web1", "groups": ["web"]}]}`,
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		hosts, err := LoadInventory(p)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if want := []Host{{Address: "web1", Groups: []string{"web"}}}; !reflect.DeepEqual(hosts, want) {
+			t.Errorf("%s: parsed %+v, want %+v", name, hosts, want)
+		}
+	}
+	if _, err := LoadInventory(filepath.Join(dir, "missing.ini")); err == nil || !strings.Contains(err.Error(), "failed to read inventory") {
+		t.Errorf("loading a missing inventory: %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+var plistTemplate = template.Must(template.New("plist").Funcs(template.FuncMap{"xml": xmlEscape}).Parse(`<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>{{ xml .Label }}</string>
+	<key>ProgramArguments</key>
+	<array>
+	{{- range .Args }}
+		<string>{{ xml . }}</string>
+	{{- end }}
+	</array>
+	{{- if .User }}
+	<key>UserName</key>
+	<string>{{ xml .User }}</string>
+	{{- end }}
+	{{- if .Group }}
+	<key>GroupName</key>
+	<string>{{ xml .Group }}</string>
+	{{- end }}
+	{{- if .WorkingDirectory }}
+	<key>WorkingDirectory</key>
+	<string>{{ xml .WorkingDirectory }}</string>
+	{{- end }}
+	{{- if .Environment }}
+	<key>EnvironmentVariables</key>
+	<dict>
+	{{- range .Environment }}
+		<key>{{ xml .Name }}</key>
+		<string>{{ xml .Value }}</string>
+	{{- end }}
+	</dict>
+	{{- end }}
+	<key>RunAtLoad</key>
+	<true/>
+	{{- if eq .Restart "always" }}
+	<key>KeepAlive</key>
+	<true/>
+	{{- else if ne .Restart "no" }}
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+	{{- end }}
+	{{- if .ThrottleInterval }}
+	<key>ThrottleInterval</key>
+	<integer>{{ .ThrottleInterval }}</integer>
+	{{- end }}
+</dict>
+</plist>
+`))
+
+// renderPlist returns upload's Systemd unit as a launchd job for macOS,
+// labelled with the unit's name. ExecStart is split on spaces into the
+// program's arguments; Restart "always" keeps the job alive, and anything
+// but "no" restarts it when it fails. An EnvironmentFile, which launchd
+// lacks, is sourced by a shell wrapped around the program. It expects
+// renderUnit to have validated the unit.
+func renderPlist(upload BinaryUpload, binaryName string) (string, error) {
+	unit := *upload.Systemd
+	command, err := execStart(upload, binaryName)
+	if err != nil {
+		return "", err
+	}
+	data := struct {
+		Label, User, Group, WorkingDirectory, Restart string
+		Args                                          []string
+		Environment                                   []struct{ Name, Value string }
+		ThrottleInterval                              int
+	}{
+		Label:            strings.TrimSuffix(unit.Name, ".service"),
+		User:             unit.User,
+		Group:            unit.Group,
+		WorkingDirectory: unit.WorkingDirectory,
+		Restart:          unit.Restart,
+		Args:             strings.Fields(command),
+	}
+	if data.Label == "" {
+		data.Label = binaryName
+	}
+	if data.Restart == "" {
+		data.Restart = "on-failure"
+	}
+	if unit.RestartSec > 0 {
+		data.ThrottleInterval = seconds(unit.RestartSec)
+	}
+	if file := unit.EnvironmentFile; file != "" {
+		source := ". " + shellQuote(file)
+		if optional := strings.TrimPrefix(file, "-"); optional != file {
+			source = "[ ! -f " + shellQuote(optional) + " ] || . " + shellQuote(optional)
+		}
+		data.Args = append([]string{"/bin/sh", "-c", "set -a; " + source + `; exec "$0" "$@"`}, data.Args...)
+	}
+	for k, v := range unit.Environment {
+		data.Environment = append(data.Environment, struct{ Name, Value string }{k, v})
+	}
+	sort.Slice(data.Environment, func(i, j int) bool { return data.Environment[i].Name < data.Environment[j].Name })
+
+	var buf bytes.Buffer
+	if err := plistTemplate.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to render launchd job: %w", err)
+	}
+	return buf.String(), nil
+}
+
+// xmlEscape escapes s for XML character data.
+func xmlEscape(s string) string {
+	var buf strings.Builder
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
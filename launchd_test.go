@@ -0,0 +1,129 @@
+package binaryinstall
+
+import (
+	"encoding/xml"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderPlist(t *testing.T) {
+	upload := BinaryUpload{DestinationDir: "/usr/local/bin", Vars: map[string]string{"port": "8080"}}
+
+	t.Run("defaults", func(t *testing.T) {
+		upload := upload
+		upload.Systemd = &SystemdUnit{}
+		plist, err := renderPlist(upload, "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>api</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>/usr/local/bin/api</string>
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+</dict>
+</plist>
+`
+		if plist != want {
+			t.Errorf("renderPlist() =\n%s\nwant\n%s", plist, want)
+		}
+	})
+
+	t.Run("everything", func(t *testing.T) {
+		upload := upload
+		upload.Systemd = &SystemdUnit{
+			Name:             "com.example.api.service",
+			ExecStart:        "{{.path}} serve --port {{.port}}",
+			User:             "_api",
+			Group:            "staff",
+			WorkingDirectory: "/var/lib/api",
+			Environment:      map[string]string{"TOKEN": "a<b>&c", "MODE": "prod"},
+			EnvironmentFile:  "-/etc/api.env",
+			Restart:          "always",
+			RestartSec:       1500 * time.Millisecond,
+		}
+		plist, err := renderPlist(upload, "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, want := range []string{
+			"<key>Label</key>\n\t<string>com.example.api</string>",
+			"<string>/bin/sh</string>\n\t\t<string>-c</string>\n\t\t<string>set -a; [ ! -f &#39;/etc/api.env&#39; ] || . &#39;/etc/api.env&#39;; exec &#34;$0&#34; &#34;$@&#34;</string>\n" +
+				"\t\t<string>/usr/local/bin/api</string>\n\t\t<string>serve</string>\n\t\t<string>--port</string>\n\t\t<string>8080</string>\n\t</array>",
+			"<key>UserName</key>\n\t<string>_api</string>\n\t<key>GroupName</key>\n\t<string>staff</string>",
+			"<key>WorkingDirectory</key>\n\t<string>/var/lib/api</string>",
+			"<key>MODE</key>\n\t\t<string>prod</string>\n\t\t<key>TOKEN</key>\n\t\t<string>a&lt;b&gt;&amp;c</string>",
+			"<key>KeepAlive</key>\n\t<true/>",
+			"<key>ThrottleInterval</key>\n\t<integer>2</integer>",
+		} {
+			if !strings.Contains(plist, want) {
+				t.Errorf("plist lacks %q:\n%s", want, plist)
+			}
+		}
+		if err := xml.Unmarshal([]byte(plist), new(struct{})); err != nil {
+			t.Errorf("plist is not well-formed XML: %v", err)
+		}
+	})
+
+	t.Run("never restarted", func(t *testing.T) {
+		upload := upload
+		upload.Systemd = &SystemdUnit{Restart: "no"}
+		plist, err := renderPlist(upload, "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(plist, "KeepAlive") {
+			t.Errorf("plist keeps the job alive:\n%s", plist)
+		}
+	})
+}
+
+func TestLaunchdServices(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	stubCommand(t, "uname", `echo Darwin`)
+	// Jobs named running* are running
+	args := stubCommand(t, "launchctl", `echo "$*" >> "$0.calls"
+case $1 in print) case $2 in system/running*) echo "state = running" ;; esac ;; esac`)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "tool_Darwin_arm64.tar.gz")
+	writeArchive(t, archive, file("tool"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup")}
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755",
+		StopService: "running-tool", RestartService: "running-other"}
+	if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+		t.Fatal(err)
+	}
+	calls, err := os.ReadFile(filepath.Join(filepath.Dir(args), "launchctl.calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `print system/running-tool
+bootout system/running-tool
+bootstrap system /Library/LaunchDaemons/running-tool.plist
+print system/running-tool
+kickstart -k system/running-other
+print system/running-other
+`
+	if string(calls) != want {
+		t.Errorf("launchctl called with\n%s\nwant\n%s", calls, want)
+	}
+}
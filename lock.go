@@ -0,0 +1,176 @@
+package binaryinstall
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultLockPath is where the deploy lock is kept on each host unless
+// LockPath is set.
+const DefaultLockPath = "/tmp/binaryinstall.lock"
+
+// lockHeld marks the output of lockScript when another run holds the lock.
+const lockHeld = "binaryinstall-lock-held:"
+
+// lockScript takes the lock directory $LOCK for $OWNER until $EXPIRES (Unix
+// seconds). mkdir is atomic, so only one run can create it. A lock whose
+// expiry has passed, or that never got its info file within a minute, is
+// moved aside (also atomic, so only one run breaks it) and taken over.
+const lockScript = `
+take() {
+    mkdir "$LOCK" 2>/dev/null || return 1
+    printf 'owner=%s\nexpires=%s\n' "$OWNER" "$EXPIRES" > "$LOCK/info"
+}
+if take; then
+    exit 0
+fi
+expires=$(sed -n 's/^expires=//p' "$LOCK/info" 2>/dev/null)
+stale=
+if [ -n "$expires" ]; then
+    [ "$(date +%s)" -ge "$expires" ] && stale=1
+elif [ -n "$(find "$LOCK" -maxdepth 0 -mmin +1 2>/dev/null)" ]; then
+    stale=1
+fi
+if [ -n "$stale" ] && mv "$LOCK" "$LOCK.stale.$$" 2>/dev/null; then
+    echo "breaking stale lock: $(sed -n 's/^owner=//p' "$LOCK.stale.$$/info" 2>/dev/null)"
+    rm -rf "$LOCK.stale.$$"
+    take && exit 0
+fi
+echo "` + lockHeld + ` $(sed -n 's/^owner=//p' "$LOCK/info" 2>/dev/null)"
+exit 75
+`
+
+// unlockScript removes $LOCK if $OWNER still holds it, so a lock broken
+// and retaken by another run is left alone.
+const unlockScript = `
+if [ "$(sed -n 's/^owner=//p' "$LOCK/info" 2>/dev/null)" = "$OWNER" ]; then
+    rm -rf "$LOCK"
+fi
+`
+
+// renewScript pushes back the expiry of $LOCK to $EXPIRES if $OWNER still
+// holds it. The info file is replaced with a rename, so other runs never
+// read it half written.
+const renewScript = `
+if [ "$(sed -n 's/^owner=//p' "$LOCK/info" 2>/dev/null)" != "$OWNER" ]; then
+    echo "` + lockHeld + ` $(sed -n 's/^owner=//p' "$LOCK/info" 2>/dev/null)"
+    exit 75
+fi
+printf 'owner=%s\nexpires=%s\n' "$OWNER" "$EXPIRES" > "$LOCK/info.$$"
+mv -f "$LOCK/info.$$" "$LOCK/info"
+`
+
+// deployLock is a deploy lock held on a host, renewed until it is released.
+type deployLock struct {
+	stop, stopped chan struct{}
+	release       func()
+
+	mu   sync.Mutex
+	lost error // set once renewing finds another run holding the lock
+}
+
+// Err returns an error once another run has taken the lock over, after
+// which installs must stop.
+func (l *deployLock) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.lost
+}
+
+// Release stops renewing the lock and removes it if this run still holds
+// it. It returns Err, so an install that lost its lock fails.
+func (l *deployLock) Release() error {
+	close(l.stop)
+	<-l.stopped
+	l.release()
+	return l.Err()
+}
+
+// acquireLock takes the deploy lock on the host of transport, retrying for
+// up to config.LockWait while another run holds it. Until it is released,
+// the lock's expiry is pushed back every third of LockTTL, so an install
+// outliving LockTTL keeps it; only a run that died leaves a lock others may
+// break. Should another run take it over anyway, renewal stops and the
+// lock's Err reports it.
+func acquireLock(config BinaryInstallConfig, transport Transport) (*deployLock, error) {
+	if kind, _ := transportKind(config); kind == TransportWinRM {
+		return nil, fmt.Errorf("the deploy lock is not supported on Windows hosts")
+	}
+	path := config.LockPath
+	if path == "" {
+		path = DefaultLockPath
+	}
+	ttl := config.LockTTL
+	if ttl <= 0 {
+		ttl = 15 * time.Minute
+	}
+	owner := lockOwner()
+	vars := "LOCK=" + shellQuote(path) + " OWNER=" + shellQuote(owner)
+
+	deadline := time.Now().Add(config.LockWait)
+	for {
+		expires := time.Now().Add(ttl).Unix()
+		out, err := runScript(config, transport, fmt.Sprintf("%s EXPIRES=%d; %s", vars, expires, lockScript))
+		if err == nil {
+			if config.Verbose {
+				log.Printf("Took the deploy lock %s on %s", path, config.RemoteHost)
+			}
+			lock := &deployLock{
+				stop:    make(chan struct{}),
+				stopped: make(chan struct{}),
+				release: func() { runScript(config, transport, vars+"; "+unlockScript) },
+			}
+			go func() {
+				defer close(lock.stopped)
+				ticker := time.NewTicker(max(ttl/3, time.Second))
+				defer ticker.Stop()
+				for {
+					select {
+					case <-lock.stop:
+						return
+					case <-ticker.C:
+					}
+					expires := time.Now().Add(ttl).Unix()
+					out, err := runScript(config, transport, fmt.Sprintf("%s EXPIRES=%d; %s", vars, expires, renewScript))
+					if _, holder, held := strings.Cut(out, lockHeld); held {
+						lock.mu.Lock()
+						lock.lost = fmt.Errorf("deploy lock %s on %s was taken over by %s", path, config.RemoteHost, strings.TrimSpace(holder))
+						lock.mu.Unlock()
+						return
+					}
+					if err != nil && config.Verbose {
+						log.Printf("Failed to renew the deploy lock %s on %s: %v", path, config.RemoteHost, err)
+					}
+				}
+			}()
+			return lock, nil
+		}
+		_, holder, held := strings.Cut(out, lockHeld)
+		if !held {
+			return nil, fmt.Errorf("failed to take the deploy lock: %w", err)
+		}
+		holder = strings.TrimSpace(holder)
+		if !time.Now().Before(deadline) {
+			return nil, fmt.Errorf("deploy lock %s is held by %s", path, holder)
+		}
+		if config.Verbose {
+			log.Printf("Deploy lock on %s is held by %s; waiting", config.RemoteHost, holder)
+		}
+		time.Sleep(min(10*time.Second, time.Until(deadline)))
+	}
+}
+
+// lockOwner identifies this run in the lock, for other runs' error messages.
+func lockOwner() string {
+	host, _ := os.Hostname()
+	name := "unknown"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+	return fmt.Sprintf("%s@%s pid %d since %s", name, host, os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+}
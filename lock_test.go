@@ -0,0 +1,129 @@
+package binaryinstall
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// lockInfo reads the field named key from the info of the lock at path.
+func lockInfo(t *testing.T, path, key string) string {
+	t.Helper()
+	info, err := os.ReadFile(filepath.Join(path, "info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(string(info), "\n") {
+		if v, ok := strings.CutPrefix(line, key+"="); ok {
+			return v
+		}
+	}
+	t.Fatalf("no %s in lock info %q", key, info)
+	return ""
+}
+
+// lockExpiry reads the expiry recorded in the lock at path.
+func lockExpiry(t *testing.T, path string) int64 {
+	t.Helper()
+	expires, err := strconv.ParseInt(lockInfo(t, path, "expires"), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expires
+}
+
+func TestAcquireLockRenews(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the lock scripts need a POSIX shell")
+	}
+	path := filepath.Join(t.TempDir(), "binaryinstall.lock")
+	config := BinaryInstallConfig{RemoteHost: "local", LockPath: path, LockTTL: 3 * time.Second}
+
+	lock, err := acquireLock(config, shTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	taken := lockExpiry(t, path)
+
+	// Past its first expiry the lock is still held, and renewed
+	time.Sleep(3500 * time.Millisecond)
+	if renewed := lockExpiry(t, path); renewed <= taken {
+		t.Errorf("lock expiry %d not renewed past %d", renewed, taken)
+	}
+	if _, err := acquireLock(config, shTransport{}); err == nil || !strings.Contains(err.Error(), "is held by") {
+		t.Errorf("second run took a renewed lock: %v", err)
+	}
+
+	if err := lock.Release(); err != nil {
+		t.Errorf("Release() = %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("lock not released: %v", err)
+	}
+}
+
+func TestAcquireLockBreaksStale(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the lock scripts need a POSIX shell")
+	}
+	path := filepath.Join(t.TempDir(), "binaryinstall.lock")
+	if err := os.Mkdir(path, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	expired := time.Now().Add(-time.Minute).Unix()
+	if err := os.WriteFile(filepath.Join(path, "info"), []byte("owner=dead run\nexpires="+strconv.FormatInt(expired, 10)+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config := BinaryInstallConfig{RemoteHost: "local", LockPath: path, LockTTL: time.Minute}
+
+	lock, err := acquireLock(config, shTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if owner := lockInfo(t, path, "owner"); owner == "dead run" {
+		t.Errorf("stale lock not taken over")
+	}
+	if err := lock.Release(); err != nil {
+		t.Errorf("Release() = %v", err)
+	}
+}
+
+func TestAcquireLockTakenOver(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the lock scripts need a POSIX shell")
+	}
+	path := filepath.Join(t.TempDir(), "binaryinstall.lock")
+	config := BinaryInstallConfig{RemoteHost: "local", LockPath: path, LockTTL: 3 * time.Second}
+
+	lock, err := acquireLock(config, shTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Another run breaks the lock and takes it, as one that wrongly found
+	// it stale would
+	expires := time.Now().Add(time.Hour).Unix()
+	if err := os.WriteFile(filepath.Join(path, "info"), []byte("owner=other run\nexpires="+strconv.FormatInt(expires, 10)+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for lock.Err() == nil && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	if err := lock.Err(); err == nil || !strings.Contains(err.Error(), "was taken over by other run") {
+		t.Errorf("Err() = %v, want the lock taken over", err)
+	}
+	if err := lock.Release(); err == nil {
+		t.Errorf("Release() of a lost lock returned no error")
+	}
+	if owner := lockInfo(t, path, "owner"); owner != "other run" {
+		t.Errorf("releasing a lost lock changed its owner to %q", owner)
+	}
+	if got := lockExpiry(t, path); got != expires {
+		t.Errorf("the other run's lock expiry changed to %d", got)
+	}
+}
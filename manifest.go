@@ -0,0 +1,316 @@
+package binaryinstall
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// manifest is the file format read by LoadUploads. Keys match the CLI's
+// -upload keys; JSON manifests use the same names.
+type manifest struct {
+	Uploads []manifestUpload `yaml:"uploads"`
+}
+
+type manifestUpload struct {
+	Path           string            `yaml:"path"`
+	Local          string            `yaml:"local"`
+	Dist           string            `yaml:"dist"`
+	HostGroups     []string          `yaml:"hostgroups"`
+	URL            string            `yaml:"url"`
+	Headers        []string          `yaml:"headers"`
+	FetchLocal     bool              `yaml:"fetchlocal"`
+	Presign        bool              `yaml:"presign"`
+	Vars           map[string]string `yaml:"vars"`
+	User           string            `yaml:"user"`
+	Password       string            `yaml:"password"`
+	Token          string            `yaml:"token"`
+	ChecksumHeader string            `yaml:"checksumheader"`
+	SHA256         string            `yaml:"sha256"`
+	BinarySHA256   string            `yaml:"binarysha256"`
+	Checksums      string            `yaml:"checksums"`
+	MinisignKey    string            `yaml:"minisignkey"`
+	Minisig        string            `yaml:"minisig"`
+	SLSASource     string            `yaml:"slsasource"`
+	SLSABuilder    string            `yaml:"slsabuilder"`
+	Provenance     string            `yaml:"provenance"`
+	Dest           string            `yaml:"dest"`
+	Owner          string            `yaml:"owner"`
+	Perm           string            `yaml:"perm"`
+	Group          string            `yaml:"group"`
+	Setuid         bool              `yaml:"setuid"`
+	Setgid         bool              `yaml:"setgid"`
+	Sticky         bool              `yaml:"sticky"`
+	BindLowPorts   bool              `yaml:"bindlowports"`
+	Caps           []string          `yaml:"caps"`
+	NoSudo         bool              `yaml:"nosudo"`
+	All            bool              `yaml:"all"`
+	Member         string            `yaml:"member"`
+	Strip          int               `yaml:"strip"`
+	FixDeps        bool              `yaml:"fixdeps"`
+	APKKeys        string            `yaml:"apkkeys"`
+	Docs           bool              `yaml:"docs"`
+	Extract        bool              `yaml:"extract"`
+	Release        string            `yaml:"release"`
+	Reinstall      bool              `yaml:"reinstall"`
+	Files          []manifestFile    `yaml:"files"`
+	FileList       string            `yaml:"filelist"`
+	Systemd        *manifestSystemd  `yaml:"systemd"`
+	RestartService string            `yaml:"restartservice"`
+	StopService    string            `yaml:"stopservice"`
+	UserService    bool              `yaml:"userservice"`
+	ActiveTimeout  string            `yaml:"activetimeout"`
+	ReadyCommand   string            `yaml:"readycmd"`
+	ReloadOnly     bool              `yaml:"reloadonly"`
+	ReloadSignal   string            `yaml:"reloadsignal"`
+	PIDFile        string            `yaml:"pidfile"`
+	PreRestart     string            `yaml:"prerestart"`
+	PostRestart    string            `yaml:"postrestart"`
+	HookTimeout    string            `yaml:"hooktimeout"`
+	Health         *manifestHealth   `yaml:"health"`
+	Consul         *manifestConsul   `yaml:"consul"`
+	RestoreCon     bool              `yaml:"restorecon"`
+	SELinux        string            `yaml:"selinux"`
+}
+
+// manifestFile is one entry of an upload's files list.
+type manifestFile struct {
+	Source string `yaml:"source"`
+	Dest   string `yaml:"dest"`
+	Perm   string `yaml:"perm"`
+	Owner  string `yaml:"owner"`
+	Group  string `yaml:"group"`
+	Keep   bool   `yaml:"keep"`
+}
+
+// manifestSystemd is an upload's systemd unit.
+type manifestSystemd struct {
+	Name        string            `yaml:"name"`
+	Description string            `yaml:"description"`
+	Exec        string            `yaml:"exec"`
+	User        string            `yaml:"user"`
+	Group       string            `yaml:"group"`
+	WorkDir     string            `yaml:"workdir"`
+	Env         map[string]string `yaml:"env"`
+	EnvFile     string            `yaml:"envfile"`
+	Restart     string            `yaml:"restart"`
+	RestartSec  string            `yaml:"restartsec"`
+	After       []string          `yaml:"after"`
+	WantedBy    string            `yaml:"wantedby"`
+	Listen      []string          `yaml:"listen"`
+}
+
+// manifestHealth is an upload's health check.
+type manifestHealth struct {
+	URL      string `yaml:"url"`
+	Status   int    `yaml:"status"`
+	Command  string `yaml:"command"`
+	Timeout  string `yaml:"timeout"`
+	Retries  int    `yaml:"retries"`
+	Interval string `yaml:"interval"`
+}
+
+// manifestConsul is an upload's Consul service.
+type manifestConsul struct {
+	Name       string            `yaml:"name"`
+	ID         string            `yaml:"id"`
+	Port       int               `yaml:"port"`
+	Address    string            `yaml:"address"`
+	Tags       []string          `yaml:"tags"`
+	Meta       map[string]string `yaml:"meta"`
+	Agent      string            `yaml:"agent"`
+	TokenFile  string            `yaml:"tokenfile"`
+	Interval   string            `yaml:"interval"`
+	Deregister string            `yaml:"deregister"`
+}
+
+// LoadUploads reads a YAML or JSON manifest describing a set of uploads, e.g.
+//
+//	uploads:
+//	  - local: dist/llmfs_Linux_x86_64.tar.gz
+//	    dest: /usr/local/bin
+//	    owner: root
+//	    perm: "0755"
+//	    bindlowports: true
+//
+// Relative local, dist and checksums paths are resolved against the manifest's directory, and
+// $VARS in headers and credentials are expanded from the environment so
+// secrets need not be checked in.
+func LoadUploads(path string) ([]BinaryUpload, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := yaml.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("failed to parse upload manifest %s: %w", path, err)
+	}
+
+	uploads := make([]BinaryUpload, 0, len(m.Uploads))
+	for i, mu := range m.Uploads {
+		if mu.Path == "" && mu.Local == "" && mu.URL == "" && mu.Dist == "" {
+			return nil, fmt.Errorf("upload %d in %s needs a path, local archive, dist directory, or url", i+1, path)
+		}
+		local, dist, checksums := mu.Local, mu.Dist, mu.Checksums
+		if local != "" && !filepath.IsAbs(local) {
+			local = filepath.Join(filepath.Dir(path), local)
+		}
+		if dist != "" && !filepath.IsAbs(dist) {
+			dist = filepath.Join(filepath.Dir(path), dist)
+		}
+		if checksums != "" && !strings.Contains(checksums, "://") && !filepath.IsAbs(checksums) {
+			checksums = filepath.Join(filepath.Dir(path), checksums)
+		}
+		var files []ArchiveFile
+		for _, f := range mu.Files {
+			files = append(files, ArchiveFile{
+				Source:       f.Source,
+				Destination:  f.Dest,
+				Permission:   f.Perm,
+				Owner:        f.Owner,
+				Group:        f.Group,
+				KeepExisting: f.Keep,
+			})
+		}
+		var unit *SystemdUnit
+		if s := mu.Systemd; s != nil {
+			unit = &SystemdUnit{
+				Name:             s.Name,
+				Description:      s.Description,
+				ExecStart:        s.Exec,
+				User:             s.User,
+				Group:            s.Group,
+				WorkingDirectory: s.WorkDir,
+				Environment:      s.Env,
+				EnvironmentFile:  s.EnvFile,
+				Restart:          s.Restart,
+				After:            s.After,
+				WantedBy:         s.WantedBy,
+				Listen:           s.Listen,
+			}
+			if s.RestartSec != "" {
+				if unit.RestartSec, err = time.ParseDuration(s.RestartSec); err != nil {
+					return nil, fmt.Errorf("upload %d in %s: invalid restartsec: %w", i+1, path, err)
+				}
+			}
+		}
+		var activeTimeout time.Duration
+		if mu.ActiveTimeout != "" {
+			if activeTimeout, err = time.ParseDuration(mu.ActiveTimeout); err != nil {
+				return nil, fmt.Errorf("upload %d in %s: invalid activetimeout: %w", i+1, path, err)
+			}
+		}
+		var hookTimeout time.Duration
+		if mu.HookTimeout != "" {
+			if hookTimeout, err = time.ParseDuration(mu.HookTimeout); err != nil {
+				return nil, fmt.Errorf("upload %d in %s: invalid hooktimeout: %w", i+1, path, err)
+			}
+		}
+		var health *HealthCheck
+		if h := mu.Health; h != nil {
+			health = &HealthCheck{URL: h.URL, Status: h.Status, Command: h.Command, Retries: h.Retries}
+			if h.Timeout != "" {
+				if health.Timeout, err = time.ParseDuration(h.Timeout); err != nil {
+					return nil, fmt.Errorf("upload %d in %s: invalid health timeout: %w", i+1, path, err)
+				}
+			}
+			if h.Interval != "" {
+				if health.Interval, err = time.ParseDuration(h.Interval); err != nil {
+					return nil, fmt.Errorf("upload %d in %s: invalid health interval: %w", i+1, path, err)
+				}
+			}
+		}
+		var consul *ConsulService
+		if c := mu.Consul; c != nil {
+			consul = &ConsulService{
+				Name:      c.Name,
+				ID:        c.ID,
+				Port:      c.Port,
+				Address:   c.Address,
+				Tags:      c.Tags,
+				Meta:      c.Meta,
+				Agent:     c.Agent,
+				TokenFile: c.TokenFile,
+			}
+			if c.Interval != "" {
+				if consul.CheckInterval, err = time.ParseDuration(c.Interval); err != nil {
+					return nil, fmt.Errorf("upload %d in %s: invalid consul interval: %w", i+1, path, err)
+				}
+			}
+			if c.Deregister != "" {
+				if consul.DeregisterAfter, err = time.ParseDuration(c.Deregister); err != nil {
+					return nil, fmt.Errorf("upload %d in %s: invalid consul deregister: %w", i+1, path, err)
+				}
+			}
+		}
+		var headers []string
+		for _, h := range mu.Headers {
+			headers = append(headers, os.ExpandEnv(h))
+		}
+		uploads = append(uploads, BinaryUpload{
+			Path:              mu.Path,
+			LocalPath:         local,
+			Dist:              dist,
+			HostGroups:        mu.HostGroups,
+			URL:               mu.URL,
+			Headers:           headers,
+			FetchLocal:        mu.FetchLocal,
+			Presign:           mu.Presign,
+			DestinationDir:    mu.Dest,
+			Owner:             mu.Owner,
+			Permission:        mu.Perm,
+			Group:             mu.Group,
+			Setuid:            mu.Setuid,
+			Setgid:            mu.Setgid,
+			Sticky:            mu.Sticky,
+			BindLowPorts:      mu.BindLowPorts,
+			Capabilities:      mu.Caps,
+			NoSudo:            mu.NoSudo,
+			InstallAll:        mu.All,
+			ArchivePath:       mu.Member,
+			StripComponents:   mu.Strip,
+			FixDependencies:   mu.FixDeps,
+			APKKeysDir:        mu.APKKeys,
+			InstallDocs:       mu.Docs,
+			ExtractAll:        mu.Extract,
+			Release:           mu.Release,
+			Reinstall:         mu.Reinstall,
+			Files:             files,
+			FilesManifest:     mu.FileList,
+			Systemd:           unit,
+			RestartService:    mu.RestartService,
+			StopService:       mu.StopService,
+			UserService:       mu.UserService,
+			ActiveTimeout:     activeTimeout,
+			ReadyCommand:      mu.ReadyCommand,
+			ReloadOnly:        mu.ReloadOnly,
+			ReloadSignal:      mu.ReloadSignal,
+			PIDFile:           mu.PIDFile,
+			PreRestart:        mu.PreRestart,
+			PostRestart:       mu.PostRestart,
+			HookTimeout:       hookTimeout,
+			HealthCheck:       health,
+			Consul:            consul,
+			SELinuxRestore:    mu.RestoreCon,
+			SELinuxContext:    mu.SELinux,
+			Vars:              mu.Vars,
+			BasicAuthUser:     os.ExpandEnv(mu.User),
+			BasicAuthPassword: os.ExpandEnv(mu.Password),
+			BearerToken:       os.ExpandEnv(mu.Token),
+			ChecksumHeader:    mu.ChecksumHeader,
+			SHA256:            mu.SHA256,
+			BinarySHA256:      mu.BinarySHA256,
+			Checksums:         checksums,
+			MinisignPublicKey: mu.MinisignKey,
+			MinisignSignature: mu.Minisig,
+			SLSASourceURI:     mu.SLSASource,
+			SLSABuilderID:     mu.SLSABuilder,
+			SLSAProvenance:    mu.Provenance,
+		})
+	}
+	return uploads, nil
+}
@@ -0,0 +1,84 @@
+package binaryinstall
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadUploads(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "uploads.yaml")
+	t.Setenv("ARTIFACT_TOKEN", "s3cret")
+	t.Setenv("ARTIFACT_PASSWORD", "pa$$")
+	if err := os.WriteFile(path, []byte(`
+uploads:
+  - local: dist/app_Linux_x86_64.tar.gz
+    dest: /usr/local/bin
+    owner: root
+    perm: "0755"
+    bindlowports: true
+  - url: https://example.com/{{.version}}/tool.tar.gz
+    vars: {version: 1.2.3}
+    headers: ["Authorization: Bearer ${ARTIFACT_TOKEN}"]
+    user: ci
+    password: $ARTIFACT_PASSWORD
+    checksumheader: X-Checksum-Sha256
+    dest: /opt/bin
+  - local: /srv/dist/tool.tar.gz
+    dest: /opt/bin
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	uploads, err := LoadUploads(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(uploads) != 3 {
+		t.Fatalf("loaded %d uploads, want 3", len(uploads))
+	}
+
+	u := uploads[0]
+	if u.LocalPath != filepath.Join(dir, "dist/app_Linux_x86_64.tar.gz") {
+		t.Errorf("relative path not resolved against the manifest: %q", u.LocalPath)
+	}
+	if u.DestinationDir != "/usr/local/bin" || u.Owner != "root" || u.Permission != "0755" || !u.BindLowPorts {
+		t.Errorf("first upload: %+v", u)
+	}
+
+	u = uploads[1]
+	if !reflect.DeepEqual(u.Headers, []string{"Authorization: Bearer s3cret"}) || u.BasicAuthUser != "ci" || u.BasicAuthPassword != "pa$$" {
+		t.Errorf("credentials not expanded: %q, %q, %q", u.Headers, u.BasicAuthUser, u.BasicAuthPassword)
+	}
+	if u.URL != "https://example.com/{{.version}}/tool.tar.gz" || u.Vars["version"] != "1.2.3" || u.ChecksumHeader != "X-Checksum-Sha256" {
+		t.Errorf("second upload: %+v", u)
+	}
+
+	if u = uploads[2]; u.LocalPath != "/srv/dist/tool.tar.gz" {
+		t.Errorf("absolute path changed to %q", u.LocalPath)
+	}
+}
+
+func TestLoadUploadsInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		manifest, wantErr string
+	}{
+		{"uploads:\n  - dest: /usr/local/bin\n", "needs a path"},
+		{"uploads:\n  - local: a.tar.gz\n    bindlowports: maybe\n", "failed to parse"},
+		{"uploads: [", "failed to parse"},
+		{"uploads:\n  - local: a.tar.gz\n    systemd:\n      restartsec: soon\n", "invalid restartsec"},
+	} {
+		path := filepath.Join(t.TempDir(), "uploads.yaml")
+		if err := os.WriteFile(path, []byte(tt.manifest), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadUploads(path); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("loading %q: %v, want an error containing %q", tt.manifest, err, tt.wantErr)
+		}
+	}
+	if _, err := LoadUploads(filepath.Join(t.TempDir(), "missing.yaml")); err == nil {
+		t.Errorf("loading a missing manifest succeeded")
+	}
+}
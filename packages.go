@@ -0,0 +1,134 @@
+package binaryinstall
+
+import (
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Package formats installed with the system package manager instead of
+// extracting a binary, selected by the artifact's extension.
+const (
+	PackageDeb = "deb"
+	PackageRPM = "rpm"
+	PackageAPK = "apk"
+)
+
+// packageKind returns the package format of the artifact file name, or ""
+// for a tar archive.
+func packageKind(name string) string {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".deb":
+		return PackageDeb
+	case ".rpm":
+		return PackageRPM
+	case ".apk":
+		return PackageAPK
+	}
+	return ""
+}
+
+// packageTemplate installs a system package rather than a binary from an
+// archive. It shares the fetch, checksum and audit steps of scriptTemplate.
+var packageTemplate = template.Must(template.Must(scriptTemplate.Clone()).New("package").Parse(`
+{{ template "prelude" . }}
+
+# 2) Note the version being replaced, so it can be reinstalled later
+previous=
+{{ if eq .Package "apk" }}
+# Print the installed version of an Alpine package, if any
+apk_version() {
+    awk -v p="P:$1" '$0 == p { f = 1 } f && /^V:/ { print substr($0, 3); exit } /^$/ { f = 0 }' /lib/apk/db/installed
+}
+PKG=$(tar -xzOf "$UPLOAD_PATH" .PKGINFO 2>/dev/null | sed -n 's/^pkgname = //p')
+previous=$(apk_version "$PKG")
+{{ else if eq .Package "rpm" }}
+PKG=$(rpm -qp --qf '%{NAME}' "$UPLOAD_PATH")
+if rpm -q "$PKG" >/dev/null 2>&1; then
+    previous=$(rpm -q --qf '%{VERSION}-%{RELEASE}' "$PKG")
+fi
+{{ else }}
+PKG=$(dpkg-deb -f "$UPLOAD_PATH" Package)
+previous=$(dpkg-query -W -f='${Version}' "$PKG" 2>/dev/null || true)
+{{ end }}
+if [ -n "$previous" ]; then
+    mkdir -p "$BACKUP_DIR"
+    echo "$previous" > "$BACKUP_DIR/$PKG.previous-version"
+    echo "replacing $PKG $previous"
+fi
+
+# 3) Install the package
+{{ if eq .Package "apk" }}
+{{ if .APKKeysDir }}
+as_root apk add --keys-dir {{ q .APKKeysDir }} "$UPLOAD_PATH"
+{{ else }}
+as_root apk add --allow-untrusted "$UPLOAD_PATH"
+{{ end }}
+VERSION=$(apk_version "$PKG")
+{{ else if eq .Package "rpm" }}
+{{ if .FixDependencies }}
+# dnf (or yum) resolves missing dependencies from the configured repositories
+if command -v dnf >/dev/null 2>&1; then
+    as_root dnf install -y "$UPLOAD_PATH"
+else
+    as_root yum install -y "$UPLOAD_PATH"
+fi
+{{ else }}
+as_root rpm -Uvh "$UPLOAD_PATH"
+{{ end }}
+VERSION=$(rpm -q --qf '%{VERSION}-%{RELEASE}' "$PKG")
+{{ else }}
+{{ if .FixDependencies }}
+if ! as_root dpkg -i "$UPLOAD_PATH"; then
+    # Pull in missing dependencies, which also finishes configuring the package
+    as_root env DEBIAN_FRONTEND=noninteractive apt-get -f install -y
+fi
+{{ else }}
+as_root dpkg -i "$UPLOAD_PATH"
+{{ end }}
+VERSION=$(dpkg-query -W -f='${Version}' "$PKG")
+{{ end }}
+echo "installed $PKG $VERSION"
+
+{{ if .AuditLog }}
+# 4) Record the install in the audit log
+INSTALLED="package=$PKG version=$VERSION"
+INSTALLED_FILE=$UPLOAD_PATH
+{{ template "audit" . }}
+{{ end }}
+
+{{ if .RestartService }}
+# 4a) Restart the service running the package's binary
+{{ template "restart" . }}
+{{ end }}
+
+{{ if .Health }}
+# 4b) Check the new version is healthy
+{{ template "health" . }}
+{{ end }}
+
+{{ if .PostRestart }}
+# 4c) Run the post-restart hook
+run_hook post-restart {{ q .PostRestart }}
+{{ end }}
+
+{{ if .Consul }}
+# 4d) Register the service with Consul
+{{ template "consul" . }}
+{{ end }}
+
+{{ if or .BackupKeep .BackupCutoff .BackupMaxKB }}
+# 4e) Prune old backups
+{{ template "prune" . }}
+{{ end }}
+
+{{ if .HostManifest }}
+# 4f) Record the package in the host manifest
+{{ template "manifest" . }}
+manifest_package "$PKG" "$VERSION" "$( (sha256sum "$UPLOAD_PATH" 2>/dev/null || shasum -a 256 "$UPLOAD_PATH") | cut -d' ' -f1)"
+write_manifest
+{{ end }}
+
+# 5) Remove the temporary directory
+rm -rf "$TEMP_DIR"
+`))
@@ -0,0 +1,222 @@
+package binaryinstall
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Defaults for BinaryInstallConfig.RetryBackoff and RetryMaxBackoff.
+const (
+	defaultRetryBackoff    = time.Second
+	defaultRetryMaxBackoff = 30 * time.Second
+)
+
+// withRetry calls fn until it succeeds, fails with a non-retryable error, or
+// config.RetryAttempts retries are used up, backing off exponentially between calls.
+func withRetry(config BinaryInstallConfig, what string, fn func() error) error {
+	backoff := config.RetryBackoff
+	if backoff <= 0 {
+		backoff = defaultRetryBackoff
+	}
+	maxBackoff := config.RetryMaxBackoff
+	if maxBackoff <= 0 {
+		maxBackoff = defaultRetryMaxBackoff
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= config.RetryAttempts || !isRetryable(err) {
+			return err
+		}
+		if config.Verbose {
+			log.Printf("%s failed (attempt %d of %d), retrying in %s: %v",
+				what, attempt+1, config.RetryAttempts+1, backoff, err)
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// isRetryable reports whether err looks like a transient connection problem
+// rather than an authentication failure or a failing remote command.
+func isRetryable(err error) bool {
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return false
+	}
+
+	var sshErr *SSHError
+	if errors.As(err, &sshErr) && sshErr.Op == "auth" {
+		return false
+	}
+
+	var exitMissing *ssh.ExitMissingError
+	if errors.As(err, &exitMissing) {
+		return true
+	}
+	var exitErr *ssh.ExitError
+	if errors.As(err, &exitErr) {
+		return false
+	}
+
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH) ||
+		errors.Is(err, syscall.ETIMEDOUT) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+
+	return errors.As(err, &sshErr) && (sshErr.Op == "dial" || sshErr.Op == "session")
+}
+
+// connectWithRetry opens a transport for config, retrying transient failures.
+// When retries are enabled the transport also reconnects and retries scripts
+// whose session could not be opened. A script that started is never run
+// again, as it may have stopped half way through an install.
+func connectWithRetry(config BinaryInstallConfig) (Transport, error) {
+	var transport Transport
+	err := withRetry(config, "connect to "+config.RemoteHost, func() error {
+		var err error
+		transport, err = newTransport(config)
+		return err
+	})
+	if err != nil || config.RetryAttempts == 0 {
+		return transport, err
+	}
+	return &retryTransport{config: config, current: transport}, nil
+}
+
+// retryTransport wraps a Transport, replacing it with a fresh connection
+// once it is found dead. The connection is shared by every upload to the
+// host, so one that still answers is kept for their sessions.
+type retryTransport struct {
+	config  BinaryInstallConfig
+	mu      sync.Mutex
+	current Transport
+}
+
+func (r *retryTransport) Run(ctx context.Context, script string) (string, error) {
+	var (
+		output string
+		runErr error
+	)
+	err := withRetry(r.config, "script on "+r.config.RemoteHost, func() error {
+		transport, err := r.transport()
+		if err != nil {
+			return err
+		}
+		output, runErr = transport.Run(ctx, script)
+		if runErr != nil && notStarted(runErr) {
+			r.discard(transport)
+			return runErr
+		}
+		return nil
+	})
+	if err != nil {
+		return output, err
+	}
+	return output, runErr
+}
+
+// notStarted reports whether err is from before a script started running,
+// such as failing to open its session, so running it again is safe.
+func notStarted(err error) bool {
+	var sshErr *SSHError
+	return errors.As(err, &sshErr) && sshErr.Op == "session"
+}
+
+// Stage forwards to the underlying transport when it stages artifacts,
+// reconnecting on transient failures. Transports resume the transfer where
+// the failed attempt left off.
+func (r *retryTransport) Stage(ctx context.Context, localPath string) (string, error) {
+	var remotePath string
+	err := withRetry(r.config, "upload to "+r.config.RemoteHost, func() error {
+		transport, err := r.transport()
+		if err != nil {
+			return err
+		}
+		stager, ok := transport.(artifactStager)
+		if !ok {
+			return errNoStaging
+		}
+		remotePath, err = stager.Stage(ctx, localPath)
+		if err != nil && isRetryable(err) {
+			r.discard(transport)
+		}
+		return err
+	})
+	return remotePath, err
+}
+
+// StageReader forwards to the underlying transport when it stages streams.
+// A stream can only be read once, so it is never retried.
+func (r *retryTransport) StageReader(ctx context.Context, name string, rd io.Reader) (string, error) {
+	transport, err := r.transport()
+	if err != nil {
+		return "", err
+	}
+	stager, ok := transport.(streamStager)
+	if !ok {
+		return "", errNoStaging
+	}
+	return stager.StageReader(ctx, name, rd)
+}
+
+func (r *retryTransport) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+// transport returns the live connection, reconnecting if it was discarded.
+func (r *retryTransport) transport() (Transport, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.current == nil {
+		transport, err := newTransport(r.config)
+		if err != nil {
+			return nil, err
+		}
+		r.current = transport
+	}
+	return r.current, nil
+}
+
+// aliveChecker is implemented by transports that can tell whether their
+// connection still works.
+type aliveChecker interface {
+	Alive() bool
+}
+
+// discard closes transport if it is still the live connection and no longer
+// answers, so a connection other uploads' sessions are using is kept.
+func (r *retryTransport) discard(transport Transport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if checker, ok := transport.(aliveChecker); ok && checker.Alive() {
+		return
+	}
+	if r.current == transport {
+		r.current.Close()
+		r.current = nil
+	}
+}
@@ -0,0 +1,77 @@
+package binaryinstall
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// flakyTransport fails its first runs with the given errors and then
+// succeeds, counting the runs and whether it was closed.
+type flakyTransport struct {
+	errs   []error
+	runs   int
+	alive  bool
+	closed bool
+}
+
+func (f *flakyTransport) Run(ctx context.Context, script string) (string, error) {
+	f.runs++
+	if f.runs <= len(f.errs) {
+		return "partial output", f.errs[f.runs-1]
+	}
+	return "done", nil
+}
+
+func (f *flakyTransport) Close() error {
+	f.closed = true
+	return nil
+}
+
+func (f *flakyTransport) Alive() bool { return f.alive }
+
+func TestRetryTransport(t *testing.T) {
+	config := BinaryInstallConfig{RemoteHost: "web1", RetryAttempts: 3, RetryBackoff: time.Millisecond}
+	sessionErr := &SSHError{Op: "session", Host: "web1", Err: io.EOF}
+
+	tests := []struct {
+		name     string
+		err      error
+		wantRuns int
+		wantErr  bool
+		alive    bool
+	}{
+		// The script never started, so it is run again on the same
+		// connection while that still answers
+		{name: "session not opened", err: sessionErr, wantRuns: 2, alive: true},
+		// A script that started may have half installed, so it is not
+		// run again whatever went wrong
+		{name: "connection lost mid-script", err: &ssh.ExitMissingError{}, wantRuns: 1, wantErr: true},
+		{name: "connection reset mid-script", err: io.ErrUnexpectedEOF, wantRuns: 1, wantErr: true},
+		{name: "script failed", err: &ssh.ExitError{}, wantRuns: 1, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &flakyTransport{errs: []error{tt.err}, alive: tt.alive}
+			retry := &retryTransport{config: config, current: transport}
+
+			out, err := retry.Run(context.Background(), "install")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Run() = %q, %v", out, err)
+			}
+			if tt.wantErr && !errors.Is(err, tt.err) {
+				t.Errorf("Run() returned %v, not the script's error %v", err, tt.err)
+			}
+			if transport.runs != tt.wantRuns {
+				t.Errorf("script ran %d times, want %d", transport.runs, tt.wantRuns)
+			}
+			if transport.closed {
+				t.Errorf("the connection was closed")
+			}
+		})
+	}
+}
@@ -0,0 +1,300 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// RollbackResult is the version of a binary Rollback restored on a host.
+type RollbackResult struct {
+	Host   string
+	Path   string // the binary restored, e.g. "/usr/local/bin/api"
+	Backup string // when the restored version was backed up, e.g. "20240102T150405Z", or its release
+	SHA256 string // of the restored binary
+}
+
+// backupStampLayout is the time layout of backup directory names, such as
+// "20240102T150405Z", in UTC.
+const backupStampLayout = "20060102T150405Z"
+
+// restoredMarker prefixes the line rollbackTemplate prints on restoring a
+// backup: the backup's name and the binary's checksum.
+const restoredMarker = "binaryinstall-restored:"
+
+// rollbackTemplate restores the most recent backup of a binary, taking it out
+// of the backups, or for releases points current at the most recent release
+// before it, and restarts its service. The version it replaces is discarded.
+var rollbackTemplate = template.Must(template.Must(scriptTemplate.Clone()).New("rollback").Parse(`set -e
+
+BINARY={{ q .BinaryName }}
+BACKUP_DIR={{ q .BackupDir }}
+DEST_DIR={{ q .DestinationDir }}
+GROUP={{ q .Group }}
+RESTART_SERVICE={{ q .RestartService }}
+STOP_SERVICE={{ q .StopService }}
+case $DEST_DIR in "~/"*) DEST_DIR="$HOME/${DEST_DIR#"~/"}" ;; esac
+case $BACKUP_DIR in "~/"*) BACKUP_DIR="$HOME/${BACKUP_DIR#"~/"}" ;; esac
+BACKUP_ROOT="${BACKUP_DIR%/}/$BINARY"
+{{ template "escalation" . }}
+{{ template "services" . }}
+
+{{ if .Release -}}
+APP_DIR=${DEST_DIR%/}
+{{ template "point_current" }}
+
+# 1) Find the most recently installed release holding the binary, other
+# than the current one
+current=$(readlink "$APP_DIR/current" 2>/dev/null) || {
+    echo "$APP_DIR/current is not a symlink to a release" >&2
+    exit 1
+}
+# It is removed below, so it must be a release and nothing else
+release=
+case $current in
+    releases/*/* | releases/ | releases/. | releases/..) ;;
+    releases/*) release=$current ;;
+esac
+if [ -z "$release" ]; then
+    echo "$APP_DIR/current points at $current, not a release in $APP_DIR/releases" >&2
+    exit 1
+fi
+backup=
+for dir in $(ls -1t "$APP_DIR/releases" 2>/dev/null); do
+    if [ "releases/$dir" != "$current" ] && [ -f "$APP_DIR/releases/$dir/$BINARY" ]; then
+        backup="releases/$dir"
+        break
+    fi
+done
+if [ -z "$backup" ]; then
+    echo "no release of $BINARY in $APP_DIR/releases before $current" >&2
+    exit 1
+fi
+{{- else -}}
+# 1) Find the most recent backup holding the binary; their timestamped names
+# sort in the order they were made
+backup=
+for dir in $(ls -1r "$BACKUP_ROOT" 2>/dev/null | grep -E '^[0-9]{8}T[0-9]{6}Z(\.[0-9]+)?$'); do
+    if [ -f "$BACKUP_ROOT/$dir/$BINARY" ]; then
+        backup="$BACKUP_ROOT/$dir"
+        break
+    fi
+done
+if [ -z "$backup" ]; then
+    echo "no backup of $BINARY in $BACKUP_ROOT" >&2
+    exit 1
+fi
+{{- end }}
+
+{{ if .PreRestart }}run_hook pre-restart {{ q .PreRestart }}
+{{ end }}
+{{- if .StopService }}
+# 2) Stop the service so its binary can be replaced
+stopped=
+if svc_running "$STOP_SERVICE"; then
+    svc stop "$STOP_SERVICE"
+    stopped=1
+fi
+{{ end }}
+
+{{ if .Release -}}
+# 3) Point current at the earlier release, and remove the one it pointed at
+point_current "$backup"
+as_root rm -rf "${APP_DIR:?}/$current"
+DEST_DIR="$APP_DIR/current"
+{{- else -}}
+# 3) Move the backup into place
+as_root mv -f "$backup/$BINARY" "$DEST_DIR/$BINARY"
+rmdir "$backup" 2>/dev/null || true
+{{- end }}
+sum=$( (sha256sum "$DEST_DIR/$BINARY" 2>/dev/null || shasum -a 256 "$DEST_DIR/$BINARY") | cut -d' ' -f1)
+echo "restored $DEST_DIR/$BINARY from ${backup##*/}"
+echo "` + restoredMarker + ` ${backup##*/} $sum"
+
+# 4) Restart the service on the restored version
+{{- if .StopService }}
+if [ -n "$stopped" ]; then
+    svc start "$STOP_SERVICE"
+    wait_active "$STOP_SERVICE"
+    echo "started $STOP_SERVICE"
+fi
+{{- end }}
+{{- if .RestartService }}
+if ! svc restart "$RESTART_SERVICE"; then
+    svc_status "$RESTART_SERVICE" >&2 || true
+    echo "failed to restart $RESTART_SERVICE" >&2
+    exit 1
+fi
+wait_active "$RESTART_SERVICE"
+echo "restarted $RESTART_SERVICE"
+{{- end }}
+{{ if .PostRestart }}run_hook post-restart {{ q .PostRestart }}
+{{ end }}
+{{- if .HostManifest }}
+# 5) Record the restored version in the host manifest
+HOST_MANIFEST={{ q .HostManifest }}
+case $HOST_MANIFEST in "~/"*) HOST_MANIFEST="$HOME/${HOST_MANIFEST#"~/"}" ;; esac
+{{ template "manifest" . }}
+MANIFEST_FIELDS="\"source\":$(json_str "rollback to ${backup##*/}")"
+{{ if .Release }}MANIFEST_FIELDS="$MANIFEST_FIELDS,\"version\":$(json_str "${backup##*/}")"
+{{ end }}manifest_file "$DEST_DIR/$BINARY"
+write_manifest
+{{ end }}`))
+
+// Rollback restores the most recent backup of upload's binary to its
+// destination on every host of config, and restarts its RestartService or
+// StopService. The backup is taken out of the backup directory, so rolling
+// back again restores the one before it, and the version it replaces is
+// discarded. For a Release upload, current is pointed at the most recently
+// installed release before the one it points at, which is removed. With a
+// HostManifest, the restored binary is recorded there as coming from the
+// backup or release. upload names the binary as it would be installed: by its
+// archive, or ArchivePath. Hosts that fail are reported as InstallFailures.
+func Rollback(config BinaryInstallConfig, upload BinaryUpload) ([]RollbackResult, error) {
+	hosts := fleetHosts(config)
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no remote host provided")
+	}
+	if kind, _ := transportKind(config); kind == TransportWinRM {
+		return nil, fmt.Errorf("rolling back is not supported on %s targets", kind)
+	}
+	if upload.InstallAll || (upload.ExtractAll && upload.Release == "") || len(upload.Files) > 0 || upload.FilesManifest != "" {
+		return nil, fmt.Errorf("only uploads installing a single binary can be rolled back")
+	}
+	if kind := packageKind(uploadArtifactBase(upload)); kind != "" {
+		return nil, fmt.Errorf("%s packages cannot be rolled back", kind)
+	}
+	binaryName := uploadBinaryName(upload)
+	if binaryName == "" {
+		return nil, fmt.Errorf("unable to derive the binary name of %s", uploadLabel(upload))
+	}
+	upload, err := expandUploadVars(upload)
+	if err != nil {
+		return nil, err
+	}
+
+	sData := ScriptData{
+		SudoPassword:   config.SudoPassword,
+		Escalation:     config.Escalation,
+		NoSudo:         upload.NoSudo,
+		BinaryName:     binaryName,
+		BackupDir:      config.BackupDir,
+		DestinationDir: upload.DestinationDir,
+		Owner:          upload.Owner,
+		Group:          upload.Group,
+		Permission:     permission(upload),
+		Release:        upload.Release,
+		HostManifest:   config.HostManifest,
+		RestartService: upload.RestartService,
+		StopService:    upload.StopService,
+		UserService:    upload.UserService,
+		ActiveTimeout:  upload.ActiveTimeout,
+		ReadyCommand:   upload.ReadyCommand,
+		PreRestart:     upload.PreRestart,
+		PostRestart:    upload.PostRestart,
+		HookTimeout:    upload.HookTimeout,
+	}
+	if sData.HookTimeout <= 0 {
+		sData.HookTimeout = 5 * time.Minute
+	}
+	if sData.ActiveTimeout <= 0 {
+		sData.ActiveTimeout = 30 * time.Second
+	}
+	if sData.Group == "" {
+		sData.Group = sData.Owner
+	}
+	if err := validateScriptData(sData, false); err != nil {
+		return nil, err
+	}
+
+	var (
+		mu      sync.Mutex
+		results []RollbackResult
+	)
+	err = runAll(len(hosts), config.MaxParallelHosts, config.ContinueOnError, func(i int) error {
+		hostConfig := forHost(config, hosts[i])
+		result, err := rollbackHost(hostConfig, sData)
+		if err != nil {
+			return &InstallFailure{Host: hostConfig.RemoteHost, Upload: uploadLabel(upload), Err: err}
+		}
+		mu.Lock()
+		results = append(results, result)
+		mu.Unlock()
+		return nil
+	})
+	return results, err
+}
+
+// rollbackHost runs rollbackTemplate for sData on config.RemoteHost.
+func rollbackHost(config BinaryInstallConfig, sData ScriptData) (result RollbackResult, err error) {
+	transport, err := connectHost(&config)
+	if err != nil {
+		return RollbackResult{Host: config.RemoteHost}, err
+	}
+	defer transport.Close()
+	var lock *deployLock
+	if config.Lock {
+		if lock, err = acquireLock(config, transport); err != nil {
+			return RollbackResult{Host: config.RemoteHost}, err
+		}
+		defer func() {
+			if lockErr := lock.Release(); lockErr != nil && err == nil {
+				err = lockErr
+			}
+		}()
+	}
+
+	return runRollback(config, transport, sData)
+}
+
+// runRollback runs rollbackTemplate for sData over transport, reporting the
+// backup it restored.
+func runRollback(config BinaryInstallConfig, transport Transport, sData ScriptData) (RollbackResult, error) {
+	result := RollbackResult{Host: config.RemoteHost, Path: path.Join(sData.DestinationDir, sData.BinaryName)}
+	if sData.Release != "" {
+		result.Path = path.Join(sData.DestinationDir, "current", sData.BinaryName)
+	}
+	sData.SudoPassword = config.SudoPassword
+	var script bytes.Buffer
+	if err := rollbackTemplate.Execute(&script, sData); err != nil {
+		return result, fmt.Errorf("failed to render rollback script: %w", err)
+	}
+	out, err := runScript(config, transport, script.String())
+	if err != nil {
+		return result, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if rest, ok := strings.CutPrefix(line, restoredMarker); ok {
+			fields := strings.Fields(rest)
+			if len(fields) == 2 {
+				result.Backup, result.SHA256 = fields[0], fields[1]
+			}
+		}
+	}
+	if config.Verbose {
+		log.Printf("Rolled back %s on %s to the backup from %s", result.Path, config.RemoteHost, result.Backup)
+	}
+	return result, nil
+}
+
+// pointCurrentScript is scriptTemplate's "point_current", which defines
+// point_current to switch a Release upload's current symlink atomically.
+const pointCurrentScript = `{{ define "point_current" -}}
+# point_current points $APP_DIR/current at $1, relative to $APP_DIR.
+point_current() {
+    if [ -e "$APP_DIR/current" ] && [ ! -L "$APP_DIR/current" ]; then
+        echo "$APP_DIR/current is not a symlink; move it aside to use releases" >&2
+        exit 1
+    fi
+    as_root rm -f "$APP_DIR/.current.$$"
+    as_root ln -s "$1" "$APP_DIR/.current.$$"
+    # GNU mv replaces the link with -T, BSD mv with -h
+    as_root mv -T "$APP_DIR/.current.$$" "$APP_DIR/current" 2>/dev/null ||
+        as_root mv -h "$APP_DIR/.current.$$" "$APP_DIR/current"
+}
+{{- end }}`
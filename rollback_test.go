@@ -0,0 +1,157 @@
+package binaryinstall
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRollbackBackups(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "api_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("api"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "bin.old")}
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "bin"), Owner: "root", Permission: "0755"}
+	if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	installed := filepath.Join(upload.DestinationDir, "api")
+	for _, previous := range []string{"", "first", "second"} {
+		if previous != "" {
+			if err := os.WriteFile(installed, []byte(previous), 0o755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+			t.Fatal(err)
+		}
+	}
+	backups, err := os.ReadDir(filepath.Join(config.BackupDir, "api"))
+	if err != nil || len(backups) != 2 {
+		t.Fatalf("backups %v (%v), want two", backups, err)
+	}
+
+	sData := ScriptData{
+		BinaryName:     "api",
+		BackupDir:      config.BackupDir,
+		DestinationDir: upload.DestinationDir,
+		Owner:          "root",
+		Group:          "root",
+		Permission:     "0755",
+		ActiveTimeout:  time.Second,
+		HookTimeout:    time.Second,
+	}
+	// Each rollback restores the most recent backup left, taking it out
+	for i, want := range []string{"second", "first"} {
+		result, err := runRollback(config, shTransport{}, sData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw, _ := os.ReadFile(installed)
+		sum := sha256.Sum256(raw)
+		if string(raw) != want || result.Path != installed || result.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("rollback %d restored %q as %+v, want %q", i+1, raw, result, want)
+		}
+		if backup := backups[len(backups)-1-i].Name(); result.Backup != backup {
+			t.Errorf("rollback %d restored the backup from %s, want %s", i+1, result.Backup, backup)
+		}
+		if _, err := os.Stat(filepath.Join(config.BackupDir, "api", result.Backup)); !os.IsNotExist(err) {
+			t.Errorf("rollback %d left its backup behind: %v", i+1, err)
+		}
+	}
+	if _, err := runRollback(config, shTransport{}, sData); err == nil || !strings.Contains(err.Error(), "no backup of api") {
+		t.Errorf("rolling back without backups returned %v", err)
+	}
+}
+
+func TestRollbackUnsupported(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		config  BinaryInstallConfig
+		upload  BinaryUpload
+		wantErr string
+	}{
+		{"no host", BinaryInstallConfig{}, BinaryUpload{Path: "api_Linux_x86_64.tar.gz"}, "no remote host provided"},
+		{"winrm", BinaryInstallConfig{RemoteHost: "winrm://win1"}, BinaryUpload{Path: "api_Windows_x86_64.zip"}, "not supported on winrm targets"},
+		{"extract all", BinaryInstallConfig{RemoteHost: "web1"}, BinaryUpload{Path: "api_Linux_x86_64.tar.gz", ExtractAll: true}, "only uploads installing a single binary"},
+		{"package", BinaryInstallConfig{RemoteHost: "web1"}, BinaryUpload{Path: "api_1.0_amd64.deb"}, "packages cannot be rolled back"},
+	} {
+		if _, err := Rollback(tt.config, tt.upload); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: returned %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestRollbackReleases(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	dir := t.TempDir()
+	archive := filepath.Join(dir, "api_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("api"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "bin.old")}
+	upload := BinaryUpload{Path: archive, DestinationDir: filepath.Join(dir, "api"), Owner: "root", Permission: "0755"}
+	releases := []string{"1.0.0", "1.1.0", "1.2.0"}
+	for i, release := range releases {
+		upload.Release = release
+		if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+			t.Fatal(err)
+		}
+		binary := filepath.Join(upload.DestinationDir, "releases", release, "api")
+		if err := os.WriteFile(binary, []byte(release), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		// Releases are ordered by when they were installed
+		when := time.Now().Add(time.Duration(i-len(releases)) * time.Hour)
+		if err := os.Chtimes(filepath.Dir(binary), when, when); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sData := ScriptData{
+		BinaryName:     "api",
+		BackupDir:      config.BackupDir,
+		DestinationDir: upload.DestinationDir,
+		Owner:          "root",
+		Group:          "root",
+		Permission:     "0755",
+		Release:        "1.2.0",
+		ActiveTimeout:  time.Second,
+		HookTimeout:    time.Second,
+	}
+	current := filepath.Join(upload.DestinationDir, "current")
+	// Each rollback points current at the release before it, removing the
+	// one it pointed at
+	for _, want := range []string{"1.1.0", "1.0.0"} {
+		result, err := runRollback(config, shTransport{}, sData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		link, _ := os.Readlink(current)
+		raw, _ := os.ReadFile(filepath.Join(current, "api"))
+		sum := sha256.Sum256([]byte(want))
+		if link != "releases/"+want || string(raw) != want || result.Backup != want || result.Path != filepath.Join(current, "api") || result.SHA256 != hex.EncodeToString(sum[:]) {
+			t.Errorf("rolled back to %s holding %q as %+v, want %s", link, raw, result, want)
+		}
+	}
+	if entries, _ := os.ReadDir(filepath.Join(upload.DestinationDir, "releases")); len(entries) != 1 {
+		t.Errorf("rolled back releases were not removed: %v", entries)
+	}
+	if _, err := runRollback(config, shTransport{}, sData); err == nil || !strings.Contains(err.Error(), "no release of api") {
+		t.Errorf("rolling back the first release returned %v", err)
+	}
+
+	// current must point at a release, since that is removed
+	if err := os.Remove(current); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink("/usr/local", current); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := runRollback(config, shTransport{}, sData); err == nil || !strings.Contains(err.Error(), "not a release") {
+		t.Errorf("rolling back from outside the releases returned %v", err)
+	}
+}
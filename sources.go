@@ -0,0 +1,499 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// ArtifactSource supplies the tar.gz for an upload. Implement it to install
+// from origins the built-in sources don't cover, either by setting
+// BinaryUpload.Source or by registering a URL scheme with RegisterSource.
+type ArtifactSource interface {
+	Fetch(ctx context.Context) (Artifact, error)
+}
+
+// Artifact is a fetched archive. Either LocalPath is set, and the file is
+// transferred to the host, or Command is, and the host runs it to download
+// the archive to "$ARTIFACT" itself.
+type Artifact struct {
+	Name      string // archive file name, e.g. "llmfs_Linux_x86_64.tar.gz"; defaults to the base of LocalPath
+	LocalPath string
+	Command   string
+	Cleanup   func() // optional, called once the install has finished
+}
+
+// SourceFunc builds the ArtifactSource for an upload's URL.
+type SourceFunc func(config BinaryInstallConfig, upload BinaryUpload) (ArtifactSource, error)
+
+var (
+	sourcesMu sync.RWMutex
+	sources   = map[string]SourceFunc{}
+)
+
+// RegisterSource resolves URLs with the given scheme, e.g. "artifacts" for
+// "artifacts://tools/llmfs/1.2.3", through f. It replaces any source already
+// registered for the scheme, including the built-in http, https, s3, gs and oci.
+func RegisterSource(scheme string, f SourceFunc) {
+	sourcesMu.Lock()
+	defer sourcesMu.Unlock()
+	sources[strings.ToLower(scheme)] = f
+}
+
+func init() {
+	RegisterSource("http", newHTTPSource)
+	RegisterSource("https", newHTTPSource)
+	RegisterSource("s3", newS3Source)
+	RegisterSource("gs", newGCSSource)
+	RegisterSource("oci", newOCISource)
+}
+
+// sourceFor returns upload.Source, or the source registered for the scheme of upload.URL.
+func sourceFor(config BinaryInstallConfig, upload BinaryUpload) (ArtifactSource, error) {
+	if upload.Source != nil {
+		return upload.Source, nil
+	}
+	scheme, _, ok := strings.Cut(upload.URL, "://")
+	if !ok {
+		return nil, fmt.Errorf("artifact URL %q has no scheme", upload.URL)
+	}
+	sourcesMu.RLock()
+	f, ok := sources[strings.ToLower(scheme)]
+	sourcesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("no artifact source registered for %s:// URLs", scheme)
+	}
+	return f(config, upload)
+}
+
+// urlName returns the archive file name at the end of rawURL's path.
+func urlName(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid artifact URL: %w", err)
+	}
+	return path.Base(u.Path), nil
+}
+
+// fetchToTemp runs cmd, built by newCmd to write into a fresh temporary
+// directory, and returns the resulting Artifact for name.
+func fetchToTemp(config BinaryInstallConfig, rawURL, name string, newCmd func(dir, localPath string) *exec.Cmd, verify func(dir, localPath string) error) (Artifact, error) {
+	dir, err := os.MkdirTemp("", "binaryinstall-")
+	if err != nil {
+		return Artifact{}, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	localPath := filepath.Join(dir, name)
+
+	if config.Verbose {
+		log.Printf("Fetching %s locally", rawURL)
+	}
+	if out, err := newCmd(dir, localPath).CombinedOutput(); err != nil {
+		cleanup()
+		return Artifact{}, fmt.Errorf("failed to fetch %s: %w: %s", rawURL, err, strings.TrimSpace(string(out)))
+	}
+	if verify != nil {
+		if err := verify(dir, localPath); err != nil {
+			cleanup()
+			return Artifact{}, err
+		}
+	}
+	return Artifact{Name: name, LocalPath: localPath, Cleanup: cleanup}, nil
+}
+
+// httpSource downloads http(s) URLs with curl, on the host unless FetchLocal is set.
+type httpSource struct {
+	config BinaryInstallConfig
+	upload BinaryUpload
+}
+
+func newHTTPSource(config BinaryInstallConfig, upload BinaryUpload) (ArtifactSource, error) {
+	return httpSource{config, upload}, nil
+}
+
+func (s httpSource) Fetch(ctx context.Context) (Artifact, error) {
+	name, err := urlName(s.upload.URL)
+	if err != nil {
+		return Artifact{}, err
+	}
+	header := s.upload.ChecksumHeader
+
+	if s.upload.FetchLocal {
+		newCmd := func(dir, localPath string) *exec.Cmd {
+			args := []string{"-fsSL", "--retry", "3", "-o", localPath}
+			if header != "" {
+				args = append(args, "-D", filepath.Join(dir, "headers"))
+			}
+			// Headers are passed on stdin to keep credentials out of the
+			// process list.
+			cmd := exec.CommandContext(ctx, "curl", append(args, "-H", "@-", s.upload.URL)...)
+			cmd.Stdin = strings.NewReader(headerLines(s.upload.Headers))
+			return cmd
+		}
+		var verify func(dir, localPath string) error
+		if header != "" {
+			verify = func(dir, localPath string) error {
+				return verifyChecksumHeader(filepath.Join(dir, "headers"), header, localPath)
+			}
+		}
+		return fetchToTemp(s.config, s.upload.URL, name, newCmd, verify)
+	}
+
+	// Headers are written with the shell's printf builtin to a file only the
+	// remote user can read, and read from there by curl or, through a
+	// wgetrc, by wget, so credentials in them never reach a command line.
+	var setup, writeCurl, writeWget, curlFlags, wgetEnv, cleanup string
+	if len(s.upload.Headers) > 0 {
+		var quoted []string
+		for _, h := range s.upload.Headers {
+			quoted = append(quoted, shellQuote(h))
+		}
+		setup = "REQUEST_HEADERS=$(mktemp)\ntrap 'rm -f \"$REQUEST_HEADERS\"' EXIT\n"
+		writeCurl = "printf '%s\\n' " + strings.Join(quoted, " ") + " > \"$REQUEST_HEADERS\"\n"
+		writeWget = "printf 'header = %s\\n' " + strings.Join(quoted, " ") + " > \"$REQUEST_HEADERS\"\n"
+		curlFlags = ` -H @"$REQUEST_HEADERS"`
+		wgetEnv = `WGETRC="$REQUEST_HEADERS" `
+		cleanup = "\nrm -f \"$REQUEST_HEADERS\"\ntrap - EXIT"
+	}
+	if header == "" {
+		indent := func(s string) string { return strings.ReplaceAll(s, "\n", "\n    ") }
+		return Artifact{Name: name, Command: fmt.Sprintf(`%sif command -v curl >/dev/null 2>&1; then
+    %scurl -fsSL --retry 3 --retry-delay 2 -C -%s -o "$ARTIFACT" %s
+else
+    %s%swget -q -c --tries=3 -O "$ARTIFACT" %s
+fi%s`, setup, indent(writeCurl), curlFlags, shellQuote(s.upload.URL), indent(writeWget), wgetEnv, shellQuote(s.upload.URL), cleanup)}, nil
+	}
+
+	// Keep the response headers and check the archive against the checksum one.
+	return Artifact{Name: name, Command: setup + writeCurl + fmt.Sprintf(`curl -fsSL --retry 3 --retry-delay 2 -C -%[1]s -D "$ARTIFACT.headers" -o "$ARTIFACT" %[2]s
+expected=$(grep -i %[3]s "$ARTIFACT.headers" | tail -n 1 | cut -d: -f2- | tr -d ' \r"' | tr 'A-F' 'a-f')
+# macOS and the BSDs have shasum and md5 in place of the GNU tools
+case ${#expected} in
+    64) actual=$( (sha256sum "$ARTIFACT" 2>/dev/null || shasum -a 256 "$ARTIFACT") | cut -d' ' -f1) ;;
+    40) actual=$( (sha1sum "$ARTIFACT" 2>/dev/null || shasum -a 1 "$ARTIFACT") | cut -d' ' -f1) ;;
+    32) actual=$( (md5sum "$ARTIFACT" 2>/dev/null || md5 -q "$ARTIFACT") | cut -d' ' -f1) ;;
+    *) echo %[4]s >&2; exit 1 ;;
+esac
+if [ "$actual" != "$expected" ]; then
+    echo "checksum mismatch: expected $expected, got $actual" >&2
+    exit 1
+fi`, curlFlags, shellQuote(s.upload.URL), shellQuote("^"+header+":"), shellQuote("missing or unrecognized "+header+" header")) + cleanup}, nil
+}
+
+// s3Source downloads s3:// URLs with the aws CLI, on the host with the
+// instance's credentials unless FetchLocal is set.
+type s3Source struct {
+	config BinaryInstallConfig
+	upload BinaryUpload
+}
+
+func newS3Source(config BinaryInstallConfig, upload BinaryUpload) (ArtifactSource, error) {
+	return s3Source{config, upload}, nil
+}
+
+func (s s3Source) Fetch(ctx context.Context) (Artifact, error) {
+	name, err := urlName(s.upload.URL)
+	if err != nil {
+		return Artifact{}, err
+	}
+
+	if s.upload.Presign && !s.upload.FetchLocal {
+		args := []string{"s3", "presign", s.upload.URL, "--expires-in", fmt.Sprint(int(presignExpiry(s.config).Seconds()))}
+		if s.config.AWSRegion != "" {
+			args = append(args, "--region", s.config.AWSRegion)
+		}
+		if s.config.AWSProfile != "" {
+			args = append(args, "--profile", s.config.AWSProfile)
+		}
+		return presigned(ctx, s.config, s.upload, exec.CommandContext(ctx, "aws", args...))
+	}
+
+	if s.upload.FetchLocal {
+		return fetchToTemp(s.config, s.upload.URL, name, func(dir, localPath string) *exec.Cmd {
+			args := []string{"s3", "cp", "--only-show-errors", s.upload.URL, localPath}
+			if s.config.AWSRegion != "" {
+				args = append(args, "--region", s.config.AWSRegion)
+			}
+			if s.config.AWSProfile != "" {
+				args = append(args, "--profile", s.config.AWSProfile)
+			}
+			return exec.CommandContext(ctx, "aws", args...)
+		}, nil)
+	}
+
+	command := `aws s3 cp --only-show-errors ` + shellQuote(s.upload.URL) + ` "$ARTIFACT"`
+	if s.config.AWSRegion != "" {
+		command += " --region " + shellQuote(s.config.AWSRegion)
+	}
+	return Artifact{Name: name, Command: command}, nil
+}
+
+// gcsSource downloads gs:// URLs with gcloud, on the host with its service
+// account unless FetchLocal or GCSCredentialsFile is set; a service-account
+// key never leaves this machine.
+type gcsSource struct {
+	config BinaryInstallConfig
+	upload BinaryUpload
+}
+
+func newGCSSource(config BinaryInstallConfig, upload BinaryUpload) (ArtifactSource, error) {
+	return gcsSource{config, upload}, nil
+}
+
+func (s gcsSource) Fetch(ctx context.Context) (Artifact, error) {
+	name, err := urlName(s.upload.URL)
+	if err != nil {
+		return Artifact{}, err
+	}
+
+	if s.upload.Presign && !s.upload.FetchLocal {
+		args := []string{"storage", "sign-url", s.upload.URL, "--duration", presignExpiry(s.config).String(), "--format", "value(signed_url)"}
+		if s.config.GCSCredentialsFile != "" {
+			args = append(args, "--private-key-file", s.config.GCSCredentialsFile)
+		}
+		return presigned(ctx, s.config, s.upload, exec.CommandContext(ctx, "gcloud", args...))
+	}
+
+	if s.upload.FetchLocal || s.config.GCSCredentialsFile != "" {
+		return fetchToTemp(s.config, s.upload.URL, name, func(dir, localPath string) *exec.Cmd {
+			cmd := exec.CommandContext(ctx, "gcloud", "storage", "cp", s.upload.URL, localPath)
+			if s.config.GCSCredentialsFile != "" {
+				cmd.Env = append(os.Environ(), "CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE="+s.config.GCSCredentialsFile)
+			}
+			return cmd
+		}, nil)
+	}
+
+	return Artifact{Name: name, Command: fmt.Sprintf(`if command -v gcloud >/dev/null 2>&1; then
+    gcloud storage cp %[1]s "$ARTIFACT"
+else
+    gsutil -q cp %[1]s "$ARTIFACT"
+fi`, shellQuote(s.upload.URL))}, nil
+}
+
+// presignExpiry returns how long presigned URLs stay valid.
+func presignExpiry(config BinaryInstallConfig) time.Duration {
+	if config.PresignExpiry > 0 {
+		return config.PresignExpiry
+	}
+	return 15 * time.Minute
+}
+
+// presigned runs cmd, which prints a presigned https URL for upload.URL
+// using local credentials, and has the remote download that URL instead.
+func presigned(ctx context.Context, config BinaryInstallConfig, upload BinaryUpload, cmd *exec.Cmd) (Artifact, error) {
+	if config.Verbose {
+		log.Printf("Presigning %s", upload.URL)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return Artifact{}, fmt.Errorf("failed to presign %s: %w: %s", upload.URL, err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return Artifact{}, fmt.Errorf("failed to presign %s: %w", upload.URL, err)
+	}
+	name, err := urlName(upload.URL)
+	if err != nil {
+		return Artifact{}, err
+	}
+
+	upload.URL = strings.TrimSpace(string(out))
+	artifact, err := httpSource{config, upload}.Fetch(ctx)
+	if err != nil {
+		return Artifact{}, err
+	}
+	// The signature's query string is not part of the archive name.
+	artifact.Name = name
+	return artifact, nil
+}
+
+// ociSource pulls "oci://registry/repo:tag" artifacts locally with oras.
+type ociSource struct {
+	config BinaryInstallConfig
+	ref    string
+}
+
+func newOCISource(config BinaryInstallConfig, upload BinaryUpload) (ArtifactSource, error) {
+	return ociSource{config, strings.TrimPrefix(upload.URL, "oci://")}, nil
+}
+
+func (s ociSource) Fetch(ctx context.Context) (Artifact, error) {
+	dir, err := os.MkdirTemp("", "binaryinstall-")
+	if err != nil {
+		return Artifact{}, err
+	}
+	localPath, err := pullOCIArtifact(ctx, s.config, s.ref, dir)
+	if err != nil {
+		os.RemoveAll(dir)
+		return Artifact{}, err
+	}
+	return Artifact{LocalPath: localPath, Cleanup: func() { os.RemoveAll(dir) }}, nil
+}
+
+// expandURL renders upload.URL as a template over upload.Vars.
+func expandURL(upload BinaryUpload) (string, error) {
+	return expandVars("URL", upload.URL, upload.Vars)
+}
+
+// expandVars renders s, the named setting, as a template over vars if it
+// contains one, e.g. "/srv/{{.env}}/bin".
+func expandVars(name, s string, vars map[string]string) (string, error) {
+	if !strings.Contains(s, "{{") {
+		return s, nil
+	}
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s template %q: %w", name, s, err)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, vars); err != nil {
+		return "", fmt.Errorf("failed to expand %s template %q: %w", name, s, err)
+	}
+	return buf.String(), nil
+}
+
+// expandUploadVars renders the destination and ownership settings of
+// upload, and of each of its files, over upload.Vars, so one upload can
+// adapt to each host's variables.
+func expandUploadVars(upload BinaryUpload) (BinaryUpload, error) {
+	type setting struct {
+		name  string
+		value *string
+	}
+	settings := []setting{
+		{"destination", &upload.DestinationDir},
+		{"owner", &upload.Owner},
+		{"group", &upload.Group},
+		{"file list", &upload.FilesManifest},
+		{"pre-restart hook", &upload.PreRestart},
+		{"post-restart hook", &upload.PostRestart},
+		{"ready command", &upload.ReadyCommand},
+		{"release", &upload.Release},
+	}
+	files := slices.Clone(upload.Files)
+	for i := range files {
+		settings = append(settings,
+			setting{"file destination", &files[i].Destination},
+			setting{"file owner", &files[i].Owner},
+			setting{"file group", &files[i].Group})
+	}
+	for _, s := range settings {
+		expanded, err := expandVars(s.name, *s.value, upload.Vars)
+		if err != nil {
+			return upload, err
+		}
+		*s.value = expanded
+	}
+	upload.Files = files
+	return upload, nil
+}
+
+// authHeaders returns the Authorization header for upload's basic or bearer credentials.
+func authHeaders(upload BinaryUpload) []string {
+	switch {
+	case upload.BearerToken != "":
+		return []string{"Authorization: Bearer " + upload.BearerToken}
+	case upload.BasicAuthUser != "":
+		creds := base64.StdEncoding.EncodeToString([]byte(upload.BasicAuthUser + ":" + upload.BasicAuthPassword))
+		return []string{"Authorization: Basic " + creds}
+	}
+	return nil
+}
+
+// headerLines returns headers as curl reads them with -H @file, a line each.
+func headerLines(headers []string) string {
+	var b strings.Builder
+	for _, h := range headers {
+		b.WriteString(h + "\n")
+	}
+	return b.String()
+}
+
+// verifyChecksumHeader checks file against the digest in the named header of
+// the curl header dump at headersPath. The algorithm follows the digest length.
+func verifyChecksumHeader(headersPath, header, file string) error {
+	raw, err := os.ReadFile(headersPath)
+	if err != nil {
+		return err
+	}
+	// With redirects there is one header block per response; the last wins.
+	var expected string
+	for _, line := range strings.Split(string(raw), "\n") {
+		name, val, ok := strings.Cut(line, ":")
+		if ok && strings.EqualFold(strings.TrimSpace(name), header) {
+			expected = strings.ToLower(strings.Trim(strings.TrimSpace(val), `"`))
+		}
+	}
+
+	var h hash.Hash
+	switch len(expected) {
+	case 64:
+		h = sha256.New()
+	case 40:
+		h = sha1.New()
+	case 32:
+		h = md5.New()
+	default:
+		return fmt.Errorf("missing or unrecognized %s header", header)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if actual := hex.EncodeToString(h.Sum(nil)); actual != expected {
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", filepath.Base(file), expected, actual)
+	}
+	return nil
+}
+
+// pullOCIArtifact pulls ref with oras into dir and returns the archive it contains.
+func pullOCIArtifact(ctx context.Context, config BinaryInstallConfig, ref, dir string) (string, error) {
+	args := []string{"pull", "--no-tty", "-o", dir}
+	if config.RegistryUsername != "" {
+		args = append(args, "--username", config.RegistryUsername, "--password-stdin")
+	}
+	cmd := exec.CommandContext(ctx, "oras", append(args, ref)...)
+	if config.RegistryUsername != "" {
+		cmd.Stdin = strings.NewReader(config.RegistryPassword)
+	}
+	if config.Verbose {
+		log.Printf("Pulling %s with oras", ref)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("oras pull %s: %w: %s", ref, err, strings.TrimSpace(string(out)))
+	}
+
+	matches, err := globArchives(dir)
+	if err != nil {
+		return "", err
+	}
+	if len(matches) != 1 {
+		return "", fmt.Errorf("expected one tar archive in %s, found %d", ref, len(matches))
+	}
+	return matches[0], nil
+}
@@ -0,0 +1,320 @@
+package binaryinstall
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// stubCommand puts an executable sh script named name first on PATH,
+// which records its arguments, one per line, in the file it returns.
+func stubCommand(t *testing.T, name, body string) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("stub commands need a POSIX shell")
+	}
+	dir := t.TempDir()
+	args := filepath.Join(dir, name+".args")
+	script := "#!/bin/sh\nprintf '%s\\n' \"$@\" > " + shellQuote(args) + "\n" + body + "\n"
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return args
+}
+
+// readArgs returns the arguments recorded by a stub command.
+func readArgs(t *testing.T, path string) []string {
+	t.Helper()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSuffix(string(raw), "\n"), "\n")
+}
+
+// fetchArtifact fetches upload with the source for its URL, returning the
+// local archive and a func removing it.
+func fetchArtifact(config BinaryInstallConfig, upload BinaryUpload) (string, func(), error) {
+	source, err := sourceFor(config, upload)
+	if err != nil {
+		return "", nil, err
+	}
+	artifact, err := source.Fetch(context.Background())
+	return artifact.LocalPath, artifact.Cleanup, err
+}
+
+func TestRemoteFetchScript(t *testing.T) {
+	tests := []struct {
+		url  string
+		want []string
+	}{
+		{
+			url:  "s3://releases/tool/tool_Linux_x86_64.tar.gz",
+			want: []string{"aws s3 cp --only-show-errors 's3://releases/tool/tool_Linux_x86_64.tar.gz'", "--region 'eu-west-1'"},
+		},
+		{
+			url: "gs://releases/tool/tool_Linux_x86_64.tar.gz",
+			want: []string{
+				"gcloud storage cp 'gs://releases/tool/tool_Linux_x86_64.tar.gz'",
+				"gsutil -q cp 'gs://releases/tool/tool_Linux_x86_64.tar.gz'",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.url, func(t *testing.T) {
+			transport := &scriptRecorder{}
+			config := BinaryInstallConfig{RemoteHost: "web1", AWSRegion: "eu-west-1", BackupDir: "/var/backups"}
+			upload := BinaryUpload{URL: tt.url, DestinationDir: "/usr/local/bin", Owner: "root", Permission: "0755"}
+			if err := processUploadSingleCommand(config, transport, upload); err != nil {
+				t.Fatal(err)
+			}
+			script := transport.script()
+			for _, want := range tt.want {
+				if !strings.Contains(script, want) {
+					t.Errorf("script lacks %q:\n%s", want, script)
+				}
+			}
+			if strings.Contains(script, "curl") {
+				t.Errorf("%s downloaded over HTTP:\n%s", tt.url, script)
+			}
+		})
+	}
+}
+
+func TestFetchLocallyS3(t *testing.T) {
+	args := stubCommand(t, "aws", `printf archive > "$5"`)
+	config := BinaryInstallConfig{AWSRegion: "eu-west-1", AWSProfile: "deploy"}
+	upload := BinaryUpload{URL: "s3://releases/tool/tool_Linux_x86_64.tar.gz", FetchLocal: true}
+
+	path, cleanup, err := fetchArtifact(config, upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := os.ReadFile(path); err != nil || string(got) != "archive" {
+		t.Errorf("fetched %q, %v", got, err)
+	}
+	want := []string{"s3", "cp", "--only-show-errors", upload.URL, path, "--region", "eu-west-1", "--profile", "deploy"}
+	if got := readArgs(t, args); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("aws called with %q, want %q", got, want)
+	}
+	cleanup()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("fetched archive not removed: %v", err)
+	}
+}
+
+func TestFetchLocallyGCS(t *testing.T) {
+	// gcloud storage cp URL PATH
+	args := stubCommand(t, "gcloud", `printf '%s' "$CLOUDSDK_AUTH_CREDENTIAL_FILE_OVERRIDE" > "$4.credentials"; printf archive > "$4"`)
+	config := BinaryInstallConfig{GCSCredentialsFile: "/keys/deploy.json"}
+	upload := BinaryUpload{URL: "gs://releases/tool/tool_Linux_x86_64.tar.gz"}
+
+	path, cleanup, err := fetchArtifact(config, upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if got, err := os.ReadFile(path); err != nil || string(got) != "archive" {
+		t.Errorf("fetched %q, %v", got, err)
+	}
+	want := []string{"storage", "cp", upload.URL, path}
+	if got := readArgs(t, args); strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("gcloud called with %q, want %q", got, want)
+	}
+	if credentials, _ := os.ReadFile(path + ".credentials"); string(credentials) != config.GCSCredentialsFile {
+		t.Errorf("gcloud used credentials %q", credentials)
+	}
+}
+
+func TestPullOCIArtifact(t *testing.T) {
+	// oras pull --no-tty -o DIR [--username USER --password-stdin] REF
+	args := stubCommand(t, "oras", `cat > "$4/password"; [ -n "$NO_ARCHIVE" ] || printf archive > "$4/tool_Linux_x86_64.tar.gz"`)
+	config := BinaryInstallConfig{RegistryUsername: "ci", RegistryPassword: "s3cret"}
+	upload := BinaryUpload{URL: "oci://ghcr.io/org/tool:v1.2.3"}
+
+	path, cleanup, err := fetchArtifact(config, upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	if filepath.Base(path) != "tool_Linux_x86_64.tar.gz" {
+		t.Errorf("pulled %s, not the artifact's archive", path)
+	}
+	got := readArgs(t, args)
+	want := []string{"pull", "--no-tty", "-o", filepath.Dir(path), "--username", "ci", "--password-stdin", "ghcr.io/org/tool:v1.2.3"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("oras called with %q, want %q", got, want)
+	}
+	if password, _ := os.ReadFile(filepath.Join(filepath.Dir(path), "password")); string(password) != "s3cret" {
+		t.Errorf("oras read password %q from stdin", password)
+	}
+
+	t.Setenv("NO_ARCHIVE", "1")
+	if _, _, err := fetchArtifact(config, upload); err == nil || !strings.Contains(err.Error(), "expected one") {
+		t.Errorf("an artifact without an archive was accepted: %v", err)
+	}
+}
+
+// staticSource is an ArtifactSource downloading from a fixed mirror.
+type staticSource struct{ url string }
+
+func (s staticSource) Fetch(ctx context.Context) (Artifact, error) {
+	return Artifact{Name: "tool_Linux_x86_64.tar.gz", Command: "fetch-from-mirror " + shellQuote(s.url) + ` "$ARTIFACT"`}, nil
+}
+
+func TestRegisterSource(t *testing.T) {
+	RegisterSource("Mirror", func(config BinaryInstallConfig, upload BinaryUpload) (ArtifactSource, error) {
+		return staticSource{upload.URL}, nil
+	})
+	transport := &scriptRecorder{}
+	upload := BinaryUpload{URL: "mirror://tools/tool/1.2.3", DestinationDir: "/usr/local/bin", Owner: "root", Permission: "0755"}
+	if err := processUploadSingleCommand(BinaryInstallConfig{RemoteHost: "web1", BackupDir: "/var/backups"}, transport, upload); err != nil {
+		t.Fatal(err)
+	}
+	if script := transport.script(); !strings.Contains(script, "fetch-from-mirror 'mirror://tools/tool/1.2.3'") {
+		t.Errorf("script does not fetch from the registered source:\n%s", script)
+	}
+
+	for _, rawURL := range []string{"ftp://example.com/tool.tar.gz", "tool.tar.gz"} {
+		if _, err := sourceFor(BinaryInstallConfig{}, BinaryUpload{URL: rawURL}); err == nil {
+			t.Errorf("%s resolved to a source", rawURL)
+		}
+	}
+}
+
+func TestPresign(t *testing.T) {
+	tests := []struct {
+		url, command, signed string
+		config               BinaryInstallConfig
+		wantArgs             []string
+	}{
+		{
+			url:      "s3://releases/tool/tool_Linux_x86_64.tar.gz",
+			command:  "aws",
+			signed:   "https://releases.s3.amazonaws.com/tool/tool_Linux_x86_64.tar.gz?X-Amz-Expires=600&X-Amz-Signature=abc",
+			config:   BinaryInstallConfig{PresignExpiry: 10 * time.Minute, AWSRegion: "eu-west-1"},
+			wantArgs: []string{"s3", "presign", "s3://releases/tool/tool_Linux_x86_64.tar.gz", "--expires-in", "600", "--region", "eu-west-1"},
+		},
+		{
+			url:      "gs://releases/tool/tool_Linux_x86_64.tar.gz",
+			command:  "gcloud",
+			signed:   "https://storage.googleapis.com/releases/tool/tool_Linux_x86_64.tar.gz?X-Goog-Signature=abc",
+			config:   BinaryInstallConfig{GCSCredentialsFile: "/keys/deploy.json"},
+			wantArgs: []string{"storage", "sign-url", "gs://releases/tool/tool_Linux_x86_64.tar.gz", "--duration", "15m0s", "--format", "value(signed_url)", "--private-key-file", "/keys/deploy.json"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.command, func(t *testing.T) {
+			args := stubCommand(t, tt.command, "echo "+shellQuote(tt.signed))
+			source, err := sourceFor(tt.config, BinaryUpload{URL: tt.url, Presign: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			artifact, err := source.Fetch(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := readArgs(t, args); strings.Join(got, " ") != strings.Join(tt.wantArgs, " ") {
+				t.Errorf("%s called with %q, want %q", tt.command, got, tt.wantArgs)
+			}
+			// The host downloads the signed URL over HTTPS, with no credentials of its own
+			if artifact.Name != "tool_Linux_x86_64.tar.gz" || artifact.LocalPath != "" {
+				t.Errorf("artifact %+v", artifact)
+			}
+			if !strings.Contains(artifact.Command, `-o "$ARTIFACT" `+shellQuote(tt.signed)) {
+				t.Errorf("command does not download the signed URL:\n%s", artifact.Command)
+			}
+		})
+	}
+}
+
+func TestChecksumHeaderScript(t *testing.T) {
+	// Hosts without the GNU tools have shasum and md5 instead
+	gnu := map[string]string{}
+	for _, tool := range []string{"sha256sum", "sha1sum", "md5sum"} {
+		path, err := exec.LookPath(tool)
+		if err != nil {
+			t.Skipf("%s is needed to stand in for shasum and md5", tool)
+		}
+		gnu[tool] = path
+		stubCommand(t, tool, "exit 127")
+	}
+	stubCommand(t, "shasum", `case $2 in 256) exec `+shellQuote(gnu["sha256sum"])+` "$3" ;; 1) exec `+shellQuote(gnu["sha1sum"])+` "$3" ;; esac; exit 1`)
+	stubCommand(t, "md5", `[ "$1" = -q ] && exec `+shellQuote(gnu["md5sum"])+` "$2"`)
+	stubCommand(t, "curl", `while [ $# -gt 0 ]; do case $1 in -D) headers=$2; shift ;; -o) out=$2; shift ;; esac; shift; done
+printf archive > "$out"
+printf 'HTTP/1.1 200 OK\r\nX-Checksum: %s\r\n\r\n' "$DIGEST" > "$headers"`)
+
+	upload := BinaryUpload{URL: "https://repo.example.com/tool_Linux_x86_64.tar.gz", ChecksumHeader: "X-Checksum"}
+	source, err := sourceFor(BinaryInstallConfig{}, upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	artifact, err := source.Fetch(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sha256sum, sha1sum, md5sum := sha256.Sum256([]byte("archive")), sha1.Sum([]byte("archive")), md5.Sum([]byte("archive"))
+	for _, tt := range []struct {
+		digest  string
+		wantErr string
+	}{
+		{hex.EncodeToString(sha256sum[:]), ""},
+		{strings.ToUpper(hex.EncodeToString(sha1sum[:])), ""},
+		{hex.EncodeToString(md5sum[:]), ""},
+		{strings.Repeat("0", 64), "checksum mismatch"},
+		{"abc", "missing or unrecognized X-Checksum header"},
+	} {
+		cmd := exec.Command("sh", "-c", artifact.Command)
+		cmd.Env = append(os.Environ(), "ARTIFACT="+filepath.Join(t.TempDir(), "tool_Linux_x86_64.tar.gz"), "DIGEST="+tt.digest)
+		out, err := cmd.CombinedOutput()
+		if tt.wantErr == "" && err != nil {
+			t.Errorf("digest %s: %v: %s", tt.digest, err, out)
+		}
+		if tt.wantErr != "" && (err == nil || !strings.Contains(string(out), tt.wantErr)) {
+			t.Errorf("digest %s: returned %v: %s, want %q", tt.digest, err, out, tt.wantErr)
+		}
+	}
+}
+
+func TestVerboseScriptRedactsCredentials(t *testing.T) {
+	var logged strings.Builder
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+	config := BinaryInstallConfig{RemoteHost: "web1", BackupDir: "/var/backups", Verbose: true}
+	upload := BinaryUpload{
+		URL:               "https://repo.example.com/{{.name}}/tool_Linux_x86_64.tar.gz",
+		Vars:              map[string]string{"name": "tool"},
+		BasicAuthUser:     "deploy",
+		BasicAuthPassword: "s3cret",
+		Headers:           []string{"X-Api-Key: k3y"},
+		DestinationDir:    "/usr/local/bin",
+		Owner:             "root",
+		Permission:        "0755",
+	}
+	if err := processUploadSingleCommand(config, &scriptRecorder{}, upload); err != nil {
+		t.Fatal(err)
+	}
+	// The Authorization header is only built once the URL is expanded
+	creds := base64.StdEncoding.EncodeToString([]byte("deploy:s3cret"))
+	if !strings.Contains(logged.String(), "repo.example.com/tool/") {
+		t.Fatalf("the script was not logged:\n%s", logged.String())
+	}
+	for _, secret := range []string{creds, "s3cret", "k3y"} {
+		if strings.Contains(logged.String(), secret) {
+			t.Errorf("the logged script holds %q:\n%s", secret, logged.String())
+		}
+	}
+}
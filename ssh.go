@@ -0,0 +1,513 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/net/proxy"
+)
+
+// defaultConnectTimeout bounds dialing and the SSH handshake when
+// BinaryInstallConfig.ConnectTimeout is unset.
+const defaultConnectTimeout = 30 * time.Second
+
+// SSHError describes a failure talking to a remote host over SSH.
+// Op is one of "dial", "auth", "handshake", "session" or "run".
+type SSHError struct {
+	Op   string
+	Host string
+	Err  error
+}
+
+func (e *SSHError) Error() string {
+	return fmt.Sprintf("ssh %s %s: %v", e.Op, e.Host, e.Err)
+}
+
+func (e *SSHError) Unwrap() error { return e.Err }
+
+// JumpHop is one bastion in a chain of jump hosts. User and KeyPath default
+// to the target's SSHUser and SSHKeyPath.
+type JumpHop struct {
+	Host    string // e.g., "bastion.example.com" or "bastion.example.com:2222"
+	User    string
+	KeyPath string
+}
+
+// ParseJumpHop parses a ProxyJump-style "[user@]host[:port]" spec.
+func ParseJumpHop(spec string) JumpHop {
+	if at := strings.LastIndex(spec, "@"); at >= 0 {
+		return JumpHop{User: spec[:at], Host: spec[at+1:]}
+	}
+	return JumpHop{Host: spec}
+}
+
+// jumpHops returns the ordered jump chain: JumpHost first, then JumpHosts.
+func jumpHops(config BinaryInstallConfig) []JumpHop {
+	var hops []JumpHop
+	if config.JumpHost != "" {
+		hops = append(hops, JumpHop{Host: config.JumpHost, User: config.JumpUser, KeyPath: config.JumpKeyPath})
+	}
+	return append(hops, config.JumpHosts...)
+}
+
+// dialSSH opens a native SSH client connection to config.RemoteHost,
+// tunneling through the jump chain when one is set. With UseSSHConfig the
+// host is first resolved against the user's ~/.ssh/config.
+func dialSSH(config BinaryInstallConfig) (*ssh.Client, error) {
+	config, err := applySSHOptions(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.UseSSHConfig {
+		resolved, err := resolveSSHConfig(config)
+		if err != nil {
+			return nil, err
+		}
+		config = resolved
+	}
+	addr := sshAddress(config.RemoteHost)
+
+	hops := jumpHops(config)
+	if len(hops) == 0 {
+		conn, err := dialTCP(config, addr)
+		if err != nil {
+			return nil, &SSHError{Op: "dial", Host: addr, Err: err}
+		}
+		return newSSHClient(config, conn, addr)
+	}
+
+	// Connect to the last hop, itself reached through the hops before it.
+	last := hops[len(hops)-1]
+	jumpConfig := config
+	jumpConfig.RemoteHost = last.Host
+	jumpConfig.JumpHost, jumpConfig.JumpUser, jumpConfig.JumpKeyPath = "", "", ""
+	jumpConfig.JumpHosts = hops[:len(hops)-1]
+	jumpConfig.SSHOptions = nil
+	if last.User != "" || config.UseSSHConfig {
+		jumpConfig.SSHUser = last.User
+	}
+	if last.KeyPath != "" {
+		jumpConfig.SSHKeyPath = last.KeyPath
+	}
+	jump, err := dialSSH(jumpConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := jump.Dial("tcp", addr)
+	if err != nil {
+		jump.Close()
+		return nil, &SSHError{Op: "dial", Host: addr, Err: fmt.Errorf("via %s: %w", last.Host, err)}
+	}
+	client, err := newSSHClient(config, conn, addr)
+	if err != nil {
+		jump.Close()
+		return nil, err
+	}
+	go func() {
+		client.Wait()
+		jump.Close()
+	}()
+	return client, nil
+}
+
+// dialTCP opens the first-hop TCP connection, through config.ProxyURL if set.
+func dialTCP(config BinaryInstallConfig, addr string) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: connectTimeout(config)}
+	if config.ProxyURL == "" {
+		return dialer.Dial("tcp", addr)
+	}
+
+	u, err := url.Parse(config.ProxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	proxyDialer, err := proxy.FromURL(u, dialer)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported proxy URL %s: %w", u.Redacted(), err)
+	}
+	if cd, ok := proxyDialer.(proxy.ContextDialer); ok {
+		ctx, cancel := context.WithTimeout(context.Background(), connectTimeout(config))
+		defer cancel()
+		return cd.DialContext(ctx, "tcp", addr)
+	}
+	return proxyDialer.Dial("tcp", addr)
+}
+
+// newSSHClient performs the SSH handshake for addr over an established conn.
+func newSSHClient(config BinaryInstallConfig, conn net.Conn, addr string) (*ssh.Client, error) {
+	auth, closeAuth, err := sshAuthMethods(config)
+	if err != nil {
+		conn.Close()
+		return nil, &SSHError{Op: "auth", Host: addr, Err: err}
+	}
+	defer closeAuth()
+
+	sshUser := config.SSHUser
+	if sshUser == "" {
+		sshUser = localUsername()
+	}
+	hostKeys, err := hostKeyCallback(config)
+	if err != nil {
+		conn.Close()
+		return nil, &SSHError{Op: "handshake", Host: addr, Err: err}
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:            sshUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeys,
+	}
+
+	// Bound the handshake by the connect timeout, then clear the deadline.
+	conn.SetDeadline(time.Now().Add(connectTimeout(config)))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		conn.Close()
+		op := "handshake"
+		if strings.Contains(err.Error(), "unable to authenticate") {
+			op = "auth"
+		}
+		return nil, &SSHError{Op: op, Host: addr, Err: err}
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := ssh.NewClient(c, chans, reqs)
+	if config.KeepAliveInterval > 0 {
+		go keepAlive(client, config.KeepAliveInterval)
+	}
+	return client, nil
+}
+
+// keepAliveMaxMissed is how many unanswered keepalives close the connection.
+const keepAliveMaxMissed = 3
+
+// keepAlive sends keepalive requests on client every interval and closes the
+// connection when the server stops answering, so stuck sessions fail.
+func keepAlive(client *ssh.Client, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		client.Wait()
+		close(done)
+	}()
+
+	missed := 0
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+
+		reply := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			reply <- err
+		}()
+
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			if err != nil {
+				client.Close()
+				return
+			}
+			missed = 0
+		case <-time.After(interval):
+			missed++
+			if missed >= keepAliveMaxMissed {
+				client.Close()
+				return
+			}
+		}
+	}
+}
+
+// connectTimeout returns config.ConnectTimeout or its default.
+func connectTimeout(config BinaryInstallConfig) time.Duration {
+	if config.ConnectTimeout > 0 {
+		return config.ConnectTimeout
+	}
+	return defaultConnectTimeout
+}
+
+// runSSHCommand runs command in a new session on client and returns its combined output.
+// The remote command is killed if ctx is done first. stdin, if non-nil, is
+// fed to the command. With forwardAgent the session requests forwarding of
+// the agent registered on client.
+func runSSHCommand(ctx context.Context, client *ssh.Client, host, command string, stdin io.Reader, forwardAgent bool) (string, error) {
+	session, err := client.NewSession()
+	if err != nil {
+		return "", &SSHError{Op: "session", Host: host, Err: err}
+	}
+	defer session.Close()
+
+	if forwardAgent {
+		if err := agent.RequestAgentForwarding(session); err != nil {
+			return "", &SSHError{Op: "session", Host: host, Err: fmt.Errorf("agent forwarding: %w", err)}
+		}
+	}
+
+	session.Stdin = stdin
+	var output bytes.Buffer
+	session.Stdout = &output
+	session.Stderr = &output
+
+	done := make(chan error, 1)
+	go func() { done <- session.Run(command) }()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		<-done
+		err = ctx.Err()
+	}
+	if err != nil {
+		return output.String(), &SSHError{Op: "run", Host: host, Err: err}
+	}
+	return output.String(), nil
+}
+
+// sshAddress appends the default SSH port to host if it has none.
+func sshAddress(host string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, "22")
+}
+
+// sshAuthMethods builds the client auth methods from the configured private key
+// and password and, when enabled or when nothing else is configured, the SSH
+// agent at SSH_AUTH_SOCK.
+// The returned func releases the agent connection once authentication is done.
+func sshAuthMethods(config BinaryInstallConfig) ([]ssh.AuthMethod, func(), error) {
+	var methods []ssh.AuthMethod
+	closeAuth := func() {}
+	byName := map[string][]ssh.AuthMethod{}
+
+	// IdentitiesOnly limits the agent to the identity file, as OpenSSH does
+	identitiesOnly := false
+	if val, ok := sshOption(config, "IdentitiesOnly"); ok && yes(val) {
+		if config.SSHKeyPath == "" {
+			return nil, closeAuth, errors.New("IdentitiesOnly=yes needs an IdentityFile or SSH key")
+		}
+		identitiesOnly = true
+	}
+
+	var key ssh.Signer
+	if config.SSHKeyPath != "" {
+		keyBytes, err := os.ReadFile(config.SSHKeyPath)
+		if err != nil {
+			return nil, closeAuth, fmt.Errorf("failed to read SSH key: %w", err)
+		}
+		key, err = parsePrivateKey(keyBytes, config.SSHKeyPassphrase)
+		if err != nil {
+			return nil, closeAuth, fmt.Errorf("failed to parse SSH key %s: %w", config.SSHKeyPath, err)
+		}
+		methods = append(methods, ssh.PublicKeys(key))
+		byName["publickey"] = append(byName["publickey"], methods[len(methods)-1])
+	}
+
+	if config.SSHPassword != "" {
+		password := config.SSHPassword
+		methods = append(methods,
+			ssh.Password(password),
+			ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range questions {
+					if !echos[i] {
+						answers[i] = password
+					}
+				}
+				return answers, nil
+			}),
+		)
+		byName["password"] = methods[len(methods)-2 : len(methods)-1]
+		byName["keyboard-interactive"] = methods[len(methods)-1:]
+	}
+
+	if config.SSHAgent || len(methods) == 0 {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			return nil, closeAuth, errors.New("SSH agent requested but SSH_AUTH_SOCK is not set")
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			return nil, closeAuth, fmt.Errorf("failed to connect to SSH agent: %w", err)
+		}
+		closeAuth = func() { conn.Close() }
+		signers := agent.NewClient(conn).Signers
+		if identitiesOnly {
+			signers = identitySigners(signers, key.PublicKey())
+		}
+		methods = append(methods, ssh.PublicKeysCallback(signers))
+		byName["publickey"] = append(byName["publickey"], methods[len(methods)-1])
+	}
+
+	// PreferredAuthentications reorders the methods and drops unlisted ones.
+	if preferred, ok := sshOption(config, "PreferredAuthentications"); ok {
+		methods = nil
+		for _, name := range strings.Split(preferred, ",") {
+			methods = append(methods, byName[strings.TrimSpace(name)]...)
+		}
+		if len(methods) == 0 {
+			return nil, closeAuth, fmt.Errorf("no configured credentials match PreferredAuthentications=%s", preferred)
+		}
+	}
+
+	return methods, closeAuth, nil
+}
+
+// identitySigners filters the agent's signers to those holding key.
+func identitySigners(signers func() ([]ssh.Signer, error), key ssh.PublicKey) func() ([]ssh.Signer, error) {
+	return func() ([]ssh.Signer, error) {
+		all, err := signers()
+		var matching []ssh.Signer
+		for _, s := range all {
+			if bytes.Equal(s.PublicKey().Marshal(), key.Marshal()) {
+				matching = append(matching, s)
+			}
+		}
+		return matching, err
+	}
+}
+
+// Host key checking modes for BinaryInstallConfig.HostKeyCheck.
+const (
+	HostKeyStrict    = "strict"     // host must already be in known_hosts
+	HostKeyAcceptNew = "accept-new" // unknown hosts are added to known_hosts
+	HostKeyInsecure  = "insecure"   // host keys are not checked at all
+)
+
+// knownHostsMu serializes appends to known_hosts from parallel connections.
+var knownHostsMu sync.Mutex
+
+// pinnedFingerprint looks up config.RemoteHost in config.HostKeyFingerprints,
+// with or without its port.
+func pinnedFingerprint(config BinaryInstallConfig) (string, bool) {
+	if fp, ok := config.HostKeyFingerprints[config.RemoteHost]; ok {
+		return fp, true
+	}
+	if host, _, err := net.SplitHostPort(config.RemoteHost); err == nil {
+		fp, ok := config.HostKeyFingerprints[host]
+		return fp, ok
+	}
+	return "", false
+}
+
+// parsePrivateKey parses a PEM private key, decrypting it with passphrase if needed.
+func parsePrivateKey(keyBytes []byte, passphrase string) (ssh.Signer, error) {
+	if passphrase != "" {
+		return ssh.ParsePrivateKeyWithPassphrase(keyBytes, []byte(passphrase))
+	}
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		return nil, errors.New("key is encrypted; set SSHKeyPassphrase")
+	}
+	return signer, err
+}
+
+// hostKeyCallback verifies host keys against a pinned fingerprint if one is
+// configured for the host, and otherwise against the known_hosts file
+// according to config.HostKeyCheck. A changed key is rejected in every mode
+// but insecure.
+func hostKeyCallback(config BinaryInstallConfig) (ssh.HostKeyCallback, error) {
+	if pinned, ok := pinnedFingerprint(config); ok {
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if got := ssh.FingerprintSHA256(key); got != pinned {
+				return fmt.Errorf("host key mismatch for %s: got %s, pinned %s", hostname, got, pinned)
+			}
+			return nil
+		}, nil
+	}
+
+	mode := config.HostKeyCheck
+	if mode == "" {
+		mode = HostKeyStrict
+	}
+	if mode == HostKeyInsecure {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+	if mode != HostKeyStrict && mode != HostKeyAcceptNew {
+		return nil, fmt.Errorf("unknown host key check mode %q", mode)
+	}
+
+	path := config.KnownHostsPath
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate known_hosts: %w", err)
+		}
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+
+	if mode == HostKeyAcceptNew {
+		if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+			return nil, fmt.Errorf("failed to create known_hosts directory: %w", err)
+		}
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create known_hosts: %w", err)
+		}
+		f.Close()
+	}
+
+	knownHostsMu.Lock()
+	checker, err := knownhosts.New(path)
+	knownHostsMu.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to load known_hosts: %w", err)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := checker(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if !errors.As(err, &keyErr) {
+			return err
+		}
+		if len(keyErr.Want) > 0 {
+			return fmt.Errorf("host key mismatch for %s: got %s %s, known_hosts (%s:%d) has %s",
+				hostname, key.Type(), ssh.FingerprintSHA256(key),
+				keyErr.Want[0].Filename, keyErr.Want[0].Line, ssh.FingerprintSHA256(keyErr.Want[0].Key))
+		}
+		if mode == HostKeyStrict {
+			return fmt.Errorf("host %s is not in %s (strict host key checking)", hostname, path)
+		}
+
+		knownHostsMu.Lock()
+		defer knownHostsMu.Unlock()
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("failed to update known_hosts: %w", err)
+		}
+		defer f.Close()
+		if _, err := fmt.Fprintln(f, knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)); err != nil {
+			return fmt.Errorf("failed to update known_hosts: %w", err)
+		}
+		if config.Verbose {
+			log.Printf("Added %s key %s for %s to %s", key.Type(), ssh.FingerprintSHA256(key), hostname, path)
+		}
+		return nil
+	}, nil
+}
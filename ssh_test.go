@@ -0,0 +1,106 @@
+package binaryinstall
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func newHostKey(t *testing.T) ssh.PublicKey {
+	t.Helper()
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestHostKeyCallback(t *testing.T) {
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 5), Port: 22}
+	key, changed := newHostKey(t), newHostKey(t)
+	check := func(mode, knownHosts string, key ssh.PublicKey) error {
+		callback, err := hostKeyCallback(BinaryInstallConfig{HostKeyCheck: mode, KnownHostsPath: knownHosts})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return callback("web1:22", addr, key)
+	}
+
+	// unknown hosts are rejected unless accept-new is asked for
+	knownHosts := filepath.Join(t.TempDir(), "known_hosts")
+	if err := os.WriteFile(knownHosts, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for _, mode := range []string{"", HostKeyStrict} {
+		if err := check(mode, knownHosts, key); err == nil || !strings.Contains(err.Error(), "strict host key checking") {
+			t.Errorf("mode %q accepted an unknown host: %v", mode, err)
+		}
+	}
+	if raw, _ := os.ReadFile(knownHosts); len(raw) > 0 {
+		t.Errorf("strict checking wrote to known_hosts: %q", raw)
+	}
+
+	if err := check(HostKeyAcceptNew, knownHosts, key); err != nil {
+		t.Fatalf("accept-new rejected an unknown host: %v", err)
+	}
+	for _, mode := range []string{"", HostKeyStrict, HostKeyAcceptNew} {
+		if err := check(mode, knownHosts, key); err != nil {
+			t.Errorf("mode %q rejected a known host: %v", mode, err)
+		}
+		if err := check(mode, knownHosts, changed); err == nil || !strings.Contains(err.Error(), "host key mismatch") {
+			t.Errorf("mode %q accepted a changed key: %v", mode, err)
+		}
+	}
+	if err := check(HostKeyInsecure, knownHosts, changed); err != nil {
+		t.Errorf("insecure rejected a changed key: %v", err)
+	}
+
+	if _, err := hostKeyCallback(BinaryInstallConfig{HostKeyCheck: "yes", KnownHostsPath: knownHosts}); err == nil {
+		t.Errorf("an unknown mode was accepted")
+	}
+}
+
+func TestIdentitiesOnly(t *testing.T) {
+	keyring := agent.NewKeyring()
+	var keys []ssh.PublicKey
+	for i := 0; i < 2; i++ {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := keyring.Add(agent.AddedKey{PrivateKey: priv}); err != nil {
+			t.Fatal(err)
+		}
+		signer, err := ssh.NewSignerFromKey(priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, signer.PublicKey())
+	}
+	signers, err := identitySigners(keyring.Signers, keys[1])()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(signers) != 1 || string(signers[0].PublicKey().Marshal()) != string(keys[1].Marshal()) {
+		t.Errorf("identitySigners() returned %d signers, want only the identity file's", len(signers))
+	}
+
+	config := BinaryInstallConfig{SSHAgent: true, SSHOptions: []string{"IdentitiesOnly=yes"}}
+	if _, err := applySSHOptions(config); err != nil {
+		t.Errorf("applySSHOptions() = %v", err)
+	}
+	if _, _, err := sshAuthMethods(config); err == nil || !strings.Contains(err.Error(), "needs an IdentityFile") {
+		t.Errorf("IdentitiesOnly without a key returned %v", err)
+	}
+}
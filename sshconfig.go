@@ -0,0 +1,98 @@
+package binaryinstall
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+
+	"github.com/kevinburke/ssh_config"
+)
+
+// resolveSSHConfig fills in connection details for config.RemoteHost from the
+// user's OpenSSH client config. Values already set on config take precedence.
+func resolveSSHConfig(config BinaryInstallConfig) (BinaryInstallConfig, error) {
+	path := config.SSHConfigPath
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return config, fmt.Errorf("failed to locate ~/.ssh/config: %w", err)
+		}
+		path = filepath.Join(home, ".ssh", "config")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) && config.SSHConfigPath == "" {
+			return config, nil
+		}
+		return config, fmt.Errorf("failed to open SSH config: %w", err)
+	}
+	defer f.Close()
+
+	cfg, err := ssh_config.Decode(f)
+	if err != nil {
+		return config, fmt.Errorf("failed to parse SSH config %s: %w", path, err)
+	}
+
+	alias, port := config.RemoteHost, ""
+	if h, p, err := net.SplitHostPort(config.RemoteHost); err == nil {
+		alias, port = h, p
+	}
+	get := func(key string) string {
+		val, _ := cfg.Get(alias, key)
+		return val
+	}
+
+	host := alias
+	if hostName := get("HostName"); hostName != "" {
+		host = strings.ReplaceAll(hostName, "%h", alias)
+	}
+	if port == "" {
+		port = get("Port")
+	}
+	if port != "" {
+		config.RemoteHost = net.JoinHostPort(host, port)
+	} else {
+		config.RemoteHost = host
+	}
+
+	if config.SSHUser == "" {
+		config.SSHUser = get("User")
+	}
+	if config.SSHKeyPath == "" {
+		if identity := get("IdentityFile"); identity != "" {
+			config.SSHKeyPath = expandHome(identity)
+		}
+	}
+	if config.JumpHost == "" && len(config.JumpHosts) == 0 {
+		if proxyJump := get("ProxyJump"); proxyJump != "" && !strings.EqualFold(proxyJump, "none") {
+			for _, spec := range strings.Split(proxyJump, ",") {
+				config.JumpHosts = append(config.JumpHosts, ParseJumpHop(strings.TrimSpace(spec)))
+			}
+		}
+	}
+	return config, nil
+}
+
+// expandHome replaces a leading "~/" in path with the user's home directory.
+func expandHome(path string) string {
+	if !strings.HasPrefix(path, "~/") {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return path
+	}
+	return filepath.Join(home, path[2:])
+}
+
+// localUsername returns the name of the user running the installer.
+func localUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
@@ -0,0 +1,98 @@
+package binaryinstall
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestResolveSSHConfig(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte(`
+# production web servers
+Host web1
+    HostName 10.0.0.11
+    Port 2222
+    User deploy
+    IdentityFile ~/.ssh/web.pem
+    ProxyJump ops@bastion1, bastion2:2200
+
+Host *.internal
+    HostName %h.example.com
+    User admin
+
+Host direct
+    ProxyJump none
+`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config BinaryInstallConfig
+		want   BinaryInstallConfig
+	}{
+		{
+			"alias",
+			BinaryInstallConfig{RemoteHost: "web1"},
+			BinaryInstallConfig{RemoteHost: "10.0.0.11:2222", SSHUser: "deploy", SSHKeyPath: filepath.Join(home, ".ssh/web.pem"),
+				JumpHosts: []JumpHop{{User: "ops", Host: "bastion1"}, {Host: "bastion2:2200"}}},
+		},
+		{
+			"explicit settings win",
+			BinaryInstallConfig{RemoteHost: "web1:22", SSHUser: "root", SSHKeyPath: "/keys/id", JumpHost: "jump"},
+			BinaryInstallConfig{RemoteHost: "10.0.0.11:22", SSHUser: "root", SSHKeyPath: "/keys/id", JumpHost: "jump"},
+		},
+		{
+			"pattern with %h",
+			BinaryInstallConfig{RemoteHost: "db.internal"},
+			BinaryInstallConfig{RemoteHost: "db.internal.example.com", SSHUser: "admin"},
+		},
+		{
+			"ProxyJump none",
+			BinaryInstallConfig{RemoteHost: "direct"},
+			BinaryInstallConfig{RemoteHost: "direct"},
+		},
+		{
+			"unknown host",
+			BinaryInstallConfig{RemoteHost: "10.1.2.3:2200"},
+			BinaryInstallConfig{RemoteHost: "10.1.2.3:2200"},
+		},
+	}
+	for _, tt := range tests {
+		tt.config.SSHConfigPath, tt.want.SSHConfigPath = path, path
+		got, err := resolveSSHConfig(tt.config)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: resolved\n%+v\nwant\n%+v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestResolveSSHConfigMissing(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	config := BinaryInstallConfig{RemoteHost: "web1"}
+	if got, err := resolveSSHConfig(config); err != nil || !reflect.DeepEqual(got, config) {
+		t.Errorf("without ~/.ssh/config: %+v, %v", got, err)
+	}
+
+	config.SSHConfigPath = filepath.Join(t.TempDir(), "missing")
+	if _, err := resolveSSHConfig(config); err == nil {
+		t.Errorf("a missing SSH config given explicitly was ignored")
+	}
+
+	bad := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(bad, []byte("Host web1\n  Match\n\"unterminated\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	config.SSHConfigPath = bad
+	if _, err := resolveSSHConfig(config); err == nil {
+		t.Errorf("a malformed SSH config was accepted")
+	}
+}
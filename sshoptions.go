@@ -0,0 +1,113 @@
+package binaryinstall
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sshOption returns the value of the named entry in config.SSHOptions.
+// Option names are matched case-insensitively, as OpenSSH does.
+func sshOption(config BinaryInstallConfig, name string) (string, bool) {
+	for _, opt := range config.SSHOptions {
+		key, val := splitSSHOption(opt)
+		if strings.EqualFold(key, name) {
+			return val, true
+		}
+	}
+	return "", false
+}
+
+// splitSSHOption splits "Key=Value" or "Key Value".
+func splitSSHOption(opt string) (string, string) {
+	opt = strings.TrimSpace(opt)
+	if i := strings.IndexAny(opt, "= \t"); i >= 0 {
+		return opt[:i], strings.TrimSpace(strings.TrimLeft(opt[i:], "= \t"))
+	}
+	return opt, ""
+}
+
+// applySSHOptions maps OpenSSH-style options onto the native client config.
+// Options take precedence over the structured fields they correspond to.
+func applySSHOptions(config BinaryInstallConfig) (BinaryInstallConfig, error) {
+	for _, opt := range config.SSHOptions {
+		key, val := splitSSHOption(opt)
+		switch strings.ToLower(key) {
+		case "hostname":
+			if _, port, err := net.SplitHostPort(config.RemoteHost); err == nil {
+				config.RemoteHost = net.JoinHostPort(val, port)
+			} else {
+				config.RemoteHost = val
+			}
+		case "port":
+			host := config.RemoteHost
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			config.RemoteHost = net.JoinHostPort(host, val)
+		case "user":
+			config.SSHUser = val
+		case "identityfile":
+			config.SSHKeyPath = expandHome(val)
+		case "connecttimeout":
+			seconds, err := strconv.Atoi(val)
+			if err != nil {
+				return config, fmt.Errorf("invalid SSH option %q: %w", opt, err)
+			}
+			config.ConnectTimeout = time.Duration(seconds) * time.Second
+		case "serveraliveinterval":
+			seconds, err := strconv.Atoi(val)
+			if err != nil {
+				return config, fmt.Errorf("invalid SSH option %q: %w", opt, err)
+			}
+			config.KeepAliveInterval = time.Duration(seconds) * time.Second
+		case "stricthostkeychecking":
+			switch strings.ToLower(val) {
+			case "yes":
+				config.HostKeyCheck = HostKeyStrict
+			case "accept-new":
+				config.HostKeyCheck = HostKeyAcceptNew
+			case "no", "off":
+				config.HostKeyCheck = HostKeyInsecure
+			default:
+				return config, fmt.Errorf("unsupported SSH option %q", opt)
+			}
+		case "userknownhostsfile":
+			config.KnownHostsPath = expandHome(val)
+		case "proxyjump":
+			config.JumpHost, config.JumpUser, config.JumpKeyPath = "", "", ""
+			config.JumpHosts = nil
+			if !strings.EqualFold(val, "none") {
+				for _, spec := range strings.Split(val, ",") {
+					config.JumpHosts = append(config.JumpHosts, ParseJumpHop(strings.TrimSpace(spec)))
+				}
+			}
+		case "identitiesonly", "preferredauthentications", "forwardagent", "compression":
+			// Read by sshAuthMethods and newSSHTransport.
+		default:
+			return config, fmt.Errorf("unsupported SSH option %q", key)
+		}
+	}
+	return config, nil
+}
+
+// yes reports whether an OpenSSH flag value is enabled.
+func yes(val string) bool {
+	switch strings.ToLower(val) {
+	case "yes", "true", "on":
+		return true
+	}
+	return false
+}
+
+// sshOptionFlags renders config.SSHOptions as "-o" arguments for CLI-based transports.
+func sshOptionFlags(config BinaryInstallConfig) []string {
+	var args []string
+	for _, opt := range config.SSHOptions {
+		key, val := splitSSHOption(opt)
+		args = append(args, "-o", key+"="+val)
+	}
+	return args
+}
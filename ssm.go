@@ -0,0 +1,120 @@
+package binaryinstall
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ssmPollInterval is how often command status is polled.
+var ssmPollInterval = 2 * time.Second
+
+// ssmTransport runs scripts through AWS Systems Manager Run Command using the
+// aws CLI, for instances that have no SSH access at all.
+type ssmTransport struct {
+	config     BinaryInstallConfig
+	instanceID string
+}
+
+func (t *ssmTransport) Run(ctx context.Context, script string) (string, error) {
+	params, err := json.Marshal(map[string][]string{"commands": {script}})
+	if err != nil {
+		return "", err
+	}
+	// The script goes through a private file rather than argv, where other
+	// local users could read it and long scripts hit the argument size limit.
+	paramsFile, err := os.CreateTemp("", "binaryinstall-ssm-*.json")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(paramsFile.Name())
+	if _, err := paramsFile.Write(params); err != nil {
+		paramsFile.Close()
+		return "", err
+	}
+	if err := paramsFile.Close(); err != nil {
+		return "", err
+	}
+
+	out, err := t.aws(ctx, "ssm", "send-command",
+		"--instance-ids", t.instanceID,
+		"--document-name", "AWS-RunShellScript",
+		"--parameters", "file://"+filepath.ToSlash(paramsFile.Name()),
+		"--query", "Command.CommandId",
+		"--output", "text")
+	if err != nil {
+		return "", fmt.Errorf("ssm send-command to %s: %w", t.instanceID, err)
+	}
+	commandID := strings.TrimSpace(string(out))
+
+	for {
+		select {
+		case <-ctx.Done():
+			// Best effort: stop the command on the instance as well.
+			t.aws(context.Background(), "ssm", "cancel-command", "--command-id", commandID)
+			return "", fmt.Errorf("ssm command %s on %s: %w", commandID, t.instanceID, ctx.Err())
+		case <-time.After(ssmPollInterval):
+		}
+
+		out, err := t.aws(ctx, "ssm", "get-command-invocation",
+			"--command-id", commandID,
+			"--instance-id", t.instanceID,
+			"--output", "json")
+		if err != nil {
+			// The invocation is not visible immediately after send-command.
+			if strings.Contains(err.Error(), "InvocationDoesNotExist") {
+				continue
+			}
+			return "", fmt.Errorf("ssm get-command-invocation %s: %w", commandID, err)
+		}
+
+		var inv struct {
+			Status                string
+			StandardOutputContent string
+			StandardErrorContent  string
+		}
+		if err := json.Unmarshal(out, &inv); err != nil {
+			return "", fmt.Errorf("failed to parse ssm invocation: %w", err)
+		}
+
+		switch inv.Status {
+		case "Pending", "InProgress", "Delayed":
+			continue
+		case "Success":
+			return inv.StandardOutputContent + inv.StandardErrorContent, nil
+		default:
+			return inv.StandardOutputContent + inv.StandardErrorContent,
+				fmt.Errorf("ssm command %s on %s finished with status %s", commandID, t.instanceID, inv.Status)
+		}
+	}
+}
+
+func (t *ssmTransport) Close() error {
+	return nil
+}
+
+// aws runs the aws CLI with the configured region and profile.
+func (t *ssmTransport) aws(ctx context.Context, args ...string) ([]byte, error) {
+	if t.config.AWSRegion != "" {
+		args = append(args, "--region", t.config.AWSRegion)
+	}
+	if t.config.AWSProfile != "" {
+		args = append(args, "--profile", t.config.AWSProfile)
+	}
+	cmd := exec.CommandContext(ctx, "aws", args...)
+	out, err := cmd.Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return out, fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return out, err
+	}
+	return out, nil
+}
@@ -0,0 +1,69 @@
+package binaryinstall
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSSMParametersFile(t *testing.T) {
+	saved := ssmPollInterval
+	ssmPollInterval = time.Millisecond
+	defer func() { ssmPollInterval = saved }()
+
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	copied := filepath.Join(t.TempDir(), "params.json")
+	args := stubCommand(t, "aws", `case $2 in
+send-command)
+	file=$(printf '%s\n' "$@" | sed -n 's|^file://||p')
+	ls -l "$file" | cut -c1-10 > `+shellQuote(copied)+`.mode
+	cp "$file" `+shellQuote(copied)+`
+	echo cmd-123 ;;
+get-command-invocation)
+	printf '%s\n' '{"Status": "Success", "StandardOutputContent": "done\n"}' ;;
+esac`)
+
+	transport := &ssmTransport{instanceID: "i-0123456789abcdef0"}
+	script := "echo 'top secret'\n"
+	out, err := transport.Run(context.Background(), script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "done\n" {
+		t.Errorf("Run() = %q", out)
+	}
+	for _, arg := range readArgs(t, args) {
+		if strings.Contains(arg, "top secret") {
+			t.Errorf("script passed on the aws command line: %q", arg)
+		}
+	}
+
+	mode, err := os.ReadFile(copied + ".mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.TrimSpace(string(mode)); got != "-rw-------" {
+		t.Errorf("parameters file mode = %s, want -rw-------", got)
+	}
+	raw, err := os.ReadFile(copied)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var params map[string][]string
+	if err := json.Unmarshal(raw, &params); err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string][]string{"commands": {script}}; !reflect.DeepEqual(params, want) {
+		t.Errorf("parameters = %v, want %v", params, want)
+	}
+	matches, _ := filepath.Glob(filepath.Join(tmp, "binaryinstall-ssm-*.json"))
+	if len(matches) != 0 {
+		t.Errorf("parameters files left behind: %v", matches)
+	}
+}
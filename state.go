@@ -0,0 +1,164 @@
+package binaryinstall
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Host outcomes recorded in a state file.
+const (
+	HostInstalled  = "installed"
+	HostFailed     = "failed"
+	HostSkipped    = "skipped"     // not attempted, e.g. after an earlier batch failed
+	HostRolledBack = "rolled back" // failed its health check and was restored; see ErrRolledBack
+)
+
+// RunState is the outcome of each host of a run, as written to
+// BinaryInstallConfig.StateFile.
+type RunState struct {
+	Hosts []HostState `json:"hosts"`
+}
+
+// HostState is one host's outcome in a RunState.
+type HostState struct {
+	Host   string    `json:"host"`
+	Status string    `json:"status"` // HostInstalled, HostFailed, HostRolledBack, or HostSkipped
+	Error  string    `json:"error,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// LoadState reads a state file written by an earlier run.
+func LoadState(path string) (RunState, error) {
+	var state RunState
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return state, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(raw, &state); err != nil {
+		return state, fmt.Errorf("failed to parse state file %s: %w", path, err)
+	}
+	return state, nil
+}
+
+// Unfinished returns the hosts that failed, were rolled back, or were
+// skipped.
+func (s RunState) Unfinished() []string {
+	var hosts []string
+	for _, h := range s.Hosts {
+		if h.Status != HostInstalled {
+			hosts = append(hosts, h.Host)
+		}
+	}
+	return hosts
+}
+
+// outcomes collects each host's result during a run. It is shared by the
+// copies of a config through a pointer, and does nothing when nil.
+type outcomes struct {
+	mu    sync.Mutex
+	hosts map[string]HostState
+}
+
+func (o *outcomes) record(host string, err error) {
+	if o == nil {
+		return
+	}
+	state := HostState{Host: host, Status: HostInstalled, Time: time.Now().UTC()}
+	if err != nil {
+		state.Status, state.Error = HostFailed, err.Error()
+		if errors.Is(err, ErrRolledBack) {
+			state.Status = HostRolledBack
+		}
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.hosts == nil {
+		o.hosts = map[string]HostState{}
+	}
+	o.hosts[host] = state
+}
+
+// retryHosts narrows hosts to those the state file at path records as
+// unfinished, returning the earlier state as well.
+func retryHosts(path string, hosts []Host) ([]Host, RunState, error) {
+	previous, err := LoadState(path)
+	if err != nil {
+		return nil, previous, err
+	}
+	unfinished := map[string]bool{}
+	for _, h := range previous.Unfinished() {
+		unfinished[h] = true
+	}
+	var retry []Host
+	for _, host := range hosts {
+		if unfinished[host.Address] {
+			retry = append(retry, host)
+		}
+	}
+	return retry, previous, nil
+}
+
+// saveState writes the outcome of each of hosts to path, over the entries
+// of previous for the same hosts.
+func saveState(path string, previous RunState, hosts []Host, o *outcomes) error {
+	o.mu.Lock()
+	current := map[string]HostState{}
+	for _, host := range hosts {
+		state, ok := o.hosts[host.Address]
+		if !ok {
+			state = HostState{Host: host.Address, Status: HostSkipped, Time: time.Now().UTC()}
+		}
+		current[host.Address] = state
+	}
+	o.mu.Unlock()
+
+	var state RunState
+	for _, h := range previous.Hosts {
+		if updated, ok := current[h.Host]; ok {
+			h = updated
+			delete(current, h.Host)
+		}
+		state.Hosts = append(state.Hosts, h)
+	}
+	for _, host := range hosts {
+		if h, ok := current[host.Address]; ok {
+			state.Hosts = append(state.Hosts, h)
+		}
+	}
+
+	raw, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(path, append(raw, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write state file: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes data to path through a temporary file renamed over
+// it, so a run that dies while writing leaves the earlier file intact.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Chmod(perm); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
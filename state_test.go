@@ -0,0 +1,121 @@
+package binaryinstall
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStateRoundTrip(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "state.json")
+	earlier := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	previous := RunState{Hosts: []HostState{
+		{Host: "old", Status: HostInstalled, Time: earlier},
+		{Host: "web2", Status: HostFailed, Error: "timeout", Time: earlier},
+	}}
+
+	o := &outcomes{}
+	o.record("web1", nil)
+	o.record("web2", errors.New("exit status 1"))
+	o.record("web3", fmt.Errorf("%w: health check failed", ErrRolledBack))
+	hosts := []Host{{Address: "web1"}, {Address: "web2"}, {Address: "web3"}, {Address: "web4"}}
+	if err := saveState(path, previous, hosts, o); err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, h := range state.Hosts {
+		got = append(got, h.Host+" "+h.Status+" "+h.Error)
+		if h.Time.IsZero() {
+			t.Errorf("%s has no time", h.Host)
+		}
+	}
+	want := []string{
+		"old installed ",
+		"web2 failed exit status 1",
+		"web1 installed ",
+		"web3 rolled back " + ErrRolledBack.Error() + ": health check failed",
+		"web4 skipped ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("saved\n%q\nwant\n%q", got, want)
+	}
+	if !state.Hosts[0].Time.Equal(earlier) {
+		t.Errorf("an earlier host's time changed to %s", state.Hosts[0].Time)
+	}
+	if unfinished := state.Unfinished(); !reflect.DeepEqual(unfinished, []string{"web2", "web3", "web4"}) {
+		t.Errorf("unfinished %q", unfinished)
+	}
+
+	retry, loaded, err := retryHosts(path, append(hosts, Host{Address: "new"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(retry, []Host{{Address: "web2"}, {Address: "web3"}, {Address: "web4"}}) {
+		t.Errorf("retrying %+v", retry)
+	}
+	if !reflect.DeepEqual(loaded, state) {
+		t.Errorf("retryHosts loaded %+v, want %+v", loaded, state)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("saving left %d files behind", len(entries)-1)
+	}
+}
+
+func TestLoadStateCorrupt(t *testing.T) {
+	for _, content := range []string{
+		"",
+		"not json",
+		`{"hosts": [{"host": "web1", "status": "installed"`,
+		`{"hosts": {"host": "web1"}}`,
+		`{"hosts": [{"host": "web1", "time": "yesterday"}]}`,
+	} {
+		path := filepath.Join(t.TempDir(), "state.json")
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadState(path); err == nil || !strings.Contains(err.Error(), "failed to parse state file") {
+			t.Errorf("loading %q: %v, want a parse error", content, err)
+		}
+		if retry, _, err := retryHosts(path, []Host{{Address: "web1"}}); err == nil {
+			t.Errorf("retrying from %q: %+v, want an error", content, retry)
+		}
+	}
+	if _, err := LoadState(filepath.Join(t.TempDir(), "missing.json")); err == nil || !strings.Contains(err.Error(), "failed to read state file") {
+		t.Errorf("loading a missing state file: %v", err)
+	}
+}
+
+func TestSaveStateReplacesCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	if err := os.WriteFile(path, []byte("{garbage"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	o := &outcomes{}
+	o.record("web1", nil)
+	if err := saveState(path, RunState{}, []Host{{Address: "web1"}}, o); err != nil {
+		t.Fatal(err)
+	}
+	state, err := LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(state.Hosts) != 1 || state.Hosts[0].Status != HostInstalled {
+		t.Errorf("saved %+v", state)
+	}
+}
@@ -0,0 +1,350 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// InstalledBinary is a binary, or another file or a package, installed on a
+// host, as its HostManifest records it. Binaries found at an upload's
+// destination but missing from the manifest have only their path, checksum,
+// mode and ownership.
+type InstalledBinary struct {
+	Path        string    `json:"path,omitempty"`
+	Package     string    `json:"package,omitempty"`
+	Binary      string    `json:"binary,omitempty"`
+	Version     string    `json:"version,omitempty"`
+	Source      string    `json:"source,omitempty"`
+	SHA256      string    `json:"sha256"`
+	Mode        string    `json:"mode,omitempty"`
+	Owner       string    `json:"owner,omitempty"`
+	Group       string    `json:"group,omitempty"`
+	InstalledAt time.Time `json:"installed_at"` // zero if not in the manifest
+	Recorded    bool      `json:"recorded"`     // whether the manifest has it
+}
+
+// HostStatus is what Status found installed on a host.
+type HostStatus struct {
+	Host     string            `json:"host"`
+	Binaries []InstalledBinary `json:"binaries"`
+}
+
+// Markers in the output of statusTemplate: around the host manifest, a line
+// per file inspected, and the remote user's home directory, which a leading
+// "~/" in paths expands to.
+const (
+	manifestBeginMarker = "binaryinstall-manifest-begin"
+	manifestEndMarker   = "binaryinstall-manifest-end"
+	fileMarker          = "binaryinstall-file:"
+	homeMarker          = "binaryinstall-home:"
+)
+
+// statusData is ScriptData with the files statusTemplate inspects.
+type statusData struct {
+	ScriptData
+	Paths         []string
+	ManifestPaths bool // also inspect every path in the host manifest
+}
+
+// statusTemplate prints the host manifest, if any, and a line per file
+// inspected: its checksum, mode, owner, group, capabilities and path, with
+// "-" for the checksum of a missing file and for capabilities where getcap
+// is missing. It changes nothing.
+var statusTemplate = template.Must(template.Must(scriptTemplate.Clone()).New("status").Parse(`set -e
+
+PATH="$PATH:/sbin:/usr/sbin"
+echo "` + homeMarker + ` $HOME"
+HOST_MANIFEST={{ q .HostManifest }}
+case $HOST_MANIFEST in "~/"*) HOST_MANIFEST="$HOME/${HOST_MANIFEST#"~/"}" ;; esac
+{{ template "escalation" . }}
+
+inspect() {
+    if ! as_root test -f "$1"; then
+        echo "` + fileMarker + ` - - - - - $1"
+        return 0
+    fi
+    sum=$( (as_root sha256sum "$1" 2>/dev/null || as_root shasum -a 256 "$1") | cut -d' ' -f1)
+    caps=-
+    if command -v getcap >/dev/null 2>&1; then
+        caps=$(as_root getcap "$1" | grep -o 'cap_[a-z_]*' | tr '\n' ,)
+        caps=${caps%,}
+        [ -n "$caps" ] || caps=none
+    fi
+    echo "` + fileMarker + ` $sum $(stat -c '%a %U %G' "$1" 2>/dev/null || stat -f '%Lp %Su %Sg' "$1") $caps $1"
+}
+
+if [ -n "$HOST_MANIFEST" ] && as_root test -f "$HOST_MANIFEST"; then
+    echo ` + manifestBeginMarker + `
+    as_root cat "$HOST_MANIFEST"
+    echo ` + manifestEndMarker + `
+    {{- if .ManifestPaths }}
+    paths=$(as_root cat "$HOST_MANIFEST" | sed -n 's/^  {"path":"\(.*\)","binary":".*/\1/p' | sed 's/\\\(.\)/\1/g')
+    old_ifs=$IFS
+    IFS='
+'
+    for path in $paths; do
+        IFS=$old_ifs
+        inspect "$path"
+    done
+    IFS=$old_ifs
+    {{- end }}
+fi
+{{ range .Paths }}
+path={{ q . }}
+case $path in "~/"*) path="$HOME/${path#"~/"}" ;; esac
+inspect "$path"
+{{ end }}`))
+
+// Status reports what is installed on every host of config: the entries of
+// its HostManifest, and the binaries config.Uploads would install that the
+// manifest has no entry for, found by checksumming them where they would be
+// installed. Only uploads of a single binary from a named archive are
+// checked this way. Hosts that cannot be reached are reported as
+// InstallFailures, after every host has been tried.
+func Status(config BinaryInstallConfig) ([]HostStatus, error) {
+	hosts := fleetHosts(config)
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no remote host provided")
+	}
+	if kind, _ := transportKind(config); kind == TransportWinRM {
+		return nil, fmt.Errorf("status is not supported on %s targets", kind)
+	}
+	if config.HostManifest == "" && len(config.Uploads) == 0 {
+		return nil, fmt.Errorf("no host manifest or uploads to report on")
+	}
+
+	var (
+		mu      sync.Mutex
+		results []HostStatus
+	)
+	err := runAll(len(hosts), config.MaxParallelHosts, true, func(i int) error {
+		hostConfig := forHost(config, hosts[i])
+		files, err := installedFiles(hostConfig.Uploads)
+		if err != nil {
+			return &InstallFailure{Host: hostConfig.RemoteHost, Err: err}
+		}
+		var paths []string
+		for _, f := range files {
+			paths = append(paths, f.Path)
+		}
+		status, err := statusHost(hostConfig, paths)
+		if err != nil {
+			return &InstallFailure{Host: hostConfig.RemoteHost, Err: err}
+		}
+		mu.Lock()
+		results = append(results, status)
+		mu.Unlock()
+		return nil
+	})
+	sort.Slice(results, func(i, j int) bool { return results[i].Host < results[j].Host })
+	return results, err
+}
+
+// installedFile is where upload installs its binary.
+type installedFile struct {
+	Path   string
+	Upload BinaryUpload // with its vars expanded
+}
+
+// installedFiles returns where uploads install their binaries, for those
+// installing a single binary from a named archive.
+func installedFiles(uploads []BinaryUpload) ([]installedFile, error) {
+	var files []installedFile
+	for _, upload := range uploads {
+		upload, err := expandUploadVars(upload)
+		if err != nil {
+			return nil, err
+		}
+		base := uploadArtifactBase(upload)
+		if upload.InstallAll || len(upload.Files) > 0 || upload.FilesManifest != "" ||
+			packageKind(base) != "" || hasGlob(base) {
+			continue
+		}
+		name := uploadBinaryName(upload)
+		if name == "" || upload.DestinationDir == "" {
+			continue
+		}
+		dir := upload.DestinationDir
+		if upload.Release != "" {
+			dir = path.Join(dir, "current")
+		}
+		files = append(files, installedFile{Path: path.Join(dir, name), Upload: upload})
+	}
+	return files, nil
+}
+
+// fileState is a file as statusTemplate found it.
+type fileState struct {
+	Path                       string // with "~/" expanded
+	Requested                  string // the path it was inspected for, if given one
+	Missing                    bool
+	SHA256, Mode, Owner, Group string
+	Capabilities               string // comma-separated, "none", or "-" if unknown
+}
+
+// inspectHost runs statusTemplate on config.RemoteHost for paths, and with
+// manifestPaths for those in the host manifest too, returning the
+// manifest's entries and the files found.
+func inspectHost(config BinaryInstallConfig, paths []string, manifestPaths bool) ([]InstalledBinary, []fileState, error) {
+	transport, err := connectHost(&config)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer transport.Close()
+	return inspect(config, transport, paths, manifestPaths)
+}
+
+// inspect is inspectHost over transport.
+func inspect(config BinaryInstallConfig, transport Transport, paths []string, manifestPaths bool) ([]InstalledBinary, []fileState, error) {
+	for _, p := range append([]string{config.HostManifest}, paths...) {
+		if strings.ContainsAny(p, "\x00\n\r") {
+			return nil, nil, fmt.Errorf("path %q contains control characters", p)
+		}
+	}
+	script, err := inspectScript(config, paths, manifestPaths)
+	if err != nil {
+		return nil, nil, err
+	}
+	out, err := runScript(config, transport, script)
+	if err != nil {
+		return nil, nil, err
+	}
+	return parseInspection(config.HostManifest, out, paths)
+}
+
+// inspectScript renders statusTemplate for paths.
+func inspectScript(config BinaryInstallConfig, paths []string, manifestPaths bool) (string, error) {
+	sData := statusData{
+		ScriptData: ScriptData{
+			SudoPassword: config.SudoPassword,
+			Escalation:   config.Escalation,
+			HostManifest: config.HostManifest,
+		},
+		Paths:         paths,
+		ManifestPaths: manifestPaths,
+	}
+	var script bytes.Buffer
+	if err := statusTemplate.Execute(&script, sData); err != nil {
+		return "", fmt.Errorf("failed to render status script: %w", err)
+	}
+	return script.String(), nil
+}
+
+// parseInspection parses the output of statusTemplate for paths into the
+// entries of hostManifest and the files found.
+func parseInspection(hostManifest, out string, paths []string) ([]InstalledBinary, []fileState, error) {
+	var manifest struct {
+		Installs []InstalledBinary `json:"installs"`
+	}
+	if begin := strings.Index(out, manifestBeginMarker+"\n"); begin >= 0 {
+		rest := out[begin+len(manifestBeginMarker)+1:]
+		end := strings.Index(rest, manifestEndMarker)
+		if end < 0 {
+			return nil, nil, fmt.Errorf("truncated host manifest %s", hostManifest)
+		}
+		if err := json.Unmarshal([]byte(rest[:end]), &manifest); err != nil {
+			return nil, nil, fmt.Errorf("failed to parse host manifest %s: %w", hostManifest, err)
+		}
+	}
+	home := ""
+	for _, line := range strings.Split(out, "\n") {
+		if rest, ok := strings.CutPrefix(line, homeMarker); ok {
+			home = strings.TrimSpace(rest)
+			break
+		}
+	}
+	requested := map[string]string{}
+	for _, p := range paths {
+		requested[expandRemoteHome(p, home)] = p
+	}
+
+	var files []fileState
+	seen := map[string]bool{}
+	for _, line := range strings.Split(out, "\n") {
+		rest, ok := strings.CutPrefix(line, fileMarker)
+		if !ok {
+			continue
+		}
+		// The path comes last, so it may hold spaces
+		fields := strings.SplitN(strings.TrimSpace(rest), " ", 6)
+		if len(fields) != 6 || seen[fields[5]] {
+			continue
+		}
+		seen[fields[5]] = true
+		files = append(files, fileState{
+			Path:         fields[5],
+			Requested:    requested[fields[5]],
+			Missing:      fields[0] == "-",
+			SHA256:       fields[0],
+			Mode:         fields[1],
+			Owner:        fields[2],
+			Group:        fields[3],
+			Capabilities: fields[4],
+		})
+	}
+	return manifest.Installs, files, nil
+}
+
+// expandRemoteHome expands a leading "~/" in p to home, as the scripts do.
+func expandRemoteHome(p, home string) string {
+	if rest, ok := strings.CutPrefix(p, "~/"); ok && home != "" {
+		return strings.TrimSuffix(home, "/") + "/" + rest
+	}
+	return p
+}
+
+// statusHost reports what is installed on config.RemoteHost: its manifest's
+// entries, and those of paths it has no entry for.
+func statusHost(config BinaryInstallConfig, paths []string) (HostStatus, error) {
+	transport, err := connectHost(&config)
+	if err != nil {
+		return HostStatus{Host: config.RemoteHost, Binaries: []InstalledBinary{}}, err
+	}
+	defer transport.Close()
+	return runStatus(config, transport, paths)
+}
+
+// runStatus is statusHost over transport.
+func runStatus(config BinaryInstallConfig, transport Transport, paths []string) (HostStatus, error) {
+	status := HostStatus{Host: config.RemoteHost, Binaries: []InstalledBinary{}}
+	installs, files, err := inspect(config, transport, paths, false)
+	if err != nil {
+		return status, err
+	}
+	recorded := map[string]bool{}
+	for _, b := range installs {
+		b.Recorded = true
+		if b.Path != "" {
+			recorded[b.Path] = true
+		}
+		status.Binaries = append(status.Binaries, b)
+	}
+	for _, f := range files {
+		if f.Missing || recorded[f.Path] {
+			continue
+		}
+		status.Binaries = append(status.Binaries, InstalledBinary{
+			Path:   f.Path,
+			Binary: path.Base(f.Path),
+			SHA256: f.SHA256,
+			Mode:   f.Mode,
+			Owner:  f.Owner,
+			Group:  f.Group,
+		})
+	}
+	sort.SliceStable(status.Binaries, func(i, j int) bool {
+		return status.Binaries[i].Path+status.Binaries[i].Package < status.Binaries[j].Path+status.Binaries[j].Package
+	})
+	if config.Verbose {
+		log.Printf("Found %d installed binaries on %s", len(status.Binaries), config.RemoteHost)
+	}
+	return status, nil
+}
@@ -0,0 +1,125 @@
+package binaryinstall
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInstalledFiles(t *testing.T) {
+	uploads := []BinaryUpload{
+		{Path: "dist/api_Linux_x86_64.tar.gz", DestinationDir: "/usr/local/bin"},
+		{URL: "https://example.com/tool_1.2.3_linux_amd64.tar.gz", DestinationDir: "/opt/tool", Release: "1.2.3"},
+		{Path: "bundle.tar.gz", ArchivePath: "bin/worker", DestinationDir: "/usr/local/bin"},
+		// Not a single binary from a named archive
+		{Path: "api_1.0_amd64.deb"},
+		{Path: "dist/api_*_Linux_x86_64.tar.gz", DestinationDir: "/usr/local/bin"},
+		{Path: "tools.tar.gz", InstallAll: true, DestinationDir: "/usr/local/bin"},
+		{Path: "api_Linux_x86_64.tar.gz"},
+	}
+	files, err := installedFiles(uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, f := range files {
+		got = append(got, f.Path)
+	}
+	want := []string{"/usr/local/bin/api", "/opt/tool/current/tool", "/usr/local/bin/worker"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("installedFiles() = %q, want %q", got, want)
+	}
+	if files[1].Upload.Release != "1.2.3" {
+		t.Errorf("installedFiles() returned the tool's upload as %+v", files[1].Upload)
+	}
+}
+
+func TestStatusOutput(t *testing.T) {
+	config := BinaryInstallConfig{RemoteHost: "web1", HostManifest: "/var/lib/binaryinstall/manifest.json"}
+	transport := &scriptRecorder{output: "noise\n" + manifestBeginMarker + `
+{"installs": [
+  {"path":"/usr/local/bin/api","binary":"api","source":"api_1.2.3_Linux_x86_64.tar.gz","version":"1.2.3","sha256":"aaa","mode":"755","owner":"root","group":"root","installed_at":"2024-01-02T15:04:05Z"},
+  {"package":"nginx","version":"1.24.0","source":"nginx.deb","sha256":"bbb","installed_at":"2024-01-03T00:00:00Z"}
+]}
+` + manifestEndMarker + `
+` + fileMarker + ` ccc 755 root root none /usr/local/bin/api
+` + fileMarker + ` ddd 700 app staff cap_net_bind_service /opt/my tools/worker
+` + fileMarker + ` - - - - - /usr/local/bin/gone
+`}
+	status, err := runStatus(config, transport, []string{"/usr/local/bin/api", "/opt/my tools/worker", "/usr/local/bin/gone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := HostStatus{Host: "web1", Binaries: []InstalledBinary{
+		{Path: "/opt/my tools/worker", Binary: "worker", SHA256: "ddd", Mode: "700", Owner: "app", Group: "staff"},
+		// The manifest's entry wins over the file found at the path
+		{Path: "/usr/local/bin/api", Binary: "api", Version: "1.2.3", Source: "api_1.2.3_Linux_x86_64.tar.gz", SHA256: "aaa", Mode: "755", Owner: "root", Group: "root",
+			InstalledAt: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC), Recorded: true},
+		{Package: "nginx", Version: "1.24.0", Source: "nginx.deb", SHA256: "bbb", InstalledAt: time.Date(2024, 1, 3, 0, 0, 0, 0, time.UTC), Recorded: true},
+	}}
+	if !reflect.DeepEqual(status, want) {
+		t.Errorf("runStatus() = %+v\nwant %+v", status, want)
+	}
+	if script := transport.script(); !strings.Contains(script, `path='/opt/my tools/worker'`) {
+		t.Errorf("script does not check the worker:\n%s", script)
+	}
+
+	for output, wantErr := range map[string]string{
+		manifestBeginMarker + "\n{\"installs\": [\n":                    "truncated host manifest",
+		manifestBeginMarker + "\nnot json\n" + manifestEndMarker + "\n": "failed to parse host manifest",
+	} {
+		if _, err := runStatus(config, &scriptRecorder{output: output}, nil); err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("output %q: returned %v, want an error containing %q", output, err, wantErr)
+		}
+	}
+	if _, err := runStatus(config, &scriptRecorder{}, []string{"/usr/local/bin/a\nb"}); err == nil || !strings.Contains(err.Error(), "control characters") {
+		t.Errorf("a path with a newline returned %v", err)
+	}
+}
+
+func TestStatusHost(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "bin.old"), HostManifest: filepath.Join(dir, "manifest.json")}
+	var uploads []BinaryUpload
+	for _, name := range []string{"api", "tool"} {
+		archive := filepath.Join(dir, name+"_1.0.0_Linux_x86_64.tar.gz")
+		writeArchive(t, archive, file(name))
+		uploads = append(uploads, BinaryUpload{Path: archive, DestinationDir: bin, Owner: "root", Permission: "0755"})
+	}
+	// Only the api is recorded in the manifest
+	if err := processUploadSingleCommand(config, shTransport{}, uploads[0]); err != nil {
+		t.Fatal(err)
+	}
+	unrecorded := config
+	unrecorded.HostManifest = ""
+	if err := processUploadSingleCommand(unrecorded, shTransport{}, uploads[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := installedFiles(uploads)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, err := runStatus(config, shTransport{}, []string{files[0].Path, files[1].Path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(status.Binaries) != 2 {
+		t.Fatalf("found %+v", status.Binaries)
+	}
+	api, tool := status.Binaries[0], status.Binaries[1]
+	if api.Path != filepath.Join(bin, "api") || !api.Recorded || api.Version != "1.0.0" || api.InstalledAt.IsZero() {
+		t.Errorf("api %+v", api)
+	}
+	if tool.Path != filepath.Join(bin, "tool") || tool.Recorded || tool.Mode != "755" || len(tool.SHA256) != 64 || !tool.InstalledAt.IsZero() {
+		t.Errorf("tool %+v", tool)
+	}
+}
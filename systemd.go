@@ -0,0 +1,236 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// SystemdUnit describes a systemd service for an upload's binary, written
+// to /etc/systemd/system/<Name>.service after the install and enabled.
+type SystemdUnit struct {
+	Name        string // unit name without ".service"; defaults to the binary name
+	Description string // defaults to the binary name
+
+	// ExecStart is the command line, a template over the upload's Vars
+	// and path (the installed binary), binary and dest, e.g.
+	// "{{.path}} serve --port 8080". Defaults to the installed binary.
+	ExecStart string
+
+	User             string            // run as this user instead of root
+	Group            string            // and group
+	WorkingDirectory string            // e.g. "/var/lib/api"
+	Environment      map[string]string // e.g. {"PORT": "8080"}
+	EnvironmentFile  string            // e.g. "/etc/default/api"; a leading "-" allows it to be missing
+
+	Restart    string        // restart policy; defaults to "on-failure"
+	RestartSec time.Duration // delay before a restart; systemd's default if zero
+
+	After    []string // units to start after; defaults to network-online.target
+	WantedBy string   // target enabling the unit; defaults to multi-user.target
+
+	// Listen, if set, installs <Name>.socket alongside the unit, listening
+	// on these ListenStream addresses, e.g. "80" or "[::]:443", and hands
+	// the sockets to the service. The binary must accept them from systemd
+	// (sd_listen_fds), and need not be allowed to bind low ports itself.
+	Listen []string
+}
+
+var (
+	unitNamePattern = regexp.MustCompile(`^[A-Za-z0-9:_.@-]+$`)
+	envNamePattern  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+var unitTemplate = template.Must(template.New("unit").Parse(`[Unit]
+Description={{ .Description }}
+{{- if .Socket }}
+Requires={{ .Socket }}
+After={{ .Socket }}
+{{- end }}
+{{- range .After }}
+After={{ . }}
+{{- if eq . "network-online.target" }}
+Wants={{ . }}
+{{- end }}
+{{- end }}
+
+[Service]
+Type=simple
+ExecStart={{ .ExecStart }}
+{{- if .User }}
+User={{ .User }}
+{{- end }}
+{{- if .Group }}
+Group={{ .Group }}
+{{- end }}
+{{- if .WorkingDirectory }}
+WorkingDirectory={{ .WorkingDirectory }}
+{{- end }}
+{{- range .Environment }}
+Environment={{ . }}
+{{- end }}
+{{- if .EnvironmentFile }}
+EnvironmentFile={{ .EnvironmentFile }}
+{{- end }}
+Restart={{ .Restart }}
+{{- if .RestartSec }}
+RestartSec={{ .RestartSec }}
+{{- end }}
+
+[Install]
+WantedBy={{ .WantedBy }}
+`))
+
+var socketTemplate = template.Must(template.New("socket").Parse(`[Unit]
+Description={{ .Description }} socket
+
+[Socket]
+{{- range .Listen }}
+ListenStream={{ . }}
+{{- end }}
+
+[Install]
+WantedBy=sockets.target
+`))
+
+// execStart returns the command line of upload's service, with its
+// ExecStart template expanded.
+func execStart(upload BinaryUpload, binaryName string) (string, error) {
+	binaryPath := path.Join(upload.DestinationDir, binaryName)
+	if upload.Release != "" {
+		binaryPath = path.Join(upload.DestinationDir, "current", binaryName)
+	}
+	command := upload.Systemd.ExecStart
+	if command == "" {
+		command = binaryPath
+	} else {
+		vars := map[string]string{}
+		for k, v := range upload.Vars {
+			vars[k] = v
+		}
+		vars["path"], vars["binary"], vars["dest"] = binaryPath, binaryName, upload.DestinationDir
+		var err error
+		if command, err = expandVars("ExecStart", command, vars); err != nil {
+			return "", err
+		}
+	}
+	if !strings.HasPrefix(command, "/") {
+		return "", fmt.Errorf("systemd ExecStart %q must start with an absolute path", command)
+	}
+	return command, nil
+}
+
+// renderUnit returns the unit name and file content for upload's Systemd
+// unit, with the binary installed as binaryName in the upload's
+// destination.
+func renderUnit(upload BinaryUpload, binaryName string) (string, string, error) {
+	unit := *upload.Systemd
+	if unit.Name == "" {
+		unit.Name = binaryName
+	}
+	unit.Name = strings.TrimSuffix(unit.Name, ".service")
+	if !unitNamePattern.MatchString(unit.Name) {
+		return "", "", fmt.Errorf("invalid systemd unit name %q", unit.Name)
+	}
+
+	var err error
+	if unit.ExecStart, err = execStart(upload, binaryName); err != nil {
+		return "", "", err
+	}
+
+	if unit.Description == "" {
+		unit.Description = binaryName
+	}
+	if unit.Restart == "" {
+		unit.Restart = "on-failure"
+	}
+	// A user instance has its own targets and runs everything as its user.
+	if upload.UserService {
+		if unit.User != "" || unit.Group != "" {
+			return "", "", fmt.Errorf("user services run as their user, so cannot set User or Group")
+		}
+		if unit.WantedBy == "" {
+			unit.WantedBy = "default.target"
+		}
+	}
+	if unit.After == nil && !upload.UserService {
+		unit.After = []string{"network-online.target"}
+	}
+	if unit.WantedBy == "" {
+		unit.WantedBy = "multi-user.target"
+	}
+	for name, val := range map[string]string{
+		"Description":      unit.Description,
+		"ExecStart":        unit.ExecStart,
+		"User":             unit.User,
+		"Group":            unit.Group,
+		"WorkingDirectory": unit.WorkingDirectory,
+		"EnvironmentFile":  unit.EnvironmentFile,
+		"Restart":          unit.Restart,
+		"WantedBy":         unit.WantedBy,
+		"After":            strings.Join(unit.After, " "),
+	} {
+		if strings.ContainsAny(val, "\x00\n\r") {
+			return "", "", fmt.Errorf("systemd %s %q contains control characters", name, val)
+		}
+	}
+
+	// Environment lines are quoted for systemd, sorted for a stable unit.
+	var env []string
+	for k, v := range unit.Environment {
+		if !envNamePattern.MatchString(k) {
+			return "", "", fmt.Errorf("invalid environment variable name %q", k)
+		}
+		if strings.ContainsAny(v, "\x00\n\r") {
+			return "", "", fmt.Errorf("environment variable %s contains control characters", k)
+		}
+		quoted := strings.NewReplacer(`\`, `\\`, `"`, `\"`, `%`, `%%`).Replace(k + "=" + v)
+		env = append(env, `"`+quoted+`"`)
+	}
+	sort.Strings(env)
+
+	data := struct {
+		SystemdUnit
+		Environment []string
+		RestartSec  string
+		Socket      string
+	}{SystemdUnit: unit, Environment: env}
+	if len(unit.Listen) > 0 {
+		data.Socket = unit.Name + ".socket"
+	}
+	if unit.RestartSec > 0 {
+		data.RestartSec = fmt.Sprintf("%gs", unit.RestartSec.Seconds())
+	}
+	var buf bytes.Buffer
+	if err := unitTemplate.Execute(&buf, data); err != nil {
+		return "", "", fmt.Errorf("failed to render systemd unit: %w", err)
+	}
+	return unit.Name, buf.String(), nil
+}
+
+// renderSocket returns the socket unit for upload's Systemd unit, named
+// name by renderUnit, or "" if it listens on nothing.
+func renderSocket(upload BinaryUpload, name string) (string, error) {
+	unit := *upload.Systemd
+	if len(unit.Listen) == 0 {
+		return "", nil
+	}
+	for _, addr := range unit.Listen {
+		if addr == "" || strings.ContainsAny(addr, " \t\x00\n\r") {
+			return "", fmt.Errorf("invalid socket address %q", addr)
+		}
+	}
+	if unit.Description == "" {
+		unit.Description = name
+	}
+	var buf bytes.Buffer
+	if err := socketTemplate.Execute(&buf, unit); err != nil {
+		return "", fmt.Errorf("failed to render systemd socket: %w", err)
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,259 @@
+package binaryinstall
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderUnit(t *testing.T) {
+	upload := BinaryUpload{DestinationDir: "/usr/local/bin", Vars: map[string]string{"port": "8080"}}
+
+	t.Run("defaults", func(t *testing.T) {
+		upload := upload
+		upload.Systemd = &SystemdUnit{}
+		name, unit, err := renderUnit(upload, "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `[Unit]
+Description=api
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+ExecStart=/usr/local/bin/api
+Restart=on-failure
+
+[Install]
+WantedBy=multi-user.target
+`
+		if name != "api" || unit != want {
+			t.Errorf("renderUnit() = %q,\n%s\nwant api,\n%s", name, unit, want)
+		}
+	})
+
+	t.Run("everything", func(t *testing.T) {
+		upload := upload
+		upload.Systemd = &SystemdUnit{
+			Name:             "api-server.service",
+			Description:      "API server",
+			ExecStart:        "{{.path}} serve --port {{.port}}",
+			User:             "api",
+			Group:            "api",
+			WorkingDirectory: "/var/lib/api",
+			Environment:      map[string]string{"TOKEN": `a "b" 100%`, "MODE": "prod"},
+			EnvironmentFile:  "-/etc/default/api",
+			Restart:          "always",
+			RestartSec:       1500 * time.Millisecond,
+			After:            []string{"postgresql.service"},
+			WantedBy:         "default.target",
+		}
+		name, unit, err := renderUnit(upload, "api")
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := `[Unit]
+Description=API server
+After=postgresql.service
+
+[Service]
+Type=simple
+ExecStart=/usr/local/bin/api serve --port 8080
+User=api
+Group=api
+WorkingDirectory=/var/lib/api
+Environment="MODE=prod"
+Environment="TOKEN=a \"b\" 100%%"
+EnvironmentFile=-/etc/default/api
+Restart=always
+RestartSec=1.5s
+
+[Install]
+WantedBy=default.target
+`
+		if name != "api-server" || unit != want {
+			t.Errorf("renderUnit() = %q,\n%s\nwant api-server,\n%s", name, unit, want)
+		}
+	})
+
+	for _, tt := range []struct {
+		name    string
+		unit    SystemdUnit
+		wantErr string
+	}{
+		{"bad name", SystemdUnit{Name: "../api"}, "invalid systemd unit name"},
+		{"relative ExecStart", SystemdUnit{ExecStart: "api serve"}, "must start with an absolute path"},
+		{"unknown var", SystemdUnit{ExecStart: "{{.path}} --host {{.host}}"}, "ExecStart"},
+		{"newline", SystemdUnit{Description: "api\nExecStartPre=/bin/evil"}, "systemd Description"},
+		{"bad env name", SystemdUnit{Environment: map[string]string{"A B": "1"}}, "invalid environment variable name"},
+		{"env newline", SystemdUnit{Environment: map[string]string{"A": "1\nB=2"}}, "environment variable A contains control characters"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			upload := upload
+			unit := tt.unit
+			upload.Systemd = &unit
+			if _, _, err := renderUnit(upload, "api"); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("renderUnit() returned %v, want an error containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSystemdScript(t *testing.T) {
+	config := BinaryInstallConfig{RemoteHost: "web1", BackupDir: "/var/backups"}
+	upload := BinaryUpload{
+		Path:           "/tmp/api_Linux_x86_64.tar.gz",
+		DestinationDir: "/usr/local/bin",
+		Owner:          "root",
+		Permission:     "0755",
+		Systemd:        &SystemdUnit{Description: "API server"},
+	}
+	transport := &scriptRecorder{}
+	if err := processUploadSingleCommand(config, transport, upload); err != nil {
+		t.Fatal(err)
+	}
+	script := transport.script()
+	for _, want := range []string{
+		"SERVICE='api'\n",
+		"<<'BINARYINSTALL_UNIT'\n[Unit]\nDescription=API server\n",
+		"WantedBy=multi-user.target\nBINARYINSTALL_UNIT\n",
+		`UNIT_FILE="/etc/systemd/system/$SERVICE.service"`,
+		`unit_cmd() { as_root "$@"; }`,
+		`unit_cmd cp "$UNIT_FILE" "$BACKUP_DIR/${UNIT_FILE##*/}"`,
+		`systemctl_() { as_root systemctl "$@"; }`,
+		"systemctl_ daemon-reload\n    systemctl_ enable \"$SERVICE.service\"\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script lacks %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, "systemctl start") || strings.Contains(script, "systemctl restart") {
+		t.Errorf("script starts the unit:\n%s", script)
+	}
+
+	upload.NoSudo = true
+	if err := processUploadSingleCommand(config, transport, upload); err == nil || !strings.Contains(err.Error(), "needs root") {
+		t.Errorf("a no-sudo install with a unit returned %v", err)
+	}
+}
+
+func TestUserService(t *testing.T) {
+	upload := BinaryUpload{DestinationDir: "/home/deploy/bin", UserService: true, Systemd: &SystemdUnit{}}
+	_, unit, err := renderUnit(upload, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(unit, "After=") || !strings.Contains(unit, "WantedBy=default.target\n") {
+		t.Errorf("user unit has system targets:\n%s", unit)
+	}
+	upload.Systemd = &SystemdUnit{User: "api"}
+	if _, _, err := renderUnit(upload, "api"); err == nil || !strings.Contains(err.Error(), "cannot set User or Group") {
+		t.Errorf("a user unit with a User returned %v", err)
+	}
+
+	// Installed without sudo, in the user's own systemd instance
+	stubCommand(t, "sudo", `echo "sudo used" >&2; exit 1`)
+	args := stubCommand(t, "systemctl", `echo "$*" >> "$0.calls"`)
+	dir := t.TempDir()
+	home := filepath.Join(dir, "home")
+	t.Setenv("HOME", home)
+	t.Setenv("XDG_CONFIG_HOME", "")
+	t.Setenv("XDG_RUNTIME_DIR", dir)
+	archive := filepath.Join(dir, "api_Linux_x86_64.tar.gz")
+	writeArchive(t, archive, file("api"))
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "backup")}
+	upload = BinaryUpload{Path: archive, DestinationDir: filepath.Join(home, "bin"), Permission: "0755", NoSudo: true,
+		UserService: true, RestartService: "api", Systemd: &SystemdUnit{}}
+	if err := os.MkdirAll(upload.DestinationDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(home, ".config/systemd/user/api.service")); err != nil {
+		t.Errorf("user unit not installed: %v", err)
+	}
+	calls, err := os.ReadFile(filepath.Join(filepath.Dir(args), "systemctl.calls"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "--user daemon-reload\n--user enable api.service\n--user restart api\n--user is-active --quiet api\n"; string(calls) != want {
+		t.Errorf("systemctl called with\n%s\nwant\n%s", calls, want)
+	}
+
+	t.Setenv("XDG_RUNTIME_DIR", filepath.Join(dir, "missing"))
+	if err := processUploadSingleCommand(config, shTransport{}, upload); err == nil || !strings.Contains(err.Error(), "loginctl enable-linger") {
+		t.Errorf("with no user instance, returned %v", err)
+	}
+}
+
+func TestRenderSocket(t *testing.T) {
+	upload := BinaryUpload{DestinationDir: "/usr/local/bin", Systemd: &SystemdUnit{Listen: []string{"80", "[::]:443"}}}
+	name, unit, err := renderUnit(upload, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(unit, "Description=web\nRequires=web.socket\nAfter=web.socket\nAfter=network-online.target\n") {
+		t.Errorf("unit does not require its socket:\n%s", unit)
+	}
+	socket, err := renderSocket(upload, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `[Unit]
+Description=web socket
+
+[Socket]
+ListenStream=80
+ListenStream=[::]:443
+
+[Install]
+WantedBy=sockets.target
+`
+	if socket != want {
+		t.Errorf("renderSocket() =\n%s\nwant\n%s", socket, want)
+	}
+
+	upload.Systemd = &SystemdUnit{}
+	if socket, err := renderSocket(upload, "web"); socket != "" || err != nil {
+		t.Errorf("without Listen, renderSocket() = %q, %v", socket, err)
+	}
+	for _, addr := range []string{"", "80 81", "80\nExecStartPre=/bin/sh"} {
+		upload.Systemd = &SystemdUnit{Listen: []string{addr}}
+		if _, err := renderSocket(upload, "web"); err == nil || !strings.Contains(err.Error(), "invalid socket address") {
+			t.Errorf("listening on %q returned %v", addr, err)
+		}
+	}
+}
+
+func TestSocketScript(t *testing.T) {
+	config := BinaryInstallConfig{RemoteHost: "web1", BackupDir: "/var/backups"}
+	upload := BinaryUpload{
+		Path:           "/tmp/web_Linux_x86_64.tar.gz",
+		DestinationDir: "/usr/local/bin",
+		Owner:          "root",
+		Permission:     "0755",
+		Systemd:        &SystemdUnit{Listen: []string{"80"}},
+	}
+	transport := &scriptRecorder{}
+	if err := processUploadSingleCommand(config, transport, upload); err != nil {
+		t.Fatal(err)
+	}
+	script := transport.script()
+	for _, want := range []string{
+		`echo "socket activation of $SERVICE needs systemd, not $INIT" >&2`,
+		`SOCKET_FILE="${UNIT_FILE%.service}.socket"`,
+		"<<'BINARYINSTALL_UNIT'\n[Unit]\nDescription=web socket\n",
+		`unit_cmd cp "$SOCKET_FILE" "$BACKUP_DIR/${SOCKET_FILE##*/}"`,
+		`unit_cmd cp "$TEMP_DIR/$SERVICE.socket" "$SOCKET_FILE"`,
+		`systemctl_ enable "$SERVICE.service" "$SERVICE.socket"`,
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script lacks %q:\n%s", want, script)
+		}
+	}
+}
@@ -0,0 +1,356 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// Transport runs install scripts on a single remote target.
+type Transport interface {
+	// Run executes script on the target and returns its combined output.
+	// Implementations abandon the script when ctx is done.
+	Run(ctx context.Context, script string) (string, error)
+	Close() error
+}
+
+// Transport names for BinaryInstallConfig.Transport.
+const (
+	TransportSSH        = "ssh"
+	TransportSSM        = "ssm"
+	TransportDocker     = "docker"
+	TransportKubernetes = "k8s"
+	TransportWinRM      = "winrm"
+	TransportTeleport   = "tsh"
+	TransportGCloudIAP  = "iap"
+)
+
+// transportKind returns the transport selected for config and the target it
+// addresses. A "scheme://" prefix on RemoteHost overrides config.Transport.
+func transportKind(config BinaryInstallConfig) (kind, target string) {
+	if scheme, target, ok := strings.Cut(config.RemoteHost, "://"); ok {
+		return scheme, target
+	}
+	if config.Transport == "" {
+		return TransportSSH, config.RemoteHost
+	}
+	return config.Transport, config.RemoteHost
+}
+
+// newTransport connects to config.RemoteHost using the configured transport.
+func newTransport(config BinaryInstallConfig) (Transport, error) {
+	kind, target := transportKind(config)
+	config.RemoteHost = target
+
+	switch kind {
+	case TransportSSH:
+		return newSSHTransport(config)
+	case TransportSSM:
+		return &ssmTransport{config: config, instanceID: config.RemoteHost}, nil
+	case TransportDocker:
+		return newDockerTransport(config.RemoteHost), nil
+	case TransportKubernetes:
+		return newKubernetesTransport(config, config.RemoteHost), nil
+	case TransportWinRM:
+		return &winrmTransport{config: config, host: config.RemoteHost}, nil
+	case TransportTeleport:
+		return newTeleportTransport(config, config.RemoteHost), nil
+	case TransportGCloudIAP:
+		return newGCloudTransport(config, config.RemoteHost), nil
+	default:
+		return nil, fmt.Errorf("unknown transport %q", kind)
+	}
+}
+
+// sshTransport runs scripts over a native SSH connection.
+type sshTransport struct {
+	client       *ssh.Client
+	host         string
+	forwardAgent bool
+	compress     bool
+	agentConn    net.Conn // local agent connection when forwarding
+}
+
+func newSSHTransport(config BinaryInstallConfig) (*sshTransport, error) {
+	if v, ok := sshOption(config, "ForwardAgent"); ok {
+		config.AgentForwarding = yes(v)
+	}
+	if v, ok := sshOption(config, "Compression"); ok {
+		config.Compression = yes(v)
+	}
+
+	client, err := dialSSH(config)
+	if err != nil {
+		return nil, err
+	}
+	t := &sshTransport{client: client, host: config.RemoteHost, compress: config.Compression}
+
+	if config.AgentForwarding {
+		socket := os.Getenv("SSH_AUTH_SOCK")
+		if socket == "" {
+			client.Close()
+			return nil, errors.New("agent forwarding requested but SSH_AUTH_SOCK is not set")
+		}
+		conn, err := net.Dial("unix", socket)
+		if err != nil {
+			client.Close()
+			return nil, fmt.Errorf("failed to connect to SSH agent: %w", err)
+		}
+		if err := agent.ForwardToAgent(client, agent.NewClient(conn)); err != nil {
+			conn.Close()
+			client.Close()
+			return nil, fmt.Errorf("failed to set up agent forwarding: %w", err)
+		}
+		t.forwardAgent, t.agentConn = true, conn
+	}
+	return t, nil
+}
+
+// Run sends the script to sh on stdin rather than as the command line, so
+// secrets in it such as a sudo password never show up in the host's process
+// list.
+func (t *sshTransport) Run(ctx context.Context, script string) (string, error) {
+	script = stdinScript(script)
+	if !t.compress {
+		return runSSHCommand(ctx, t.client, t.host, "sh", strings.NewReader(script), t.forwardAgent)
+	}
+	// x/crypto/ssh has no zlib support, so gzip the script ourselves.
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	io.WriteString(zw, script)
+	zw.Close()
+	return runSSHCommand(ctx, t.client, t.host, "gzip -dc | sh", &gz, t.forwardAgent)
+}
+
+// Stage streams a local artifact to a temporary path on the host over the
+// SSH session, gzip-compressed when compression is enabled. A transfer of the
+// same file that was cut off earlier is resumed, sending only the bytes the
+// host does not have yet.
+func (t *sshTransport) Stage(ctx context.Context, localPath string) (string, error) {
+	// The commands span lines, so sh runs them whatever the login shell
+	run := func(ctx context.Context, command string) (string, error) {
+		return runSSHCommand(ctx, t.client, t.host, "sh -c "+shellQuote(command), nil, false)
+	}
+	return stageResumable(ctx, localPath, run, t.send)
+}
+
+// StageReader streams r to the target over an SSH session's stdin.
+func (t *sshTransport) StageReader(ctx context.Context, name string, r io.Reader) (string, error) {
+	remotePath := stagingPath(name)
+	return remotePath, t.send(ctx, name, r, remotePath, false)
+}
+
+// send writes r to remotePath, appending to it when resuming.
+func (t *sshTransport) send(ctx context.Context, name string, r io.Reader, remotePath string, resume bool) error {
+	redirect := " > "
+	if resume {
+		redirect = " >> "
+	}
+	stdin := r
+	command := "cat" + redirect + shellQuote(remotePath)
+	if t.compress {
+		pr, pw := io.Pipe()
+		go func() {
+			zw := gzip.NewWriter(pw)
+			_, err := io.Copy(zw, r)
+			if err == nil {
+				err = zw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		stdin = pr
+		command = "gzip -dc" + redirect + shellQuote(remotePath)
+	}
+
+	if out, err := runSSHCommand(ctx, t.client, t.host, command, stdin, false); err != nil {
+		return fmt.Errorf("failed to upload %s: %w: %s", name, err, strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// Alive reports whether the SSH connection still answers requests.
+func (t *sshTransport) Alive() bool {
+	_, _, err := t.client.SendRequest("keepalive@openssh.com", true, nil)
+	return err == nil
+}
+
+func (t *sshTransport) Close() error {
+	if t.agentConn != nil {
+		t.agentConn.Close()
+	}
+	return t.client.Close()
+}
+
+// artifactStager is implemented by transports that can copy a local
+// artifact onto the target before installing it.
+type artifactStager interface {
+	// Stage copies localPath onto the target and returns its path there.
+	Stage(ctx context.Context, localPath string) (string, error)
+}
+
+// streamStager is implemented by transports that can stage an artifact
+// straight from a stream, without a copy on the local filesystem.
+type streamStager interface {
+	// StageReader copies r onto the target as name and returns its path there.
+	StageReader(ctx context.Context, name string, r io.Reader) (string, error)
+}
+
+// errNoStaging is returned by wrappers whose underlying transport does not stage artifacts.
+var errNoStaging = errors.New("transport cannot transfer local artifacts")
+
+// stagingPath returns a unique temporary path on the target for the file name
+// of localPath.
+func stagingPath(localPath string) string {
+	return fmt.Sprintf("/tmp/binaryinstall-%d-%s", time.Now().UnixNano(), filepath.Base(localPath))
+}
+
+// resumableStagingPath returns a temporary path on the target for localPath
+// that stays the same across runs while the file is unchanged, so a
+// transfer that was cut off can be resumed.
+func resumableStagingPath(localPath string, info os.FileInfo) string {
+	abs, err := filepath.Abs(localPath)
+	if err != nil {
+		abs = localPath
+	}
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", abs, info.Size(), info.ModTime().UnixNano())))
+	return fmt.Sprintf("/tmp/binaryinstall-%x-%s", sum[:6], filepath.Base(localPath))
+}
+
+// stagingToken identifies this process in the locks on resumable staging
+// paths, so its own retries can resume a transfer a concurrent run cannot.
+var stagingToken = fmt.Sprintf("%d-%d", os.Getpid(), time.Now().UnixNano())
+
+// stageResumable copies localPath onto the target, running commands there
+// with run and sending bytes with send. The copy goes to
+// resumableStagingPath, locked against concurrent runs, which get a copy of
+// their own instead, and resumes where an earlier transfer was cut off. The
+// complete copy is then moved to a path of this run's own, so no other run
+// can remove it, and if any of it was sent earlier it must match the local
+// file's checksum, or is sent again.
+func stageResumable(ctx context.Context, localPath string, run func(ctx context.Context, command string) (string, error),
+	send func(ctx context.Context, name string, r io.Reader, remotePath string, resume bool) error) (string, error) {
+	f, err := os.Open(localPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	name := filepath.Base(localPath)
+	runPath := stagingPath(localPath)
+
+	partial := resumableStagingPath(localPath, info)
+	out, err := run(ctx, claimStagingCommand(partial))
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w: %s", localPath, err, strings.TrimSpace(out))
+	}
+	if strings.TrimSpace(out) == "busy" {
+		return runPath, send(ctx, name, f, runPath, false)
+	}
+	offset, err := resumeOffset(f, info, out)
+	if err != nil {
+		return "", err
+	}
+	if offset < info.Size() {
+		if err := send(ctx, name, f, partial, offset > 0); err != nil {
+			run(ctx, "rm -rf "+shellQuote(partial+".lock"))
+			return "", err
+		}
+	}
+	out, err = run(ctx, finishStagingCommand(partial, runPath))
+	if err != nil {
+		return "", fmt.Errorf("failed to upload %s: %w: %s", localPath, err, strings.TrimSpace(out))
+	}
+	if offset == 0 {
+		return runPath, nil
+	}
+
+	h := sha256.New()
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	if strings.TrimSpace(out) == fmt.Sprintf("%x", h.Sum(nil)) {
+		return runPath, nil
+	}
+	// The bytes already on the target were not those of the file
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return runPath, send(ctx, name, f, runPath, false)
+}
+
+// claimStagingCommand locks the resumable staging path p for this process
+// and prints how much of it the target has, or "busy" if another run holds
+// the lock or p belongs to another user. Locks left for an hour by runs
+// that died are broken.
+func claimStagingCommand(p string) string {
+	file, lock := shellQuote(p), shellQuote(p+".lock")
+	return fmt.Sprintf(`find %[2]s -maxdepth 0 -mmin +60 -exec rm -rf {} \; 2>/dev/null
+if mkdir %[2]s 2>/dev/null; then
+    echo %[3]s > %[2]s/owner
+elif [ "$(cat %[2]s/owner 2>/dev/null)" != %[3]s ]; then
+    echo busy
+    exit 0
+fi
+if [ -e %[1]s ] && [ ! -O %[1]s ]; then
+    rm -rf %[2]s
+    echo busy
+    exit 0
+fi
+wc -c < %[1]s 2>/dev/null || echo 0`, file, lock, shellQuote(stagingToken))
+}
+
+// finishStagingCommand moves the complete copy at the resumable staging
+// path p to runPath, releases p's lock, and prints the copy's checksum.
+func finishStagingCommand(p, runPath string) string {
+	file, lock, dest := shellQuote(p), shellQuote(p+".lock"), shellQuote(runPath)
+	return fmt.Sprintf(`mv -f %[1]s %[3]s
+status=$?
+rm -rf %[2]s
+[ $status -eq 0 ] || exit $status
+(sha256sum %[3]s 2>/dev/null || shasum -a 256 %[3]s) | cut -d' ' -f1`, file, lock, dest)
+}
+
+// resumeOffset parses the remote size printed by claimStagingCommand and
+// seeks f past the bytes the target already has. A partial copy larger than
+// the file is stale and sent again from the start.
+func resumeOffset(f *os.File, info os.FileInfo, out string) (int64, error) {
+	offset, err := strconv.ParseInt(strings.TrimSpace(out), 10, 64)
+	if err != nil || offset > info.Size() {
+		offset = 0
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return offset, nil
+}
+
+// stdinScript wraps script for sh to read from stdin. The braces make sh
+// read the whole script before running any of it, so commands in it that
+// read stdin cannot consume the rest of the script.
+func stdinScript(script string) string {
+	return "{\n" + script + "\n}\n"
+}
+
+// shellQuote quotes s for safe use as a single POSIX shell word.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
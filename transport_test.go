@@ -0,0 +1,201 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+)
+
+// shTransport runs scripts with sh on this machine.
+type shTransport struct{}
+
+func (shTransport) Run(ctx context.Context, script string) (string, error) {
+	out, err := exec.CommandContext(ctx, "sh", "-c", script).CombinedOutput()
+	return string(out), err
+}
+
+func (shTransport) Close() error { return nil }
+
+// scriptRecorder is a Transport recording the scripts it is given instead
+// of running them, answering each with output.
+type scriptRecorder struct {
+	mu      sync.Mutex
+	scripts []string
+	output  string
+}
+
+func (r *scriptRecorder) Run(ctx context.Context, script string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.scripts = append(r.scripts, script)
+	return r.output, nil
+}
+
+func (r *scriptRecorder) Close() error { return nil }
+
+// script returns the last script run.
+func (r *scriptRecorder) script() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.scripts) == 0 {
+		return ""
+	}
+	return r.scripts[len(r.scripts)-1]
+}
+
+// localStager runs staging commands with sh and sends bytes to files on this
+// machine, standing in for a target.
+func localStager() (func(context.Context, string) (string, error), func(context.Context, string, io.Reader, string, bool) error) {
+	run := func(ctx context.Context, command string) (string, error) {
+		out, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
+		return string(out), err
+	}
+	send := func(ctx context.Context, name string, r io.Reader, remotePath string, resume bool) error {
+		flag := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+		if resume {
+			flag = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+		}
+		f, err := os.OpenFile(remotePath, flag, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(f, r)
+		return err
+	}
+	return run, send
+}
+
+func TestStageResumable(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("staging commands need a POSIX shell")
+	}
+	content := bytes.Repeat([]byte("0123456789"), 1000)
+	localPath := filepath.Join(t.TempDir(), "tool.tar.gz")
+	if err := os.WriteFile(localPath, content, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(localPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	partial := resumableStagingPath(localPath, info)
+	t.Cleanup(func() { os.RemoveAll(partial); os.RemoveAll(partial + ".lock") })
+	run, send := localStager()
+
+	tests := []struct {
+		name     string
+		partial  []byte // left on the target by an earlier transfer
+		locked   bool   // another run holds the lock
+		wantSent int    // bytes sent by this run
+	}{
+		{name: "fresh", wantSent: len(content)},
+		{name: "truncated partial", partial: content[:4000], wantSent: len(content) - 4000},
+		{name: "complete", partial: content, wantSent: 0},
+		// The rest is sent, the checksum fails, and the whole file is sent again
+		{name: "corrupt partial", partial: []byte("not the archive"), wantSent: 2*len(content) - len("not the archive")},
+		// The other run's partial file is left alone, and this one sends its own
+		{name: "locked by another run", partial: content[:10], locked: true, wantSent: len(content)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			os.RemoveAll(partial + ".lock")
+			os.Remove(partial)
+			if tt.partial != nil {
+				if err := os.WriteFile(partial, tt.partial, 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.locked {
+				if err := os.Mkdir(partial+".lock", 0o700); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(partial+".lock/owner", []byte("another-run\n"), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			sent := 0
+			counted := func(ctx context.Context, name string, r io.Reader, remotePath string, resume bool) error {
+				b, err := io.ReadAll(r)
+				if err != nil {
+					return err
+				}
+				sent += len(b)
+				return send(ctx, name, bytes.NewReader(b), remotePath, resume)
+			}
+			staged, err := stageResumable(context.Background(), localPath, run, counted)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.Remove(staged)
+			if staged == partial {
+				t.Fatalf("staged at the shared path %s", partial)
+			}
+			got, err := os.ReadFile(staged)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, content) {
+				t.Fatalf("staged %d bytes not matching the file", len(got))
+			}
+			if sent != tt.wantSent {
+				t.Errorf("sent %d bytes, want %d", sent, tt.wantSent)
+			}
+			_, err = os.Stat(partial + ".lock")
+			if tt.locked && err != nil {
+				t.Errorf("another run's lock was removed")
+			}
+			if !tt.locked && err == nil {
+				t.Errorf("lock left behind")
+			}
+		})
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("quoting is checked with a POSIX shell")
+	}
+	for _, s := range []string{
+		"",
+		"plain",
+		"'",
+		"''",
+		"it's",
+		`'\''`,
+		"$(touch pwned)",
+		"`touch pwned`",
+		"${HOME}",
+		"a\nb",
+		"a\r\nb",
+		"line\n'; touch pwned; '",
+		`back\slash`,
+		"tab\tand space",
+		"* ? [a]",
+		"-n",
+		"\x01\x1b[31m",
+		"; | & < > ( ) { } !",
+	} {
+		dir := t.TempDir()
+		cmd := exec.Command("sh", "-c", "printf %s "+shellQuote(s))
+		cmd.Dir = dir
+		out, err := cmd.Output()
+		if err != nil {
+			t.Errorf("shellQuote(%q): %v", s, err)
+			continue
+		}
+		if string(out) != s {
+			t.Errorf("shellQuote(%q) read back as %q", s, out)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "pwned")); err == nil {
+			t.Errorf("shellQuote(%q) ran a command", s)
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// UninstallOptions selects what Uninstall removes besides the binary.
+type UninstallOptions struct {
+	RemoveUnit    bool // the service definition installed for the upload's Systemd unit, and its socket
+	RemoveConfig  bool // files the upload installed with KeepExisting, such as edited configs
+	RemoveBackups bool // the binary's backups under BackupDir
+}
+
+// UninstallResult is what Uninstall removed from a host.
+type UninstallResult struct {
+	Host    string
+	Removed []string // paths removed, e.g. "/usr/local/bin/api"
+}
+
+// removedMarker prefixes each line uninstallTemplate prints for a path it
+// removed.
+const removedMarker = "binaryinstall-removed:"
+
+// uninstallData is ScriptData with what uninstallTemplate removes.
+type uninstallData struct {
+	ScriptData
+	UninstallOptions
+	Service string // the service running the binary, if any
+}
+
+// uninstallTemplate stops and disables the service running a binary, then
+// removes the binary, or the files, directory or releases its upload
+// installed, and anything else the options select.
+var uninstallTemplate = template.Must(template.Must(scriptTemplate.Clone()).New("uninstall").Parse(`set -e
+
+BINARY={{ q .BinaryName }}
+BACKUP_DIR={{ q .BackupDir }}
+DEST_DIR={{ q .DestinationDir }}
+GROUP={{ q .Group }}
+HOST_MANIFEST={{ q .HostManifest }}
+case $DEST_DIR in "~/"*) DEST_DIR="$HOME/${DEST_DIR#"~/"}" ;; esac
+case $BACKUP_DIR in "~/"*) BACKUP_DIR="$HOME/${BACKUP_DIR#"~/"}" ;; esac
+case $HOST_MANIFEST in "~/"*) HOST_MANIFEST="$HOME/${HOST_MANIFEST#"~/"}" ;; esac
+DEST_DIR=${DEST_DIR%/}
+BACKUP_ROOT="${BACKUP_DIR%/}/$BINARY"
+{{ template "escalation" . }}
+{{ template "services" . }}
+{{ if .HostManifest }}{{ template "manifest" . }}{{ end }}
+
+# remove deletes $1, if it exists, and reports it
+remove() {
+    if as_root test -e "$1" || [ -L "$1" ]; then
+        as_root rm -rf "$1"
+        echo "removed $1"
+        echo "` + removedMarker + ` $1"
+    fi
+}
+
+{{ with .Service }}
+# 1) Stop the service and keep it from starting at boot
+SERVICE={{ q . }}
+{{ if $.ServiceSocket }}[ "$INIT" != systemd ] || systemctl_ disable --now "$SERVICE.socket" || true
+{{ end -}}
+if svc_running "$SERVICE"; then
+    svc stop "$SERVICE"
+    echo "stopped $SERVICE"
+fi
+case $INIT in
+launchd) as_root launchctl disable "system/$SERVICE" ;;
+systemd) systemctl_ disable "$SERVICE.service" 2>/dev/null ;;
+openrc) as_root rc-update del "$SERVICE" default 2>/dev/null ;;
+rcd) as_root sysrc -x "$(printf %s "$SERVICE" | tr -c 'A-Za-z0-9_' _)_enable" 2>/dev/null ;;
+sysv)
+    if command -v update-rc.d >/dev/null 2>&1; then
+        as_root update-rc.d -f "$SERVICE" remove
+    elif command -v chkconfig >/dev/null 2>&1; then
+        as_root chkconfig --del "$SERVICE"
+    fi 2>/dev/null ;;
+esac || echo "warning: could not disable $SERVICE" >&2
+{{ end }}
+
+# 2) Remove what the upload installed
+{{ if .Release -}}
+remove "$DEST_DIR/current"
+remove "$DEST_DIR/releases"
+{{ if .HostManifest }}manifest_remove "$DEST_DIR/current/$BINARY"
+{{ end }}
+{{- else if .ExtractAll -}}
+remove "$DEST_DIR"
+{{ if .HostManifest }}manifest_remove "$DEST_DIR/$BINARY"
+{{ end }}
+{{- else if .Files -}}
+{{ range .Files }}{{ if or (not .KeepExisting) $.RemoveConfig }}remove {{ q .Destination }}
+{{ if $.HostManifest }}manifest_remove {{ q .Destination }}
+{{ end }}{{ end }}{{ end }}
+{{- else -}}
+remove "$DEST_DIR/$BINARY"
+{{ if .HostManifest }}manifest_remove "$DEST_DIR/$BINARY"
+{{ end }}
+{{- end }}
+
+{{ if and .RemoveUnit .ServiceUnit }}
+# 3) Remove the service definition
+case $INIT in
+launchd) UNIT_FILE="/Library/LaunchDaemons/$SERVICE.plist" ;;
+rcd) UNIT_FILE="/usr/local/etc/rc.d/$SERVICE" ;;
+openrc|sysv) UNIT_FILE="/etc/init.d/$SERVICE" ;;
+systemd)
+    {{ if .UserService }}UNIT_FILE="${XDG_CONFIG_HOME:-$HOME/.config}/systemd/user/$SERVICE.service"
+    {{ else }}UNIT_FILE="/etc/systemd/system/$SERVICE.service"
+    {{ end }};;
+esac
+remove "$UNIT_FILE"
+{{ if .ServiceSocket }}remove "${UNIT_FILE%.service}.socket"
+{{ end }}[ "$INIT" != systemd ] || systemctl_ daemon-reload
+{{ end }}
+
+{{ if .RemoveBackups }}
+# 4) Remove the binary's backups
+remove "$BACKUP_ROOT"
+{{ end }}
+
+{{ if .HostManifest }}
+# 5) Drop what was removed from the host manifest
+write_manifest
+{{ end }}`))
+
+// Uninstall removes upload's binary from every host of config, as it would
+// be installed: a single binary, the directory of an ExtractAll upload, the
+// releases of a Release upload, or the listed Files, except KeepExisting
+// ones unless opts.RemoveConfig is set. The service running it, the
+// upload's Systemd unit or else its StopService or RestartService, is
+// stopped and disabled first. With a HostManifest, the removed binaries'
+// entries are dropped from it. Hosts that fail are reported as
+// InstallFailures.
+func Uninstall(config BinaryInstallConfig, upload BinaryUpload, opts UninstallOptions) ([]UninstallResult, error) {
+	hosts := fleetHosts(config)
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no remote host provided")
+	}
+	if kind, _ := transportKind(config); kind == TransportWinRM {
+		return nil, fmt.Errorf("uninstalling is not supported on %s targets", kind)
+	}
+	if upload.InstallAll || upload.FilesManifest != "" {
+		return nil, fmt.Errorf("uploads installing every executable or a file manifest from the archive cannot be uninstalled, as their files are only known from the archive")
+	}
+	if kind := packageKind(uploadArtifactBase(upload)); kind != "" {
+		return nil, fmt.Errorf("%s packages are uninstalled with the package manager", kind)
+	}
+	binaryName := uploadBinaryName(upload)
+	if binaryName == "" {
+		return nil, fmt.Errorf("unable to derive the binary name of %s", uploadLabel(upload))
+	}
+	upload, err := expandUploadVars(upload)
+	if err != nil {
+		return nil, err
+	}
+
+	sData := uninstallData{
+		ScriptData: ScriptData{
+			SudoPassword:   config.SudoPassword,
+			Escalation:     config.Escalation,
+			NoSudo:         upload.NoSudo,
+			BinaryName:     binaryName,
+			BackupDir:      config.BackupDir,
+			DestinationDir: upload.DestinationDir,
+			Owner:          upload.Owner,
+			Group:          upload.Group,
+			Permission:     permission(upload),
+			ExtractAll:     upload.ExtractAll,
+			Release:        upload.Release,
+			Files:          upload.Files,
+			UserService:    upload.UserService,
+			HostManifest:   config.HostManifest,
+			HookTimeout:    5 * time.Minute,
+			ActiveTimeout:  30 * time.Second,
+		},
+		UninstallOptions: opts,
+		Service:          upload.StopService,
+	}
+	if sData.Service == "" {
+		sData.Service = upload.RestartService
+	}
+	if upload.Systemd != nil {
+		if sData.ServiceName, sData.ServiceUnit, err = renderUnit(upload, binaryName); err != nil {
+			return nil, err
+		}
+		if sData.ServiceSocket, err = renderSocket(upload, sData.ServiceName); err != nil {
+			return nil, err
+		}
+		sData.Service = sData.ServiceName
+	}
+	if sData.Group == "" {
+		sData.Group = sData.Owner
+	}
+	if err := validateScriptData(sData.ScriptData, false); err != nil {
+		return nil, err
+	}
+	if strings.ContainsAny(sData.Service, "\x00\n\r") {
+		return nil, fmt.Errorf("service %q contains control characters", sData.Service)
+	}
+
+	var (
+		mu      sync.Mutex
+		results []UninstallResult
+	)
+	err = runAll(len(hosts), config.MaxParallelHosts, config.ContinueOnError, func(i int) error {
+		hostConfig := forHost(config, hosts[i])
+		result, err := uninstallHost(hostConfig, sData)
+		if err != nil {
+			return &InstallFailure{Host: hostConfig.RemoteHost, Upload: uploadLabel(upload), Err: err}
+		}
+		mu.Lock()
+		results = append(results, result)
+		mu.Unlock()
+		return nil
+	})
+	return results, err
+}
+
+// uninstallHost runs uninstallTemplate for sData on config.RemoteHost.
+func uninstallHost(config BinaryInstallConfig, sData uninstallData) (result UninstallResult, err error) {
+	result = UninstallResult{Host: config.RemoteHost}
+	transport, err := connectHost(&config)
+	if err != nil {
+		return result, err
+	}
+	defer transport.Close()
+	var lock *deployLock
+	if config.Lock {
+		if lock, err = acquireLock(config, transport); err != nil {
+			return result, err
+		}
+		defer func() {
+			if lockErr := lock.Release(); lockErr != nil && err == nil {
+				err = lockErr
+			}
+		}()
+	}
+	return runUninstall(config, transport, sData)
+}
+
+// runUninstall runs uninstallTemplate for sData over transport, reporting
+// what it removed.
+func runUninstall(config BinaryInstallConfig, transport Transport, sData uninstallData) (UninstallResult, error) {
+	result := UninstallResult{Host: config.RemoteHost}
+	sData.SudoPassword = config.SudoPassword
+	var script bytes.Buffer
+	if err := uninstallTemplate.Execute(&script, sData); err != nil {
+		return result, fmt.Errorf("failed to render uninstall script: %w", err)
+	}
+	out, err := runScript(config, transport, script.String())
+	if err != nil {
+		return result, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if rest, ok := strings.CutPrefix(line, removedMarker); ok {
+			result.Removed = append(result.Removed, strings.TrimSpace(rest))
+		}
+	}
+	if config.Verbose {
+		log.Printf("Removed %d paths from %s", len(result.Removed), config.RemoteHost)
+	}
+	return result, nil
+}
@@ -0,0 +1,143 @@
+package binaryinstall
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUninstallUnsupported(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		config  BinaryInstallConfig
+		upload  BinaryUpload
+		wantErr string
+	}{
+		{"no host", BinaryInstallConfig{}, BinaryUpload{Path: "api_Linux_x86_64.tar.gz"}, "no remote host provided"},
+		{"winrm", BinaryInstallConfig{RemoteHost: "winrm://win1"}, BinaryUpload{Path: "api_Windows_x86_64.zip"}, "not supported on winrm targets"},
+		{"install all", BinaryInstallConfig{RemoteHost: "web1"}, BinaryUpload{Path: "tools.tar.gz", InstallAll: true}, "cannot be uninstalled"},
+		{"package", BinaryInstallConfig{RemoteHost: "web1"}, BinaryUpload{Path: "api_1.0_amd64.deb"}, "uninstalled with the package manager"},
+	} {
+		if _, err := Uninstall(tt.config, tt.upload, UninstallOptions{}); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: returned %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestUninstallBinary(t *testing.T) {
+	stubCommand(t, "sudo", `case $1 in chown|setcap) exit 0 ;; esac; exec "$@"`)
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	config := BinaryInstallConfig{RemoteHost: "local", BackupDir: filepath.Join(dir, "bin.old"), HostManifest: filepath.Join(dir, "manifest.json")}
+	// Install the api twice, so it has a backup, and the tool once
+	for _, name := range []string{"api", "api", "tool"} {
+		archive := filepath.Join(dir, name+"_Linux_x86_64.tar.gz")
+		writeArchive(t, archive, file(name))
+		upload := BinaryUpload{Path: archive, DestinationDir: bin, Owner: "root", Permission: "0755", Reinstall: true}
+		if err := processUploadSingleCommand(config, shTransport{}, upload); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sData := uninstallData{
+		ScriptData: ScriptData{
+			BinaryName:     "api",
+			BackupDir:      config.BackupDir,
+			DestinationDir: bin,
+			Owner:          "root",
+			Group:          "root",
+			HostManifest:   config.HostManifest,
+			HookTimeout:    time.Second,
+			ActiveTimeout:  time.Second,
+		},
+		UninstallOptions: UninstallOptions{RemoveBackups: true},
+	}
+	result, err := runUninstall(config, shTransport{}, sData)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, tool := filepath.Join(bin, "api"), filepath.Join(bin, "tool")
+	if want := []string{api, filepath.Join(config.BackupDir, "api")}; !reflect.DeepEqual(result.Removed, want) {
+		t.Errorf("removed %q, want %q", result.Removed, want)
+	}
+	if _, err := os.Stat(tool); err != nil {
+		t.Errorf("the tool was removed: %v", err)
+	}
+	entries := readHostManifest(t, config.HostManifest)
+	if _, ok := entries[api]; ok || len(entries) != 1 {
+		t.Errorf("host manifest after uninstalling the api: %+v", entries)
+	}
+
+	// Uninstalling again finds nothing to remove
+	if result, err := runUninstall(config, shTransport{}, sData); err != nil || len(result.Removed) != 0 {
+		t.Errorf("uninstalling again removed %q, %v", result.Removed, err)
+	}
+}
+
+func TestUninstallFiles(t *testing.T) {
+	dir := t.TempDir()
+	binary, conf := filepath.Join(dir, "bin", "api"), filepath.Join(dir, "etc", "api.conf")
+	sData := uninstallData{ScriptData: ScriptData{
+		Escalation:     EscalateNone,
+		BinaryName:     "api",
+		BackupDir:      filepath.Join(dir, "bin.old"),
+		DestinationDir: filepath.Join(dir, "bin"),
+		Files: []ArchiveFile{
+			{Source: "api", Destination: binary},
+			{Source: "api.conf", Destination: conf, KeepExisting: true},
+		},
+		HookTimeout:   time.Second,
+		ActiveTimeout: time.Second,
+	}}
+	for _, removeConfig := range []bool{false, true} {
+		for _, p := range []string{binary, conf} {
+			if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(p, nil, 0o644); err != nil {
+				t.Fatal(err)
+			}
+		}
+		sData.RemoveConfig = removeConfig
+		result, err := runUninstall(BinaryInstallConfig{RemoteHost: "local"}, shTransport{}, sData)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []string{binary}
+		if removeConfig {
+			want = append(want, conf)
+		}
+		if !reflect.DeepEqual(result.Removed, want) {
+			t.Errorf("with RemoveConfig %v, removed %q, want %q", removeConfig, result.Removed, want)
+		}
+	}
+}
+
+func TestUninstallService(t *testing.T) {
+	systemdHost(t)
+	stubCommand(t, "sudo", `exec "$@"`)
+	calls := stubSystemctl(t, `case $1 in is-active) exit 0 ;; esac`)
+	dir := t.TempDir()
+	sData := uninstallData{
+		ScriptData: ScriptData{
+			BinaryName:     "api",
+			BackupDir:      filepath.Join(dir, "bin.old"),
+			DestinationDir: filepath.Join(dir, "bin"),
+			HookTimeout:    time.Second,
+			ActiveTimeout:  time.Second,
+		},
+		Service: "api",
+	}
+	if _, err := runUninstall(BinaryInstallConfig{RemoteHost: "local"}, shTransport{}, sData); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := calls(), "is-active --quiet api\nstop api\ndisable api.service"; got != want {
+		t.Errorf("systemctl called with\n%s\nwant\n%s", got, want)
+	}
+}
@@ -0,0 +1,259 @@
+package binaryinstall
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// archiveExtensions are the tar archive extensions recognized in file names,
+// longest first so ".tar.gz" is matched before ".gz" would be.
+var archiveExtensions = []string{".tar.gz", ".tar.xz", ".tar.bz2", ".tgz", ".txz", ".tbz2", ".tbz", ".tar"}
+
+// trimArchiveExt removes a recognized archive extension from name.
+func trimArchiveExt(name string) string {
+	for _, ext := range archiveExtensions {
+		if strings.HasSuffix(name, ext) {
+			return strings.TrimSuffix(name, ext)
+		}
+	}
+	return name
+}
+
+// archiveBinaryName derives the binary's name from its archive's file name
+// by dropping the extension and everything from the first underscore, e.g.
+// "llmfs_Linux_x86_64.tar.gz" => "llmfs".
+func archiveBinaryName(base string) string {
+	name, _, _ := strings.Cut(trimArchiveExt(base), "_")
+	return name
+}
+
+// uploadArtifactBase returns the file name of upload's artifact, from its
+// Path, LocalPath, Name or URL.
+func uploadArtifactBase(upload BinaryUpload) string {
+	for _, s := range []string{upload.Path, upload.LocalPath, upload.Name, upload.URL} {
+		if s != "" {
+			return filepath.Base(s)
+		}
+	}
+	return ""
+}
+
+// uploadBinaryName returns the name upload's binary is installed under: the
+// base name of its ArchivePath, or one derived from its artifact's name.
+func uploadBinaryName(upload BinaryUpload) string {
+	if upload.ArchivePath != "" {
+		return path.Base(upload.ArchivePath)
+	}
+	return archiveBinaryName(uploadArtifactBase(upload))
+}
+
+// globArchives returns the archives directly in dir, of any recognized format.
+func globArchives(dir string) ([]string, error) {
+	var matches []string
+	for _, ext := range archiveExtensions {
+		m, err := filepath.Glob(filepath.Join(dir, "*"+ext))
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, m...)
+	}
+	return matches, nil
+}
+
+// hasGlob reports whether p contains glob metacharacters.
+func hasGlob(p string) bool {
+	return strings.ContainsAny(p, "*?[")
+}
+
+// expandLocalGlobs replaces each upload whose LocalPath is a glob, e.g.
+// "dist/*_Linux_x86_64.tar.gz", with one upload per matching file.
+func expandLocalGlobs(uploads []BinaryUpload) ([]BinaryUpload, error) {
+	var expanded []BinaryUpload
+	for _, upload := range uploads {
+		if !hasGlob(upload.LocalPath) {
+			expanded = append(expanded, upload)
+			continue
+		}
+		matches, err := filepath.Glob(upload.LocalPath)
+		if err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", upload.LocalPath, err)
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no local files match %s", upload.LocalPath)
+		}
+		for _, match := range matches {
+			upload.LocalPath = match
+			expanded = append(expanded, upload)
+		}
+	}
+	return expanded, nil
+}
+
+// expandRemoteGlobs replaces each upload whose Path is a glob with one upload
+// per file matching it on the host behind transport.
+func expandRemoteGlobs(config BinaryInstallConfig, transport Transport, uploads []BinaryUpload) ([]BinaryUpload, error) {
+	var expanded []BinaryUpload
+	for _, upload := range uploads {
+		if !hasGlob(upload.Path) {
+			expanded = append(expanded, upload)
+			continue
+		}
+		if kind, _ := transportKind(config); kind == TransportWinRM {
+			return nil, fmt.Errorf("remote globs are not supported on %s targets", kind)
+		}
+		script := "for f in " + globQuote(upload.Path) + `; do [ -e "$f" ] && printf '%s\n' "$f"; done; true`
+		out, err := runScript(config, transport, script)
+		if err != nil {
+			return nil, fmt.Errorf("failed to expand %s: %w", upload.Path, err)
+		}
+		var matches []string
+		for _, line := range strings.Split(out, "\n") {
+			if line = strings.TrimRight(line, "\r"); line != "" {
+				matches = append(matches, line)
+			}
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no remote files match %s", upload.Path)
+		}
+		for _, match := range matches {
+			upload.Path = match
+			expanded = append(expanded, upload)
+		}
+	}
+	return expanded, nil
+}
+
+// globQuote shell-quotes pattern except for its glob metacharacters, so the
+// shell expands the glob but nothing else.
+func globQuote(pattern string) string {
+	var b, lit strings.Builder
+	flush := func() {
+		if lit.Len() > 0 {
+			b.WriteString(shellQuote(lit.String()))
+			lit.Reset()
+		}
+	}
+	for _, r := range pattern {
+		if strings.ContainsRune("*?[]!", r) {
+			flush()
+			b.WriteRune(r)
+		} else {
+			lit.WriteRune(r)
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// DistArtifact is a release archive found in a goreleaser dist directory.
+type DistArtifact struct {
+	Path   string // e.g. "dist/llmfs_Linux_x86_64.tar.gz"
+	Binary string // e.g. "llmfs"
+	OS     string // GOOS, e.g. "linux"
+	Arch   string // GOARCH, e.g. "amd64"
+}
+
+// ScanDist lists the tar archives in a goreleaser dist directory, parsing
+// the OS and architecture from names such as "llmfs_Linux_x86_64.tar.gz" or
+// "llmfs_1.2.3_linux_arm64.tar.xz". Archives without both are skipped.
+func ScanDist(dir string) ([]DistArtifact, error) {
+	matches, err := globArchives(dir)
+	if err != nil {
+		return nil, err
+	}
+	var artifacts []DistArtifact
+	for _, match := range matches {
+		parts := strings.Split(trimArchiveExt(filepath.Base(match)), "_")
+		for i := 1; i < len(parts)-1; i++ {
+			goos := normalizeOS(parts[i])
+			if goos == "" {
+				continue
+			}
+			artifacts = append(artifacts, DistArtifact{
+				Path:   match,
+				Binary: parts[0],
+				OS:     goos,
+				Arch:   normalizeArch(strings.Join(parts[i+1:], "_")),
+			})
+			break
+		}
+	}
+	return artifacts, nil
+}
+
+// normalizeOS maps an OS as found in archive names or uname -s to its GOOS,
+// or "" if it is not one.
+func normalizeOS(s string) string {
+	switch s = strings.ToLower(s); s {
+	case "linux", "darwin", "windows", "freebsd", "openbsd", "netbsd":
+		return s
+	}
+	return ""
+}
+
+// normalizeArch maps an architecture as found in archive names or uname -m
+// to its GOARCH.
+func normalizeArch(s string) string {
+	switch s = strings.ToLower(s); {
+	case s == "x86_64" || strings.HasPrefix(s, "amd64"):
+		return "amd64"
+	case s == "aarch64" || s == "arm64":
+		return "arm64"
+	case s == "i386" || s == "i686" || s == "386":
+		return "386"
+	case strings.HasPrefix(s, "arm"):
+		return "arm"
+	}
+	return s
+}
+
+// expandDist replaces each upload with a Dist directory by one upload per
+// binary in it, picking the archive built for the host behind transport.
+func expandDist(config BinaryInstallConfig, transport Transport, uploads []BinaryUpload) ([]BinaryUpload, error) {
+	var goos, goarch string
+	var expanded []BinaryUpload
+	for _, upload := range uploads {
+		if upload.Dist == "" {
+			expanded = append(expanded, upload)
+			continue
+		}
+		if goos == "" {
+			if kind, _ := transportKind(config); kind == TransportWinRM {
+				return nil, fmt.Errorf("dist uploads are not supported on %s targets", kind)
+			}
+			out, err := runScript(config, transport, "uname -sm")
+			if err != nil {
+				return nil, fmt.Errorf("failed to detect platform: %w", err)
+			}
+			fields := strings.Fields(out)
+			if len(fields) != 2 {
+				return nil, fmt.Errorf("unexpected uname output %q", out)
+			}
+			goos, goarch = normalizeOS(fields[0]), normalizeArch(fields[1])
+		}
+
+		artifacts, err := ScanDist(upload.Dist)
+		if err != nil {
+			return nil, err
+		}
+		seen := map[string]bool{}
+		for _, artifact := range artifacts {
+			if artifact.OS != goos || artifact.Arch != goarch || seen[artifact.Binary] {
+				continue
+			}
+			seen[artifact.Binary] = true
+			match := upload
+			match.Dist, match.LocalPath = "", artifact.Path
+			if upload.seedDist != "" {
+				match.Path, match.LocalPath = upload.seedDist+"/"+filepath.Base(artifact.Path), ""
+			}
+			expanded = append(expanded, match)
+		}
+		if len(seen) == 0 {
+			return nil, fmt.Errorf("no %s/%s archives in %s", goos, goarch, upload.Dist)
+		}
+	}
+	return expanded, nil
+}
@@ -0,0 +1,208 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// lookupChecksum finds the SHA-256 for the archive named name in the
+// goreleaser-style checksums file at upload.Checksums, a local path or an
+// http(s) URL fetched with the upload's headers.
+func lookupChecksum(ctx context.Context, config BinaryInstallConfig, upload BinaryUpload, name string) (string, error) {
+	var raw []byte
+	var err error
+	if strings.HasPrefix(upload.Checksums, "http://") || strings.HasPrefix(upload.Checksums, "https://") {
+		// The upload's credentials are only folded into its headers when it
+		// has a download URL; a local archive's checksums need them too.
+		headers := upload.Headers
+		if upload.URL == "" {
+			headers = append(authHeaders(upload), headers...)
+		}
+		// Headers are passed on stdin to keep credentials out of the process list
+		cmd := exec.CommandContext(ctx, "curl", "-fsSL", "--retry", "3", "-H", "@-", upload.Checksums)
+		cmd.Stdin = strings.NewReader(headerLines(headers))
+		if raw, err = cmd.Output(); err != nil {
+			return "", fmt.Errorf("failed to fetch %s: %w", upload.Checksums, err)
+		}
+	} else if raw, err = os.ReadFile(upload.Checksums); err != nil {
+		return "", err
+	}
+
+	// Each line is "<sha256>  <file>"; sha256sum marks binary mode with "*".
+	for _, line := range strings.Split(string(raw), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			if config.Verbose {
+				log.Printf("Found checksum for %s in %s", name, upload.Checksums)
+			}
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	return "", fmt.Errorf("no checksum for %s in %s", name, upload.Checksums)
+}
+
+// verifyUploadSignature checks the locally available archive of upload
+// against its minisign signature: upload.MinisignSignature, or the archive's
+// path or URL with ".minisig" appended.
+func verifyUploadSignature(ctx context.Context, config BinaryInstallConfig, upload BinaryUpload) error {
+	if upload.LocalPath == "" {
+		return fmt.Errorf("minisign verification needs an archive that is local or fetched locally")
+	}
+	sig := upload.MinisignSignature
+	if sig == "" {
+		sig = upload.LocalPath + ".minisig"
+		if upload.URL != "" {
+			sig = upload.URL + ".minisig"
+		}
+	}
+
+	sig, cleanup, err := fetchSidecar(ctx, config, upload, sig)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	if err := verifyMinisign(upload.MinisignPublicKey, upload.LocalPath, sig); err != nil {
+		return fmt.Errorf("minisign verification of %s failed: %w", filepath.Base(upload.LocalPath), err)
+	}
+	if config.Verbose {
+		log.Printf("Verified minisign signature of %s", filepath.Base(upload.LocalPath))
+	}
+	return nil
+}
+
+// fetchSidecar returns a local path for loc, a file published next to the
+// archive such as a signature. URLs are fetched locally through the same
+// source as the archive, with its headers and credentials.
+func fetchSidecar(ctx context.Context, config BinaryInstallConfig, upload BinaryUpload, loc string) (string, func(), error) {
+	if !strings.Contains(loc, "://") {
+		return loc, func() {}, nil
+	}
+	sidecar := upload
+	sidecar.URL, sidecar.Source, sidecar.FetchLocal, sidecar.ChecksumHeader = loc, nil, true, ""
+	source, err := sourceFor(config, sidecar)
+	if err != nil {
+		return "", nil, err
+	}
+	artifact, err := source.Fetch(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	cleanup := func() {}
+	if artifact.Cleanup != nil {
+		cleanup = artifact.Cleanup
+	}
+	if artifact.LocalPath == "" {
+		cleanup()
+		return "", nil, fmt.Errorf("failed to fetch %s locally", loc)
+	}
+	return artifact.LocalPath, cleanup, nil
+}
+
+// verifyProvenance checks the locally available archive of upload against
+// its SLSA provenance with slsa-verifier, requiring the configured source
+// repository and, if set, builder.
+func verifyProvenance(ctx context.Context, config BinaryInstallConfig, upload BinaryUpload) error {
+	if upload.LocalPath == "" {
+		return fmt.Errorf("provenance verification needs an archive that is local or fetched locally")
+	}
+	if upload.SLSAProvenance == "" {
+		return fmt.Errorf("no SLSA provenance given for %s", filepath.Base(upload.LocalPath))
+	}
+	provenance, cleanup, err := fetchSidecar(ctx, config, upload, upload.SLSAProvenance)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	args := []string{"verify-artifact", upload.LocalPath, "--provenance-path", provenance, "--source-uri", upload.SLSASourceURI}
+	if upload.SLSABuilderID != "" {
+		args = append(args, "--builder-id", upload.SLSABuilderID)
+	}
+	if out, err := exec.CommandContext(ctx, "slsa-verifier", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("SLSA provenance verification of %s failed: %w: %s", filepath.Base(upload.LocalPath), err, strings.TrimSpace(string(out)))
+	}
+	if config.Verbose {
+		log.Printf("Verified SLSA provenance of %s from %s", filepath.Base(upload.LocalPath), upload.SLSASourceURI)
+	}
+	return nil
+}
+
+// verifyMinisign verifies file against the minisign signature in sigPath.
+// publicKey is the base64 key line of a minisign .pub file, or the whole file.
+func verifyMinisign(publicKey, file, sigPath string) error {
+	var keyLine string
+	for _, line := range strings.Split(publicKey, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "untrusted comment:") {
+			keyLine = line
+		}
+	}
+	key, err := base64.StdEncoding.DecodeString(keyLine)
+	if err != nil || len(key) != 42 || string(key[:2]) != "Ed" {
+		return fmt.Errorf("invalid minisign public key")
+	}
+	keyID, pub := key[2:10], ed25519.PublicKey(key[10:])
+
+	raw, err := os.ReadFile(sigPath)
+	if err != nil {
+		return err
+	}
+	lines := strings.Split(strings.ReplaceAll(string(raw), "\r", ""), "\n")
+	if len(lines) < 4 || !strings.HasPrefix(lines[2], "trusted comment: ") {
+		return fmt.Errorf("malformed signature file %s", sigPath)
+	}
+	sig, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sig) != 74 {
+		return fmt.Errorf("malformed signature in %s", sigPath)
+	}
+	globalSig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalSig) != ed25519.SignatureSize {
+		return fmt.Errorf("malformed global signature in %s", sigPath)
+	}
+	if !bytes.Equal(sig[2:10], keyID) {
+		return fmt.Errorf("signature was made with a different key")
+	}
+
+	// "ED" signatures cover the BLAKE2b-512 hash of the file, legacy "Ed"
+	// ones the file itself.
+	var message []byte
+	switch string(sig[:2]) {
+	case "ED":
+		h, _ := blake2b.New512(nil)
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if _, err := io.Copy(h, f); err != nil {
+			return err
+		}
+		message = h.Sum(nil)
+	case "Ed":
+		if message, err = os.ReadFile(file); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", sig[:2])
+	}
+	if !ed25519.Verify(pub, message, sig[10:]) {
+		return fmt.Errorf("signature does not match")
+	}
+
+	trusted := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(pub, append(append([]byte{}, sig[10:]...), trusted...), globalSig) {
+		return fmt.Errorf("trusted comment signature does not match")
+	}
+	return nil
+}
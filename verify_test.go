@@ -0,0 +1,146 @@
+package binaryinstall
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// minisignKey is a minisign key pair made from a fixed seed.
+type minisignKey struct {
+	id   []byte
+	priv ed25519.PrivateKey
+}
+
+func newMinisignKey(seed byte, id string) minisignKey {
+	return minisignKey{
+		id:   []byte(id),
+		priv: ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize)),
+	}
+}
+
+// pub returns the key as a minisign .pub file.
+func (k minisignKey) pub() string {
+	key := append(append([]byte("Ed"), k.id...), k.priv.Public().(ed25519.PublicKey)...)
+	return "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(key) + "\n"
+}
+
+// sign returns a minisign signature file for data, made with algorithm "ED"
+// or the legacy "Ed".
+func (k minisignKey) sign(algorithm string, data []byte, trusted string) string {
+	message := data
+	if algorithm == "ED" {
+		h := blake2b.Sum512(data)
+		message = h[:]
+	}
+	sig := ed25519.Sign(k.priv, message)
+	global := ed25519.Sign(k.priv, append(append([]byte{}, sig...), trusted...))
+	return "untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(append(append([]byte(algorithm), k.id...), sig...)) + "\n" +
+		"trusted comment: " + trusted + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n"
+}
+
+func TestVerifyMinisign(t *testing.T) {
+	data := []byte("#!/bin/sh\necho release 1.2.3\n")
+	key := newMinisignKey(1, "\x01\x02\x03\x04\x05\x06\x07\x08")
+	other := newMinisignKey(2, "\x08\x07\x06\x05\x04\x03\x02\x01")
+	sameID := newMinisignKey(3, "\x01\x02\x03\x04\x05\x06\x07\x08")
+	valid := key.sign("ED", data, "timestamp:1700000000\tfile:app.tar.gz")
+
+	tests := []struct {
+		name    string
+		pub     string
+		file    []byte
+		sig     string
+		wantErr string // empty if it verifies
+	}{
+		{"valid", key.pub(), data, valid, ""},
+		{"valid legacy", key.pub(), data, key.sign("Ed", data, "legacy"), ""},
+		{"key line only", strings.Split(key.pub(), "\n")[1], data, valid, ""},
+		{"CRLF signature", key.pub(), data, strings.ReplaceAll(valid, "\n", "\r\n"), ""},
+
+		{"wrong key", other.pub(), data, valid, "different key"},
+		{"wrong key with the same id", sameID.pub(), data, valid, "signature does not match"},
+		{"tampered file", key.pub(), append(append([]byte{}, data...), '\n'), valid, "signature does not match"},
+		{"tampered legacy file", key.pub(), []byte("#!/bin/sh\necho pwned\n"), key.sign("Ed", data, "legacy"), "signature does not match"},
+		{"tampered trusted comment", key.pub(), data, strings.Replace(valid, "file:app.tar.gz", "file:other.tar.gz", 1), "trusted comment signature does not match"},
+
+		{"invalid public key", "untrusted comment: x\nnot base64!\n", data, valid, "invalid minisign public key"},
+		{"short public key", base64.StdEncoding.EncodeToString([]byte("Ed1234")), data, valid, "invalid minisign public key"},
+		{"empty signature file", key.pub(), data, "", "malformed signature file"},
+		{"missing trusted comment", key.pub(), data, replaceLine(valid, 2, "comment: timestamp:1700000000"), "malformed signature file"},
+		{"signature not base64", key.pub(), data, replaceLine(valid, 1, "$(touch pwned)"), "malformed signature in"},
+		{"short signature", key.pub(), data, replaceLine(valid, 1, base64.StdEncoding.EncodeToString([]byte("ED12345678"))), "malformed signature in"},
+		{"global signature not base64", key.pub(), data, replaceLine(valid, 3, "'\n"), "malformed global signature"},
+		{"unknown algorithm", key.pub(), data, key.sign("XX", data, "x"), "unsupported signature algorithm"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		file, sigPath := filepath.Join(dir, "app.tar.gz"), filepath.Join(dir, "app.tar.gz.minisig")
+		if err := os.WriteFile(file, tt.file, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(sigPath, []byte(tt.sig), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		err := verifyMinisign(tt.pub, file, sigPath)
+		switch {
+		case tt.wantErr == "" && err != nil:
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+		case tt.wantErr != "" && err == nil:
+			t.Errorf("%s: verified, want an error containing %q", tt.name, tt.wantErr)
+		case tt.wantErr != "" && !strings.Contains(err.Error(), tt.wantErr):
+			t.Errorf("%s: error %q, want one containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+// replaceLine returns s with its line i replaced by line.
+func replaceLine(s string, i int, line string) string {
+	lines := strings.Split(s, "\n")
+	lines[i] = line
+	return strings.Join(lines, "\n")
+}
+
+func TestLookupChecksumHeaders(t *testing.T) {
+	sum := strings.Repeat("ab", 32)
+	stdin := filepath.Join(t.TempDir(), "stdin")
+	stubCommand(t, "curl", "cat > "+shellQuote(stdin)+"\necho '"+sum+"  app_linux_amd64.tar.gz'")
+
+	tests := []struct {
+		name   string
+		upload BinaryUpload
+	}{
+		{"local archive", BinaryUpload{LocalPath: "app_linux_amd64.tar.gz"}},
+		{"download URL", BinaryUpload{URL: "https://example.com/app_linux_amd64.tar.gz", Headers: []string{"Authorization: Bearer s3cret"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			upload := tt.upload
+			upload.BearerToken = "s3cret"
+			upload.Checksums = "https://example.com/checksums.txt"
+			got, err := lookupChecksum(context.Background(), BinaryInstallConfig{}, upload, "app_linux_amd64.tar.gz")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != sum {
+				t.Errorf("lookupChecksum() = %s, want %s", got, sum)
+			}
+			raw, err := os.ReadFile(stdin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := strings.Count(string(raw), "Authorization: Bearer s3cret"); n != 1 {
+				t.Errorf("curl got the bearer token %d times in %q, want once", n, raw)
+			}
+		})
+	}
+}
@@ -0,0 +1,229 @@
+package binaryinstall
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// cronSchedule is a parsed five-field cron expression: minute, hour, day of
+// month, month, and day of week.
+type cronSchedule struct {
+	minute, hour, dom, month, dow uint64 // bit sets of allowed values
+	domAny, dowAny                bool
+	loc                           *time.Location
+}
+
+var (
+	monthNames = []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	dayNames   = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+// parseCron parses a cron expression such as "* 9-16 * * mon-thu", which
+// matches every minute from 9:00 to 16:59, Monday to Thursday. It may start
+// with CRON_TZ=<zone> (or TZ=<zone>) to be evaluated in that time zone
+// rather than the local one.
+func parseCron(expr string) (*cronSchedule, error) {
+	s := &cronSchedule{loc: time.Local}
+	fields := strings.Fields(expr)
+	if len(fields) > 0 && (strings.HasPrefix(fields[0], "CRON_TZ=") || strings.HasPrefix(fields[0], "TZ=")) {
+		_, zone, _ := strings.Cut(fields[0], "=")
+		loc, err := time.LoadLocation(zone)
+		if err != nil {
+			return nil, fmt.Errorf("invalid time zone in %q: %w", expr, err)
+		}
+		s.loc, fields = loc, fields[1:]
+	}
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields", expr)
+	}
+
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("invalid minute in %q: %w", expr, err)
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("invalid hour in %q: %w", expr, err)
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("invalid day of month in %q: %w", expr, err)
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12, monthNames); err != nil {
+		return nil, fmt.Errorf("invalid month in %q: %w", expr, err)
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7, dayNames); err != nil {
+		return nil, fmt.Errorf("invalid day of week in %q: %w", expr, err)
+	}
+	if s.dow&(1<<7) != 0 { // 7 is Sunday too
+		s.dow |= 1
+	}
+	// as in cron, a day field starting with * (such as */2) is unrestricted
+	// when deciding whether both must match
+	s.domAny, s.dowAny = strings.HasPrefix(fields[2], "*"), strings.HasPrefix(fields[4], "*")
+	return s, nil
+}
+
+// parseCronField parses a comma-separated list of values, ranges (a-b),
+// steps (*/n, a-b/n) and, with names, three-letter names counted from lo.
+func parseCronField(field string, lo, hi int, names []string) (uint64, error) {
+	value := func(s string) (int, error) {
+		for i, name := range names {
+			if strings.EqualFold(s, name) {
+				return lo + i, nil
+			}
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < lo || n > hi {
+			return 0, fmt.Errorf("%q is not between %d and %d", s, lo, hi)
+		}
+		return n, nil
+	}
+
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			if step, err = strconv.Atoi(stepStr); err != nil || step <= 0 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+		}
+		start, end := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if start, err = value(a); err != nil {
+				return 0, err
+			}
+			end = start
+			if isRange {
+				if end, err = value(b); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				end = hi
+			}
+			if end < start {
+				return 0, fmt.Errorf("range %q runs backwards", rng)
+			}
+		}
+		for n := start; n <= end; n += step {
+			bits |= 1 << n
+		}
+	}
+	return bits, nil
+}
+
+// matches reports whether the minute containing t is in the schedule. As in
+// cron, when both day fields are restricted either may match.
+func (s *cronSchedule) matches(t time.Time) bool {
+	t = t.In(s.loc)
+	if s.minute&(1<<t.Minute()) == 0 || s.hour&(1<<t.Hour()) == 0 || s.month&(1<<int(t.Month())) == 0 {
+		return false
+	}
+	domOK, dowOK := s.dom&(1<<t.Day()) != 0, s.dow&(1<<int(t.Weekday())) != 0
+	if s.domAny || s.dowAny {
+		return domOK && dowOK
+	}
+	return domOK || dowOK
+}
+
+// inDeployWindow reports whether now falls within one of windows, and if
+// not, when the next one opens (zero if none does within a year).
+func inDeployWindow(windows []string, now time.Time) (bool, time.Time, error) {
+	schedules := make([]*cronSchedule, len(windows))
+	for i, w := range windows {
+		s, err := parseCron(w)
+		if err != nil {
+			return false, time.Time{}, err
+		}
+		schedules[i] = s
+	}
+	matches := func(t time.Time) bool {
+		for _, s := range schedules {
+			if s.matches(t) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches(now) {
+		return true, time.Time{}, nil
+	}
+	t := now.Truncate(time.Minute)
+	for end := now.AddDate(1, 0, 0); t.Before(end); {
+		t = t.Add(time.Minute)
+		if matches(t) {
+			return false, t, nil
+		}
+	}
+	return false, time.Time{}, nil
+}
+
+// checkDeployWindow returns an error if now is outside config.DeployWindows,
+// or with DeployWindowWait, sleeps until the next window opens.
+func checkDeployWindow(config BinaryInstallConfig) error {
+	if len(config.DeployWindows) == 0 {
+		return nil
+	}
+	now := time.Now()
+	open, next, err := inDeployWindow(config.DeployWindows, now)
+	if err != nil {
+		return err
+	}
+	switch {
+	case open:
+		return nil
+	case config.IgnoreDeployWindows:
+		if config.Verbose {
+			log.Printf("Outside the deploy windows; installing anyway")
+		}
+		return nil
+	case next.IsZero():
+		return fmt.Errorf("outside the deploy windows, and none opens within a year")
+	case config.DeployWindowWait:
+		if config.Verbose {
+			log.Printf("Outside the deploy windows; waiting until %s", next.Format(time.RFC1123))
+		}
+		time.Sleep(next.Sub(now))
+		return nil
+	}
+	return fmt.Errorf("outside the deploy windows; the next opens at %s", next.Format(time.RFC1123))
+}
+
+// LoadDeployWindows reads the deploy windows of environment from a YAML
+// file mapping environment names to cron expressions, e.g.
+//
+//	prod:
+//	  - "CRON_TZ=America/New_York * 9-15 * * mon-thu"
+//	staging:
+//	  - "* * * * *"
+//
+// An environment missing from the file is an error, so a typo does not
+// lift every restriction.
+func LoadDeployWindows(path, environment string) ([]string, error) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read deploy windows: %w", err)
+	}
+	var byEnv map[string][]string
+	if err := yaml.Unmarshal(raw, &byEnv); err != nil {
+		return nil, fmt.Errorf("failed to parse deploy windows %s: %w", path, err)
+	}
+	windows, ok := byEnv[environment]
+	if !ok {
+		return nil, fmt.Errorf("no deploy windows for environment %q in %s", environment, path)
+	}
+	for _, w := range windows {
+		if _, err := parseCron(w); err != nil {
+			return nil, err
+		}
+	}
+	return windows, nil
+}
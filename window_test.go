@@ -0,0 +1,179 @@
+package binaryinstall
+
+import (
+	"testing"
+	"time"
+)
+
+// bitsOf returns the bit set of the values ns.
+func bitsOf(ns ...int) uint64 {
+	var bits uint64
+	for _, n := range ns {
+		bits |= 1 << n
+	}
+	return bits
+}
+
+// between returns the values lo to hi, stepping by step.
+func between(lo, hi, step int) []int {
+	var ns []int
+	for n := lo; n <= hi; n += step {
+		ns = append(ns, n)
+	}
+	return ns
+}
+
+func TestParseCronField(t *testing.T) {
+	tests := []struct {
+		field  string
+		lo, hi int
+		names  []string
+		want   uint64
+	}{
+		{"*", 0, 59, nil, bitsOf(between(0, 59, 1)...)},
+		{"5", 0, 59, nil, bitsOf(5)},
+		{"0", 0, 59, nil, bitsOf(0)},
+		{"59", 0, 59, nil, bitsOf(59)},
+		{"1-3", 0, 59, nil, bitsOf(1, 2, 3)},
+		{"1,3,5-6", 0, 59, nil, bitsOf(1, 3, 5, 6)},
+		{"*/15", 0, 59, nil, bitsOf(0, 15, 30, 45)},
+		{"10-20/5", 0, 59, nil, bitsOf(10, 15, 20)},
+		{"10-21/5", 0, 59, nil, bitsOf(10, 15, 20)},
+		{"50/5", 0, 59, nil, bitsOf(50, 55)},
+		{"*/2", 1, 31, nil, bitsOf(between(1, 31, 2)...)},
+		{"*/100", 0, 59, nil, bitsOf(0)},
+		{"jan-mar", 1, 12, monthNames, bitsOf(1, 2, 3)},
+		{"DEC", 1, 12, monthNames, bitsOf(12)},
+		{"mon-fri", 0, 7, dayNames, bitsOf(1, 2, 3, 4, 5)},
+		{"sun,Sat", 0, 7, dayNames, bitsOf(0, 6)},
+		{"mon-fri/2", 0, 7, dayNames, bitsOf(1, 3, 5)},
+		{"7", 0, 7, dayNames, bitsOf(7)},
+	}
+	for _, tt := range tests {
+		got, err := parseCronField(tt.field, tt.lo, tt.hi, tt.names)
+		if err != nil {
+			t.Errorf("parseCronField(%q): %v", tt.field, err)
+		} else if got != tt.want {
+			t.Errorf("parseCronField(%q) = %b, want %b", tt.field, got, tt.want)
+		}
+	}
+
+	for _, field := range []string{
+		"", "60", "-1", "5-1", "1-", "-5", "1,,2", ",", "1-2-3",
+		"*/0", "*/-1", "*/x", "*/", "x", "*-5", "jan", "1.5", "0x10",
+	} {
+		if bits, err := parseCronField(field, 0, 59, nil); err == nil {
+			t.Errorf("parseCronField(%q) = %b, want an error", field, bits)
+		}
+	}
+	for _, field := range []string{"thu-mon", "8", "sunday", "mo"} {
+		if bits, err := parseCronField(field, 0, 7, dayNames); err == nil {
+			t.Errorf("parseCronField(%q) for days = %b, want an error", field, bits)
+		}
+	}
+}
+
+func TestParseCronInvalid(t *testing.T) {
+	for _, expr := range []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"CRON_TZ=Nowhere/City * * * * *",
+		"CRON_TZ=UTC * * * *",
+	} {
+		if _, err := parseCron(expr); err == nil {
+			t.Errorf("parseCron(%q) succeeded, want an error", expr)
+		}
+	}
+}
+
+func TestCronMatches(t *testing.T) {
+	// January 1, 2024 was a Monday.
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, time.January, day, hour, minute, 30, 0, time.UTC)
+	}
+	tests := []struct {
+		expr string
+		t    time.Time
+		want bool
+	}{
+		{"* * * * *", at(3, 4, 5), true},
+		{"CRON_TZ=UTC * 9-16 * * mon-thu", at(4, 16, 59), true},
+		{"CRON_TZ=UTC * 9-16 * * mon-thu", at(4, 17, 0), false},
+		{"CRON_TZ=UTC * 9-16 * * mon-thu", at(5, 10, 0), false},
+		{"CRON_TZ=UTC */15 * * * *", at(1, 0, 45), true},
+		{"CRON_TZ=UTC */15 * * * *", at(1, 0, 46), false},
+		{"CRON_TZ=UTC * * * feb *", at(1, 0, 0), false},
+
+		// 7 and 0 are both Sunday
+		{"CRON_TZ=UTC * * * * 7", at(7, 12, 0), true},
+		{"CRON_TZ=UTC * * * * 0", at(7, 12, 0), true},
+		{"CRON_TZ=UTC * * * * 7", at(8, 12, 0), false},
+
+		// with one day field restricted, only it counts
+		{"CRON_TZ=UTC 0 9 * * mon", at(15, 9, 0), true},
+		{"CRON_TZ=UTC 0 9 * * mon", at(2, 9, 0), false},
+		{"CRON_TZ=UTC 0 9 1 * *", at(1, 9, 0), true},
+		{"CRON_TZ=UTC 0 9 1 * *", at(15, 9, 0), false},
+
+		// with both restricted, either matches
+		{"CRON_TZ=UTC 0 9 1 * mon", at(1, 9, 0), true},
+		{"CRON_TZ=UTC 0 9 1 * mon", at(15, 9, 0), true},
+		{"CRON_TZ=UTC 0 9 1 * mon", time.Date(2024, time.February, 1, 9, 0, 0, 0, time.UTC), true},
+		{"CRON_TZ=UTC 0 9 1 * mon", at(2, 9, 0), false},
+		{"CRON_TZ=UTC 0 9 1 * mon", at(1, 9, 1), false},
+
+		// as in cron, a day field starting with * is unrestricted for this
+		{"CRON_TZ=UTC 0 9 */2 * mon", at(15, 9, 0), true},
+		{"CRON_TZ=UTC 0 9 */2 * mon", at(3, 9, 0), false},
+		{"CRON_TZ=UTC 0 9 */2 * mon", at(8, 9, 0), false},
+
+		{"CRON_TZ=America/New_York * 9 * * *", at(1, 14, 30), true},
+		{"CRON_TZ=America/New_York * 9 * * *", at(1, 9, 30), false},
+		{"TZ=Asia/Tokyo * 0 2 * *", at(1, 15, 0), true},
+	}
+	for _, tt := range tests {
+		s, err := parseCron(tt.expr)
+		if err != nil {
+			t.Errorf("parseCron(%q): %v", tt.expr, err)
+			continue
+		}
+		if got := s.matches(tt.t); got != tt.want {
+			t.Errorf("%q matches %s = %v, want %v", tt.expr, tt.t.Format(time.RFC1123), got, tt.want)
+		}
+	}
+}
+
+func TestInDeployWindow(t *testing.T) {
+	now := time.Date(2024, time.January, 2, 10, 0, 0, 0, time.UTC) // a Tuesday
+	tests := []struct {
+		windows []string
+		open    bool
+		next    time.Time
+	}{
+		{[]string{"CRON_TZ=UTC * 9-16 * * tue"}, true, time.Time{}},
+		{[]string{"CRON_TZ=UTC 0 9 * * mon"}, false, time.Date(2024, time.January, 8, 9, 0, 0, 0, time.UTC)},
+		{[]string{"CRON_TZ=UTC 0 9 * * mon", "CRON_TZ=UTC 30 11 * * *"}, false, time.Date(2024, time.January, 2, 11, 30, 0, 0, time.UTC)},
+		{[]string{"CRON_TZ=UTC 0 0 30 feb *"}, false, time.Time{}},
+	}
+	for _, tt := range tests {
+		open, next, err := inDeployWindow(tt.windows, now)
+		if err != nil {
+			t.Errorf("%q: %v", tt.windows, err)
+			continue
+		}
+		if open != tt.open || !next.Equal(tt.next) {
+			t.Errorf("%q: open %v, next %s; want %v, %s", tt.windows, open, next, tt.open, tt.next)
+		}
+	}
+	if _, _, err := inDeployWindow([]string{"* * * * *", "* * *"}, now); err == nil {
+		t.Errorf("an invalid window was accepted")
+	}
+}
@@ -0,0 +1,259 @@
+package binaryinstall
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"text/template"
+)
+
+// winrmWrapper is run by a local pwsh to execute the install script on the
+// target through PowerShell remoting (WinRM). Everything it needs is passed
+// through the environment so nothing has to be quoted.
+const winrmWrapper = `
+$ErrorActionPreference = 'Stop'
+$params = @{
+    ComputerName = $env:BINARYINSTALL_WINRM_HOST
+    ScriptBlock  = [scriptblock]::Create($env:BINARYINSTALL_SCRIPT)
+}
+if ($env:BINARYINSTALL_WINRM_PORT) { $params.Port = [int]$env:BINARYINSTALL_WINRM_PORT }
+if ($env:BINARYINSTALL_WINRM_HTTPS -eq '1') { $params.UseSSL = $true }
+if ($env:BINARYINSTALL_WINRM_USER) {
+    $password = ConvertTo-SecureString $env:BINARYINSTALL_WINRM_PASSWORD -AsPlainText -Force
+    $params.Credential = New-Object System.Management.Automation.PSCredential($env:BINARYINSTALL_WINRM_USER, $password)
+}
+Invoke-Command @params
+`
+
+// winrmTransport runs PowerShell install scripts on Windows hosts over WinRM
+// using a local pwsh.
+type winrmTransport struct {
+	config BinaryInstallConfig
+	host   string
+}
+
+func (t *winrmTransport) Run(ctx context.Context, script string) (string, error) {
+	host, port := t.host, ""
+	if h, p, err := net.SplitHostPort(t.host); err == nil {
+		host, port = h, p
+	}
+	https := ""
+	if t.config.WinRMHTTPS {
+		https = "1"
+	}
+
+	cmd := exec.CommandContext(ctx, "pwsh", "-NoProfile", "-NonInteractive", "-Command", winrmWrapper)
+	cmd.Env = append(os.Environ(),
+		"BINARYINSTALL_WINRM_HOST="+host,
+		"BINARYINSTALL_WINRM_PORT="+port,
+		"BINARYINSTALL_WINRM_HTTPS="+https,
+		"BINARYINSTALL_WINRM_USER="+t.config.WinRMUser,
+		"BINARYINSTALL_WINRM_PASSWORD="+t.config.WinRMPassword,
+		"BINARYINSTALL_SCRIPT="+script,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		return string(out), fmt.Errorf("winrm %s: %w", t.host, err)
+	}
+	return string(out), nil
+}
+
+func (t *winrmTransport) Close() error {
+	return nil
+}
+
+// powershellTemplate is the Windows counterpart of scriptTemplate. Owner is
+// applied with icacls unless it is the Unix default "root"; Permission and
+// Capabilities have no Windows equivalent. Windows cannot overwrite a running
+// executable, so RestartService is stopped before the binary is replaced and
+// started afterwards, like StopService.
+var powershellTemplate = template.Must(template.New("powershellScript").Funcs(template.FuncMap{"q": powershellQuote, "seconds": seconds}).Parse(`
+$ErrorActionPreference = 'Stop'
+
+# Every value is quoted once, here, and only used through variables. The
+# temporary directory is generated by the installer and expands $env:TEMP.
+$TempDir = "{{.TempDir}}"
+$UploadPath = {{ q .UploadPath }}
+$BinaryName = {{ q .BinaryName }}
+$BackupDir = {{ q .BackupDir }}
+$DestDir = {{ q .DestinationDir }}
+$Owner = {{ q .Owner }}
+
+# Back up into a directory for this install, never reusing an earlier one.
+$BackupRoot = Join-Path $BackupDir $BinaryName
+$BackupDir = Join-Path $BackupRoot ([DateTime]::UtcNow.ToString("yyyyMMdd'T'HHmmss'Z'"))
+if (Test-Path -LiteralPath $BackupDir) {
+    $n = 1
+    while (Test-Path -LiteralPath "$BackupDir.$n") { $n++ }
+    $BackupDir = "$BackupDir.$n"
+}
+
+# 1) Make the temporary directory
+New-Item -ItemType Directory -Force -Path $TempDir | Out-Null
+
+{{ if .SHA256 }}
+# 1b) Verify the archive checksum before touching the destination
+$actual = (Get-FileHash -Algorithm SHA256 -LiteralPath $UploadPath).Hash.ToLower()
+if ($actual -ne {{ q .SHA256 }}) { throw "archive checksum mismatch: expected $({{ q .SHA256 }}), got $actual" }
+{{ end }}
+
+{{ if .CheckArchive }}
+# 1c) Refuse archives whose members could escape the temporary directory
+$members = tar -tf $UploadPath
+if ($LASTEXITCODE -ne 0) { throw "tar exited with code $LASTEXITCODE" }
+if ($members | Where-Object { $_ -match '^([/\\]|[A-Za-z]:)|(^|[/\\])\.\.([/\\]|$)' }) {
+    throw "refusing archive with absolute or parent-relative paths"
+}
+{{ end }}
+
+# 2) Extract the tarball (tar.exe ships with Windows 10 and Server 2019+ and
+# detects the compression itself)
+tar -xf $UploadPath -C $TempDir{{ if .StripComponents }} --strip-components {{ .StripComponents }}{{ end }}
+if ($LASTEXITCODE -ne 0) { throw "tar exited with code $LASTEXITCODE" }
+
+# 3) Verify the new binary exists, preferring the .exe name
+$binary = "$BinaryName.exe"
+if (-not (Test-Path -LiteralPath "$TempDir\$binary")) { $binary = $BinaryName }
+if (-not (Test-Path -LiteralPath "$TempDir\$binary")) { throw "$BinaryName not found in archive" }
+
+{{ if .BinarySHA256 }}
+# 3a) Verify the extracted binary's checksum
+$actual = (Get-FileHash -Algorithm SHA256 -LiteralPath "$TempDir\$binary").Hash.ToLower()
+if ($actual -ne {{ q .BinarySHA256 }}) { throw "binary checksum mismatch: expected $({{ q .BinarySHA256 }}), got $actual" }
+{{ end }}
+
+$unchanged = $false
+{{ if not (or .Reinstall .WindowsService) }}
+# 3b) Leave the host as it is if the same binary, with the owner the install
+# would give it, is already installed
+if ((Test-Path -LiteralPath "$DestDir\$binary") -and
+    (Get-FileHash -Algorithm SHA256 -LiteralPath "$DestDir\$binary").Hash -eq (Get-FileHash -Algorithm SHA256 -LiteralPath "$TempDir\$binary").Hash{{ if and .Owner (ne .Owner "root") }} -and
+    ((Get-Acl -LiteralPath "$DestDir\$binary").Owner -in @($Owner, "$env:COMPUTERNAME\$Owner", "$env:USERDOMAIN\$Owner")){{ end }}) {
+    $unchanged = $true
+    Write-Output "unchanged $DestDir\$binary"
+    Write-Output "` + unchangedMarker + `"
+}
+{{ end }}
+
+# Steps 4 to 7b change the host, so an unchanged binary skips them
+if (-not $unchanged) {
+
+# 4) Ensure the destination directory exists
+New-Item -ItemType Directory -Force -Path $DestDir | Out-Null
+
+{{ if or .RestartService .StopService }}
+# 4a) Stop the services using the binary, starting them again on the old one
+# if the install fails
+$stopped = @()
+trap {
+    foreach ($name in $stopped) { Start-Service -Name $name -ErrorAction Continue }
+    break
+}
+foreach ($name in @({{ if .StopService }}{{ q .StopService }}{{ end }}{{ if and .StopService .RestartService }}, {{ end }}{{ if .RestartService }}{{ q .RestartService }}{{ end }})) {
+    $service = Get-Service -Name $name -ErrorAction SilentlyContinue
+    if ($service -and $service.Status -ne 'Stopped') {
+        Stop-Service -Force -Name $name
+        $stopped += $name
+    }
+}
+{{ end }}
+
+# 5) Backup existing binary if it exists
+if (Test-Path -LiteralPath "$DestDir\$binary") {
+    New-Item -ItemType Directory -Force -Path $BackupDir | Out-Null
+    Move-Item -Force -LiteralPath "$DestDir\$binary" -Destination "$BackupDir\"
+}
+
+# 6) Copy the new binary to destination
+Copy-Item -Force -LiteralPath "$TempDir\$binary" -Destination "$DestDir\$binary"
+
+{{ if and .Owner (ne .Owner "root") }}
+# 7) Set ownership
+icacls "$DestDir\$binary" /setowner $Owner | Out-Null
+if ($LASTEXITCODE -ne 0) { throw "icacls exited with code $LASTEXITCODE" }
+{{ end }}
+
+{{ with .WindowsService }}
+# 7a) Register the service, or update an existing registration in place. The
+# command line is written to the registry directly, as sc.exe mangles quotes.
+$ServiceName = {{ q .Name }}
+$ServiceKey = "HKLM:\SYSTEM\CurrentControlSet\Services\$ServiceName"
+if (Get-Service -Name $ServiceName -ErrorAction SilentlyContinue) {
+    Set-ItemProperty -LiteralPath $ServiceKey -Name ImagePath -Value {{ q .Command }}
+    Set-Service -Name $ServiceName -DisplayName {{ q .DisplayName }} -StartupType Automatic
+} else {
+    New-Service -Name $ServiceName -BinaryPathName {{ q .Command }} -DisplayName {{ q .DisplayName }} -StartupType Automatic | Out-Null
+}
+{{- if .Environment }}
+Set-ItemProperty -LiteralPath $ServiceKey -Name Environment -Type MultiString -Value @({{ range $i, $e := .Environment }}{{ if $i }}, {{ end }}{{ q $e }}{{ end }})
+{{- else }}
+Remove-ItemProperty -LiteralPath $ServiceKey -Name Environment -ErrorAction SilentlyContinue
+{{- end }}
+{{- if .Restart }}
+sc.exe failure $ServiceName reset= 86400 actions= restart/{{ .RestartDelay }}/restart/{{ .RestartDelay }}/restart/{{ .RestartDelay }} | Out-Null
+if ($LASTEXITCODE -ne 0) { throw "sc.exe exited with code $LASTEXITCODE" }
+{{- else }}
+Remove-ItemProperty -LiteralPath $ServiceKey -Name FailureActions -ErrorAction SilentlyContinue
+{{- end }}
+{{ end }}
+
+{{ if or .RestartService .StopService }}
+# 7b) Start the stopped services, and RestartService even if it was not
+# running, waiting for each to come up
+$starting = $stopped{{ if .RestartService }} + @({{ q .RestartService }}) | Select-Object -Unique{{ end }}
+$stopped = @()
+foreach ($name in $starting) {
+    Start-Service -Name $name
+    try {
+        (Get-Service -Name $name).WaitForStatus('Running', [TimeSpan]::FromSeconds({{ seconds .ActiveTimeout }}))
+    } catch {
+        throw "$name did not come up within {{ seconds .ActiveTimeout }}s"
+    }
+    Write-Output "started $name"
+}
+{{ end }}
+
+}
+
+{{ if or .BackupKeep .BackupCutoff .BackupMaxKB }}
+# 7c) Prune the binary's older backups, newest first, always keeping the
+# most recent
+$n = 0
+$total = 0
+Get-ChildItem -Directory -LiteralPath $BackupRoot -ErrorAction SilentlyContinue |
+    Where-Object { $_.Name -match '^\d{8}T\d{6}Z(\.\d+)?$' } |
+    Sort-Object Name -Descending |
+    ForEach-Object {
+        $n++
+        $total += [int64]((Get-ChildItem -Recurse -File -LiteralPath $_.FullName | Measure-Object -Sum Length).Sum / 1024)
+        if ($n -gt 1 -and ({{ if .BackupKeep }}$n -gt {{ .BackupKeep }} -or {{ end }}{{ if .BackupCutoff }}[string]::CompareOrdinal($_.Name, {{ q .BackupCutoff }}) -lt 0 -or {{ end }}{{ if .BackupMaxKB }}$total -gt {{ .BackupMaxKB }} -or {{ end }}$false)) {
+            Remove-Item -Recurse -Force -LiteralPath $_.FullName
+            Write-Output "pruned backup $($_.FullName)"
+        }
+    }
+{{ end }}
+
+# 8) Remove the temporary directory
+Remove-Item -Recurse -Force -LiteralPath $TempDir
+`))
+
+// powershellQuote quotes s as a single-quoted PowerShell string literal.
+// PowerShell also treats the typographic single quotes as quote characters.
+func powershellQuote(s string) string {
+	var b strings.Builder
+	b.WriteByte('\'')
+	for _, r := range s {
+		if strings.ContainsRune("'\u2018\u2019\u201a\u201b", r) {
+			b.WriteRune(r)
+		}
+		b.WriteRune(r)
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
@@ -0,0 +1,66 @@
+package binaryinstall
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestPowershellScript(t *testing.T) {
+	tests := []struct {
+		name    string
+		upload  BinaryUpload
+		want    []string
+		notWant []string
+	}{
+		{
+			name:   "owner",
+			upload: BinaryUpload{Path: "/dist/tool_Windows_x86_64.tar.gz", DestinationDir: `C:\Tools`, Owner: `CORP\svc-tool`},
+			want: []string{
+				`$TempDir = "$env:TEMP\install-`,
+				`$UploadPath = '/dist/tool_Windows_x86_64.tar.gz'`,
+				`$DestDir = 'C:\Tools'`,
+				`$Owner = 'CORP\svc-tool'`,
+				`tar -xf $UploadPath -C $TempDir`,
+				`Copy-Item -Force -LiteralPath "$TempDir\$binary" -Destination "$DestDir\$binary"`,
+				`icacls "$DestDir\$binary" /setowner $Owner`,
+			},
+		},
+		{
+			// Values are only used through variables set once, quoted
+			name:   "hostile values",
+			upload: BinaryUpload{Path: "/dist/tool_Windows_x86_64.tar.gz", DestinationDir: `C:\Tools\$(Stop-Computer)'; Stop-Computer; '`, Owner: "O'Brien"},
+			want: []string{
+				`$DestDir = 'C:\Tools\$(Stop-Computer)''; Stop-Computer; '''`,
+				`$Owner = 'O''Brien'`,
+			},
+			notWant: []string{`"C:\Tools\$(Stop-Computer)`},
+		},
+		{
+			// root is the Unix default owner and means nothing on Windows
+			name:    "default owner",
+			upload:  BinaryUpload{Path: "/dist/tool_Windows_x86_64.tar.gz", DestinationDir: `C:\Tools`, Owner: "root"},
+			want:    []string{`Copy-Item -Force`},
+			notWant: []string{"icacls", "chown", "#!/bin"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transport := &scriptRecorder{}
+			config := BinaryInstallConfig{RemoteHost: "winrm://win1:5986", BackupDir: `C:\Backups`}
+			if err := processUploadSingleCommand(config, transport, tt.upload); err != nil {
+				t.Fatal(err)
+			}
+			script := transport.script()
+			for _, want := range tt.want {
+				if !strings.Contains(script, want) {
+					t.Errorf("script lacks %q:\n%s", want, script)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(script, notWant) {
+					t.Errorf("script has %q:\n%s", notWant, script)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package binaryinstall
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// windowsService is upload's Systemd unit as a Windows service, registered
+// with the service control manager by powershellTemplate.
+type windowsService struct {
+	Name, DisplayName string
+	Command           string   // the service's binary path and arguments
+	Environment       []string // NAME=value, set in the service's registry key
+	Restart           bool     // restart the service when it fails
+	RestartDelay      int      // milliseconds before a restart
+}
+
+// windowsCommandPattern matches a command line starting with an absolute
+// Windows path, optionally quoted.
+var windowsCommandPattern = regexp.MustCompile(`^"?[A-Za-z]:\\`)
+
+// renderWindowsService returns upload's Systemd unit as a Windows service
+// running the binary installed as binaryName. The ExecStart template's path
+// is the binary with ".exe" appended unless binaryName has it; the default
+// command line is the installed binary. User, Group, WorkingDirectory and
+// EnvironmentFile have no counterpart, and After and WantedBy are ignored.
+func renderWindowsService(upload BinaryUpload, binaryName string) (*windowsService, error) {
+	unit := *upload.Systemd
+	svc := &windowsService{
+		Name:        strings.TrimSuffix(unit.Name, ".service"),
+		DisplayName: unit.Description,
+		Restart:     unit.Restart != "no",
+	}
+	if svc.Name == "" {
+		svc.Name = binaryName
+	}
+	if !unitNamePattern.MatchString(svc.Name) {
+		return nil, fmt.Errorf("invalid service name %q", svc.Name)
+	}
+	if svc.DisplayName == "" {
+		svc.DisplayName = binaryName
+	}
+	for name, val := range map[string]string{
+		"User":             unit.User,
+		"Group":            unit.Group,
+		"WorkingDirectory": unit.WorkingDirectory,
+		"EnvironmentFile":  unit.EnvironmentFile,
+	} {
+		if val != "" {
+			return nil, fmt.Errorf("systemd %s is not supported for Windows services", name)
+		}
+	}
+
+	exe := binaryName
+	if !strings.HasSuffix(strings.ToLower(exe), ".exe") {
+		exe += ".exe"
+	}
+	binaryPath := strings.TrimSuffix(upload.DestinationDir, `\`) + `\` + exe
+	svc.Command = `"` + binaryPath + `"`
+	if unit.ExecStart != "" {
+		vars := map[string]string{}
+		for k, v := range upload.Vars {
+			vars[k] = v
+		}
+		vars["path"], vars["binary"], vars["dest"] = binaryPath, binaryName, upload.DestinationDir
+		var err error
+		if svc.Command, err = expandVars("ExecStart", unit.ExecStart, vars); err != nil {
+			return nil, err
+		}
+		if !windowsCommandPattern.MatchString(svc.Command) {
+			return nil, fmt.Errorf("ExecStart %q must start with an absolute Windows path", svc.Command)
+		}
+	}
+
+	if unit.RestartSec > 0 {
+		svc.RestartDelay = int(unit.RestartSec.Milliseconds())
+	} else {
+		svc.RestartDelay = 1000
+	}
+	for k, v := range unit.Environment {
+		if !envNamePattern.MatchString(k) {
+			return nil, fmt.Errorf("invalid environment variable name %q", k)
+		}
+		svc.Environment = append(svc.Environment, k+"="+v)
+	}
+	sort.Strings(svc.Environment)
+	for _, val := range append([]string{svc.DisplayName, svc.Command}, svc.Environment...) {
+		if strings.ContainsAny(val, "\x00\n\r") {
+			return nil, fmt.Errorf("Windows service setting %q contains control characters", val)
+		}
+	}
+	return svc, nil
+}
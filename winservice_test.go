@@ -0,0 +1,117 @@
+package binaryinstall
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderWindowsService(t *testing.T) {
+	upload := BinaryUpload{DestinationDir: `C:\Tools\`, Vars: map[string]string{"port": "8080"}}
+
+	upload.Systemd = &SystemdUnit{}
+	svc, err := renderWindowsService(upload, "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := windowsService{Name: "api", DisplayName: "api", Command: `"C:\Tools\api.exe"`, Restart: true, RestartDelay: 1000}
+	if !reflect.DeepEqual(*svc, want) {
+		t.Errorf("defaults: %+v, want %+v", *svc, want)
+	}
+
+	upload.Systemd = &SystemdUnit{
+		Name:        "api-server.service",
+		Description: "API server",
+		ExecStart:   `"{{.path}}" serve --port {{.port}}`,
+		Environment: map[string]string{"MODE": "prod", "HOME": `C:\api`},
+		Restart:     "no",
+		RestartSec:  2 * time.Second,
+	}
+	svc, err = renderWindowsService(upload, "api.exe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = windowsService{
+		Name:         "api-server",
+		DisplayName:  "API server",
+		Command:      `"C:\Tools\api.exe" serve --port 8080`,
+		Environment:  []string{`HOME=C:\api`, "MODE=prod"},
+		RestartDelay: 2000,
+	}
+	if !reflect.DeepEqual(*svc, want) {
+		t.Errorf("everything: %+v, want %+v", *svc, want)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		unit    SystemdUnit
+		wantErr string
+	}{
+		{"bad name", SystemdUnit{Name: `api\x`}, "invalid service name"},
+		{"user", SystemdUnit{User: "svc"}, "systemd User is not supported"},
+		{"environment file", SystemdUnit{EnvironmentFile: `C:\api.env`}, "systemd EnvironmentFile is not supported"},
+		{"relative command", SystemdUnit{ExecStart: "api.exe serve"}, "must start with an absolute Windows path"},
+		{"bad environment name", SystemdUnit{Environment: map[string]string{"A=B": "1"}}, "invalid environment variable name"},
+		{"newline", SystemdUnit{Description: "api\r\nx"}, "contains control characters"},
+	} {
+		upload := upload
+		unit := tt.unit
+		upload.Systemd = &unit
+		if _, err := renderWindowsService(upload, "api"); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: returned %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWindowsServiceScript(t *testing.T) {
+	config := BinaryInstallConfig{RemoteHost: "winrm://win1:5986", BackupDir: `C:\Backups`}
+	upload := BinaryUpload{
+		Path:           "/dist/api_Windows_x86_64.tar.gz",
+		DestinationDir: `C:\Tools`,
+		RestartService: "api",
+		Systemd:        &SystemdUnit{Description: "API server", Environment: map[string]string{"MODE": "prod"}},
+	}
+	transport := &scriptRecorder{}
+	if err := processUploadSingleCommand(config, transport, upload); err != nil {
+		t.Fatal(err)
+	}
+	script := transport.script()
+	for _, want := range []string{
+		"foreach ($name in @('api')) {",
+		"Stop-Service -Force -Name $name",
+		`New-Service -Name $ServiceName -BinaryPathName '"C:\Tools\api.exe"' -DisplayName 'API server' -StartupType Automatic`,
+		"Set-ItemProperty -LiteralPath $ServiceKey -Name Environment -Type MultiString -Value @('MODE=prod')",
+		"sc.exe failure $ServiceName reset= 86400 actions= restart/1000/restart/1000/restart/1000",
+		"$starting = $stopped + @('api') | Select-Object -Unique",
+		"throw \"$name did not come up within 30s\"",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script lacks %q:\n%s", want, script)
+		}
+	}
+	// The service is stopped before the binary is replaced, and started after
+	stop := strings.Index(script, "Stop-Service")
+	replace := strings.Index(script, `Move-Item -Force -LiteralPath "$DestDir\$binary"`)
+	start := strings.Index(script, "Start-Service -Name $name\n")
+	if !(stop < replace && replace < start) {
+		t.Errorf("stop at %d, replace at %d, start at %d, want them in that order", stop, replace, start)
+	}
+
+	for _, tt := range []struct {
+		name    string
+		change  func(*BinaryUpload)
+		wantErr string
+	}{
+		{"reload", func(u *BinaryUpload) { u.ReloadOnly = true }, "reloading services is not supported on Windows"},
+		{"user service", func(u *BinaryUpload) { u.UserService = true }, "user services are not supported on Windows"},
+		{"consul", func(u *BinaryUpload) { u.Consul = &ConsulService{} }, "registering with Consul is not supported on Windows"},
+		{"ready command", func(u *BinaryUpload) { u.ReadyCommand = "exit 0" }, "ready commands are not supported on Windows"},
+	} {
+		upload := upload
+		tt.change(&upload)
+		if err := processUploadSingleCommand(config, &scriptRecorder{}, upload); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("%s: returned %v, want an error containing %q", tt.name, err, tt.wantErr)
+		}
+	}
+}